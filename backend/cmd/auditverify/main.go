@@ -0,0 +1,85 @@
+// Command auditverify checks the audit log hash chains and their signed checkpoints. It
+// reads the same environment as the server and exits with status 1 when a chain is broken.
+//
+//	go run ./cmd/auditverify [-chain <organization ID|platform>] [-checkpoint]
+package main
+
+import (
+	"crypto"
+	"file-vault/internal/auth"
+	"file-vault/internal/config"
+	"file-vault/internal/database"
+	"file-vault/internal/services"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	chain := flag.String("chain", "", "verify a single chain, an organization ID or \"platform\"")
+	checkpoint := flag.Bool("checkpoint", false, "sign a checkpoint of every chain after verifying")
+	flag.Parse()
+
+	cfg := config.Load()
+	db, err := database.Initialize(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed::Initialize Database: ", err)
+	}
+	defer db.Close()
+
+	var signer crypto.Signer
+	if cfg.AuditCheckpointKeyFile != "" {
+		if signer, err = auth.LoadSigningKey(cfg.AuditCheckpointKeyFile); err != nil {
+			log.Fatal("Failed::Load Audit Checkpoint Key: ", err)
+		}
+	}
+	verificationKeys := []crypto.PublicKey{}
+	for _, path := range cfg.AuditCheckpointVerificationKeyFiles {
+		key, err := auth.LoadVerificationKey(path)
+		if err != nil {
+			log.Fatal("Failed::Load Audit Checkpoint Key: ", err)
+		}
+		verificationKeys = append(verificationKeys, key)
+	}
+	auditChain, err := services.NewAuditChainService(db, signer, verificationKeys...)
+	if err != nil {
+		log.Fatal("Failed::Load Audit Checkpoint Keys: ", err)
+	}
+
+	chains := []string{*chain}
+	if *chain == "" {
+		if chains, err = auditChain.Chains(); err != nil {
+			log.Fatal("Failed::List Audit Chains: ", err)
+		}
+	}
+
+	broken := false
+	for _, id := range chains {
+		report, err := auditChain.Verify(id)
+		if err != nil {
+			log.Fatalf("Failed::Verify Audit Chain %s: %v", id, err)
+		}
+		if report.Valid {
+			fmt.Printf("%s: ok, %d entries, %d archived, %d checkpoints\n", id, report.EntriesChecked, report.EntriesArchived,
+				report.CheckpointsChecked)
+			continue
+		}
+		broken = true
+		entry := "missing entry"
+		if report.FirstBroken.EntryID != nil {
+			entry = "entry " + report.FirstBroken.EntryID.String()
+		}
+		fmt.Printf("%s: BROKEN at #%d (%s): %s\n", id, report.FirstBroken.ChainSeq, entry, report.FirstBroken.Reason)
+	}
+	if broken {
+		os.Exit(1)
+	}
+
+	if *checkpoint {
+		if err := auditChain.Checkpoint(); err != nil {
+			log.Fatal("Failed::Audit Checkpoint: ", err)
+		}
+		fmt.Println("checkpoints written")
+	}
+}
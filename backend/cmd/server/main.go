@@ -1,47 +1,80 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"database/sql"
+	"errors"
 	"file-vault/internal/auth"
 	"file-vault/internal/config"
 	"file-vault/internal/database"
 	"file-vault/internal/graph"
 	"file-vault/internal/graph/generated"
 	"file-vault/internal/handlers"
+	"file-vault/internal/lifecycle"
+	"file-vault/internal/logging"
+	"file-vault/internal/mail"
+	"file-vault/internal/metrics"
+	"file-vault/internal/models"
 	"file-vault/internal/rate_limiter"
 	"file-vault/internal/services"
+	"file-vault/internal/tracing"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/99designs/gqlgen/graphql/playground"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 
 	"github.com/gorilla/websocket"
 )
 
 func main() {
 	cfg := config.Load()
+	if err := logging.Setup(os.Stdout, cfg.LogLevel, cfg.LogFormat); err != nil {
+		logging.Fatal("Invalid logging configuration", "error", err)
+	}
+	if err := auth.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logging.Fatal("Invalid trusted proxies", "error", err)
+	}
+	tracer, err := tracing.Setup(context.Background(), tracing.Config{
+		ServiceName:  cfg.TracingServiceName,
+		Environment:  cfg.Environment,
+		OTLPEndpoint: cfg.TracingOTLPEndpoint,
+		SampleRatio:  cfg.TracingSampleRatio,
+	})
+	if err != nil {
+		logging.Fatal("Invalid tracing configuration", "error", err)
+	}
 
 	db, err := database.Initialize(cfg.DatabaseURL)
 	if err != nil {
-		log.Fatal("Failed::Initialize Database: ", err)
+		logging.Fatal("Failed to initialize database", "error", err)
 	}
-	defer db.Close()
-	cleanupService := services.NewCleanUpService(db) // to clean up expired downloads
-	go cleanupService.CleanupExpiredDownloads()
-
 	if err := database.RunMigrations(db); err != nil {
-		log.Fatal("Failed::Run Migrations", err)
+		logging.Fatal("Failed to run migrations", "error", err)
+	}
+
+	latestMigration, err := database.LatestMigration()
+	if err != nil {
+		logging.Fatal("Failed to read migrations", "error", err)
 	}
 
 	redis := services.NewRedisClient(cfg.RedisURL)
-	defer redis.Close()
+	healthService := services.NewHealthService(db, redis, cfg.StoragePath, latestMigration, time.Duration(cfg.HealthCheckTimeout)*time.Second)
+	eventBus := services.NewEventBus(redis)
 	rlConfig := services.RlConfig{
 		GlobalRateLimit:   cfg.GlobalRateLimit,
 		GlobalBurstLimit:  cfg.GlobalBurstLimit,
@@ -53,16 +86,148 @@ func main() {
 	dedupService := services.NewDeduplicationService(db)
 	fileService := services.NewFileService(dedupService, cfg.StoragePath)
 	rateLimiter := services.NewRateLimiter(redis, rlConfig)
+	loginGuard := services.NewLoginGuard(redis, services.LoginGuardConfig{
+		MaxAccountFailures: cfg.LoginMaxAccountFailures,
+		MaxIPFailures:      cfg.LoginMaxIPFailures,
+		FailureWindow:      time.Duration(cfg.LoginFailureWindow) * time.Second,
+		LockoutDuration:    time.Duration(cfg.LoginLockoutDuration) * time.Second,
+		DelayThreshold:     cfg.LoginDelayThreshold,
+		MaxDelay:           time.Duration(cfg.LoginMaxDelay) * time.Second,
+	})
 	storageService := services.NewStorageService(db)
+	auditService := services.NewAuditService(db)
+	jobQueue := services.NewJobQueue(db, services.JobQueueConfig{
+		Workers:      cfg.JobWorkers,
+		PollInterval: time.Duration(cfg.JobPollInterval) * time.Second,
+		LockTimeout:  time.Duration(cfg.JobLockTimeout) * time.Second,
+		BackoffBase:  time.Duration(cfg.JobBackoffBase) * time.Second,
+		BackoffMax:   time.Duration(cfg.JobBackoffMax) * time.Second,
+		MaxAttempts:  cfg.JobMaxAttempts,
+	})
+	outbox := services.NewOutbox(db, jobQueue)
+	outbox.Handle(services.TopicFileEvent, eventBus.Relay)
+	fileJobs := services.NewFileJobs(db, fileService, jobQueue, outbox)
+	jobRetention := time.Duration(cfg.JobRetentionDays) * 24 * time.Hour
+	cleanupService := services.NewCleanUpService(db, auditService, auditRetention(cfg), jobQueue, jobRetention) // to clean up expired downloads
+	orgService := services.NewOrganizationService(db, auditService)
+	authz := services.NewAuthorizationService(db, orgService, auditService)
+	garbageCollector := services.NewGarbageCollector(db, fileJobs)
+	groupService := services.NewGroupService(db, auditService)
+	userService := services.NewUserService(db, fileJobs, auditService)
+	impersonationService := services.NewImpersonationService(db, auditService)
+	auditChain, err := loadAuditChain(cfg, db)
+	if err != nil {
+		logging.Fatal("Failed to load audit checkpoint keys", "error", err)
+	}
+	scheduler, err := loadScheduler(cfg, db, cleanupService, garbageCollector, outbox, auditChain)
+	if err != nil {
+		logging.Fatal("Failed to load schedules", "error", err)
+	}
+	webhookService := services.NewWebhookService(db, auditService, jobQueue, services.WebhookConfig{
+		Timeout:             time.Duration(cfg.WebhookTimeout) * time.Second,
+		MaxAttempts:         cfg.WebhookMaxAttempts,
+		BackoffBase:         time.Duration(cfg.WebhookBackoffBase) * time.Second,
+		BackoffMax:          time.Duration(cfg.WebhookBackoffMax) * time.Second,
+		DisableAfter:        cfg.WebhookDisableAfter,
+		AllowPrivateTargets: cfg.WebhookAllowPrivateTargets,
+	})
+	settingsService := services.NewSettingsService(db, auditService)
+	twoFactorService := services.NewTwoFactorService(db, cfg.TwoFactorIssuer, auditService)
+	accountTokenService := services.NewAccountTokenService(db)
+	identityService := services.NewIdentityService(db, cfg.DefaultStorageQuota, auditService)
+	ldapAuthenticator := services.NewLDAPAuthenticator(services.LDAPConfig{
+		URL:                cfg.LDAPURL,
+		StartTLS:           cfg.LDAPStartTLS,
+		InsecureSkipVerify: cfg.LDAPInsecureSkipVerify,
+		BindDN:             cfg.LDAPBindDN,
+		BindPassword:       cfg.LDAPBindPassword,
+		BaseDN:             cfg.LDAPBaseDN,
+		UserFilter:         cfg.LDAPUserFilter,
+		EmailAttribute:     cfg.LDAPEmailAttribute,
+		UsernameAttribute:  cfg.LDAPUsernameAttribute,
+		GroupAttribute:     cfg.LDAPGroupAttribute,
+		AdminGroups:        cfg.LDAPAdminGroups,
+		AllowProvisioning:  cfg.LDAPAllowProvisioning,
+	})
+	oidcService := services.NewOIDCService(redis, services.OIDCConfig{
+		IssuerURL:         cfg.OIDCIssuerURL,
+		ClientID:          cfg.OIDCClientID,
+		ClientSecret:      cfg.OIDCClientSecret,
+		RedirectURL:       cfg.OIDCRedirectURL,
+		Scopes:            cfg.OIDCScopes,
+		RoleClaim:         cfg.OIDCRoleClaim,
+		AdminValues:       cfg.OIDCAdminValues,
+		AllowProvisioning: cfg.OIDCAllowProvisioning,
+	})
+	mailer, err := mail.NewMailer(mail.Config{
+		Host:               cfg.SMTPHost,
+		Port:               cfg.SMTPPort,
+		Username:           cfg.SMTPUsername,
+		Password:           cfg.SMTPPassword,
+		From:               cfg.SMTPFrom,
+		TLSMode:            cfg.SMTPTLSMode,
+		InsecureSkipVerify: cfg.SMTPInsecureSkipVerify,
+	})
+	if err != nil {
+		logging.Fatal("Failed to initialize mailer", "error", err)
+	}
+
+	tokenKeys, err := loadTokenKeys(cfg)
+	if err != nil {
+		logging.Fatal("Failed to load token keys", "error", err)
+	}
+	loginTokens := services.NewLoginTokenService(tokenKeys, settingsService, authz)
 
 	resolver := &graph.Resolver{
-		DB:             db,
-		FileService:    fileService,
-		DedupService:   dedupService,
-		RateLimiter:    rateLimiter,
-		StorageService: storageService,
-		Config:         cfg,
+		DB:                db,
+		FileService:       fileService,
+		DedupService:      dedupService,
+		RateLimiter:       rateLimiter,
+		LoginGuard:        loginGuard,
+		StorageService:    storageService,
+		SettingsService:   settingsService,
+		TwoFactorService:  twoFactorService,
+		AccountTokens:     accountTokenService,
+		IdentityService:   identityService,
+		LDAPAuthenticator: ldapAuthenticator,
+		TokenKeys:         tokenKeys,
+		LoginTokens:       loginTokens,
+		Authz:             authz,
+		GarbageCollector:  garbageCollector,
+		GroupService:      groupService,
+		Orgs:              orgService,
+		Users:             userService,
+		Impersonation:     impersonationService,
+		Audit:             auditService,
+		AuditChain:        auditChain,
+		Events:            eventBus,
+		WebhookService:    webhookService,
+		JobQueue:          jobQueue,
+		Outbox:            outbox,
+		FileJobs:          fileJobs,
+		Scheduler:         scheduler,
+		Mailer:            mailer,
+		Config:            cfg,
 	}
+	jobQueue.Register(graph.JobAccountMail, resolver.SendAccountMail)
+
+	// background workers stop when workerCtx is cancelled on shutdown
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		jobQueue.Run(workerCtx)
+	}()
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		if err := scheduler.Run(workerCtx); err != nil {
+			logging.Fatal("Failed to run scheduler", "error", err)
+		}
+	}()
+	// subscriptions are long-lived, they are closed when draining starts
+	drainCtx, startDraining := context.WithCancel(context.Background())
+	state := lifecycle.NewState()
 
 	srv := handler.NewDefaultServer(generated.NewExecutableSchema(generated.Config{
 		Resolvers: resolver,
@@ -70,6 +235,19 @@ func main() {
 
 	srv.AddTransport(transport.Websocket{
 		KeepAlivePingInterval: 10 * time.Second,
+		// browsers cannot set headers on websockets, the token comes in the init payload
+		InitFunc: func(ctx context.Context, payload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+			if token := strings.TrimPrefix(payload.Authorization(), "Bearer "); token != "" && auth.GetUserIDFromContext(ctx) == "" {
+				ctx = auth.ContextWithToken(ctx, token, tokenKeys, userService.TokenState)
+			}
+			if orgID := payload.GetString(auth.OrganizationHeader); orgID != "" {
+				ctx = auth.WithOrgID(ctx, orgID)
+			}
+			ctx, cancel := context.WithCancel(ctx)
+			stop := context.AfterFunc(drainCtx, cancel)
+			context.AfterFunc(ctx, func() { stop() })
+			return ctx, &payload, nil
+		},
 		Upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // change this to allow only selected origins
@@ -83,6 +261,13 @@ func main() {
 		MaxMemory:     10 * 1024 * 1024, // 10 MB
 		MaxUploadSize: 50 * 1024 * 1024, // 50 MB
 	})
+	srv.Use(metrics.GraphQL{})
+	srv.Use(tracing.GraphQL{})
+	srv.Use(graph.Dataloaders{Resolver: resolver})
+	srv.SetErrorPresenter(func(ctx context.Context, err error) *gqlerror.Error {
+		slog.WarnContext(ctx, "GraphQL error", "path", graphql.GetPath(ctx).String(), "error", err)
+		return graphql.DefaultErrorPresenter(ctx, err)
+	})
 
 	//srv.SetQueryCache(lru.New(1000))
 	//srv.Use(extension.Introspection{})
@@ -96,7 +281,8 @@ func main() {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, X-Organization-ID, X-Request-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
 
@@ -108,7 +294,7 @@ func main() {
 		})
 	}
 
-	graphqlHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(srv, cfg.JWTSecret), rateLimiter))
+	graphqlHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(srv, tokenKeys, userService.TokenState), rateLimiter))
 	mux.Handle("/graphql", graphqlHandler)
 
 	if os.Getenv("GO_ENV") != "production" {
@@ -117,18 +303,26 @@ func main() {
 	}
 
 	fileDownloadHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("file download handler request")
+		// the record must belong to the caller, the user ID in the URL is not trusted
+		userID, err := authz.Authorize(r.Context(), models.PermissionFilesRead)
+		if err != nil {
+			if errors.Is(err, services.ErrPermissionDenied) {
+				http.Error(w, "Permission denied", http.StatusForbidden)
+			} else {
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+			}
+			return
+		}
 		downloadID := r.PathValue("downloadID")
-		userID := r.PathValue("userID")
 
 		var fileContentID uuid.UUID
 		var fileName string
 		var userFileID uuid.UUID
 		var ownerID uuid.UUID
 		query := `SELECT user_file_id, file_name, file_content_id, owner_id FROM file_downloads WHERE id = $1 AND user_id = $2`
-		err := db.QueryRow(query, downloadID, userID).Scan(&userFileID, &fileName, &fileContentID, &ownerID)
+		err = db.QueryRow(query, downloadID, userID).Scan(&userFileID, &fileName, &fileContentID, &ownerID)
 		if err != nil {
-			fmt.Printf("DownloadHandler: Failed to get download record: %v\n", err)
+			slog.DebugContext(r.Context(), "Download record not found", "download_id", downloadID, "error", err)
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
 		}
@@ -138,78 +332,115 @@ func main() {
 		query = `SELECT mime_type, file_path FROM file_contents WHERE id = $1`
 		err = db.QueryRow(query, fileContentID).Scan(&mimeType, &filePath)
 		if err != nil {
-			fmt.Printf("DownloadHandler: Failed to get file content: %v\n", err)
+			slog.ErrorContext(r.Context(), "Failed to get file content for download", "file_content_id", fileContentID, "error", err)
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
 		}
 
-		fmt.Printf("DownloadHandler: File path from DB: %s, File name: %s, MIME type: %s\n", filePath, fileName, mimeType)
-
-		if err := fileService.DownloadFile(&w, filePath, fileName, mimeType); err != nil {
-			fmt.Printf("DownloadHandler: Failed to download file: %v\n", err)
+		if err := fileService.DownloadFile(r.Context(), &w, filePath, fileName, mimeType); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to download file", "file_content_id", fileContentID, "error", err)
 			http.Error(w, "File not found", http.StatusNotFound)
 			return
 		} else if ownerID.String() != userID {
 			// download count is incremented when someone else downloads your file
-			query = `UPDATE user_files SET download_count = download_count + 1 WHERE id = $1`
-			_, err = db.Exec(query, userFileID)
+			err = jobQueue.Enqueue(nil, services.JobCountDownload, services.CountDownloadJob{FileID: userFileID}, services.JobOptions{})
 			if err != nil {
-				fmt.Printf("Failed to update download count")
-				return
+				slog.WarnContext(r.Context(), "Failed to queue download count update", "file_id", userFileID, "error", err)
 			}
 		}
+		err = auditService.Record(r.Context(), nil, services.AuditEvent{UserID: userID, Action: models.AuditActionDownload, FileID: &userFileID})
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed to create audit log for download", "error", err)
+		}
 	})
 
-	fileHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(fileDownloadHandler, cfg.JWTSecret), rateLimiter))
+	fileHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(fileDownloadHandler, tokenKeys, userService.TokenState), rateLimiter))
 
 	filePreviewHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.FilePreviewHandler(w, r, db, fileService)
+		handlers.FilePreviewHandler(w, r, db, fileService, authz, auditService)
 	})
 
-	previewHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(filePreviewHandler, cfg.JWTSecret), rateLimiter))
+	previewHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(filePreviewHandler, tokenKeys, userService.TokenState), rateLimiter))
 
 	mux.Handle("/api/files/{downloadID}/download/{userID}", fileHandler)
 	mux.Handle("/api/files/{downloadID}/preview/{userID}", previewHandler)
 
-	// Test endpoint to verify server is working
-	mux.HandleFunc("/api/test", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status": "ok", "message": "Server is running"}`)
-	})
+	// detailed health, pool and disk status for administrators
+	systemStatusHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.SystemStatus(w, r, healthService, authz)
+	}), tokenKeys, userService.TokenState), rateLimiter))
+	mux.Handle("GET /api/admin/status", systemStatusHandler)
 
 	searchHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.SearchUsers(w, r, db)
+		handlers.SearchUsers(w, r, db, authz)
 	})
-	userSearchHanlder := corsHandler(rate_limiter.Middleware(auth.Middleware(searchHandler, cfg.JWTSecret), rateLimiter))
+	userSearchHanlder := corsHandler(rate_limiter.Middleware(auth.Middleware(searchHandler, tokenKeys, userService.TokenState), rateLimiter))
 	mux.Handle("/api/users/search", userSearchHanlder)
 
 	// Shared files routes
 	mySharedHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.GetMySharedFiles(w, r, db)
-	}), cfg.JWTSecret), rateLimiter))
+		handlers.GetMySharedFiles(w, r, db, authz)
+	}), tokenKeys, userService.TokenState), rateLimiter))
 	mux.Handle("/api/shares/my-shared", mySharedHandler)
 
 	sharedWithMeHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.GetFilesSharedWithMe(w, r, db)
-	}), cfg.JWTSecret), rateLimiter))
+		handlers.GetFilesSharedWithMe(w, r, db, authz)
+	}), tokenKeys, userService.TokenState), rateLimiter))
 	mux.Handle("/api/shares/shared-with-me", sharedWithMeHandler)
 
 	// Unshare file route
 	unshareHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.UnshareFile(w, r, db)
-	}), cfg.JWTSecret), rateLimiter))
+		handlers.UnshareFile(w, r, db, authz, auditService)
+	}), tokenKeys, userService.TokenState), rateLimiter))
 	mux.Handle("/api/shares/unshare/", unshareHandler)
 
 	// Download shared file route
 	downloadSharedHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.DownloadSharedFile(w, r, db, fileService)
-	}), cfg.JWTSecret), rateLimiter))
+		handlers.DownloadSharedFile(w, r, db, fileService, authz, auditService, jobQueue)
+	}), tokenKeys, userService.TokenState), rateLimiter))
 	mux.Handle("/api/shares/download/", downloadSharedHandler)
 
+	// audit log export for compliance reviews
+	auditExportHandler := corsHandler(rate_limiter.Middleware(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.ExportAuditLogs(w, r, auditService, authz)
+	}), tokenKeys, userService.TokenState), rateLimiter))
+	mux.Handle("/api/audit/export", auditExportHandler)
+
+	// public keys for services verifying our access tokens
+	mux.Handle("GET /.well-known/jwks.json", corsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.JWKS(w, r, tokenKeys)
+	})))
+
+	// OpenID Connect single sign-on
+	if oidcService.Enabled() {
+		oidcLoginHandler := corsHandler(rate_limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.OIDCLogin(w, r, cfg, oidcService)
+		}), rateLimiter))
+		mux.Handle("/api/auth/oidc/login", oidcLoginHandler)
+
+		oidcCallbackHandler := corsHandler(rate_limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.OIDCCallback(w, r, cfg, oidcService, identityService, loginTokens, userService, auditService)
+		}), rateLimiter))
+		mux.Handle("/api/auth/oidc/callback", oidcCallbackHandler)
+	}
+
+	mux.Handle("GET /readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Readiness(w, r, state, healthService)
+	}))
+
+	// liveness stays outside the draining middleware, a draining server is still alive
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", handlers.Liveness)
+	root.Handle("GET /metrics", metrics.Handler(cfg.MetricsToken))
+	root.Handle("/", lifecycle.Middleware(tracing.Middleware(metrics.Middleware(mux)), state))
+	prometheus.MustRegister(
+		collectors.NewDBStatsCollector(db, "file_vault"),
+		metrics.NewStorageCollector(storageService.GetGlobalStats, time.Duration(cfg.MetricsStorageMaxAge)*time.Second),
+	)
+
 	server := &http.Server{
 		Addr:           cfg.Host + ":" + cfg.Port,
-		Handler:        mux,
+		Handler:        logging.Middleware(root),
 		ReadTimeout:    20 * time.Second,
 		WriteTimeout:   20 * time.Second,
 		IdleTimeout:    60 * time.Second,
@@ -217,19 +448,170 @@ func main() {
 	}
 
 	go func() {
-		log.Printf("Server starting on port %s", cfg.Port)
-		log.Printf("GraphQL endpoint: http://localhost:%s/graphql", cfg.Port)
+		slog.Info("Server starting", "port", cfg.Port, "graphql", "http://localhost:"+cfg.Port+"/graphql")
 		if os.Getenv("GO_ENV") != "production" {
-			log.Printf("GraphQL playground: http://localhost:%s/playground", cfg.Port)
+			slog.Info("GraphQL playground enabled", "url", "http://localhost:"+cfg.Port+"/playground")
 		}
 
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal("Failed to start server:", err)
+			logging.Fatal("Failed to start server", "error", err)
 		}
 	}()
 
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	sig := <-quit
+	slog.Info("Shutting down", "signal", sig.String())
+
+	// readiness fails first, load balancers stop sending traffic before it is turned away
+	state.SetNotReady()
+	time.Sleep(time.Duration(cfg.ShutdownReadinessDelay) * time.Second)
+
+	state.StartDraining()
+	startDraining()
+	stopWorkers()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Failed to drain requests", "error", err)
+		server.Close()
+	}
+
+	workersStopped := make(chan struct{})
+	go func() {
+		<-jobsDone
+		<-schedulerDone
+		close(workersStopped)
+	}()
+	select {
+	case <-workersStopped:
+	case <-time.After(time.Duration(cfg.ShutdownWorkerTimeout) * time.Second):
+		// unfinished jobs are picked up again once their lock expires
+		slog.Error("Background workers did not stop before the deadline")
+	}
+
+	// flush the spans of the last requests and jobs
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelTracing()
+	if err := tracer.Shutdown(tracingCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	if err := redis.Close(); err != nil {
+		slog.Error("Failed to close Redis", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database", "error", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// loadTokenKeys builds the access token key set. With RS256/EdDSA the current key signs new
+// tokens while JWT_VERIFICATION_KEY_FILES keeps retired keys valid until their tokens expire.
+func loadTokenKeys(cfg *config.Config) (*auth.KeySet, error) {
+	if cfg.JWTAlgorithm == auth.AlgorithmHS256 {
+		return auth.NewHMACKeySet(cfg.JWTSecret), nil
+	}
 
+	var signer crypto.Signer
+	var err error
+	if cfg.JWTSigningKeyFile != "" {
+		signer, err = auth.LoadSigningKey(cfg.JWTSigningKeyFile)
+	} else {
+		slog.Warn("JWT_SIGNING_KEY_FILE is not set, using an ephemeral key. Tokens will not survive a restart", "algorithm", cfg.JWTAlgorithm)
+		signer, err = auth.GenerateSigningKey(cfg.JWTAlgorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	verificationKeys := []crypto.PublicKey{}
+	for _, path := range cfg.JWTVerificationKeyFiles {
+		key, err := auth.LoadVerificationKey(path)
+		if err != nil {
+			return nil, err
+		}
+		verificationKeys = append(verificationKeys, key)
+	}
+
+	keys, err := auth.NewKeySet(signer, verificationKeys...)
+	if err != nil {
+		return nil, err
+	}
+	if keys.Algorithm() != cfg.JWTAlgorithm {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY_FILE holds a %s key but JWT_ALGORITHM is %s", keys.Algorithm(), cfg.JWTAlgorithm)
+	}
+	if cfg.JWTAcceptLegacyHS256 {
+		keys.AcceptLegacySecret(cfg.JWTSecret)
+	}
+	slog.Info("Signing access tokens", "algorithm", keys.Algorithm(), "key_id", keys.SigningKeyID())
+	return keys, nil
+}
+
+// auditRetention turns AUDIT_RETENTION_DAYS and AUDIT_RETENTION_POLICIES into the policy
+// the cleanup service archives audit entries by
+func auditRetention(cfg *config.Config) services.AuditRetention {
+	day := 24 * time.Hour
+	retention := services.AuditRetention{
+		Default:     time.Duration(cfg.AuditRetentionDays) * day,
+		Actions:     map[models.AuditAction]time.Duration{},
+		ArchivePath: cfg.AuditArchivePath,
+	}
+	for action, days := range cfg.AuditRetentionPolicies {
+		retention.Actions[models.AuditAction(strings.ToUpper(action))] = time.Duration(days) * day
+	}
+	return retention
+}
+
+// loadScheduler registers the maintenance tasks on their schedules. Audit checkpoints are
+// only written with a signing key.
+func loadScheduler(cfg *config.Config, db *sql.DB, cleanup *services.CleanUpService, gc *services.GarbageCollector,
+	outbox *services.Outbox, auditChain *services.AuditChainService) (*services.Scheduler, error) {
+	scheduler := services.NewScheduler(db, time.Duration(cfg.SchedulerInterval)*time.Second)
+	if err := scheduler.Register("cleanup", cfg.ScheduleCleanup, cleanup.Cleanup); err != nil {
+		return nil, err
+	}
+	if err := scheduler.Register("garbage_collection", cfg.ScheduleGarbageCollection, gc.Run); err != nil {
+		return nil, err
+	}
+	// a relay job can run before the message it was queued for commits
+	err := scheduler.Register("outbox_relay", cfg.ScheduleOutboxRelay, func(ctx context.Context) error {
+		return outbox.Relay(ctx, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AuditCheckpointKeyFile == "" {
+		slog.Info("Audit checkpoints disabled", "reason", services.ErrCheckpointsDisabled.Error())
+		return scheduler, nil
+	}
+	checkpoints := fmt.Sprintf("@every %dm", cfg.AuditCheckpointInterval)
+	err = scheduler.Register("audit_checkpoint", checkpoints, func(context.Context) error {
+		return auditChain.Checkpoint()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scheduler, nil
+}
+
+// loadAuditChain sets up signing of audit log checkpoints with AUDIT_CHECKPOINT_KEY_FILE.
+// Retired keys stay in AUDIT_CHECKPOINT_VERIFICATION_KEY_FILES so their checkpoints verify.
+func loadAuditChain(cfg *config.Config, db *sql.DB) (*services.AuditChainService, error) {
+	var signer crypto.Signer
+	if cfg.AuditCheckpointKeyFile != "" {
+		var err error
+		if signer, err = auth.LoadSigningKey(cfg.AuditCheckpointKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	verificationKeys := []crypto.PublicKey{}
+	for _, path := range cfg.AuditCheckpointVerificationKeyFiles {
+		key, err := auth.LoadVerificationKey(path)
+		if err != nil {
+			return nil, err
+		}
+		verificationKeys = append(verificationKeys, key)
+	}
+	return services.NewAuditChainService(db, signer, verificationKeys...)
 }
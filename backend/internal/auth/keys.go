@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("token is signed with an unknown key")
+	ErrUnsupportedKey    = errors.New("unsupported key type, expected RSA or Ed25519")
+)
+
+// verificationKey is a key tokens may be signed with. The method is pinned per key so a
+// token can never pick its own algorithm (e.g. HS256 with an RSA public key as the secret).
+type verificationKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+// KeySet holds the key new tokens are signed with and every key that is still accepted.
+// Keys are rotated by adding a new signing key and keeping the old one as a verification
+// key until the last token signed with it has expired.
+type KeySet struct {
+	signingKID    string
+	signingMethod jwt.SigningMethod
+	signingKey    interface{}
+
+	verification map[string]verificationKey
+	// legacy accepts HS256 tokens without a kid, as issued before asymmetric signing
+	legacy *verificationKey
+}
+
+// NewHMACKeySet signs and verifies with a single shared secret. Tokens carry no kid.
+func NewHMACKeySet(secret string) *KeySet {
+	key := &verificationKey{method: jwt.SigningMethodHS256, key: []byte(secret)}
+	return &KeySet{
+		signingMethod: key.method,
+		signingKey:    key.key,
+		verification:  map[string]verificationKey{},
+		legacy:        key,
+	}
+}
+
+// NewKeySet signs with an RSA (RS256) or Ed25519 (EdDSA) private key. The kid of every key
+// is its RFC 7638 thumbprint, so retired keys keep matching the tokens they signed.
+func NewKeySet(signer crypto.Signer, verificationKeys ...crypto.PublicKey) (*KeySet, error) {
+	ks := &KeySet{verification: map[string]verificationKey{}}
+
+	current, err := ks.addVerificationKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	ks.signingKID = current.kid
+	ks.signingMethod = current.method
+	ks.signingKey = signer
+
+	for _, public := range verificationKeys {
+		if _, err := ks.addVerificationKey(public); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+// AcceptLegacySecret keeps accepting HS256 tokens signed with secret while moving to
+// asymmetric keys. New tokens are never signed with it.
+func (ks *KeySet) AcceptLegacySecret(secret string) {
+	ks.legacy = &verificationKey{method: jwt.SigningMethodHS256, key: []byte(secret)}
+}
+
+func (ks *KeySet) Algorithm() string {
+	return ks.signingMethod.Alg()
+}
+
+func (ks *KeySet) SigningKeyID() string {
+	return ks.signingKID
+}
+
+func (ks *KeySet) addVerificationKey(public crypto.PublicKey) (verificationKey, error) {
+	jwk, err := publicJWK(public)
+	if err != nil {
+		return verificationKey{}, err
+	}
+
+	key := verificationKey{kid: jwk.Kid, key: public}
+	switch public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	}
+	ks.verification[key.kid] = key
+	return key, nil
+}
+
+func (ks *KeySet) sign(claims *Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	if ks.signingKID != "" {
+		token.Header["kid"] = ks.signingKID
+	}
+	return token.SignedString(ks.signingKey)
+}
+
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	var key *verificationKey
+	if kid, ok := token.Header["kid"].(string); ok {
+		if k, found := ks.verification[kid]; found {
+			key = &k
+		}
+	} else if _, hasKID := token.Header["kid"]; !hasKID {
+		key = ks.legacy
+	}
+	if key == nil {
+		return nil, ErrUnknownSigningKey
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	return key.key, nil
+}
+
+func (ks *KeySet) validMethods() []string {
+	methods := []string{}
+	seen := map[string]bool{}
+	add := func(alg string) {
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	for _, key := range ks.verification {
+		add(key.method.Alg())
+	}
+	if ks.legacy != nil {
+		add(ks.legacy.method.Alg())
+	}
+	return methods
+}
+
+// JWK is the public part of a verification key as published on /.well-known/jwks.json
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys other services need to verify our tokens. The shared
+// HMAC secret is never published, so an HS256-only key set has no keys.
+func (ks *KeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if current, ok := ks.verification[ks.signingKID]; ok {
+		jwk, _ := publicJWK(current.key)
+		set.Keys = append(set.Keys, jwk)
+	}
+	for kid, key := range ks.verification {
+		if kid == ks.signingKID {
+			continue
+		}
+		jwk, _ := publicJWK(key.key)
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// KeyID returns the RFC 7638 thumbprint of an RSA or Ed25519 public key
+func KeyID(public crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(public)
+	if err != nil {
+		return "", err
+	}
+	return jwk.Kid, nil
+}
+
+func publicJWK(public crypto.PublicKey) (JWK, error) {
+	var jwk JWK
+	var thumbprintInput []byte
+
+	// the thumbprint members must be serialized in lexicographic order (RFC 7638)
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk = JWK{
+			Kty: "RSA",
+			Alg: AlgorithmRS256,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+		thumbprintInput, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N})
+	case ed25519.PublicKey:
+		jwk = JWK{
+			Kty: "OKP",
+			Alg: AlgorithmEdDSA,
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}
+		thumbprintInput, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X})
+	default:
+		return JWK{}, ErrUnsupportedKey
+	}
+
+	sum := sha256.Sum256(thumbprintInput)
+	jwk.Kid = base64.RawURLEncoding.EncodeToString(sum[:])
+	jwk.Use = "sig"
+	return jwk, nil
+}
+
+// GenerateSigningKey creates a throwaway key for development when no key file is configured.
+// Tokens signed with it stop validating when the process restarts.
+func GenerateSigningKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgorithmRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	default:
+		return nil, fmt.Errorf("cannot generate a key for algorithm %q", algorithm)
+	}
+}
+
+// LoadSigningKey reads a PEM encoded PKCS#8 (or PKCS#1 RSA) private key
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s: %w", path, ErrUnsupportedKey)
+	}
+}
+
+// LoadVerificationKey reads a PEM encoded public key. Private keys are accepted too so a
+// retired signing key file can be listed as is.
+func LoadVerificationKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "PUBLIC KEY" {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	}
+
+	signer, err := LoadSigningKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Public(), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
@@ -2,7 +2,9 @@ package auth
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"file-vault/internal/logging"
+	"log/slog"
 	"net/http"
 	"strings"
 
@@ -12,73 +14,163 @@ import (
 type contextKey string
 
 const (
-	UserIDKey   contextKey = "user_id"
-	UserRoleKey contextKey = "user_role"
+	UserIDKey         contextKey = "user_id"
+	UserRoleKey       contextKey = "user_role"
+	TwoFactorSetupKey contextKey = "two_factor_setup"
+	// ActorIDKey and ImpersonationKey are set when staff acts as the user in UserIDKey
+	ActorIDKey       contextKey = "actor_id"
+	ImpersonationKey contextKey = "impersonation_id"
+	// OrgIDKey holds the organization requested with the X-Organization-ID header.
+	// Membership is checked by the organization service, not here.
+	OrgIDKey contextKey = "org_id"
+	// ClientInfoKey holds the address and user agent of the request for audit entries
+	ClientInfoKey contextKey = "client_info"
 )
 
+// ClientInfo identifies where a request came from
+type ClientInfo struct {
+	IPAddress string
+	UserAgent string
+}
+
+const OrganizationHeader = "X-Organization-ID"
+
+var ErrTwoFactorSetupRequired = errors.New("two-factor authentication must be enabled before using admin features")
+
 type Claims struct {
 	UserID string `json:"user_id"`
 	Role   string `json:"role"`
+	// Purpose is set on single-use tokens (e.g. the 2FA challenge) that must not act as access tokens
+	Purpose        string `json:"purpose,omitempty"`
+	TwoFactorSetup bool   `json:"2fa_setup,omitempty"`
+	// ActorID is the staff member behind an impersonation token
+	ActorID string `json:"actor_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func Middleware(next http.Handler, JWTSecret string) http.Handler {
+// AccountLookup returns the current role of the token's user and whether the token may be
+// used. Tokens stay valid until they expire, the lookup makes suspensions, deletions, role
+// changes and ended impersonations apply to tokens already handed out.
+type AccountLookup func(claims *Claims) (role string, active bool, err error)
+
+func Middleware(next http.Handler, keys *KeySet, accounts AccountLookup) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := ExtractUserFromRequest(r, JWTSecret)
+		r = WithClientInfo(r)
+		ctx := ExtractUserFromRequest(r, keys, accounts)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func ExtractUserFromRequest(r *http.Request, JWTSecret string) context.Context {
+func ExtractUserFromRequest(r *http.Request, keys *KeySet, accounts AccountLookup) context.Context {
 	ctx := r.Context()
 
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		fmt.Printf(" ExtractUserFromRequest: No Authorization header\n")
 		return ctx
 	}
-	fmt.Printf(" ExtractUserFromRequest: %v\n", authHeader)
 
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 	if tokenString == authHeader {
-		fmt.Printf(" ExtractUserFromRequest: No Bearer prefix found\n")
+		slog.DebugContext(ctx, "Authorization header without bearer token")
 		return ctx
 	}
 
-	fmt.Printf(" ExtractUserFromRequest: Token string: %v\n", tokenString)
-
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(JWTSecret), nil
-	})
+	ctx = ContextWithToken(ctx, tokenString, keys, accounts)
+	if orgID := r.Header.Get(OrganizationHeader); orgID != "" {
+		ctx = WithOrgID(ctx, orgID)
+	}
+	return ctx
+}
 
+// ContextWithToken adds the user of an access token to ctx. Invalid tokens leave ctx
+// unauthenticated. Websocket connections use it for the token sent in their init payload.
+func ContextWithToken(ctx context.Context, tokenString string, keys *KeySet, accounts AccountLookup) context.Context {
+	claims, err := ValidateToken(tokenString, keys)
 	if err != nil {
-		fmt.Printf(" ExtractUserFromRequest: Token parse error: %v\n", err)
+		slog.DebugContext(ctx, "Rejected access token", "error", err)
 		return ctx
 	}
 
-	if !token.Valid {
-		fmt.Printf(" ExtractUserFromRequest: Token is not valid\n")
+	if claims.Purpose != "" {
+		slog.DebugContext(ctx, "Rejected token that is not an access token", "purpose", claims.Purpose)
 		return ctx
 	}
-
-	if claims, ok := token.Claims.(*Claims); ok {
-		fmt.Printf(" ExtractUserFromRequest: UserID: %v, Role: %v\n", claims.UserID, claims.Role)
-		ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
-		ctx = context.WithValue(ctx, UserRoleKey, claims.Role)
-	} else {
-		fmt.Printf(" ExtractUserFromRequest: Failed to extract claims\n")
+	role := claims.Role
+	if accounts != nil {
+		current, active, err := accounts(claims)
+		if err != nil || !active {
+			slog.DebugContext(ctx, "Rejected access token of inactive account", "user_id", claims.UserID, "error", err)
+			return ctx
+		}
+		role = current
+	}
+	ctx = logging.With(ctx, slog.String("user_id", claims.UserID))
+	ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
+	ctx = context.WithValue(ctx, UserRoleKey, role)
+	ctx = context.WithValue(ctx, TwoFactorSetupKey, claims.TwoFactorSetup)
+	if claims.ActorID != "" {
+		ctx = context.WithValue(ctx, ActorIDKey, claims.ActorID)
+		ctx = context.WithValue(ctx, ImpersonationKey, claims.ID)
+		ctx = logging.With(ctx, slog.String("actor_id", claims.ActorID))
 	}
 	return ctx
 }
 
+// WithOrgID sets the organization a request asks to act in
+func WithOrgID(ctx context.Context, orgID string) context.Context {
+	return context.WithValue(ctx, OrgIDKey, orgID)
+}
+
 func GetUserIDFromContext(ctx context.Context) string {
-	fmt.Printf(" GetUserIDFromContext: %v ", ctx.Value(UserIDKey))
 	if userID, ok := ctx.Value(UserIDKey).(string); ok {
 		return userID
 	}
 	return ""
 }
 
+// GetClientInfo returns the client of the request, with placeholders outside of requests
+func GetClientInfo(ctx context.Context) ClientInfo {
+	if info, ok := ctx.Value(ClientInfoKey).(ClientInfo); ok {
+		return info
+	}
+	return ClientInfo{IPAddress: "127.0.0.1", UserAgent: "FileVault-Client"}
+}
+
+// WithClientInfo stores the client of the request for handlers outside of Middleware
+func WithClientInfo(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ClientInfoKey, clientInfo(r)))
+}
+
+func clientInfo(r *http.Request) ClientInfo {
+	userAgent := r.UserAgent()
+	if userAgent == "" {
+		userAgent = "FileVault-Client"
+	}
+	return ClientInfo{IPAddress: ClientIP(r), UserAgent: userAgent}
+}
+
+func GetOrgIDFromContext(ctx context.Context) string {
+	if orgID, ok := ctx.Value(OrgIDKey).(string); ok {
+		return orgID
+	}
+	return ""
+}
+
+// GetActorIDFromContext returns the staff member impersonating the user, empty otherwise
+func GetActorIDFromContext(ctx context.Context) string {
+	if actorID, ok := ctx.Value(ActorIDKey).(string); ok {
+		return actorID
+	}
+	return ""
+}
+
+func GetImpersonationIDFromContext(ctx context.Context) string {
+	if sessionID, ok := ctx.Value(ImpersonationKey).(string); ok {
+		return sessionID
+	}
+	return ""
+}
+
 func GetUserRoleFromContext(ctx context.Context) string {
 	if role, ok := ctx.Value(UserRoleKey).(string); ok {
 		return role
@@ -93,17 +185,3 @@ func RequireAuth(ctx context.Context) (string, error) {
 	}
 	return userID, nil
 }
-
-func RequireAdmin(ctx context.Context) (string, error) {
-	userID, err := RequireAuth(ctx)
-	if err != nil {
-		return "", err
-	}
-
-	role := GetUserRoleFromContext(ctx)
-	if role != "ADMIN" {
-		return "", jwt.ErrTokenInvalidClaims
-	}
-
-	return userID, nil
-}
@@ -6,24 +6,43 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateToken(userID, role, JWTSecret string) (string, error) {
-	claims := &Claims{
-		UserID: userID,
-		Role:   role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt: jwt.NewNumericDate(time.Now()),
-		},
-	}
+const (
+	// PurposeTwoFactorChallenge marks the short-lived token handed out between the
+	// password check and the TOTP check. It is never accepted as an access token.
+	PurposeTwoFactorChallenge = "2fa_challenge"
+
+	TwoFactorChallengeTTL = 5 * time.Minute
+)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(JWTSecret))
+func GenerateToken(userID, role string, keys *KeySet) (string, error) {
+	return signClaims(newClaims(userID, role, 24*time.Hour), keys)
 }
 
-func ValidateToken(tokenString, JWTSecret string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(JWTSecret), nil
-	})
+// GenerateTwoFactorSetupToken issues an access token for an admin that still has to
+// enroll in 2FA. Admin-only operations are refused until a full token is issued.
+func GenerateTwoFactorSetupToken(userID, role string, keys *KeySet) (string, error) {
+	claims := newClaims(userID, role, 24*time.Hour)
+	claims.TwoFactorSetup = true
+	return signClaims(claims, keys)
+}
+
+func GenerateChallengeToken(userID, role string, keys *KeySet) (string, error) {
+	claims := newClaims(userID, role, TwoFactorChallengeTTL)
+	claims.Purpose = PurposeTwoFactorChallenge
+	return signClaims(claims, keys)
+}
+
+// GenerateImpersonationToken issues an access token acting as userID on behalf of actorID.
+// The session ID goes in the jti claim so the token dies with the session.
+func GenerateImpersonationToken(sessionID, userID, role, actorID string, expiresAt time.Time, keys *KeySet) (string, error) {
+	claims := newClaims(userID, role, time.Until(expiresAt))
+	claims.ActorID = actorID
+	claims.ID = sessionID
+	return signClaims(claims, keys)
+}
+
+func ValidateToken(tokenString string, keys *KeySet) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.keyFunc, jwt.WithValidMethods(keys.validMethods()))
 
 	if err != nil {
 		return nil, err
@@ -35,3 +54,29 @@ func ValidateToken(tokenString, JWTSecret string) (*Claims, error) {
 
 	return nil, jwt.ErrTokenInvalidClaims
 }
+
+func ValidateChallengeToken(tokenString string, keys *KeySet) (*Claims, error) {
+	claims, err := ValidateToken(tokenString, keys)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != PurposeTwoFactorChallenge {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}
+
+func newClaims(userID, role string, ttl time.Duration) *Claims {
+	return &Claims{
+		UserID: userID,
+		Role:   role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+}
+
+func signClaims(claims *Claims, keys *KeySet) (string, error) {
+	return keys.sign(claims)
+}
@@ -1,18 +1,25 @@
 package config
 
 import (
+	"file-vault/internal/logging"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
+// DefaultJWTSecret is only meant for local development, Load refuses it in production
+const DefaultJWTSecret = "your-super-secret-jwt-key"
+
 type Config struct {
 	Port                string
 	Host                string
+	TrustedProxies      []string // reverse proxies whose X-Forwarded-For is believed
 	DatabaseURL         string
+	Environment         string
 	JWTSecret           string
 	StoragePath         string
 	DefaultStorageQuota int64
@@ -23,19 +30,119 @@ type Config struct {
 	UserBurstLimit      int
 	UserBlockLimit      int
 	UserBlockDuration   int
+	TwoFactorIssuer     string
+
+	AppBaseURL                     string
+	SMTPHost                       string
+	SMTPPort                       string
+	SMTPUsername                   string
+	SMTPPassword                   string
+	SMTPFrom                       string
+	SMTPTLSMode                    string
+	SMTPInsecureSkipVerify         bool
+	EmailVerificationTTL           int // hours
+	PasswordResetTTL               int // minutes
+	RequireVerifiedEmailForSharing bool
+
+	LoginMaxAccountFailures int
+	LoginMaxIPFailures      int
+	LoginFailureWindow      int // seconds
+	LoginLockoutDuration    int // seconds
+	LoginDelayThreshold     int
+	LoginMaxDelay           int // seconds
+
+	ImpersonationTTL int // minutes
+
+	AuditCheckpointKeyFile              string
+	AuditCheckpointVerificationKeyFiles []string
+	AuditCheckpointInterval             int // minutes
+	// AuditRetentionDays applies to every action without its own entry in
+	// AuditRetentionPolicies, 0 keeps entries forever
+	AuditRetentionDays     int
+	AuditRetentionPolicies map[string]int // action to days
+	AuditArchivePath       string
+
+	WebhookTimeout             int // seconds
+	WebhookMaxAttempts         int
+	WebhookBackoffBase         int // seconds
+	WebhookBackoffMax          int // seconds
+	WebhookDisableAfter        int // failed deliveries in a row
+	WebhookAllowPrivateTargets bool
+
+	JobWorkers       int
+	JobPollInterval  int // seconds
+	JobLockTimeout   int // seconds
+	JobMaxAttempts   int
+	JobBackoffBase   int // seconds
+	JobBackoffMax    int // seconds
+	JobRetentionDays int // days finished jobs are kept
+
+	// shutdown: readiness fails for ShutdownReadinessDelay before requests are drained for
+	// up to ShutdownTimeout, background workers get ShutdownWorkerTimeout to finish
+	ShutdownReadinessDelay int // seconds
+	ShutdownTimeout        int // seconds
+	ShutdownWorkerTimeout  int // seconds
+
+	HealthCheckTimeout int // seconds each dependency check in /readyz gets
+
+	LogLevel  string // debug, info, warn or error
+	LogFormat string // json or text
+
+	// /metrics requires MetricsToken as a bearer token when it is set
+	MetricsToken         string
+	MetricsStorageMaxAge int // seconds the storage totals are cached between scrapes
+
+	// traces are exported over OTLP/HTTP, an empty endpoint disables tracing
+	TracingOTLPEndpoint string
+	TracingSampleRatio  float64 // share of new traces that are recorded, 0 to 1
+	TracingServiceName  string
+
+	SchedulerInterval         int    // seconds between schedule checks
+	ScheduleCleanup           string // cron expressions, "off" disables the task
+	ScheduleGarbageCollection string
+	ScheduleOutboxRelay       string
+
+	OIDCIssuerURL         string
+	OIDCClientID          string
+	OIDCClientSecret      string
+	OIDCRedirectURL       string
+	OIDCScopes            []string
+	OIDCRoleClaim         string
+	OIDCAdminValues       []string
+	OIDCAllowProvisioning bool
+
+	LDAPURL                string
+	LDAPStartTLS           bool
+	LDAPInsecureSkipVerify bool
+	LDAPBindDN             string
+	LDAPBindPassword       string
+	LDAPBaseDN             string
+	LDAPUserFilter         string
+	LDAPEmailAttribute     string
+	LDAPUsernameAttribute  string
+	LDAPGroupAttribute     string
+	LDAPAdminGroups        []string
+	LDAPAllowProvisioning  bool
+
+	JWTAlgorithm            string // HS256, RS256 or EdDSA
+	JWTSigningKeyFile       string
+	JWTVerificationKeyFiles []string
+	JWTAcceptLegacyHS256    bool
 }
 
 func Load() *Config {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		logging.Fatal("Failed to load .env file", "error", err)
 	}
 
 	ret := &Config{
 		Port:                getEnv("PORT", "8080"),
 		Host:                getEnv("HOST", "localhost"),
+		TrustedProxies:      getEnvAsList("TRUSTED_PROXIES", nil),
 		DatabaseURL:         buildDatabaseURL(),
-		JWTSecret:           getEnv("JWT_SECRET", "your-super-secret-jwt-key"),
+		Environment:         getEnv("GO_ENV", "development"),
+		JWTSecret:           getEnv("JWT_SECRET", DefaultJWTSecret),
 		StoragePath:         getEnv("STORAGE_PATH", "./storage/"),
 		GlobalRateLimit:     getEnvAsInt("API_RATE_LIMIT", 1000),
 		GlobalBurstLimit:    getEnvAsInt("API_BURST_LIMIT", 2000),
@@ -45,11 +152,126 @@ func Load() *Config {
 		UserBlockDuration:   getEnvAsInt("USER_BLOCK_DURATION", 3600),
 		DefaultStorageQuota: getEnvAsInt64GB("DEFAULT_STORAGE_QUOTA", 1),
 		RedisURL:            getEnv("REDIS_URL", "redis://localhost:6379"),
+		TwoFactorIssuer:     getEnv("TWO_FACTOR_ISSUER", "FileVault"),
+
+		AppBaseURL:                     getEnv("APP_BASE_URL", "http://localhost:3000"),
+		SMTPHost:                       getEnv("SMTP_HOST", ""),
+		SMTPPort:                       getEnv("SMTP_PORT", "587"),
+		SMTPUsername:                   getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:                   getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:                       getEnv("SMTP_FROM", "FileVault <no-reply@filevault.local>"),
+		SMTPTLSMode:                    getEnv("SMTP_TLS_MODE", "starttls"),
+		SMTPInsecureSkipVerify:         getEnvAsBool("SMTP_INSECURE_SKIP_VERIFY", false),
+		EmailVerificationTTL:           getEnvAsInt("EMAIL_VERIFICATION_TTL", 48),
+		PasswordResetTTL:               getEnvAsInt("PASSWORD_RESET_TTL", 30),
+		RequireVerifiedEmailForSharing: getEnvAsBool("REQUIRE_VERIFIED_EMAIL_FOR_SHARING", false),
+
+		LoginMaxAccountFailures: getEnvAsInt("LOGIN_MAX_ACCOUNT_FAILURES", 10),
+		LoginMaxIPFailures:      getEnvAsInt("LOGIN_MAX_IP_FAILURES", 50),
+		LoginFailureWindow:      getEnvAsInt("LOGIN_FAILURE_WINDOW", 900),
+		LoginLockoutDuration:    getEnvAsInt("LOGIN_LOCKOUT_DURATION", 900),
+		LoginDelayThreshold:     getEnvAsInt("LOGIN_DELAY_THRESHOLD", 3),
+		LoginMaxDelay:           getEnvAsInt("LOGIN_MAX_DELAY", 60),
+
+		ImpersonationTTL: getEnvAsInt("IMPERSONATION_TTL", 30),
+
+		AuditCheckpointKeyFile:              getEnv("AUDIT_CHECKPOINT_KEY_FILE", ""),
+		AuditCheckpointVerificationKeyFiles: getEnvAsList("AUDIT_CHECKPOINT_VERIFICATION_KEY_FILES", nil),
+		AuditCheckpointInterval:             getEnvAsInt("AUDIT_CHECKPOINT_INTERVAL", 60),
+		AuditRetentionDays:                  getEnvAsInt("AUDIT_RETENTION_DAYS", 0),
+		AuditRetentionPolicies:              getEnvAsIntMap("AUDIT_RETENTION_POLICIES"),
+		AuditArchivePath:                    getEnv("AUDIT_ARCHIVE_PATH", "./storage/audit-archive/"),
+
+		WebhookTimeout:             getEnvAsInt("WEBHOOK_TIMEOUT", 10),
+		WebhookMaxAttempts:         getEnvAsInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookBackoffBase:         getEnvAsInt("WEBHOOK_BACKOFF_BASE", 30),
+		WebhookBackoffMax:          getEnvAsInt("WEBHOOK_BACKOFF_MAX", 21600),
+		WebhookDisableAfter:        getEnvAsInt("WEBHOOK_DISABLE_AFTER", 20),
+		WebhookAllowPrivateTargets: getEnvAsBool("WEBHOOK_ALLOW_PRIVATE_TARGETS", false),
+
+		JobWorkers:       getEnvAsInt("JOB_WORKERS", 4),
+		JobPollInterval:  getEnvAsInt("JOB_POLL_INTERVAL", 2),
+		JobLockTimeout:   getEnvAsInt("JOB_LOCK_TIMEOUT", 300),
+		JobMaxAttempts:   getEnvAsInt("JOB_MAX_ATTEMPTS", 10),
+		JobBackoffBase:   getEnvAsInt("JOB_BACKOFF_BASE", 10),
+		JobBackoffMax:    getEnvAsInt("JOB_BACKOFF_MAX", 3600),
+		JobRetentionDays: getEnvAsInt("JOB_RETENTION_DAYS", 7),
+
+		ShutdownReadinessDelay: getEnvAsInt("SHUTDOWN_READINESS_DELAY", 5),
+		ShutdownTimeout:        getEnvAsInt("SHUTDOWN_TIMEOUT", 30),
+		ShutdownWorkerTimeout:  getEnvAsInt("SHUTDOWN_WORKER_TIMEOUT", 30),
+
+		HealthCheckTimeout: getEnvAsInt("HEALTH_CHECK_TIMEOUT", 2),
+
+		LogLevel:  getEnv("LOG_LEVEL", "info"),
+		LogFormat: getEnv("LOG_FORMAT", "text"),
+
+		MetricsToken:         getEnv("METRICS_TOKEN", ""),
+		MetricsStorageMaxAge: getEnvAsInt("METRICS_STORAGE_MAX_AGE", 60),
+
+		TracingOTLPEndpoint: getEnv("TRACING_OTLP_ENDPOINT", ""),
+		TracingSampleRatio:  getEnvAsFloat("TRACING_SAMPLE_RATIO", 1.0),
+		TracingServiceName:  getEnv("TRACING_SERVICE_NAME", "file-vault"),
+
+		SchedulerInterval:         getEnvAsInt("SCHEDULER_INTERVAL", 15),
+		ScheduleCleanup:           getEnv("SCHEDULE_CLEANUP", "*/30 * * * *"),
+		ScheduleGarbageCollection: getEnv("SCHEDULE_GARBAGE_COLLECTION", "0 3 * * *"),
+		ScheduleOutboxRelay:       getEnv("SCHEDULE_OUTBOX_RELAY", "* * * * *"),
+
+		OIDCIssuerURL:         getEnv("OIDC_ISSUER_URL", ""),
+		OIDCClientID:          getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:      getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:       getEnv("OIDC_REDIRECT_URL", "http://localhost:8080/api/auth/oidc/callback"),
+		OIDCScopes:            getEnvAsList("OIDC_SCOPES", []string{"openid", "email", "profile"}),
+		OIDCRoleClaim:         getEnv("OIDC_ROLE_CLAIM", ""),
+		OIDCAdminValues:       getEnvAsList("OIDC_ADMIN_VALUES", nil),
+		OIDCAllowProvisioning: getEnvAsBool("OIDC_ALLOW_PROVISIONING", true),
+
+		LDAPURL:                getEnv("LDAP_URL", ""),
+		LDAPStartTLS:           getEnvAsBool("LDAP_START_TLS", false),
+		LDAPInsecureSkipVerify: getEnvAsBool("LDAP_INSECURE_SKIP_VERIFY", false),
+		LDAPBindDN:             getEnv("LDAP_BIND_DN", ""),
+		LDAPBindPassword:       getEnv("LDAP_BIND_PASSWORD", ""),
+		LDAPBaseDN:             getEnv("LDAP_BASE_DN", ""),
+		LDAPUserFilter:         getEnv("LDAP_USER_FILTER", "(|(uid={username})(mail={username}))"),
+		LDAPEmailAttribute:     getEnv("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		LDAPUsernameAttribute:  getEnv("LDAP_USERNAME_ATTRIBUTE", "uid"),
+		LDAPGroupAttribute:     getEnv("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		LDAPAdminGroups:        getEnvAsList("LDAP_ADMIN_GROUPS", nil),
+		LDAPAllowProvisioning:  getEnvAsBool("LDAP_ALLOW_PROVISIONING", true),
+
+		JWTAlgorithm:            getEnv("JWT_ALGORITHM", "HS256"),
+		JWTSigningKeyFile:       getEnv("JWT_SIGNING_KEY_FILE", ""),
+		JWTVerificationKeyFiles: getEnvAsList("JWT_VERIFICATION_KEY_FILES", nil),
+		JWTAcceptLegacyHS256:    getEnvAsBool("JWT_ACCEPT_LEGACY_HS256", false),
+	}
+
+	if err := ret.validate(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
 	}
-	fmt.Printf("userblocklimi: %v\n", ret.UserBlockLimit)
 	return ret
 }
 
+func (c *Config) IsProduction() bool {
+	return c.Environment == "production"
+}
+
+func (c *Config) validate() error {
+	usesSecret := c.JWTAlgorithm == "HS256" || c.JWTAcceptLegacyHS256
+	if c.IsProduction() && usesSecret && (c.JWTSecret == DefaultJWTSecret || c.JWTSecret == "") {
+		return fmt.Errorf("JWT_SECRET must be set to a random value in production")
+	}
+	switch c.JWTAlgorithm {
+	case "HS256", "RS256", "EdDSA":
+	default:
+		return fmt.Errorf("JWT_ALGORITHM must be HS256, RS256 or EdDSA, got %q", c.JWTAlgorithm)
+	}
+	if c.IsProduction() && c.JWTAlgorithm != "HS256" && c.JWTSigningKeyFile == "" {
+		return fmt.Errorf("JWT_SIGNING_KEY_FILE is required for %s in production", c.JWTAlgorithm)
+	}
+	return nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -60,13 +282,59 @@ func getEnv(key, defaultValue string) string {
 func getEnvAsInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
-			fmt.Printf("env key: %v  value %v \n", key, intValue)
 			return intValue
 		}
 	}
 	return defaultValue
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvAsIntMap reads a list of key=number pairs such as "LOGIN=90,DOWNLOAD=365"
+func getEnvAsIntMap(key string) map[string]int {
+	values := map[string]int{}
+	for _, item := range getEnvAsList(key, nil) {
+		name, value, found := strings.Cut(item, "=")
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if !found || err != nil {
+			slog.Warn("Ignoring invalid configuration entry", "key", key, "entry", item)
+			continue
+		}
+		values[strings.TrimSpace(name)] = number
+	}
+	return values
+}
+
 func getEnvAsInt64(key string, defaultValue int64) int64 {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
@@ -0,0 +1,28 @@
+-- TOTP two-factor authentication
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) DEFAULT NULL;
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- single-use recovery codes, only the sha256 of each code is stored
+CREATE TABLE user_recovery_codes (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash VARCHAR(64) NOT NULL,
+  used_at TIMESTAMPTZ DEFAULT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX idx_user_recovery_codes_user_id ON user_recovery_codes(user_id);
+
+-- runtime settings that admins can change without a redeploy
+CREATE TABLE app_settings (
+  key VARCHAR(100) PRIMARY KEY,
+  value TEXT NOT NULL,
+  updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+INSERT INTO app_settings (key, value) VALUES ('admin_2fa_required', 'false')
+ON CONFLICT (key) DO NOTHING;
+
+ALTER TYPE audit_action ADD VALUE 'TWO_FACTOR_ENABLED';
+ALTER TYPE audit_action ADD VALUE 'TWO_FACTOR_DISABLED';
@@ -0,0 +1,21 @@
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ DEFAULT NULL;
+
+-- accounts that existed before verification was introduced are trusted
+UPDATE users SET email_verified = TRUE, email_verified_at = NOW();
+
+CREATE TYPE account_token_purpose AS ENUM ('EMAIL_VERIFICATION', 'PASSWORD_RESET');
+
+-- single-use tokens sent by email, only the sha256 of the token is stored
+CREATE TABLE account_tokens (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  purpose account_token_purpose NOT NULL,
+  token_hash VARCHAR(64) NOT NULL UNIQUE,
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ DEFAULT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX idx_account_tokens_user_id ON account_tokens(user_id);
+CREATE INDEX idx_account_tokens_expires_at ON account_tokens(expires_at);
@@ -0,0 +1,4 @@
+-- Add login related actions to audit_action enum
+ALTER TYPE audit_action ADD VALUE 'LOGIN';
+ALTER TYPE audit_action ADD VALUE 'LOGIN_FAILED';
+ALTER TYPE audit_action ADD VALUE 'ACCOUNT_UNLOCKED';
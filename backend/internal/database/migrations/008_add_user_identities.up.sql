@@ -0,0 +1,13 @@
+-- identities from external providers (OIDC, LDAP) linked to local users
+CREATE TABLE user_identities (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider VARCHAR(50) NOT NULL,
+  issuer VARCHAR(500) NOT NULL DEFAULT '',
+  subject VARCHAR(500) NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW(),
+  last_login_at TIMESTAMPTZ DEFAULT NOW(),
+  UNIQUE (provider, issuer, subject)
+);
+
+CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);
@@ -0,0 +1,5 @@
+-- Roles beyond USER/ADMIN, their permissions are seeded in the next migration
+-- because new enum values cannot be used in the transaction that adds them
+ALTER TYPE user_role ADD VALUE 'AUDITOR';
+ALTER TYPE user_role ADD VALUE 'SUPPORT';
+ALTER TYPE user_role ADD VALUE 'STORAGE_ADMIN';
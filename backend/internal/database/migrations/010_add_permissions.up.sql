@@ -0,0 +1,47 @@
+-- Permissions checked by the authorization service
+CREATE TABLE permissions (
+  name VARCHAR(100) PRIMARY KEY,
+  description TEXT NOT NULL
+);
+
+CREATE TABLE role_permissions (
+  role user_role NOT NULL,
+  permission VARCHAR(100) NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (role, permission)
+);
+
+INSERT INTO permissions (name, description) VALUES
+  ('files:read', 'Browse, download and preview own and shared files'),
+  ('files:write', 'Upload, update and delete own files and folders'),
+  ('files:share', 'Share own files with other users or publicly'),
+  ('users:search', 'Search users to share files with'),
+  ('users:read', 'List all users'),
+  ('users:unlock', 'Unlock accounts locked by failed logins'),
+  ('users:manage', 'Delete other user accounts'),
+  ('files:read_all', 'List files of every user'),
+  ('files:delete_all', 'Delete files of any user'),
+  ('audit:read', 'Read the audit log'),
+  ('storage:read', 'View global storage statistics'),
+  ('storage:manage_quota', 'Change user storage quotas'),
+  ('storage:gc', 'Run storage garbage collection'),
+  ('settings:manage', 'Change security settings such as the admin 2FA policy'),
+  ('roles:manage', 'Change the permissions granted to roles');
+
+-- every role is a regular user for their own files
+INSERT INTO role_permissions (role, permission)
+SELECT role::user_role, permission
+FROM unnest(ARRAY['USER', 'ADMIN', 'AUDITOR', 'SUPPORT', 'STORAGE_ADMIN']) AS role
+CROSS JOIN unnest(ARRAY['files:read', 'files:write', 'files:share', 'users:search']) AS permission;
+
+INSERT INTO role_permissions (role, permission)
+SELECT 'ADMIN', name FROM permissions
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('AUDITOR', 'audit:read'),
+  ('SUPPORT', 'users:read'),
+  ('SUPPORT', 'users:unlock'),
+  ('STORAGE_ADMIN', 'storage:read'),
+  ('STORAGE_ADMIN', 'storage:manage_quota'),
+  ('STORAGE_ADMIN', 'storage:gc');
@@ -0,0 +1,81 @@
+-- Groups of users that files and folders can be shared with. Owner managed groups belong
+-- to the user who created them, admin managed groups have no owner.
+CREATE TABLE user_groups (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  name VARCHAR(100) NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  owner_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE group_members (
+  group_id UUID NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX idx_user_groups_owner_id ON user_groups(owner_id);
+CREATE INDEX idx_group_members_user_id ON group_members(user_id);
+
+ALTER TYPE share_type ADD VALUE 'GROUP';
+
+ALTER TABLE file_shares ADD COLUMN shared_with_group_id UUID REFERENCES user_groups(id) ON DELETE CASCADE;
+CREATE INDEX idx_file_shares_shared_with_group_id ON file_shares(shared_with_group_id);
+
+CREATE TABLE folder_shares (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  folder_id UUID NOT NULL REFERENCES folders(id) ON DELETE CASCADE,
+  shared_with_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  shared_with_group_id UUID REFERENCES user_groups(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CHECK ((shared_with_user_id IS NULL) <> (shared_with_group_id IS NULL))
+);
+
+CREATE INDEX idx_folder_shares_folder_id ON folder_shares(folder_id);
+CREATE INDEX idx_folder_shares_shared_with_user_id ON folder_shares(shared_with_user_id);
+CREATE INDEX idx_folder_shares_shared_with_group_id ON folder_shares(shared_with_group_id);
+
+-- Folders shared with a user directly or through a group, including every subfolder.
+-- Membership is resolved on every call so removing a member revokes access at once.
+CREATE OR REPLACE FUNCTION shared_folders_for_user(p_user UUID)
+RETURNS TABLE (folder_id UUID, folder_share_id UUID) AS $$
+  WITH RECURSIVE shared AS (
+    SELECT fos.folder_id, fos.id AS folder_share_id
+    FROM folder_shares fos
+    WHERE fos.shared_with_user_id = p_user
+       OR fos.shared_with_group_id IN (SELECT gm.group_id FROM group_members gm WHERE gm.user_id = p_user)
+    UNION
+    SELECT f.id, s.folder_share_id
+    FROM folders f
+    JOIN shared s ON f.parent_folder_id = s.folder_id
+  )
+  SELECT s.folder_id, s.folder_share_id FROM shared s;
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION can_access_file(p_user UUID, p_file UUID)
+RETURNS BOOLEAN AS $$
+  SELECT EXISTS (
+    SELECT 1 FROM user_files uf
+    WHERE uf.id = p_file
+      AND (
+        uf.user_id = p_user
+        OR uf.is_public = true
+        OR EXISTS (
+          SELECT 1 FROM file_shares fs
+          WHERE fs.file_id = uf.id
+            AND (
+              fs.shared_with_user_id = p_user
+              OR fs.shared_with_group_id IN (SELECT gm.group_id FROM group_members gm WHERE gm.user_id = p_user)
+            )
+        )
+        OR uf.folder_id IN (SELECT sf.folder_id FROM shared_folders_for_user(p_user) sf)
+      )
+  );
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO permissions (name, description) VALUES
+  ('groups:manage', 'Manage admin groups and the members of any group');
+
+INSERT INTO role_permissions (role, permission) VALUES ('ADMIN', 'groups:manage');
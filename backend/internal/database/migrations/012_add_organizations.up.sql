@@ -0,0 +1,131 @@
+-- Organizations scope files, folders, groups, quotas and audit logs. Existing data moves
+-- into a default organization that new users join automatically.
+CREATE TYPE org_role AS ENUM ('OWNER', 'ADMIN', 'MEMBER');
+
+CREATE TABLE organizations (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  name VARCHAR(100) NOT NULL,
+  slug VARCHAR(50) NOT NULL UNIQUE,
+  storage_quota BIGINT, -- NULL means unlimited
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE organization_members (
+  org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role org_role NOT NULL DEFAULT 'MEMBER',
+  joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (org_id, user_id)
+);
+
+CREATE INDEX idx_organization_members_user_id ON organization_members(user_id);
+
+CREATE TABLE organization_settings (
+  org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+  key VARCHAR(100) NOT NULL,
+  value TEXT NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (org_id, key)
+);
+
+-- what org owners and admins may do inside their own organization
+CREATE TABLE org_role_permissions (
+  role org_role NOT NULL,
+  permission VARCHAR(100) NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+  PRIMARY KEY (role, permission)
+);
+
+INSERT INTO permissions (name, description) VALUES
+  ('orgs:manage', 'Manage organization members and settings'),
+  ('orgs:create', 'Create new organizations');
+
+INSERT INTO role_permissions (role, permission)
+SELECT role::user_role, 'orgs:create'
+FROM unnest(ARRAY['USER', 'ADMIN', 'AUDITOR', 'SUPPORT', 'STORAGE_ADMIN']) AS role;
+
+INSERT INTO role_permissions (role, permission) VALUES ('ADMIN', 'orgs:manage');
+
+INSERT INTO org_role_permissions (role, permission)
+SELECT role::org_role, permission
+FROM unnest(ARRAY['OWNER', 'ADMIN']) AS role
+CROSS JOIN unnest(ARRAY[
+  'orgs:manage', 'users:read', 'audit:read', 'storage:read',
+  'files:read_all', 'files:delete_all', 'groups:manage'
+]) AS permission;
+
+INSERT INTO organizations (name, slug) VALUES ('Default', 'default');
+
+INSERT INTO organization_members (org_id, user_id, role)
+SELECT o.id, u.id, CASE WHEN u.role = 'ADMIN' THEN 'ADMIN'::org_role ELSE 'MEMBER'::org_role END
+FROM organizations o CROSS JOIN users u
+WHERE o.slug = 'default';
+
+ALTER TABLE users ADD COLUMN default_org_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
+UPDATE users SET default_org_id = (SELECT id FROM organizations WHERE slug = 'default');
+
+-- scope existing data to the default organization
+ALTER TABLE user_files ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE folders ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE user_groups ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE audit_logs ADD COLUMN org_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
+
+UPDATE user_files SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+UPDATE folders SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+UPDATE user_groups SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+UPDATE audit_logs SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+
+ALTER TABLE user_files ALTER COLUMN org_id SET NOT NULL;
+ALTER TABLE folders ALTER COLUMN org_id SET NOT NULL;
+ALTER TABLE user_groups ALTER COLUMN org_id SET NOT NULL;
+
+CREATE INDEX idx_user_files_org_id ON user_files(org_id);
+CREATE INDEX idx_folders_org_id ON folders(org_id);
+CREATE INDEX idx_user_groups_org_id ON user_groups(org_id);
+CREATE INDEX idx_audit_logs_org_id ON audit_logs(org_id);
+
+-- every new account, whatever created it, joins the default organization
+CREATE OR REPLACE FUNCTION join_default_organization()
+RETURNS TRIGGER AS $$
+DECLARE
+  default_org UUID;
+BEGIN
+  SELECT id INTO default_org FROM organizations WHERE slug = 'default';
+  IF default_org IS NOT NULL THEN
+    INSERT INTO organization_members (org_id, user_id) VALUES (default_org, NEW.id)
+    ON CONFLICT DO NOTHING;
+    UPDATE users SET default_org_id = default_org WHERE id = NEW.id AND default_org_id IS NULL;
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER join_default_organization AFTER INSERT ON users
+FOR EACH ROW EXECUTE FUNCTION join_default_organization();
+
+-- shares only reach members of the file's organization, public files stay public
+CREATE OR REPLACE FUNCTION can_access_file(p_user UUID, p_file UUID)
+RETURNS BOOLEAN AS $$
+  SELECT EXISTS (
+    SELECT 1 FROM user_files uf
+    WHERE uf.id = p_file
+      AND (
+        uf.is_public = true
+        OR (
+          EXISTS (SELECT 1 FROM organization_members om WHERE om.org_id = uf.org_id AND om.user_id = p_user)
+          AND (
+            uf.user_id = p_user
+            OR EXISTS (
+              SELECT 1 FROM file_shares fs
+              WHERE fs.file_id = uf.id
+                AND (
+                  fs.shared_with_user_id = p_user
+                  OR fs.shared_with_group_id IN (SELECT gm.group_id FROM group_members gm WHERE gm.user_id = p_user)
+                )
+            )
+            OR uf.folder_id IN (SELECT sf.folder_id FROM shared_folders_for_user(p_user) sf)
+          )
+        )
+      )
+  );
+$$ LANGUAGE sql STABLE;
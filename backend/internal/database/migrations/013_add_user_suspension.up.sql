@@ -0,0 +1,5 @@
+-- suspended accounts keep their data but can't log in, their tokens are rejected
+ALTER TABLE users ADD COLUMN suspended_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN suspended_reason TEXT;
+
+CREATE INDEX idx_users_suspended_at ON users(suspended_at) WHERE suspended_at IS NOT NULL;
@@ -0,0 +1,31 @@
+-- Support staff can act as a user for a limited time. Sessions are recorded so the
+-- target can see them and tokens stop working once a session ends.
+ALTER TYPE audit_action ADD VALUE 'IMPERSONATION_STARTED';
+ALTER TYPE audit_action ADD VALUE 'IMPERSONATION_ENDED';
+
+CREATE TABLE impersonation_sessions (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  actor_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  target_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  reason TEXT NOT NULL DEFAULT '',
+  started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  ended_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_impersonation_sessions_target_id ON impersonation_sessions(target_id);
+CREATE INDEX idx_impersonation_sessions_actor_id ON impersonation_sessions(actor_id);
+
+-- actions taken under impersonation are attributed to the target in user_id and to the
+-- acting staff member here
+ALTER TABLE audit_logs ADD COLUMN actor_id UUID REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE audit_logs ADD COLUMN impersonation_id UUID REFERENCES impersonation_sessions(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_audit_logs_impersonation_id ON audit_logs(impersonation_id);
+
+INSERT INTO permissions (name, description) VALUES
+  ('users:impersonate', 'Act as another user for a limited time');
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('ADMIN', 'users:impersonate'),
+  ('SUPPORT', 'users:impersonate');
@@ -0,0 +1,7 @@
+-- audit log pages are read newest first by creation time and ID, usually narrowed to an
+-- organization or a user
+CREATE INDEX idx_audit_logs_created_at_id ON audit_logs(created_at DESC, id DESC);
+CREATE INDEX idx_audit_logs_org_id_created_at ON audit_logs(org_id, created_at DESC, id DESC);
+CREATE INDEX idx_audit_logs_user_id_created_at ON audit_logs(user_id, created_at DESC, id DESC);
+CREATE INDEX idx_audit_logs_actor_id ON audit_logs(actor_id);
+CREATE INDEX idx_audit_logs_ip_address ON audit_logs USING gist(ip_address inet_ops);
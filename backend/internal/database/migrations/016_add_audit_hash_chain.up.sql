@@ -0,0 +1,121 @@
+-- Audit entries are chained per organization: every entry stores the hash of the entry
+-- before it in its chain and a hash over its own content, so edited or removed entries
+-- break the chain. Entries keep the IDs of deleted users and files instead of following
+-- them through foreign keys, which would delete or rewrite them.
+ALTER TABLE audit_logs DROP CONSTRAINT IF EXISTS audit_logs_user_id_fkey;
+ALTER TABLE audit_logs DROP CONSTRAINT IF EXISTS audit_logs_file_id_fkey;
+ALTER TABLE audit_logs DROP CONSTRAINT IF EXISTS audit_logs_org_id_fkey;
+ALTER TABLE audit_logs DROP CONSTRAINT IF EXISTS audit_logs_actor_id_fkey;
+ALTER TABLE audit_logs DROP CONSTRAINT IF EXISTS audit_logs_impersonation_id_fkey;
+
+ALTER TABLE audit_logs ADD COLUMN chain_id TEXT;
+ALTER TABLE audit_logs ADD COLUMN chain_seq BIGINT;
+ALTER TABLE audit_logs ADD COLUMN prev_hash TEXT;
+ALTER TABLE audit_logs ADD COLUMN entry_hash TEXT;
+
+-- audit_log_field length-prefixes a value so no two entries share a canonical form, NULL
+-- is written as '-'
+CREATE FUNCTION audit_log_field(value TEXT) RETURNS TEXT AS $$
+  SELECT COALESCE(octet_length(value)::text || ':' || value, '-')
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- audit_log_canonical is the content an entry hash covers. The verifier in
+-- services/audit_chain_service.go rebuilds it and must be changed together with it.
+CREATE FUNCTION audit_log_canonical(entry audit_logs) RETURNS TEXT AS $$
+  SELECT audit_log_field(entry.id::text)
+    || audit_log_field(entry.chain_id)
+    || audit_log_field(entry.chain_seq::text)
+    || audit_log_field(entry.user_id::text)
+    || audit_log_field(entry.action::text)
+    || audit_log_field(entry.file_id::text)
+    || audit_log_field(host(entry.ip_address))
+    || audit_log_field(entry.user_agent)
+    || audit_log_field(to_char(entry.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'))
+    || audit_log_field(entry.org_id::text)
+    || audit_log_field(entry.actor_id::text)
+    || audit_log_field(entry.impersonation_id::text)
+$$ LANGUAGE SQL STABLE;
+
+CREATE FUNCTION audit_log_hash(prev_hash TEXT, entry audit_logs) RETURNS TEXT AS $$
+  SELECT encode(sha256(convert_to(prev_hash || audit_log_canonical(entry), 'UTF8')), 'hex')
+$$ LANGUAGE SQL STABLE;
+
+-- audit_log_chain links a new entry to the head of its chain. Writers to the same chain
+-- are serialized by an advisory lock held until their transaction ends.
+CREATE FUNCTION audit_log_chain() RETURNS TRIGGER AS $$
+DECLARE
+  head RECORD;
+BEGIN
+  NEW.created_at := COALESCE(NEW.created_at, NOW());
+  NEW.chain_id := COALESCE(NEW.org_id::text, 'platform');
+  PERFORM pg_advisory_xact_lock(hashtext('audit_logs:' || NEW.chain_id));
+
+  SELECT chain_seq, entry_hash INTO head FROM audit_logs
+  WHERE chain_id = NEW.chain_id
+  ORDER BY chain_seq DESC
+  LIMIT 1;
+
+  NEW.chain_seq := COALESCE(head.chain_seq, 0) + 1;
+  NEW.prev_hash := COALESCE(head.entry_hash, repeat('0', 64));
+  NEW.entry_hash := audit_log_hash(NEW.prev_hash, NEW);
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- chain the existing entries in the order they were written
+DO $$
+DECLARE
+  entry audit_logs;
+  seqs JSONB := '{}';
+  hashes JSONB := '{}';
+  chain TEXT;
+BEGIN
+  FOR entry IN SELECT * FROM audit_logs ORDER BY created_at, id LOOP
+    chain := COALESCE(entry.org_id::text, 'platform');
+    entry.chain_id := chain;
+    entry.chain_seq := COALESCE((seqs ->> chain)::bigint, 0) + 1;
+    entry.prev_hash := COALESCE(hashes ->> chain, repeat('0', 64));
+    entry.entry_hash := audit_log_hash(entry.prev_hash, entry);
+
+    UPDATE audit_logs
+    SET chain_id = entry.chain_id, chain_seq = entry.chain_seq,
+        prev_hash = entry.prev_hash, entry_hash = entry.entry_hash
+    WHERE id = entry.id;
+
+    seqs := jsonb_set(seqs, ARRAY[chain], to_jsonb(entry.chain_seq));
+    hashes := jsonb_set(hashes, ARRAY[chain], to_jsonb(entry.entry_hash));
+  END LOOP;
+END $$;
+
+ALTER TABLE audit_logs ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE audit_logs ALTER COLUMN chain_id SET NOT NULL;
+ALTER TABLE audit_logs ALTER COLUMN chain_seq SET NOT NULL;
+ALTER TABLE audit_logs ALTER COLUMN prev_hash SET NOT NULL;
+ALTER TABLE audit_logs ALTER COLUMN entry_hash SET NOT NULL;
+CREATE UNIQUE INDEX idx_audit_logs_chain ON audit_logs(chain_id, chain_seq);
+
+CREATE TRIGGER audit_logs_chain BEFORE INSERT ON audit_logs
+  FOR EACH ROW EXECUTE FUNCTION audit_log_chain();
+
+-- entries are never changed, removing them is left to retention and shows in the chain
+CREATE FUNCTION audit_log_immutable() RETURNS TRIGGER AS $$
+BEGIN
+  RAISE EXCEPTION 'audit log entries are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_logs_immutable BEFORE UPDATE ON audit_logs
+  FOR EACH ROW EXECUTE FUNCTION audit_log_immutable();
+
+-- checkpoints pin the head of a chain with a signature made outside the database, so a
+-- chain rewritten from scratch or cut off at its end is still detected
+CREATE TABLE audit_checkpoints (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  chain_id TEXT NOT NULL,
+  chain_seq BIGINT NOT NULL,
+  entry_hash TEXT NOT NULL,
+  key_id TEXT NOT NULL,
+  signature TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (chain_id, chain_seq)
+);
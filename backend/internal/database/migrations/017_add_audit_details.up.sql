@@ -0,0 +1,44 @@
+-- Every security-relevant change is audited, with the state before and after it in details
+ALTER TYPE audit_action ADD VALUE 'FILE_UPDATED';
+ALTER TYPE audit_action ADD VALUE 'FOLDER_CREATED';
+ALTER TYPE audit_action ADD VALUE 'FOLDER_SHARED';
+ALTER TYPE audit_action ADD VALUE 'FOLDER_UNSHARED';
+ALTER TYPE audit_action ADD VALUE 'EMAIL_VERIFIED';
+ALTER TYPE audit_action ADD VALUE 'PASSWORD_RESET';
+ALTER TYPE audit_action ADD VALUE 'RECOVERY_CODES_REGENERATED';
+ALTER TYPE audit_action ADD VALUE 'SETTING_CHANGED';
+ALTER TYPE audit_action ADD VALUE 'USER_SUSPENDED';
+ALTER TYPE audit_action ADD VALUE 'USER_REACTIVATED';
+ALTER TYPE audit_action ADD VALUE 'USER_ROLE_CHANGED';
+ALTER TYPE audit_action ADD VALUE 'USER_QUOTA_CHANGED';
+ALTER TYPE audit_action ADD VALUE 'USER_DELETED';
+ALTER TYPE audit_action ADD VALUE 'ROLE_PERMISSIONS_CHANGED';
+ALTER TYPE audit_action ADD VALUE 'GROUP_CREATED';
+ALTER TYPE audit_action ADD VALUE 'GROUP_DELETED';
+ALTER TYPE audit_action ADD VALUE 'GROUP_MEMBER_ADDED';
+ALTER TYPE audit_action ADD VALUE 'GROUP_MEMBER_REMOVED';
+ALTER TYPE audit_action ADD VALUE 'ORG_CREATED';
+ALTER TYPE audit_action ADD VALUE 'ORG_MEMBER_ADDED';
+ALTER TYPE audit_action ADD VALUE 'ORG_MEMBER_REMOVED';
+ALTER TYPE audit_action ADD VALUE 'ORG_SETTINGS_CHANGED';
+ALTER TYPE audit_action ADD VALUE 'ORG_QUOTA_CHANGED';
+
+ALTER TABLE audit_logs ADD COLUMN details JSONB;
+
+-- details join the hashed content. Entries without details hash as before, so the chains
+-- written until now stay valid.
+CREATE OR REPLACE FUNCTION audit_log_canonical(entry audit_logs) RETURNS TEXT AS $$
+  SELECT audit_log_field(entry.id::text)
+    || audit_log_field(entry.chain_id)
+    || audit_log_field(entry.chain_seq::text)
+    || audit_log_field(entry.user_id::text)
+    || audit_log_field(entry.action::text)
+    || audit_log_field(entry.file_id::text)
+    || audit_log_field(host(entry.ip_address))
+    || audit_log_field(entry.user_agent)
+    || audit_log_field(to_char(entry.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'))
+    || audit_log_field(entry.org_id::text)
+    || audit_log_field(entry.actor_id::text)
+    || audit_log_field(entry.impersonation_id::text)
+    || CASE WHEN entry.details IS NULL THEN '' ELSE audit_log_field(entry.details::text) END
+$$ LANGUAGE SQL STABLE;
@@ -0,0 +1,37 @@
+-- Entries outlive the users and files they name, so they keep a copy of the names as they
+-- were when the entry was written. The copies are for display and not part of the hash.
+ALTER TABLE audit_logs ADD COLUMN username TEXT;
+ALTER TABLE audit_logs ADD COLUMN actor_username TEXT;
+ALTER TABLE audit_logs ADD COLUMN filename TEXT;
+
+ALTER TABLE audit_logs DISABLE TRIGGER audit_logs_immutable;
+UPDATE audit_logs al SET
+  username = (SELECT username FROM users WHERE id = al.user_id),
+  actor_username = (SELECT username FROM users WHERE id = al.actor_id),
+  filename = (SELECT filename FROM user_files WHERE id = al.file_id);
+ALTER TABLE audit_logs ENABLE TRIGGER audit_logs_immutable;
+
+-- expired entries are written to compressed NDJSON files before they are pruned
+CREATE TABLE audit_archives (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  path TEXT NOT NULL,
+  sha256 TEXT NOT NULL,
+  entries INTEGER NOT NULL,
+  first_created_at TIMESTAMPTZ NOT NULL,
+  last_created_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- a pruned entry leaves its hashes behind, so the entries around it still link up and the
+-- archived copy can be checked against the chain
+CREATE TABLE audit_log_tombstones (
+  chain_id TEXT NOT NULL,
+  chain_seq BIGINT NOT NULL,
+  entry_id UUID NOT NULL,
+  prev_hash TEXT NOT NULL,
+  entry_hash TEXT NOT NULL,
+  archive_id UUID NOT NULL REFERENCES audit_archives(id),
+  PRIMARY KEY (chain_id, chain_seq)
+);
+
+CREATE INDEX idx_audit_logs_action_created_at ON audit_logs(action, created_at);
@@ -0,0 +1,55 @@
+-- Webhooks POST file and share events to external systems. A user's webhooks see their own
+-- files, organization webhooks (user_id NULL) see every file of the organization.
+CREATE TYPE webhook_delivery_status AS ENUM ('PENDING', 'SUCCEEDED', 'FAILED');
+
+ALTER TYPE audit_action ADD VALUE 'WEBHOOK_CREATED';
+ALTER TYPE audit_action ADD VALUE 'WEBHOOK_UPDATED';
+ALTER TYPE audit_action ADD VALUE 'WEBHOOK_DELETED';
+
+CREATE TABLE webhooks (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+  user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  url TEXT NOT NULL,
+  events TEXT[] NOT NULL,
+  -- only files in this folder or below it, every file when NULL
+  folder_id UUID REFERENCES folders(id) ON DELETE CASCADE,
+  -- kept in plain text, deliveries are signed with it
+  secret TEXT NOT NULL,
+  enabled BOOLEAN NOT NULL DEFAULT true,
+  consecutive_failures INTEGER NOT NULL DEFAULT 0,
+  disabled_reason TEXT,
+  created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_webhooks_org_id ON webhooks(org_id);
+CREATE INDEX idx_webhooks_user_id ON webhooks(user_id);
+
+CREATE TABLE webhook_deliveries (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  webhook_id UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+  event_type TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  status webhook_delivery_status NOT NULL DEFAULT 'PENDING',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ,
+  last_status_code INTEGER,
+  last_error TEXT,
+  replay_of UUID REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  delivered_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, created_at);
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'PENDING';
+
+INSERT INTO permissions (name, description) VALUES
+  ('webhooks:manage', 'Manage the webhooks of an organization');
+
+INSERT INTO role_permissions (role, permission) VALUES ('ADMIN', 'webhooks:manage');
+
+INSERT INTO org_role_permissions (role, permission) VALUES
+  ('OWNER', 'webhooks:manage'),
+  ('ADMIN', 'webhooks:manage');
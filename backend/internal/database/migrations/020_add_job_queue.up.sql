@@ -0,0 +1,43 @@
+-- Durable background work. Jobs written in the transaction of a change exist exactly when
+-- the change committed. Workers claim them with SKIP LOCKED, failed jobs are retried with
+-- backoff and end up DEAD once they run out of attempts.
+CREATE TYPE job_status AS ENUM ('QUEUED', 'RUNNING', 'SUCCEEDED', 'DEAD');
+
+CREATE TABLE jobs (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  kind TEXT NOT NULL,
+  payload JSONB NOT NULL DEFAULT '{}',
+  status job_status NOT NULL DEFAULT 'QUEUED',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  max_attempts INTEGER NOT NULL,
+  run_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  -- at most one queued job per key, later ones are dropped
+  unique_key TEXT,
+  locked_by TEXT,
+  locked_until TIMESTAMPTZ,
+  last_error TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  finished_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX idx_jobs_unique_key ON jobs(unique_key) WHERE status = 'QUEUED';
+CREATE INDEX idx_jobs_due ON jobs(run_at) WHERE status = 'QUEUED';
+CREATE INDEX idx_jobs_locked_until ON jobs(locked_until) WHERE status = 'RUNNING';
+CREATE INDEX idx_jobs_status_created_at ON jobs(status, created_at);
+
+-- Events of committed changes, relayed in order to the event bus by the outbox.relay job
+CREATE TABLE outbox (
+  id BIGSERIAL PRIMARY KEY,
+  topic TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- thumbnails are generated per content, deduplicated files share them
+ALTER TABLE file_contents ADD COLUMN thumbnail_path TEXT;
+
+INSERT INTO permissions (name, description) VALUES
+  ('jobs:manage', 'View, retry and discard background jobs');
+
+INSERT INTO role_permissions (role, permission) VALUES ('ADMIN', 'jobs:manage');
@@ -0,0 +1,31 @@
+-- Periodic maintenance runs once per cluster: the instance that holds the task's advisory
+-- lock and moves next_run_at forward runs it, the others skip the slot.
+CREATE TYPE scheduled_task_trigger AS ENUM ('SCHEDULE', 'MANUAL');
+CREATE TYPE scheduled_task_run_status AS ENUM ('RUNNING', 'SUCCEEDED', 'FAILED');
+
+CREATE TABLE scheduled_tasks (
+  name TEXT PRIMARY KEY,
+  schedule TEXT NOT NULL, -- cron expression
+  next_run_at TIMESTAMPTZ NOT NULL,
+  last_run_at TIMESTAMPTZ,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE scheduled_task_runs (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  task_name TEXT NOT NULL REFERENCES scheduled_tasks(name) ON DELETE CASCADE,
+  trigger scheduled_task_trigger NOT NULL,
+  triggered_by UUID REFERENCES users(id) ON DELETE SET NULL,
+  instance TEXT NOT NULL,
+  status scheduled_task_run_status NOT NULL DEFAULT 'RUNNING',
+  error TEXT,
+  started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_scheduled_task_runs_task_name ON scheduled_task_runs(task_name, started_at DESC);
+CREATE INDEX idx_scheduled_task_runs_started_at ON scheduled_task_runs(started_at);
+
+-- maintenance tasks are background work, jobs:manage covers them
+UPDATE permissions SET description = 'View, retry and discard background jobs and run scheduled tasks'
+WHERE name = 'jobs:manage';
@@ -0,0 +1,4 @@
+INSERT INTO permissions (name, description) VALUES
+  ('system:status', 'View the detailed health and resource status of the server');
+
+INSERT INTO role_permissions (role, permission) VALUES ('ADMIN', 'system:status');
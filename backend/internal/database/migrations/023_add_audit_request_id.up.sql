@@ -0,0 +1,3 @@
+-- request_id ties an audit entry to the server logs of the request that wrote it. It is
+-- correlation data and not part of the content the entry hash covers.
+ALTER TABLE audit_logs ADD COLUMN request_id TEXT;
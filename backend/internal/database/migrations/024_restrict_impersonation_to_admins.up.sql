@@ -0,0 +1,3 @@
+-- impersonation hands out the target's role, staff below ADMIN could reach the permissions
+-- of other staff roles through it
+DELETE FROM role_permissions WHERE role = 'SUPPORT' AND permission = 'users:impersonate';
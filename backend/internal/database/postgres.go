@@ -1,22 +1,38 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"embed"
 	"fmt"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed migrations/*.sql
 var migrationFiles embed.FS
 
 func Initialize(databaseURL string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", databaseURL)
+	// only calls made within a trace get spans, background queries would each start one
+	db, err := otelsql.Open("postgres", databaseURL,
+		otelsql.WithAttributes(semconv.DBSystemNamePostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitConnPrepare:      true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, method otelsql.Method, query string, args []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("Failed::Database Connection: %v", err)
 	}
@@ -54,3 +70,25 @@ func RunMigrations(db *sql.DB) error {
 
 	return nil
 }
+
+// LatestMigration returns the version of the newest embedded migration, the version the
+// database is at once RunMigrations succeeded
+func LatestMigration() (uint, error) {
+	source, err := iofs.New(migrationFiles, "migrations")
+	if err != nil {
+		return 0, fmt.Errorf("Failed::Create Migration Source: %w", err)
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := source.Next(version)
+		if err != nil {
+			return version, nil
+		}
+		version = next
+	}
+}
@@ -0,0 +1,191 @@
+package graph
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"file-vault/internal/auth"
+	"file-vault/internal/mail"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+type accountMailData struct {
+	Username  string
+	Link      string
+	ExpiresIn string
+}
+
+// RequestEmailVerification is the resolver for the requestEmailVerification field.
+func (r *mutationResolver) RequestEmailVerification(ctx context.Context) (bool, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return false, fmt.Errorf("authentication required")
+	}
+
+	user, err := r.loadUserByID(userID)
+	if err != nil {
+		return false, fmt.Errorf("Failed::User not found: %w", err)
+	}
+	if user.EmailVerified {
+		return false, fmt.Errorf("Failed::Email address is already verified")
+	}
+
+	r.sendEmailVerification(user)
+	return true, nil
+}
+
+// VerifyEmail is the resolver for the verifyEmail field.
+func (r *mutationResolver) VerifyEmail(ctx context.Context, token string) (bool, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	userID, err := r.AccountTokens.Consume(tx, token, services.AccountTokenEmailVerification)
+	if err != nil {
+		return false, fmt.Errorf("Failed::Verify email: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE users SET email_verified = true, email_verified_at = NOW() WHERE id = $1`, userID)
+	if err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if err := r.Audit.Record(ctx, tx, services.AuditEvent{UserID: userID, Action: models.AuditActionEmailVerified}); err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RequestPasswordReset is the resolver for the requestPasswordReset field.
+// It always succeeds so the response cannot be used to find out which emails are registered.
+func (r *mutationResolver) RequestPasswordReset(ctx context.Context, email string) (bool, error) {
+	user := &models.User{}
+	query := `SELECT id, username, email FROM users WHERE email = $1`
+	err := r.DB.QueryRow(query, email).Scan(&user.ID, &user.Username, &user.Email)
+	if err == sql.ErrNoRows {
+		slog.InfoContext(ctx, "Password reset requested for unknown email")
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+
+	ttl := time.Duration(r.Config.PasswordResetTTL) * time.Minute
+	r.sendAccountMail(user, services.AccountTokenPasswordReset, mail.TemplatePasswordReset, "/reset-password", ttl)
+	return true, nil
+}
+
+// ResetPassword is the resolver for the resetPassword field.
+func (r *mutationResolver) ResetPassword(ctx context.Context, token string, newPassword string) (bool, error) {
+	if len(newPassword) < minPasswordLength {
+		return false, fmt.Errorf("Failed::Password must be at least %d characters", minPasswordLength)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return false, fmt.Errorf("Failed::Password hashing error: %w", err)
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	userID, err := r.AccountTokens.Consume(tx, token, services.AccountTokenPasswordReset)
+	if err != nil {
+		return false, fmt.Errorf("Failed::Reset password: %w", err)
+	}
+
+	// receiving the reset mail also proves the address is reachable
+	_, err = tx.Exec(`
+		UPDATE users SET password_hash = $1,
+			email_verified = true, email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $2
+	`, string(hashedPassword), userID)
+	if err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if err := r.Audit.Record(ctx, tx, services.AuditEvent{UserID: userID, Action: models.AuditActionPasswordReset}); err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *Resolver) sendEmailVerification(user *models.User) {
+	ttl := time.Duration(r.Config.EmailVerificationTTL) * time.Hour
+	r.sendAccountMail(user, services.AccountTokenEmailVerification, mail.TemplateVerifyEmail, "/verify-email", ttl)
+}
+
+// JobAccountMail is the kind of the jobs sending account mails
+const JobAccountMail = "mail.account"
+
+// accountMailJob is what an account mail needs, the token is only issued when it is sent
+type accountMailJob struct {
+	UserID   string                       `json:"user_id"`
+	Purpose  services.AccountTokenPurpose `json:"purpose"`
+	Template string                       `json:"template"`
+	Path     string                       `json:"path"`
+	TTL      time.Duration                `json:"ttl"`
+}
+
+// sendAccountMail queues a mail with a link containing a fresh token to the user.
+// Failures to queue it are only logged.
+func (r *Resolver) sendAccountMail(user *models.User, purpose services.AccountTokenPurpose, templateName, path string, ttl time.Duration) {
+	job := accountMailJob{UserID: user.ID.String(), Purpose: purpose, Template: templateName, Path: path, TTL: ttl}
+	if err := r.JobQueue.Enqueue(nil, JobAccountMail, job, services.JobOptions{}); err != nil {
+		slog.Warn("Failed to queue account mail", "template", templateName, "user_id", user.ID, "error", err)
+	}
+}
+
+// SendAccountMail issues the token of an account mail and sends it. It is the handler of
+// mail.account jobs, a retry issues a new token which invalidates the one of the failed attempt.
+func (r *Resolver) SendAccountMail(ctx context.Context, payload json.RawMessage) error {
+	var job accountMailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	user, err := r.loadUserByID(job.UserID)
+	if err == sql.ErrNoRows {
+		return nil // deleted in the meantime
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := r.AccountTokens.Issue(job.UserID, job.Purpose, job.TTL)
+	if err != nil {
+		return fmt.Errorf("failed to issue %s token: %w", job.Purpose, err)
+	}
+	data := accountMailData{
+		Username:  user.Username,
+		Link:      r.Config.AppBaseURL + job.Path + "?token=" + url.QueryEscape(token),
+		ExpiresIn: humanizeDuration(job.TTL),
+	}
+	return r.Mailer.Send(user.Email, job.Template, data)
+}
+
+func humanizeDuration(d time.Duration) string {
+	if d >= time.Hour && d%time.Hour == 0 {
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d minutes", int(d.Minutes()))
+}
@@ -0,0 +1,131 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	backend "file-vault"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+const maxAuditPageSize = 500
+
+// AuditLogPage is the resolver for the auditLogPage field.
+func (r *queryResolver) AuditLogPage(ctx context.Context, filter *backend.AuditLogFilter, first *int, after *string) (*backend.AuditLogPage, error) {
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionAuditRead)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	auditFilter := toAuditFilter(filter)
+	auditFilter.OrgID, auditFilter.AllOrgs = scope.OrgID, scope.AllOrgs
+	return r.auditPage(auditFilter, first, after)
+}
+
+// MyActivity is the resolver for the myActivity field.
+func (r *queryResolver) MyActivity(ctx context.Context, filter *backend.AuditLogFilter, first *int, after *string) (*backend.AuditLogPage, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Authentication required: %w", err)
+	}
+
+	// the user's own entries from every organization, whatever the filter asks for
+	auditFilter := toAuditFilter(filter)
+	self := uuid.MustParse(userID)
+	auditFilter.UserID = &self
+	auditFilter.AllOrgs = true
+	return r.auditPage(auditFilter, first, after)
+}
+
+// VerifyAuditLog is the resolver for the verifyAuditLog field.
+func (r *queryResolver) VerifyAuditLog(ctx context.Context, orgID *uuid.UUID) ([]*models.AuditChainVerification, error) {
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionAuditRead)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	var chains []string
+	switch {
+	case orgID != nil:
+		if !scope.Includes(*orgID) {
+			return nil, fmt.Errorf("Failed::Organization not found")
+		}
+		chains = []string{orgID.String()}
+	case scope.AllOrgs:
+		if chains, err = r.AuditChain.Chains(); err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+	default:
+		chains = []string{scope.OrgID.String()}
+	}
+
+	reports := []*models.AuditChainVerification{}
+	for _, chain := range chains {
+		report, err := r.AuditChain.Verify(chain)
+		if err != nil {
+			return nil, fmt.Errorf("Failed::Verify audit log: %w", err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func (r *queryResolver) auditPage(filter services.AuditFilter, first *int, after *string) (*backend.AuditLogPage, error) {
+	limit := 50
+	if first != nil {
+		limit = *first
+	}
+	cursor := ""
+	if after != nil {
+		cursor = *after
+	}
+
+	entries, next, err := r.Audit.Page(filter, cursor, clampAuditLimit(limit))
+	if err != nil {
+		return nil, auditQueryError(err)
+	}
+	page := &backend.AuditLogPage{Entries: entries}
+	if next != "" {
+		page.NextCursor = &next
+	}
+	return page, nil
+}
+
+func toAuditFilter(filter *backend.AuditLogFilter) services.AuditFilter {
+	if filter == nil {
+		return services.AuditFilter{}
+	}
+	result := services.AuditFilter{
+		UserID:  filter.UserID,
+		ActorID: filter.ActorID,
+		Actions: filter.Actions,
+		FileID:  filter.FileID,
+		From:    filter.From,
+		To:      filter.To,
+	}
+	if filter.IPRange != nil {
+		result.IPRange = *filter.IPRange
+	}
+	return result
+}
+
+func clampAuditLimit(limit int) int {
+	if limit < 1 {
+		return 1
+	}
+	if limit > maxAuditPageSize {
+		return maxAuditPageSize
+	}
+	return limit
+}
+
+func auditQueryError(err error) error {
+	if errors.Is(err, services.ErrInvalidAuditCursor) || errors.Is(err, services.ErrInvalidIPRange) {
+		return fmt.Errorf("Failed::%w", err)
+	}
+	return fmt.Errorf("failed to query audit logs: %w", err)
+}
@@ -3,86 +3,23 @@ package graph
 import (
 	"context"
 	"database/sql"
+	"errors"
 	backend "file-vault"
 	"file-vault/internal/auth"
 	"file-vault/internal/models"
+	"file-vault/internal/services"
 	"fmt"
-	"strings"
+	"log/slog"
 	"time"
 
-	"github.com/99designs/gqlgen/graphql"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Helper function to create audit log entries
-func (r *mutationResolver) createAuditLog(ctx context.Context, userID string, action models.AuditAction, fileID *string, ipAddress, userAgent string) error {
-	auditLogID := uuid.New()
-
-	query := `
-		INSERT INTO audit_logs (id, user_id, action, file_id, ip_address, user_agent, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, NOW())
-	`
-
-	var fileUUID *uuid.UUID
-	if fileID != nil {
-		parsedFileID, err := uuid.Parse(*fileID)
-		if err == nil {
-			fileUUID = &parsedFileID
-		}
-	}
-
-	fmt.Printf("createAuditLog: Inserting audit log - ID: %s, UserID: %s, Action: %s, FileID: %v, IP: %s, UserAgent: %s\n",
-		auditLogID, userID, action, fileUUID, ipAddress, userAgent)
-
-	_, err := r.DB.Exec(query, auditLogID, userID, action, fileUUID, ipAddress, userAgent)
-	if err != nil {
-		fmt.Printf("createAuditLog: Database error: %v\n", err)
-	}
-	return err
-}
-
-// Helper function to get client IP and User Agent from context
+// getClientInfo returns the address and user agent of the request
 func (r *mutationResolver) getClientInfo(ctx context.Context) (string, string) {
-	// Default values
-	ipAddress := "127.0.0.1"
-	userAgent := "FileVault-Client"
-
-	// Try to extract from HTTP headers if available
-	if req := graphql.GetOperationContext(ctx); req != nil {
-		if headers := req.Headers; headers != nil {
-			// Extract User-Agent header
-			if ua := headers.Get("User-Agent"); ua != "" {
-				userAgent = ua
-				fmt.Printf("getClientInfo: Extracted User-Agent: %s\n", userAgent)
-			} else {
-				fmt.Printf("getClientInfo: No User-Agent header found\n")
-			}
-
-			// Extract IP address from various headers
-			if xff := headers.Get("X-Forwarded-For"); xff != "" {
-				// X-Forwarded-For can contain multiple IPs, take the first one
-				if ips := strings.Split(xff, ","); len(ips) > 0 {
-					ipAddress = strings.TrimSpace(ips[0])
-					fmt.Printf("getClientInfo: Extracted IP from X-Forwarded-For: %s\n", ipAddress)
-				}
-			} else if xri := headers.Get("X-Real-IP"); xri != "" {
-				ipAddress = xri
-				fmt.Printf("getClientInfo: Extracted IP from X-Real-IP: %s\n", ipAddress)
-			} else if xri := headers.Get("X-Forwarded"); xri != "" {
-				ipAddress = xri
-				fmt.Printf("getClientInfo: Extracted IP from X-Forwarded: %s\n", ipAddress)
-			} else {
-				fmt.Printf("getClientInfo: No IP headers found, using default: %s\n", ipAddress)
-			}
-		} else {
-			fmt.Printf("getClientInfo: No headers available in context\n")
-		}
-	} else {
-		fmt.Printf("getClientInfo: No operation context available\n")
-	}
-
-	return ipAddress, userAgent
+	client := auth.GetClientInfo(ctx)
+	return client.IPAddress, client.UserAgent
 }
 
 // Register is the resolver for the register field.
@@ -112,69 +49,209 @@ func (r *mutationResolver) Register(ctx context.Context, input backend.RegisterI
 		UpdatedAt:    time.Now(),
 	}
 
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	defer tx.Rollback()
+
 	query := `
 		INSERT INTO users (id, username, email, password_hash, role, storage_quota, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
-	_, err = r.DB.Exec(query, user.ID, user.Username, user.Email, user.PasswordHash, user.Role,
+	_, err = tx.Exec(query, user.ID, user.Username, user.Email, user.PasswordHash, user.Role,
 		user.StorageQuota, user.CreatedAt, user.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("Failed::Database Error: %w", err)
 	}
+	err = r.Audit.Record(ctx, tx, services.AuditEvent{UserID: user.ID.String(), Action: models.AuditActionRegister})
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
 
-	token, err := auth.GenerateToken(user.ID.String(), string(user.Role), r.Config.JWTSecret)
+	token, err := auth.GenerateToken(user.ID.String(), string(user.Role), r.TokenKeys)
 	if err != nil {
 		return nil, fmt.Errorf("Failed::Token cannot be generated: %w", err)
 	}
 
-	fmt.Printf(" Register: Generated token for user %v: %v\n", user.ID.String(), token)
+	slog.InfoContext(ctx, "User registered", "user_id", user.ID)
 
-	// Log audit event for user registration
-	ipAddress, userAgent := r.getClientInfo(ctx)
-	fmt.Printf("Register: Creating audit log for user registration %s\n", user.ID.String())
-	err = r.createAuditLog(ctx, user.ID.String(), models.AuditActionRegister, nil, ipAddress, userAgent)
-	if err != nil {
-		fmt.Printf("Warning: Failed to create audit log for registration: %v\n", err)
-	} else {
-		fmt.Printf("Register: Successfully created audit log for user registration %s\n", user.ID.String())
-	}
+	r.sendEmailVerification(user)
 
 	return &backend.AuthPayload{
-		Token: token,
+		Token: &token,
 		User:  userToGraphQL(user),
 	}, nil
 }
 
 // Login is the resolver for the login field.
 func (r *mutationResolver) Login(ctx context.Context, input *backend.LoginInput) (*backend.AuthPayload, error) {
+	ipAddress, userAgent := r.getClientInfo(ctx)
+
+	if err := r.LoginGuard.Check(ctx, input.Email, ipAddress); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+
+	user, err := r.authenticatePassword(ctx, input.Email, input.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		// unknown emails are counted too so they look the same as wrong passwords
+		r.recordLoginFailure(ctx, user, input.Email, ipAddress, userAgent)
+		return nil, fmt.Errorf("Failed::Invalid email or password")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Users.EnsureActive(user.ID.String()); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+
+	// password is correct, the second factor is checked by verifyTwoFactor
+	tokens, err := r.LoginTokens.AfterFirstFactor(user)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Token cannot be generated: %w", err)
+	}
+	if tokens.ChallengeToken != "" {
+		slog.InfoContext(ctx, "Two-factor challenge issued", "user_id", user.ID)
+		return &backend.AuthPayload{
+			User:              userToGraphQL(user),
+			TwoFactorRequired: true,
+			ChallengeToken:    &tokens.ChallengeToken,
+		}, nil
+	}
+
+	r.recordLoginSuccess(ctx, user, ipAddress, userAgent)
+	return authPayload(ctx, user, tokens), nil
+}
+
+var errInvalidCredentials = errors.New("invalid email or password")
+
+// authenticatePassword checks the directory first when LDAP is configured and falls back to
+// local bcrypt accounts for logins the directory does not know. On errInvalidCredentials the
+// returned user is set when the account exists locally, so the failure can be audited.
+func (r *mutationResolver) authenticatePassword(ctx context.Context, login, password string) (*models.User, error) {
+	if r.LDAPAuthenticator.Enabled() {
+		identity, err := r.LDAPAuthenticator.Authenticate(login, password)
+		switch {
+		case err == nil:
+			user, _, err := r.IdentityService.ResolveUser(ctx, *identity, r.LDAPAuthenticator.AllowProvisioning())
+			if errors.Is(err, services.ErrProvisioningDisabled) {
+				return nil, fmt.Errorf("Failed::%w", err)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Failed::Database Error: %w", err)
+			}
+			return user, nil
+		case errors.Is(err, services.ErrLDAPInvalidCredentials):
+			return r.findUserByEmail(login), errInvalidCredentials
+		case !errors.Is(err, services.ErrLDAPUserNotFound):
+			slog.ErrorContext(ctx, "LDAP login failed", "error", err)
+			return nil, fmt.Errorf("Failed::Directory unavailable, try again later")
+		}
+	}
+
 	var user models.User
-	fmt.Printf(" Login: %v ", input.Email)
-	query := `SELECT id, username, email, password_hash, role, storage_quota, created_at, updated_at FROM users WHERE email = $1`
-	err := r.DB.QueryRow(query, input.Email).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role,
-		&user.StorageQuota, &user.CreatedAt, &user.UpdatedAt,
+	query := `SELECT id, username, email, email_verified, password_hash, role, storage_quota, totp_enabled, created_at, updated_at FROM users WHERE email = $1`
+	err := r.DB.QueryRow(query, login).Scan(
+		&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.PasswordHash, &user.Role,
+		&user.StorageQuota, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt,
 	)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("Failed::Invalid email or password: %w", err)
+		return nil, errInvalidCredentials
 	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed::Database Error: %w", err)
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(input.Password))
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
 	if err != nil {
-		return nil, fmt.Errorf("Failed::Invalid email or password: %w", err)
+		return &user, errInvalidCredentials
 	}
+	return &user, nil
+}
 
-	token, err := auth.GenerateToken(user.ID.String(), string(user.Role), r.Config.JWTSecret)
+func (r *mutationResolver) findUserByEmail(email string) *models.User {
+	var user models.User
+	err := r.DB.QueryRow(`SELECT id, email FROM users WHERE LOWER(email) = LOWER($1)`, email).Scan(&user.ID, &user.Email)
 	if err != nil {
-		return nil, fmt.Errorf("Failed::Token cannot be generated: %w", err)
+		return nil
+	}
+	return &user
+}
+
+// recordLoginFailure feeds the brute-force counters and writes a LOGIN_FAILED audit entry for known accounts
+func (r *mutationResolver) recordLoginFailure(ctx context.Context, user *models.User, email, ipAddress, userAgent string) {
+	locked, err := r.LoginGuard.RecordFailure(ctx, email, ipAddress)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to record login failure", "error", err)
+	}
+	if locked {
+		slog.WarnContext(ctx, "Login locked after repeated failures", "ip_address", ipAddress)
+	}
+
+	if user == nil {
+		return
+	}
+	err = r.Audit.Record(ctx, nil, services.AuditEvent{UserID: user.ID.String(), Action: models.AuditActionLoginFailed})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to create audit log for failed login", "error", err)
+	}
+}
+
+func (r *mutationResolver) recordLoginSuccess(ctx context.Context, user *models.User, ipAddress, userAgent string) {
+	if err := r.LoginGuard.RecordSuccess(ctx, user.Email); err != nil {
+		slog.WarnContext(ctx, "Failed to reset login failures", "error", err)
+	}
+	if err := r.Audit.Record(ctx, nil, services.AuditEvent{UserID: user.ID.String(), Action: models.AuditActionLogin}); err != nil {
+		slog.WarnContext(ctx, "Failed to create audit log for login", "error", err)
+	}
+}
+
+// UnlockAccount is the resolver for the unlockAccount field.
+func (r *mutationResolver) UnlockAccount(ctx context.Context, userID uuid.UUID) (bool, error) {
+	adminID, err := r.Authz.Authorize(ctx, models.PermissionUsersUnlock)
+	if err != nil {
+		return false, fmt.Errorf("access denied: %w", err)
+	}
+
+	user, err := r.loadUserByID(userID.String())
+	if err != nil {
+		return false, fmt.Errorf("Failed::User not found: %w", err)
+	}
+
+	if err := r.LoginGuard.Unlock(ctx, user.Email); err != nil {
+		return false, fmt.Errorf("Failed::Unlock account: %w", err)
 	}
 
-	fmt.Printf(" Login: Generated token for user %v: %v\n", user.ID.String(), token)
+	err = r.Audit.Record(ctx, nil, services.AuditEvent{
+		UserID:  adminID,
+		Action:  models.AuditActionAccountUnlocked,
+		Details: services.AuditDetails{"target_user_id": userID},
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to create audit log for account unlock", "error", err)
+	}
+
+	return true, nil
+}
 
+// issueAuthPayload hands out an access token once every required factor has been checked.
+// Admins without 2FA get a restricted token when the admin 2FA policy is on.
+func (r *mutationResolver) issueAuthPayload(ctx context.Context, user *models.User) (*backend.AuthPayload, error) {
+	tokens, err := r.LoginTokens.Issue(user)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Token cannot be generated: %w", err)
+	}
+	return authPayload(ctx, user, tokens), nil
+}
+
+func authPayload(ctx context.Context, user *models.User, tokens *services.LoginTokens) *backend.AuthPayload {
+	slog.InfoContext(ctx, "User logged in", "user_id", user.ID)
 	return &backend.AuthPayload{
-		Token: token,
-		User:  userToGraphQL(&user),
-	}, nil
+		Token:                  &tokens.Token,
+		User:                   userToGraphQL(user),
+		TwoFactorSetupRequired: tokens.TwoFactorSetupRequired,
+	}
 }
@@ -0,0 +1,433 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// MyGroups is the resolver for the myGroups field.
+func (r *queryResolver) MyGroups(ctx context.Context) ([]*models.Group, error) {
+	scope, err := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesRead)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	groups, err := r.GroupService.ListForUser(scope.UserID, scope.OrgID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	for _, group := range groups {
+		if err := r.loadGroupRelations(group); err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+	}
+	return groups, nil
+}
+
+// Group is the resolver for the group field.
+func (r *queryResolver) Group(ctx context.Context, id uuid.UUID) (*models.Group, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Authentication required: %w", err)
+	}
+
+	group, err := r.findGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	member, err := r.GroupService.IsMember(id, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if !member && !r.canManageGroup(ctx, group, userID) {
+		return nil, fmt.Errorf("Failed::Group not found")
+	}
+
+	if err := r.loadGroupRelations(group); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return group, nil
+}
+
+// CreateGroup is the resolver for the createGroup field.
+func (r *mutationResolver) CreateGroup(ctx context.Context, name string, description *string, adminManaged *bool) (*models.Group, error) {
+	scope, err := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesShare)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, fmt.Errorf("Failed::Group name must be 1 to 100 characters")
+	}
+	desc := ""
+	if description != nil {
+		desc = strings.TrimSpace(*description)
+	}
+
+	var ownerID *uuid.UUID
+	groupAdmin := r.canAdministerGroups(ctx, scope.OrgID)
+	if adminManaged != nil && *adminManaged {
+		if !groupAdmin {
+			return nil, fmt.Errorf("access denied: %w", services.ErrPermissionDenied)
+		}
+	} else {
+		allowed, err := r.Orgs.GetBoolSetting(scope.OrgID, services.OrgSettingAllowGroupCreation)
+		if err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+		if !allowed && !groupAdmin {
+			return nil, fmt.Errorf("Failed::Only organization admins can create groups here")
+		}
+		owner, err := uuid.Parse(scope.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed::Invalid user ID: %w", err)
+		}
+		ownerID = &owner
+	}
+
+	group, err := r.GroupService.Create(ctx, scope.OrgID, ownerID, name, desc)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Create group: %w", err)
+	}
+	if err := r.loadGroupRelations(group); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return group, nil
+}
+
+// DeleteGroup is the resolver for the deleteGroup field.
+func (r *mutationResolver) DeleteGroup(ctx context.Context, groupID uuid.UUID) (bool, error) {
+	group, err := r.authorizeGroupManagement(ctx, groupID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.GroupService.Delete(ctx, group.ID); err != nil {
+		return false, fmt.Errorf("Failed::Delete group: %w", err)
+	}
+	return true, nil
+}
+
+// AddGroupMember is the resolver for the addGroupMember field.
+func (r *mutationResolver) AddGroupMember(ctx context.Context, groupID uuid.UUID, userID uuid.UUID) (*models.Group, error) {
+	group, err := r.authorizeGroupManagement(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.loadUserByID(userID.String()); err != nil {
+		return nil, fmt.Errorf("Failed::User not found")
+	}
+	if member, err := r.Orgs.IsMember(group.OrgID, userID.String()); err != nil || !member {
+		return nil, fmt.Errorf("Failed::Only members of the group's organization can join it")
+	}
+
+	if err := r.GroupService.AddMember(ctx, group.ID, userID); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+	if err := r.loadGroupRelations(group); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return group, nil
+}
+
+// RemoveGroupMember is the resolver for the removeGroupMember field.
+func (r *mutationResolver) RemoveGroupMember(ctx context.Context, groupID uuid.UUID, userID uuid.UUID) (*models.Group, error) {
+	group, err := r.authorizeGroupManagement(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if group.OwnerID != nil && *group.OwnerID == userID {
+		return nil, fmt.Errorf("Failed::The owner cannot be removed, delete the group instead")
+	}
+
+	if err := r.GroupService.RemoveMember(ctx, group.ID, userID); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+	if err := r.loadGroupRelations(group); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return group, nil
+}
+
+// ShareFolder is the resolver for the shareFolder field.
+func (r *mutationResolver) ShareFolder(ctx context.Context, folderID uuid.UUID, userID *uuid.UUID, groupID *uuid.UUID) (*models.FolderShare, error) {
+	currentUserID, err := r.Authz.Authorize(ctx, models.PermissionFilesShare)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+	if (userID == nil) == (groupID == nil) {
+		return nil, fmt.Errorf("Failed::Specify either userId or groupId")
+	}
+	if err := r.requireVerifiedEmailForSharing(currentUserID); err != nil {
+		return nil, err
+	}
+
+	folder, err := r.loadFolder(folderID)
+	if err != nil || folder.UserID.String() != currentUserID {
+		return nil, fmt.Errorf("folder not found or access denied")
+	}
+
+	share := &models.FolderShare{FolderID: folderID, SharedWithUserID: userID, SharedWithGroupID: groupID, Folder: folder}
+	if groupID != nil {
+		group, err := r.groupForSharing(ctx, *groupID, currentUserID, folder.OrgID)
+		if err != nil {
+			return nil, err
+		}
+		share.SharedWithGroup = group
+	} else {
+		user, err := r.orgMemberForSharing(*userID, folder.OrgID)
+		if err != nil {
+			return nil, err
+		}
+		share.SharedWithUser = userToGraphQL(user)
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO folder_shares (folder_id, shared_with_user_id, shared_with_group_id)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	err = tx.QueryRow(query, folderID, userID, groupID).Scan(&share.ID, &share.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create folder share: %w", err)
+	}
+	err = r.Audit.Record(ctx, tx, services.AuditEvent{
+		UserID: currentUserID,
+		Action: models.AuditActionFolderShared,
+		OrgID:  &folder.OrgID,
+		Details: services.AuditDetails{
+			"folder_id":           folderID,
+			"share_id":            share.ID,
+			"shared_with_user_id": userID,
+			"group_id":            groupID,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create folder share: %w", err)
+	}
+	return share, nil
+}
+
+// UnshareFolder is the resolver for the unshareFolder field.
+func (r *mutationResolver) UnshareFolder(ctx context.Context, folderID uuid.UUID) (bool, error) {
+	currentUserID, err := r.Authz.Authorize(ctx, models.PermissionFilesShare)
+	if err != nil {
+		return false, fmt.Errorf("access denied: %w", err)
+	}
+
+	folder, err := r.loadFolder(folderID)
+	if err != nil || folder.UserID.String() != currentUserID {
+		return false, fmt.Errorf("folder not found or access denied")
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// everyone who had access through these shares, directly or as a group member
+	query := `
+		WITH removed AS (
+			DELETE FROM folder_shares WHERE folder_id = $1
+			RETURNING shared_with_user_id, shared_with_group_id
+		)
+		SELECT shared_with_user_id FROM removed WHERE shared_with_user_id IS NOT NULL
+		UNION
+		SELECT gm.user_id FROM removed JOIN group_members gm ON gm.group_id = removed.shared_with_group_id
+	`
+	rows, err := tx.Query(query, folderID)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove folder shares: %w", err)
+	}
+	var affected []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return false, err
+		}
+		affected = append(affected, userID)
+	}
+	rows.Close()
+
+	for _, userID := range affected {
+		if err := services.RevokeStaleDownloads(tx, userID); err != nil {
+			return false, err
+		}
+	}
+	err = r.Audit.Record(ctx, tx, services.AuditEvent{
+		UserID:  currentUserID,
+		Action:  models.AuditActionFolderUnshared,
+		OrgID:   &folder.OrgID,
+		Details: services.AuditDetails{"folder_id": folderID, "affected_user_ids": affected},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// requireVerifiedEmailForSharing refuses to share files and folders of users with an
+// unverified email address while RequireVerifiedEmailForSharing is on
+func (r *mutationResolver) requireVerifiedEmailForSharing(userID string) error {
+	if !r.Config.RequireVerifiedEmailForSharing {
+		return nil
+	}
+	var verified bool
+	err := r.DB.QueryRow("SELECT email_verified FROM users WHERE id = $1", userID).Scan(&verified)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if !verified {
+		return fmt.Errorf("Failed::Verify your email address before sharing files")
+	}
+	return nil
+}
+
+// groupForSharing loads a group the current user may share with: their own groups and the
+// groups they are a member of, within the organization of what is shared.
+func (r *mutationResolver) groupForSharing(ctx context.Context, groupID uuid.UUID, userID string, orgID uuid.UUID) (*models.Group, error) {
+	group, err := r.findGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if group.OrgID != orgID {
+		return nil, fmt.Errorf("Failed::Group not found")
+	}
+	member, err := r.GroupService.IsMember(groupID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if !member && !r.canManageGroup(ctx, group, userID) {
+		return nil, fmt.Errorf("Failed::You can only share with groups you belong to")
+	}
+	return group, nil
+}
+
+// orgMemberForSharing loads a user files of orgID may be shared with
+func (r *mutationResolver) orgMemberForSharing(userID, orgID uuid.UUID) (*models.User, error) {
+	user, err := r.loadUserByID(userID.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed::User not found")
+	}
+	member, err := r.Orgs.IsMember(orgID, userID.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if !member {
+		return nil, fmt.Errorf("Failed::You can only share with members of the organization")
+	}
+	return user, nil
+}
+
+func (r *mutationResolver) authorizeGroupManagement(ctx context.Context, groupID uuid.UUID) (*models.Group, error) {
+	userID, err := r.Authz.Authorize(ctx, models.PermissionFilesShare)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	group, err := r.findGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !r.canManageGroup(ctx, group, userID) {
+		return nil, fmt.Errorf("Failed::Only the group owner can change this group")
+	}
+	return group, nil
+}
+
+// canManageGroup allows the owner of an owner managed group, and admins for every group
+// they administer
+func (r *Resolver) canManageGroup(ctx context.Context, group *models.Group, userID string) bool {
+	if group.OwnerID != nil && group.OwnerID.String() == userID {
+		return true
+	}
+	return r.canAdministerGroups(ctx, group.OrgID)
+}
+
+// canAdministerGroups allows platform group admins everywhere and organization admins in
+// their own organization
+func (r *Resolver) canAdministerGroups(ctx context.Context, orgID uuid.UUID) bool {
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionGroupsManage)
+	return err == nil && scope.Includes(orgID)
+}
+
+func (r *Resolver) findGroup(groupID uuid.UUID) (*models.Group, error) {
+	group, err := r.GroupService.Get(groupID)
+	if errors.Is(err, services.ErrGroupNotFound) {
+		return nil, fmt.Errorf("Failed::Group not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return group, nil
+}
+
+func (r *Resolver) loadGroupRelations(group *models.Group) error {
+	members, err := r.GroupService.Members(group.ID)
+	if err != nil {
+		return err
+	}
+	group.Members = members
+
+	if group.OwnerID != nil {
+		owner, err := r.loadUserByID(group.OwnerID.String())
+		if err != nil {
+			return err
+		}
+		group.Owner = userToGraphQL(owner)
+	}
+	return nil
+}
+
+func (r *Resolver) loadFolder(folderID uuid.UUID) (*models.Folder, error) {
+	var folder models.Folder
+	query := `SELECT id, user_id, org_id, name, parent_folder_id, is_public, created_at, updated_at FROM folders WHERE id = $1`
+	err := r.DB.QueryRow(query, folderID).Scan(
+		&folder.ID, &folder.UserID, &folder.OrgID, &folder.Name, &folder.ParentFolderID, &folder.IsPublic, &folder.CreatedAt, &folder.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := r.loadUserByID(folder.UserID.String())
+	if err != nil {
+		return nil, err
+	}
+	folder.User = userToGraphQL(user)
+	return &folder, nil
+}
+
+// loadOwnFolder loads a folder userID may put files and folders into, one of their own in
+// orgID. Other members' folders stay out of reach even inside a shared organization.
+func (r *Resolver) loadOwnFolder(folderID, orgID uuid.UUID, userID string) (*models.Folder, error) {
+	folder, err := r.loadFolder(folderID)
+	if err != nil {
+		return nil, err
+	}
+	if folder.OrgID != orgID || folder.UserID.String() != userID {
+		return nil, errors.New("folder belongs to another user or organization")
+	}
+	return folder, nil
+}
@@ -0,0 +1,148 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	backend "file-vault"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Impersonate is the resolver for the impersonate field.
+func (r *mutationResolver) Impersonate(ctx context.Context, userID uuid.UUID, reason string) (*backend.ImpersonationPayload, error) {
+	actorID, err := r.Authz.Authorize(ctx, models.PermissionUsersImpersonate)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return nil, err
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, fmt.Errorf("Failed::A reason is required to impersonate a user")
+	}
+
+	target, err := r.loadUserByID(userID.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed::User not found")
+	}
+
+	ttl := time.Duration(r.Config.ImpersonationTTL) * time.Minute
+	session, err := r.Impersonation.Start(ctx, uuid.MustParse(actorID), userID, reason, ttl)
+	if errors.Is(err, services.ErrImpersonationNotAllowed) || errors.Is(err, services.ErrUserNotFound) {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+
+	// the token carries the target's role, never the permissions of the staff member
+	token, err := auth.GenerateImpersonationToken(session.ID.String(), target.ID.String(), string(target.Role),
+		actorID, session.ExpiresAt, r.TokenKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Token cannot be generated: %w", err)
+	}
+
+	if err := r.loadImpersonationUsers(session); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return &backend.ImpersonationPayload{Token: token, Session: session}, nil
+}
+
+// EndImpersonation is the resolver for the endImpersonation field.
+func (r *mutationResolver) EndImpersonation(ctx context.Context, sessionID *uuid.UUID) (bool, error) {
+	if _, err := auth.RequireAuth(ctx); err != nil {
+		return false, fmt.Errorf("Failed::Authentication required: %w", err)
+	}
+
+	// with an impersonation token the session is the one of the token
+	actorID := auth.GetActorIDFromContext(ctx)
+	current := auth.GetImpersonationIDFromContext(ctx)
+	if actorID == "" {
+		actorID = auth.GetUserIDFromContext(ctx)
+	} else if sessionID == nil || sessionID.String() == current {
+		id, err := uuid.Parse(current)
+		if err != nil {
+			return false, fmt.Errorf("Failed::Invalid impersonation session")
+		}
+		sessionID = &id
+	}
+	if sessionID == nil {
+		return false, fmt.Errorf("Failed::No impersonation session given")
+	}
+
+	err := r.Impersonation.End(ctx, *sessionID, uuid.MustParse(actorID))
+	if errors.Is(err, services.ErrImpersonationNotFound) {
+		return false, fmt.Errorf("Failed::%w", err)
+	}
+	if err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return true, nil
+}
+
+// MyImpersonations is the resolver for the myImpersonations field.
+func (r *queryResolver) MyImpersonations(ctx context.Context) ([]*models.ImpersonationSession, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Authentication required: %w", err)
+	}
+
+	sessions, err := r.Impersonation.ListForTarget(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	for _, session := range sessions {
+		if err := r.loadImpersonationUsers(session); err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+	}
+	return sessions, nil
+}
+
+// ImpersonationSessions is the resolver for the impersonationSessions field.
+func (r *queryResolver) ImpersonationSessions(ctx context.Context, userID uuid.UUID) ([]*models.ImpersonationSession, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionAuditRead); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	sessions, err := r.Impersonation.ListForTarget(userID.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	for _, session := range sessions {
+		if err := r.loadImpersonationUsers(session); err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+	}
+	return sessions, nil
+}
+
+// forbidWhileImpersonating refuses account security changes made with an impersonation
+// token, support may look around but not take over the account
+func forbidWhileImpersonating(ctx context.Context) error {
+	if auth.GetActorIDFromContext(ctx) != "" {
+		return fmt.Errorf("Failed::Not allowed while impersonating a user")
+	}
+	return nil
+}
+
+func (r *Resolver) loadImpersonationUsers(session *models.ImpersonationSession) error {
+	actor, err := r.loadUserByID(session.ActorID.String())
+	if err != nil {
+		return err
+	}
+	target, err := r.loadUserByID(session.TargetID.String())
+	if err != nil {
+		return err
+	}
+	session.Actor = userToGraphQL(actor)
+	session.Target = userToGraphQL(target)
+	return nil
+}
@@ -0,0 +1,125 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Jobs is the resolver for the jobs field.
+func (r *queryResolver) Jobs(ctx context.Context, status *models.JobStatus, kind *string, limit *int, offset *int) ([]*models.Job, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionJobsManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	n, skip := 50, 0
+	if limit != nil && *limit > 0 && *limit <= 200 {
+		n = *limit
+	}
+	if offset != nil && *offset > 0 {
+		skip = *offset
+	}
+	jobs, err := r.JobQueue.List(status, kind, n, skip)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return jobs, nil
+}
+
+// JobCounts is the resolver for the jobCounts field.
+func (r *queryResolver) JobCounts(ctx context.Context) ([]*models.JobCount, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionJobsManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	counts, err := r.JobQueue.Counts()
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return counts, nil
+}
+
+// RetryJob is the resolver for the retryJob field.
+func (r *mutationResolver) RetryJob(ctx context.Context, jobID uuid.UUID) (*models.Job, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionJobsManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	job, err := r.JobQueue.Retry(jobID)
+	if err != nil {
+		return nil, jobError(err)
+	}
+	return job, nil
+}
+
+// DiscardJob is the resolver for the discardJob field.
+func (r *mutationResolver) DiscardJob(ctx context.Context, jobID uuid.UUID) (bool, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionJobsManage); err != nil {
+		return false, fmt.Errorf("access denied: %w", err)
+	}
+
+	if err := r.JobQueue.Discard(jobID); err != nil {
+		return false, jobError(err)
+	}
+	return true, nil
+}
+
+func jobError(err error) error {
+	if errors.Is(err, services.ErrJobNotFound) {
+		return fmt.Errorf("Failed::Job not found")
+	}
+	return fmt.Errorf("Failed::Database Error: %w", err)
+}
+
+// ScheduledTasks is the resolver for the scheduledTasks field.
+func (r *queryResolver) ScheduledTasks(ctx context.Context) ([]*models.ScheduledTask, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionJobsManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	tasks, err := r.Scheduler.Tasks()
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return tasks, nil
+}
+
+// ScheduledTaskRuns is the resolver for the scheduledTaskRuns field.
+func (r *queryResolver) ScheduledTaskRuns(ctx context.Context, name *string, limit *int) ([]*models.ScheduledTaskRun, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionJobsManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	n := 50
+	if limit != nil && *limit > 0 && *limit <= 200 {
+		n = *limit
+	}
+	runs, err := r.Scheduler.Runs(name, n)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return runs, nil
+}
+
+// RunScheduledTask is the resolver for the runScheduledTask field.
+func (r *mutationResolver) RunScheduledTask(ctx context.Context, name string) (*models.ScheduledTaskRun, error) {
+	userID, err := r.Authz.Authorize(ctx, models.PermissionJobsManage)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	run, err := r.Scheduler.RunNow(name, uuid.MustParse(userID))
+	switch {
+	case errors.Is(err, services.ErrScheduledTaskNotFound):
+		return nil, fmt.Errorf("Failed::Scheduled task not found")
+	case errors.Is(err, services.ErrScheduledTaskRunning):
+		return nil, fmt.Errorf("Failed::%s is already running", name)
+	case err != nil:
+		return nil, fmt.Errorf("Failed::Run scheduled task: %w", err)
+	}
+	return run, nil
+}
@@ -0,0 +1,309 @@
+package graph
+
+import (
+	"context"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/google/uuid"
+	"github.com/graph-gophers/dataloader/v7"
+	"github.com/lib/pq"
+)
+
+// loaderWait is how long a loader collects keys before it runs the batch. Sibling fields
+// are resolved concurrently, so a page of files asks within this window.
+const loaderWait = 2 * time.Millisecond
+
+// Loaders batch the lookups of the field resolvers into one query per kind. Every response
+// gets its own, results are cached for one query or one subscription event and never
+// shared between callers.
+type Loaders struct {
+	Users        *dataloader.Loader[uuid.UUID, *models.User]
+	UserFiles    *dataloader.Loader[uuid.UUID, *models.UserFile]
+	FileContents *dataloader.Loader[uuid.UUID, *models.FileContent]
+	// Folders, Shares and the file lists only return what the caller may see
+	Folders       *dataloader.Loader[uuid.UUID, *models.Folder]
+	Shares        *dataloader.Loader[uuid.UUID, []*models.FileShare] // by file ID
+	FilesByUser   *dataloader.Loader[uuid.UUID, []*models.UserFile]
+	FilesByFolder *dataloader.Loader[uuid.UUID, []*models.UserFile]
+}
+
+type loadersKey struct{}
+
+// Dataloaders is a gqlgen extension that gives every response its own Loaders
+type Dataloaders struct {
+	Resolver *Resolver
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.ResponseInterceptor
+} = Dataloaders{}
+
+func (Dataloaders) ExtensionName() string {
+	return "Dataloaders"
+}
+
+func (Dataloaders) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (d Dataloaders) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	return next(context.WithValue(ctx, loadersKey{}, d.Resolver.newLoaders(ctx)))
+}
+
+// loaders returns the Loaders of the current response, or new ones outside of one
+func (r *Resolver) loaders(ctx context.Context) *Loaders {
+	if loaders, ok := ctx.Value(loadersKey{}).(*Loaders); ok {
+		return loaders
+	}
+	return r.newLoaders(ctx)
+}
+
+func (r *Resolver) newLoaders(ctx context.Context) *Loaders {
+	// most responses never load a file list, the scope is only looked up when one does
+	f := &loaderFetcher{r: r, viewer: sync.OnceValue(func() *fileViewer { return r.newFileViewer(ctx) })}
+	return &Loaders{
+		Users:         newLoader(f.users),
+		UserFiles:     newLoader(f.userFiles),
+		FileContents:  newLoader(f.fileContents),
+		Folders:       newLoader(f.folders),
+		Shares:        newLoader(f.shares),
+		FilesByUser:   newLoader(f.filesByUser),
+		FilesByFolder: newLoader(f.filesByFolder),
+	}
+}
+
+// newLoader turns fetch, which returns the values it found by key, into a loader. Keys
+// without a value load as the zero value, the resolvers decide whether that is an error.
+func newLoader[V any](fetch func(ctx context.Context, keys []uuid.UUID) (map[uuid.UUID]V, error)) *dataloader.Loader[uuid.UUID, V] {
+	batch := func(ctx context.Context, keys []uuid.UUID) []*dataloader.Result[V] {
+		values, err := fetch(ctx, keys)
+		results := make([]*dataloader.Result[V], len(keys))
+		for i, key := range keys {
+			if err != nil {
+				results[i] = &dataloader.Result[V]{Error: err}
+			} else {
+				results[i] = &dataloader.Result[V]{Data: values[key]}
+			}
+		}
+		return results
+	}
+	return dataloader.NewBatchedLoader(batch, dataloader.WithWait[uuid.UUID, V](loaderWait))
+}
+
+// fileViewer is who the loaders resolve for: the caller and, with files:read_all, the
+// organizations in its scope
+type fileViewer struct {
+	userID  uuid.UUID // uuid.Nil for anonymous callers, they only see public files
+	allOrgs bool
+	orgID   *uuid.UUID
+}
+
+func (r *Resolver) newFileViewer(ctx context.Context) *fileViewer {
+	viewer := &fileViewer{}
+	if userID, err := auth.RequireAuth(ctx); err == nil {
+		viewer.userID, _ = uuid.Parse(userID)
+	}
+	if scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionFilesReadAll); err == nil {
+		viewer.allOrgs, viewer.orgID = scope.AllOrgs, &scope.OrgID
+	}
+	return viewer
+}
+
+// loaderFetcher runs the batch queries. Queries that filter by visibility take the viewer
+// as $2, $3 and $4.
+type loaderFetcher struct {
+	r      *Resolver
+	viewer func() *fileViewer
+}
+
+// visibleFile matches the files of uf the viewer can access and, with files:read_all, the
+// files in its scope
+const visibleFile = `(can_access_file($2, uf.id) OR $3 OR uf.org_id = $4)`
+
+const userFileColumns = `uf.id, uf.user_id, uf.file_content_id, uf.filename, uf.folder_id,
+	uf.is_public, uf.download_count, uf.tags, uf.created_at, uf.updated_at`
+
+func scanUserFile(row interface{ Scan(...interface{}) error }) (*models.UserFile, error) {
+	var file models.UserFile
+	err := row.Scan(
+		&file.ID, &file.UserID, &file.FileContentID, &file.Filename,
+		&file.FolderID, &file.IsPublic, &file.DownloadCount,
+		pq.Array(&file.Tags), &file.CreatedAt, &file.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return userFileToGraphQL(&file), nil
+}
+
+func (f *loaderFetcher) users(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]*models.User, error) {
+	query := `
+		SELECT id, username, email, email_verified, role, storage_quota, totp_enabled, created_at, updated_at,
+			suspended_at, suspended_reason
+		FROM users
+		WHERE id = ANY($1)
+	`
+	rows, err := f.r.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[uuid.UUID]*models.User{}
+	for rows.Next() {
+		var user models.User
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.Role, &user.StorageQuota,
+			&user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt, &user.SuspendedAt, &user.SuspendedReason)
+		if err != nil {
+			return nil, err
+		}
+		users[user.ID] = userToGraphQL(&user)
+	}
+	return users, rows.Err()
+}
+
+func (f *loaderFetcher) userFiles(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]*models.UserFile, error) {
+	query := `SELECT ` + userFileColumns + ` FROM user_files uf WHERE uf.id = ANY($1)`
+	rows, err := f.r.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := map[uuid.UUID]*models.UserFile{}
+	for rows.Next() {
+		file, err := scanUserFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files[file.ID] = file
+	}
+	return files, rows.Err()
+}
+
+func (f *loaderFetcher) fileContents(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]*models.FileContent, error) {
+	query := `
+		SELECT id, sha256_hash, file_path, size, mime_type, reference_count, created_at
+		FROM file_contents
+		WHERE id = ANY($1)
+	`
+	rows, err := f.r.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contents := map[uuid.UUID]*models.FileContent{}
+	for rows.Next() {
+		var content models.FileContent
+		err := rows.Scan(&content.ID, &content.SHA256Hash, &content.FilePath, &content.Size, &content.MimeType,
+			&content.ReferenceCount, &content.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		contents[content.ID] = &content
+	}
+	return contents, rows.Err()
+}
+
+// folders returns the folders the viewer owns or that are shared with them, and with
+// files:read_all the folders in its scope
+func (f *loaderFetcher) folders(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]*models.Folder, error) {
+	viewer := f.viewer()
+	query := `
+		SELECT f.id, f.user_id, f.org_id, f.name, f.parent_folder_id, f.is_public, f.created_at, f.updated_at
+		FROM folders f
+		WHERE f.id = ANY($1) AND (
+			f.user_id = $2
+			OR f.id IN (SELECT sf.folder_id FROM shared_folders_for_user($2) sf)
+			OR $3 OR f.org_id = $4
+		)
+	`
+	rows, err := f.r.DB.QueryContext(ctx, query, pq.Array(ids), viewer.userID, viewer.allOrgs, viewer.orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := map[uuid.UUID]*models.Folder{}
+	for rows.Next() {
+		var folder models.Folder
+		err := rows.Scan(&folder.ID, &folder.UserID, &folder.OrgID, &folder.Name, &folder.ParentFolderID,
+			&folder.IsPublic, &folder.CreatedAt, &folder.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		folders[folder.ID] = &folder
+	}
+	return folders, rows.Err()
+}
+
+// shares returns the shares of the given files, only for their owner and staff with
+// files:read_all in scope. Recipients do not learn who else a file is shared with.
+func (f *loaderFetcher) shares(ctx context.Context, fileIDs []uuid.UUID) (map[uuid.UUID][]*models.FileShare, error) {
+	viewer := f.viewer()
+	query := `
+		SELECT fs.id, fs.file_id, fs.shared_with_user_id, fs.shared_with_group_id, fs.share_type, fs.share_period,
+			fs.created_at, fs.updated_at
+		FROM file_shares fs
+		JOIN user_files uf ON uf.id = fs.file_id
+		WHERE fs.file_id = ANY($1) AND (uf.user_id = $2 OR $3 OR uf.org_id = $4)
+		ORDER BY fs.created_at
+	`
+	rows, err := f.r.DB.QueryContext(ctx, query, pq.Array(fileIDs), viewer.userID, viewer.allOrgs, viewer.orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := map[uuid.UUID][]*models.FileShare{}
+	for rows.Next() {
+		var share models.FileShare
+		err := rows.Scan(&share.ID, &share.FileID, &share.SharedWithUserID, &share.SharedWithGroupID,
+			&share.ShareType, &share.SharePeriod, &share.CreatedAt, &share.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		shares[share.FileID] = append(shares[share.FileID], &share)
+	}
+	return shares, rows.Err()
+}
+
+func (f *loaderFetcher) filesByUser(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID][]*models.UserFile, error) {
+	return f.fileLists(ctx, "uf.user_id", userIDs, func(file *models.UserFile) uuid.UUID { return file.UserID })
+}
+
+func (f *loaderFetcher) filesByFolder(ctx context.Context, folderIDs []uuid.UUID) (map[uuid.UUID][]*models.UserFile, error) {
+	return f.fileLists(ctx, "uf.folder_id", folderIDs, func(file *models.UserFile) uuid.UUID { return *file.FolderID })
+}
+
+// fileLists returns the files the viewer may see grouped by column, newest first
+func (f *loaderFetcher) fileLists(ctx context.Context, column string, ids []uuid.UUID, key func(*models.UserFile) uuid.UUID) (map[uuid.UUID][]*models.UserFile, error) {
+	viewer := f.viewer()
+	query := `
+		SELECT ` + userFileColumns + `
+		FROM user_files uf
+		WHERE ` + column + ` = ANY($1) AND ` + visibleFile + `
+		ORDER BY uf.created_at DESC
+	`
+	rows, err := f.r.DB.QueryContext(ctx, query, pq.Array(ids), viewer.userID, viewer.allOrgs, viewer.orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := map[uuid.UUID][]*models.UserFile{}
+	for rows.Next() {
+		file, err := scanUserFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files[key(file)] = append(files[key(file)], file)
+	}
+	return files, rows.Err()
+}
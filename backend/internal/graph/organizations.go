@@ -0,0 +1,295 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	backend "file-vault"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// MyOrganizations is the resolver for the myOrganizations field.
+func (r *queryResolver) MyOrganizations(ctx context.Context) ([]*models.Organization, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Authentication required: %w", err)
+	}
+
+	orgs, err := r.Orgs.ListForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	for _, org := range orgs {
+		if org.Settings, err = r.Orgs.Settings(org.ID); err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+	}
+	return orgs, nil
+}
+
+// CurrentOrganization is the resolver for the currentOrganization field.
+func (r *queryResolver) CurrentOrganization(ctx context.Context) (*models.Organization, error) {
+	scope, err := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesRead)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+	return r.loadOrganization(scope.OrgID, scope.UserID)
+}
+
+// OrganizationMembers is the resolver for the organizationMembers field.
+func (r *queryResolver) OrganizationMembers(ctx context.Context, orgID *uuid.UUID) ([]*models.OrganizationMember, error) {
+	_, target, err := r.authorizeOrg(ctx, models.PermissionUsersRead, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := r.Orgs.Members(target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return members, nil
+}
+
+// OrganizationStorageStats is the resolver for the organizationStorageStats field.
+func (r *queryResolver) OrganizationStorageStats(ctx context.Context, orgID *uuid.UUID) (*models.StorageStats, error) {
+	_, target, err := r.authorizeOrg(ctx, models.PermissionStorageRead, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := r.StorageService.GetOrgStats(target.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Failed to get organization storage stats: %w", err)
+	}
+	return storageStatsToGraphQL(stats), nil
+}
+
+// CreateOrganization is the resolver for the createOrganization field.
+func (r *mutationResolver) CreateOrganization(ctx context.Context, name string, slug string) (*models.Organization, error) {
+	userID, err := r.Authz.Authorize(ctx, models.PermissionOrgsCreate)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, fmt.Errorf("Failed::Organization name must be 1 to 100 characters")
+	}
+
+	org, err := r.Orgs.Create(ctx, name, strings.ToLower(strings.TrimSpace(slug)), userID)
+	if errors.Is(err, services.ErrInvalidOrgSlug) {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Create organization: %w", err)
+	}
+	if org.Settings, err = r.Orgs.Settings(org.ID); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return org, nil
+}
+
+// SetDefaultOrganization is the resolver for the setDefaultOrganization field.
+func (r *mutationResolver) SetDefaultOrganization(ctx context.Context, orgID uuid.UUID) (*models.Organization, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Authentication required: %w", err)
+	}
+
+	if err := r.Orgs.SetDefault(orgID, userID); err != nil {
+		if errors.Is(err, services.ErrNotOrgMember) {
+			return nil, fmt.Errorf("Failed::Organization not found")
+		}
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return r.loadOrganization(orgID, userID)
+}
+
+// AddOrganizationMember is the resolver for the addOrganizationMember field. Members that
+// already belong to the organization get the new role. Organization managers can only add
+// users they already share an organization other than the default one with, platform
+// admins anyone.
+func (r *mutationResolver) AddOrganizationMember(ctx context.Context, userID uuid.UUID, role *models.OrgRole, orgID *uuid.UUID) ([]*models.OrganizationMember, error) {
+	scope, target, err := r.authorizeOrg(ctx, models.PermissionOrgsManage, orgID)
+	if err != nil {
+		return nil, err
+	}
+	newRole := models.OrgRoleMember
+	if role != nil {
+		newRole = *role
+	}
+	if _, err := r.loadUserByID(userID.String()); err != nil {
+		return nil, fmt.Errorf("Failed::User not found")
+	}
+	if !scope.AllOrgs {
+		// same answer as an unknown user, so user IDs can't be probed
+		shares, err := r.Orgs.SharesOrganization(scope.UserID, userID.String())
+		if err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+		if !shares {
+			return nil, fmt.Errorf("Failed::User not found")
+		}
+	}
+	if err := r.checkOwnerChange(scope, target, userID, newRole); err != nil {
+		return nil, err
+	}
+
+	if err := r.Orgs.AddMember(ctx, target, userID, newRole); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+	members, err := r.Orgs.Members(target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return members, nil
+}
+
+// RemoveOrganizationMember is the resolver for the removeOrganizationMember field.
+func (r *mutationResolver) RemoveOrganizationMember(ctx context.Context, userID uuid.UUID, orgID *uuid.UUID) ([]*models.OrganizationMember, error) {
+	scope, target, err := r.authorizeOrg(ctx, models.PermissionOrgsManage, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkOwnerChange(scope, target, userID, ""); err != nil {
+		return nil, err
+	}
+
+	if err := r.Orgs.RemoveMember(ctx, target, userID); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+	members, err := r.Orgs.Members(target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return members, nil
+}
+
+// UpdateOrganizationSettings is the resolver for the updateOrganizationSettings field.
+func (r *mutationResolver) UpdateOrganizationSettings(ctx context.Context, settings []*backend.OrganizationSettingInput, orgID *uuid.UUID) (*models.Organization, error) {
+	scope, target, err := r.authorizeOrg(ctx, models.PermissionOrgsManage, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, setting := range settings {
+		if err := r.Orgs.SetSetting(ctx, target, setting.Key, setting.Value); err != nil {
+			return nil, fmt.Errorf("Failed::%w", err)
+		}
+	}
+	return r.loadOrganization(target, scope.UserID)
+}
+
+// SetOrganizationQuota is the resolver for the setOrganizationQuota field.
+func (r *mutationResolver) SetOrganizationQuota(ctx context.Context, orgID uuid.UUID, quota *int) (*models.Organization, error) {
+	// quotas are a platform decision, organization admins can't raise their own
+	userID, err := r.Authz.Authorize(ctx, models.PermissionStorageManageQuota)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Access denied: %w", err)
+	}
+
+	var limit *int64
+	if quota != nil {
+		if *quota < 0 {
+			return nil, fmt.Errorf("Failed::Quota must not be negative")
+		}
+		value := int64(*quota)
+		limit = &value
+	}
+	if err := r.Orgs.SetQuota(ctx, orgID, limit); err != nil {
+		if errors.Is(err, services.ErrOrgNotFound) {
+			return nil, fmt.Errorf("Failed::Organization not found")
+		}
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return r.loadOrganization(orgID, userID)
+}
+
+// StorageQuota is the resolver for the storageQuota field.
+func (r *organizationResolver) StorageQuota(ctx context.Context, obj *models.Organization) (*int, error) {
+	if obj.StorageQuota == nil {
+		return nil, nil
+	}
+	quota := int(*obj.StorageQuota)
+	return &quota, nil
+}
+
+// authorizeOrg checks an organization admin permission and picks the organization it is
+// used on: orgID when given, else the current one. Other organizations than the current
+// one are only reachable through a platform role.
+func (r *Resolver) authorizeOrg(ctx context.Context, permission models.Permission, orgID *uuid.UUID) (*services.Scope, uuid.UUID, error) {
+	scope, err := r.Authz.AuthorizeScope(ctx, permission)
+	if err != nil {
+		return nil, uuid.Nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	target := scope.OrgID
+	if orgID != nil {
+		target = *orgID
+	}
+	if target == uuid.Nil || !scope.Includes(target) {
+		return nil, uuid.Nil, fmt.Errorf("Failed::Organization not found")
+	}
+	return scope, target, nil
+}
+
+// checkOwnerChange keeps organization admins from promoting owners or changing them. Only
+// owners and platform admins may, role is empty when the member is removed.
+func (r *Resolver) checkOwnerChange(scope *services.Scope, orgID, userID uuid.UUID, role models.OrgRole) error {
+	if scope.AllOrgs || scope.OrgRole == models.OrgRoleOwner {
+		return nil
+	}
+
+	current, err := r.Orgs.Membership(orgID, userID.String())
+	if err != nil && !errors.Is(err, services.ErrNotOrgMember) {
+		return fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if role == models.OrgRoleOwner || (current != nil && current.Role == models.OrgRoleOwner) {
+		return fmt.Errorf("Failed::Only owners can change owners")
+	}
+	return nil
+}
+
+func (r *Resolver) loadOrganization(orgID uuid.UUID, userID string) (*models.Organization, error) {
+	org, err := r.Orgs.Get(orgID, userID)
+	if errors.Is(err, services.ErrOrgNotFound) {
+		return nil, fmt.Errorf("Failed::Organization not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if org.Settings, err = r.Orgs.Settings(orgID); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return org, nil
+}
+
+// checkOrgQuota rejects uploads that would take the organization over its storage quota.
+// New files are counted at full size even when their content is already stored.
+func (r *Resolver) checkOrgQuota(orgID uuid.UUID, files []*services.UploadFile) error {
+	org, err := r.Orgs.Get(orgID, uuid.Nil.String())
+	if err != nil {
+		return fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if org.StorageQuota == nil {
+		return nil
+	}
+
+	stats, err := r.StorageService.GetOrgStats(orgID.String())
+	if err != nil {
+		return fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	used := stats.TotalUsed
+	for _, file := range files {
+		used += file.Size
+	}
+	if used > *org.StorageQuota {
+		return fmt.Errorf("Failed::Organization storage quota exceeded")
+	}
+	return nil
+}
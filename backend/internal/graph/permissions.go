@@ -0,0 +1,116 @@
+package graph
+
+import (
+	"context"
+	backend "file-vault"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"fmt"
+)
+
+var allRoles = []models.UserRole{
+	models.UserRoleUser,
+	models.UserRoleAdmin,
+	models.UserRoleAuditor,
+	models.UserRoleSupport,
+	models.UserRoleStorageAdmin,
+}
+
+// MyPermissions is the resolver for the myPermissions field.
+func (r *queryResolver) MyPermissions(ctx context.Context) ([]string, error) {
+	if _, err := auth.RequireAuth(ctx); err != nil {
+		return nil, fmt.Errorf("Failed::Authentication required: %w", err)
+	}
+
+	permissions, err := r.Authz.RolePermissions(models.UserRole(auth.GetUserRoleFromContext(ctx)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return permissionsToStrings(permissions), nil
+}
+
+// Permissions is the resolver for the permissions field.
+func (r *queryResolver) Permissions(ctx context.Context) ([]string, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionRolesManage); err != nil {
+		return nil, fmt.Errorf("Failed::Access denied: %w", err)
+	}
+
+	permissions, err := r.Authz.AllPermissions()
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return permissionsToStrings(permissions), nil
+}
+
+// RolePermissions is the resolver for the rolePermissions field.
+func (r *queryResolver) RolePermissions(ctx context.Context) ([]*backend.RolePermissions, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionRolesManage); err != nil {
+		return nil, fmt.Errorf("Failed::Access denied: %w", err)
+	}
+
+	result := []*backend.RolePermissions{}
+	for _, role := range allRoles {
+		permissions, err := r.Authz.RolePermissions(role)
+		if err != nil {
+			return nil, fmt.Errorf("Failed::Database Error: %w", err)
+		}
+		result = append(result, &backend.RolePermissions{Role: role, Permissions: permissionsToStrings(permissions)})
+	}
+	return result, nil
+}
+
+// SetRolePermissions is the resolver for the setRolePermissions field.
+func (r *mutationResolver) SetRolePermissions(ctx context.Context, role models.UserRole, permissions []string) (*backend.RolePermissions, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionRolesManage); err != nil {
+		return nil, fmt.Errorf("Failed::Access denied: %w", err)
+	}
+
+	granted := make([]models.Permission, len(permissions))
+	for i, permission := range permissions {
+		granted[i] = models.Permission(permission)
+	}
+	// admins must not be able to lock everyone out of role management
+	if role == models.UserRoleAdmin && !containsPermission(granted, models.PermissionRolesManage) {
+		return nil, fmt.Errorf("Failed::ADMIN must keep %s", models.PermissionRolesManage)
+	}
+
+	if err := r.Authz.SetRolePermissions(ctx, role, granted); err != nil {
+		return nil, fmt.Errorf("Failed::Update permissions: %w", err)
+	}
+
+	updated, err := r.Authz.RolePermissions(role)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return &backend.RolePermissions{Role: role, Permissions: permissionsToStrings(updated)}, nil
+}
+
+// CollectGarbage is the resolver for the collectGarbage field.
+func (r *mutationResolver) CollectGarbage(ctx context.Context) (int, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionStorageGC); err != nil {
+		return 0, fmt.Errorf("Failed::Access denied: %w", err)
+	}
+
+	removed, err := r.GarbageCollector.Collect(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Failed::Garbage collection: %w", err)
+	}
+	return removed, nil
+}
+
+func permissionsToStrings(permissions []models.Permission) []string {
+	result := make([]string, len(permissions))
+	for i, permission := range permissions {
+		result[i] = string(permission)
+	}
+	return result
+}
+
+func containsPermission(permissions []models.Permission, permission models.Permission) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
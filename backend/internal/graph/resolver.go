@@ -9,25 +9,53 @@ import (
 	"file-vault/internal/auth"
 	"file-vault/internal/config"
 	"file-vault/internal/graph/generated"
+	"file-vault/internal/mail"
 	"file-vault/internal/models"
 	"file-vault/internal/services"
+	"file-vault/internal/tracing"
 	"fmt"
 	"io"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/99designs/gqlgen/graphql"
 	"github.com/google/uuid"
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Resolver struct {
-	DB             *sql.DB
-	FileService    *services.FileService
-	DedupService   *services.DeduplicationService
-	RateLimiter    *services.RateLimiter
-	StorageService *services.StorageService
-	Config         *config.Config
+	DB               *sql.DB
+	FileService      *services.FileService
+	DedupService     *services.DeduplicationService
+	RateLimiter      *services.RateLimiter
+	LoginGuard       *services.LoginGuard
+	StorageService   *services.StorageService
+	SettingsService  *services.SettingsService
+	TwoFactorService *services.TwoFactorService
+	AccountTokens    *services.AccountTokenService
+	IdentityService  *services.IdentityService
+	// LDAPAuthenticator replaces the bcrypt check for directory users when configured
+	LDAPAuthenticator *services.LDAPAuthenticator
+	TokenKeys         *auth.KeySet
+	LoginTokens       *services.LoginTokenService
+	Authz             *services.AuthorizationService
+	GarbageCollector  *services.GarbageCollector
+	GroupService      *services.GroupService
+	Orgs              *services.OrganizationService
+	Users             *services.UserService
+	Impersonation     *services.ImpersonationService
+	Audit             *services.AuditService
+	AuditChain        *services.AuditChainService
+	Events            *services.EventBus
+	WebhookService    *services.WebhookService
+	JobQueue          *services.JobQueue
+	Outbox            *services.Outbox
+	FileJobs          *services.FileJobs
+	Scheduler         *services.Scheduler
+	Mailer            *mail.Mailer
+	Config            *config.Config
 }
 
 // Size is the resolver for the size field.
@@ -39,24 +67,30 @@ func (r *fileContentResolver) Size(ctx context.Context, obj *models.FileContent)
 // UploadFiles is the resolver for the uploadFiles field.
 func (r *mutationResolver) UploadFiles(ctx context.Context, files []*graphql.Upload, folderId *uuid.UUID) ([]*models.UserFile, error) {
 	// panic("not implemented uploadFiles")
-	fmt.Printf(" UploadFiles: Starting UploadFiles query\n")
-	userID, err := auth.RequireAuth(ctx)
+	scope, err := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesWrite)
 	if err != nil {
-		return nil, fmt.Errorf("authentication required")
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+	userID := scope.UserID
+
+	if folderId != nil {
+		if _, err := r.loadOwnFolder(*folderId, scope.OrgID, userID); err != nil {
+			return nil, fmt.Errorf("folder not found or access denied")
+		}
 	}
 
 	// // Convert GraphQL uploads to service uploads
 	var serviceFiles []*services.UploadFile
 	for _, file := range files {
+		_, span := tracing.Start(ctx, "files.read_and_hash", attribute.Int64("file.size", file.Size))
 		fileContent, err := io.ReadAll(file.File)
 		if err != nil {
-			fmt.Printf("Read failed: %v\n", err)
+			tracing.End(span, err)
 			return nil, fmt.Errorf("Falied::Read file: %w", err)
 		}
-		fmt.Printf("Read file Content\n")
 		hash, err := GenerateSHA256Hash(&fileContent)
+		tracing.End(span, err)
 		if err != nil {
-			fmt.Printf("failed hash generation: %v\n", err)
 			return nil, err
 		}
 		serviceFile := &services.UploadFile{
@@ -68,12 +102,27 @@ func (r *mutationResolver) UploadFiles(ctx context.Context, files []*graphql.Upl
 		}
 		serviceFiles = append(serviceFiles, serviceFile)
 	}
-	fmt.Printf(" Generated hash for %d files\n", len(serviceFiles))
-	filePaths, err := r.FileService.UploadFiles(serviceFiles)
+	if err := r.checkOrgQuota(scope.OrgID, serviceFiles); err != nil {
+		return nil, err
+	}
+	filePaths, err := r.FileService.UploadFiles(ctx, serviceFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 	for i, file := range serviceFiles {
+		if err := services.LockBlob(ctx, tx, filePaths[i]); err != nil {
+			return nil, err
+		}
+		if err := r.FileService.EnsureStored(ctx, file, filePaths[i]); err != nil {
+			slog.ErrorContext(ctx, "Failed to restore file", "path", filePaths[i], "error", err)
+			return nil, fmt.Errorf("Failed::Saving File")
+		}
 		var fileId uuid.UUID
 		query := `
 			INSERT INTO file_contents (sha256_hash, file_path, size, mime_type, reference_count)
@@ -82,28 +131,42 @@ func (r *mutationResolver) UploadFiles(ctx context.Context, files []*graphql.Upl
 			DO UPDATE SET reference_count = file_contents.reference_count + 1
 			RETURNING id;`
 
-		// Debug logging to identify UTF-8 issues
-		fmt.Printf("DEBUG: Inserting file_content - Hash: %s, Path: %s, Size: %d, MimeType: %s\n",
-			file.Hash, filePaths[i], file.Size, file.MimeType)
-
-		err := r.DB.QueryRow(query, file.Hash, filePaths[i], file.Size, file.MimeType, 1).Scan(&fileId)
+		err := tx.QueryRowContext(ctx, query, file.Hash, filePaths[i], file.Size, file.MimeType, 1).Scan(&fileId)
 		if err != nil {
-			fmt.Printf("ERROR: Failed to insert file_content: %v\n", err)
 			return nil, fmt.Errorf("failed to insert file content: %w", err)
 		}
+		if err := r.FileJobs.EnqueueThumbnail(tx, fileId, file.MimeType); err != nil {
+			return nil, err
+		}
 		query = `
-			INSERT INTO user_files (user_id, file_content_id, filename, folder_id)	
-			VALUES ($1, $2, $3, $4);
+			INSERT INTO user_files (user_id, file_content_id, filename, folder_id, org_id)	
+			VALUES ($1, $2, $3, $4, $5) RETURNING id;
 		`
-		// Debug logging for user_files insertion
-		fmt.Printf("DEBUG: Inserting user_file - UserID: %s, FileID: %s, Filename: %s, FolderID: %v\n",
-			userID, fileId, file.Name, folderId)
 
-		_, err = r.DB.Exec(query, userID, fileId, file.Name, folderId)
+		var userFileID uuid.UUID
+		err = tx.QueryRowContext(ctx, query, userID, fileId, file.Name, folderId, scope.OrgID).Scan(&userFileID)
 		if err != nil {
-			fmt.Printf("ERROR: Failed to insert user_file: %v\n", err)
 			return nil, fmt.Errorf("failed to insert user file: %w", err)
 		}
+		err = r.Audit.Record(ctx, tx, services.AuditEvent{
+			Action:  models.AuditActionUpload,
+			FileID:  &userFileID,
+			Details: services.AuditDetails{"filename": file.Name, "size": file.Size, "sha256": file.Hash},
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = r.WebhookService.Enqueue(ctx, tx, services.WebhookEvent{Type: models.FileEventUploaded, FileID: userFileID})
+		if err != nil {
+			return nil, err
+		}
+		event := models.FileEvent{Type: models.FileEventUploaded, FileID: userFileID, OwnerID: uuid.MustParse(userID)}
+		if err := r.Outbox.Add(tx, services.TopicFileEvent, services.FileEventMessage{Event: event}); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
 
 	// Get the uploaded file IDs to return
@@ -112,7 +175,7 @@ func (r *mutationResolver) UploadFiles(ctx context.Context, files []*graphql.Upl
 		// Get the file content ID that was inserted
 		var fileContentID uuid.UUID
 		query := `SELECT id FROM file_contents WHERE sha256_hash = $1`
-		err := r.DB.QueryRow(query, file.Hash).Scan(&fileContentID)
+		err := r.DB.QueryRowContext(ctx, query, file.Hash).Scan(&fileContentID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get file content ID: %w", err)
 		}
@@ -120,48 +183,33 @@ func (r *mutationResolver) UploadFiles(ctx context.Context, files []*graphql.Upl
 		// Get the user file ID that was inserted
 		var userFileID uuid.UUID
 		query = `SELECT id FROM user_files WHERE user_id = $1 AND file_content_id = $2 AND filename = $3`
-		err = r.DB.QueryRow(query, userID, fileContentID, file.Name).Scan(&userFileID)
+		err = r.DB.QueryRowContext(ctx, query, userID, fileContentID, file.Name).Scan(&userFileID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get user file ID: %w", err)
 		}
 
 		// Load the full file object with relations
-		fullFile, err := r.loadUserFileWithRelations(userFileID.String())
+		fullFile, err := r.loadUserFileWithRelations(ctx, userFileID.String())
 		if err != nil {
 			return nil, fmt.Errorf("failed to load file relations: %w", err)
 		}
 		result = append(result, fullFile)
 	}
 
-	// Log audit event for file upload
-	ipAddress, userAgent := r.getClientInfo(ctx)
-	fmt.Printf("UploadFiles: Creating audit logs for %d files\n", len(result))
-	for _, file := range result {
-		fileIDStr := file.ID.String()
-		fmt.Printf("UploadFiles: Creating audit log for file %s\n", fileIDStr)
-		err := r.createAuditLog(ctx, userID, models.AuditActionUpload, &fileIDStr, ipAddress, userAgent)
-		if err != nil {
-			fmt.Printf("Warning: Failed to create audit log for upload: %v\n", err)
-		} else {
-			fmt.Printf("UploadFiles: Successfully created audit log for file %s\n", fileIDStr)
-		}
-	}
-
 	return result, nil
 }
 
 // DeleteFile is the resolver for the deleteFile field.
 func (r *mutationResolver) DeleteFile(ctx context.Context, fileId uuid.UUID) (bool, error) {
 	// panic("not implemented deleteFile")
-	userID, err := auth.RequireAuth(ctx)
-	fmt.Printf(" DeleteFile: Starting DeleteFile query: %v\n", fileId.String())
+	userID, err := r.Authz.Authorize(ctx, models.PermissionFilesWrite)
 	if err != nil {
-		return false, fmt.Errorf("authentication required")
+		return false, fmt.Errorf("access denied: %w", err)
 	}
 
-	// Check if user is admin
-	userRole := auth.GetUserRoleFromContext(ctx)
-	isAdmin := userRole == "ADMIN"
+	// Check if user may delete files of others, everywhere or in their organization
+	adminScope, scopeErr := r.Authz.AuthorizeScope(ctx, models.PermissionFilesDeleteAll)
+	isAdmin := scopeErr == nil
 
 	// transaction
 	tx, err := r.DB.BeginTx(ctx, nil)
@@ -172,67 +220,78 @@ func (r *mutationResolver) DeleteFile(ctx context.Context, fileId uuid.UUID) (bo
 
 	// Verify file ownership (admin can delete any file, regular users only their own)
 	var exists bool
-	var fileContentID uuid.UUID
+	var fileContentID, ownerID uuid.UUID
 	var query string
 	var args []interface{}
 
-	if isAdmin {
+	if isAdmin && adminScope.AllOrgs {
 		// Admin can delete any file
-		query = `SELECT file_content_id FROM user_files WHERE id = $1`
+		query = `SELECT file_content_id, user_id FROM user_files WHERE id = $1`
 		args = []interface{}{fileId}
+	} else if isAdmin {
+		// Organization admins can delete any file of the organization and their own
+		query = `SELECT file_content_id, user_id FROM user_files WHERE id = $1 AND (org_id = $2 OR user_id = $3)`
+		args = []interface{}{fileId, adminScope.OrgID, userID}
 	} else {
 		// Regular users can only delete their own files
-		query = `SELECT file_content_id FROM user_files WHERE id = $1 AND user_id = $2`
+		query = `SELECT file_content_id, user_id FROM user_files WHERE id = $1 AND user_id = $2`
 		args = []interface{}{fileId, userID}
 	}
 
-	err = tx.QueryRow(query, args...).Scan(&fileContentID)
+	err = tx.QueryRow(query, args...).Scan(&fileContentID, &ownerID)
 	exists = (err != sql.ErrNoRows)
 	if err != nil {
 		return false, err
 	}
 	if exists {
+		// queued while the file is still there to describe
+		err = r.WebhookService.Enqueue(ctx, tx, services.WebhookEvent{Type: models.FileEventDeleted, FileID: fileId})
+		if err != nil {
+			return false, err
+		}
 		// Delete file
-		fmt.Printf(" DeleteFile: Deleting file: %v\n", fileId.String())
 		query := `UPDATE file_contents SET reference_count = reference_count - 1 WHERE id = $1 RETURNING reference_count`
 		var referenceCount int
 
 		if err := tx.QueryRow(query, fileContentID).Scan(&referenceCount); err != nil {
-			fmt.Printf(" DeleteFile: Failed to update reference count: %v\n", err)
 			return false, err
 		}
-		fmt.Printf(" DeleteFile: Reference count updated: %v\n", referenceCount)
-		var filePath string
+		slog.DebugContext(ctx, "File content reference count updated", "file_content_id", fileContentID, "reference_count", referenceCount)
 		if referenceCount <= 0 {
-			query := `DELETE FROM file_contents WHERE id = $1 RETURNING file_path`
-			if err := tx.QueryRow(query, fileContentID).Scan(&filePath); err != nil {
+			var filePath, thumbnailPath string
+			query := `DELETE FROM file_contents WHERE id = $1 RETURNING file_path, COALESCE(thumbnail_path, '')`
+			if err := tx.QueryRow(query, fileContentID).Scan(&filePath, &thumbnailPath); err != nil {
+				return false, err
+			}
+			// the blobs are removed once the deletion committed
+			if err := r.FileJobs.EnqueueBlobDeletion(tx, filePath, thumbnailPath); err != nil {
 				return false, err
 			}
 		}
 
-		query = `DELETE FROM user_files WHERE id = $1`
-		if _, err := tx.Exec(query, fileId); err != nil {
+		// recorded first, the entry's file reference is kept after the row is gone
+		err = r.Audit.Record(ctx, tx, services.AuditEvent{UserID: userID, Action: models.AuditActionDelete, FileID: &fileId})
+		if err != nil {
 			return false, err
 		}
-
-		if err := tx.Commit(); err != nil {
+		// the shares go with the file, their users are looked up before
+		recipients, err := shareRecipients(tx, fileId)
+		if err != nil {
 			return false, err
 		}
-		if referenceCount <= 0 && r.FileService.DeleteFile(filePath) != nil {
-			fmt.Printf("Warning::Failed to delete the file from storage\n")
+		query = `DELETE FROM user_files WHERE id = $1`
+		if _, err := tx.Exec(query, fileId); err != nil {
+			return false, err
 		}
-
-		// Log audit event for file deletion
-		ipAddress, userAgent := r.getClientInfo(ctx)
-		fileIDStr := fileId.String()
-		fmt.Printf("DeleteFile: Creating audit log for file deletion %s\n", fileIDStr)
-		err = r.createAuditLog(ctx, userID, models.AuditActionDelete, &fileIDStr, ipAddress, userAgent)
+		event := models.FileEvent{Type: models.FileEventDeleted, FileID: fileId, OwnerID: ownerID}
+		err = r.Outbox.Add(tx, services.TopicFileEvent, services.FileEventMessage{Event: event, Recipients: recipients})
 		if err != nil {
-			fmt.Printf("Warning: Failed to create audit log for deletion: %v\n", err)
-		} else {
-			fmt.Printf("DeleteFile: Successfully created audit log for file deletion %s\n", fileIDStr)
+			return false, err
 		}
 
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
 		return true, nil
 	} else {
 		return false, fmt.Errorf("file not found or access denied")
@@ -242,9 +301,9 @@ func (r *mutationResolver) DeleteFile(ctx context.Context, fileId uuid.UUID) (bo
 // UpdateFile is the resolver for the updateFile field.
 func (r *mutationResolver) UpdateFile(ctx context.Context, fileID uuid.UUID, input *backend.UpdateFileInput) (*models.UserFile, error) {
 	// panic("not implemented updateFile")
-	userID, err := auth.RequireAuth(ctx)
+	userID, err := r.Authz.Authorize(ctx, models.PermissionFilesWrite)
 	if err != nil {
-		return nil, fmt.Errorf("authentication required")
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
 	// Build update query dynamically
@@ -270,12 +329,14 @@ func (r *mutationResolver) UpdateFile(ctx context.Context, fileID uuid.UUID, inp
 		args = append(args, *input.IsPublic)
 	}
 
+	var newFolderID *uuid.UUID
 	if input.FolderID != nil {
 		argCount++
 		setParts = append(setParts, fmt.Sprintf("folder_id = $%d", argCount))
 		if (*input.FolderID).String() == "" {
 			args = append(args, nil)
 		} else {
+			newFolderID = input.FolderID
 			args = append(args, *input.FolderID)
 		}
 	}
@@ -288,39 +349,85 @@ func (r *mutationResolver) UpdateFile(ctx context.Context, fileID uuid.UUID, inp
 	setParts = append(setParts, fmt.Sprintf("updated_at = $%d", argCount))
 	args = append(args, time.Now())
 
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var filename string
+	var tags []string
+	var isPublic bool
+	var folderID *uuid.UUID
+	var orgID uuid.UUID
+	err = tx.QueryRow(`SELECT filename, tags, is_public, folder_id, org_id FROM user_files WHERE id = $1 AND user_id = $2 FOR UPDATE`, fileID, userID).
+		Scan(&filename, pq.Array(&tags), &isPublic, &folderID, &orgID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("file not found or access denied")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update file: %w", err)
+	}
+	// a file in a folder is reachable through the folder's shares, so it may only move into
+	// the owner's folders of its own organization
+	if newFolderID != nil {
+		if _, err := r.loadOwnFolder(*newFolderID, orgID, userID); err != nil {
+			return nil, fmt.Errorf("folder not found or access denied")
+		}
+	}
+
 	query := fmt.Sprintf(`
 		UPDATE user_files 
 		SET %s 
 		WHERE id = $1 AND user_id = $2
 	`, strings.Join(setParts, ", "))
 
-	result, err := r.DB.Exec(query, args...)
-	if err != nil {
+	if _, err := tx.Exec(query, args...); err != nil {
 		return nil, fmt.Errorf("failed to update file: %w", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	// only the fields of the input are part of the entry
+	before, after := services.AuditDetails{}, services.AuditDetails{}
+	if input.Filename != nil {
+		before["filename"], after["filename"] = filename, *input.Filename
+	}
+	if input.Tags != nil {
+		before["tags"], after["tags"] = tags, input.Tags
+	}
+	if input.IsPublic != nil {
+		before["is_public"], after["is_public"] = isPublic, *input.IsPublic
+	}
+	if input.FolderID != nil {
+		before["folder_id"], after["folder_id"] = folderID, newFolderID
+	}
+	err = r.Audit.Record(ctx, tx, services.AuditEvent{
+		UserID:  userID,
+		Action:  models.AuditActionFileUpdated,
+		FileID:  &fileID,
+		Details: services.AuditChange(before, after),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get affected rows: %w", err)
+		return nil, err
 	}
-	if rowsAffected == 0 {
-		return nil, fmt.Errorf("file not found or access denied")
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update file: %w", err)
 	}
 
-	return r.loadUserFileWithRelations(fileID.String())
+	return r.loadUserFileWithRelations(ctx, fileID.String())
 }
 
 // CreateFolder is the resolver for the createFolder field.
 func (r *mutationResolver) CreateFolder(ctx context.Context, input backend.CreateFolderInput) (*models.Folder, error) {
 	// panic("not implemented createFolder")
-	userID, err := auth.RequireAuth(ctx)
+	scope, err := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesWrite)
 	if err != nil {
-		return nil, fmt.Errorf("authentication required")
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
 	folder := &models.Folder{
 		ID:        uuid.New(),
-		UserID:    uuid.MustParse(userID),
+		UserID:    uuid.MustParse(scope.UserID),
+		OrgID:     scope.OrgID,
 		Name:      input.Name,
 		IsPublic:  *input.IsPublic,
 		CreatedAt: time.Now(),
@@ -328,19 +435,40 @@ func (r *mutationResolver) CreateFolder(ctx context.Context, input backend.Creat
 	}
 
 	if input.ParentFolderID != nil {
+		if _, err := r.loadOwnFolder(*input.ParentFolderID, scope.OrgID, scope.UserID); err != nil {
+			return nil, fmt.Errorf("parent folder not found or access denied")
+		}
 		parentID := *input.ParentFolderID
 		folder.ParentFolderID = &parentID
 	}
 
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create folder: %w", err)
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO folders (id, user_id, name, parent_folder_id, is_public, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO folders (id, user_id, org_id, name, parent_folder_id, is_public, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
-	_, err = r.DB.Exec(query, folder.ID, folder.UserID, folder.Name,
+	_, err = tx.Exec(query, folder.ID, folder.UserID, folder.OrgID, folder.Name,
 		folder.ParentFolderID, folder.IsPublic, folder.CreatedAt, folder.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create folder: %w", err)
 	}
+	err = r.Audit.Record(ctx, tx, services.AuditEvent{
+		UserID:  scope.UserID,
+		Action:  models.AuditActionFolderCreated,
+		OrgID:   &scope.OrgID,
+		Details: services.AuditDetails{"folder_id": folder.ID, "name": folder.Name, "parent_folder_id": folder.ParentFolderID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create folder: %w", err)
+	}
 
 	return folderToGraphQL(folder), nil
 }
@@ -356,42 +484,78 @@ func (r *mutationResolver) UpdateFolder(ctx context.Context, folderID uuid.UUID,
 }
 
 // ShareFile is the resolver for the shareFile field.
-func (r *mutationResolver) ShareFile(ctx context.Context, fileId uuid.UUID, shareType models.ShareType, userId *uuid.UUID) (*models.FileShare, error) {
+func (r *mutationResolver) ShareFile(ctx context.Context, fileId uuid.UUID, shareType models.ShareType, userId *uuid.UUID, groupId *uuid.UUID) (*models.FileShare, error) {
 	// panic("not implemented shareFile")
-	currentUserID, err := auth.RequireAuth(ctx)
+	currentUserID, err := r.Authz.Authorize(ctx, models.PermissionFilesShare)
 	if err != nil {
-		return nil, fmt.Errorf("authentication required")
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
-	// Verify file ownership
-	var count int
-	err = r.DB.QueryRow("SELECT COUNT(*) FROM user_files WHERE id = $1 AND user_id = $2",
-		fileId, currentUserID).Scan(&count)
+	if err := r.requireVerifiedEmailForSharing(currentUserID); err != nil {
+		return nil, err
+	}
+
+	// Verify file ownership, shares stay inside the file's organization
+	var orgID uuid.UUID
+	err = r.DB.QueryRow("SELECT org_id FROM user_files WHERE id = $1 AND user_id = $2",
+		fileId, currentUserID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("file not found or access denied")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("database error: %w", err)
 	}
-	if count == 0 {
-		return nil, fmt.Errorf("file not found or access denied")
+	if shareType == models.ShareTypePublic {
+		allowed, err := r.Orgs.GetBoolSetting(orgID, services.OrgSettingAllowPublicSharing)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if !allowed {
+			return nil, fmt.Errorf("Failed::Public sharing is disabled in this organization")
+		}
 	}
 
 	// Create file share
 	share := &models.FileShare{
-		ID:        uuid.New(),
-		FileID:    fileId,
-		ShareType: models.ShareType(shareType),
-		CreatedAt: time.Now(),
+		ID:          uuid.New(),
+		FileID:      fileId,
+		ShareType:   models.ShareType(shareType),
+		SharePeriod: models.SharePeriodPermanent,
+		CreatedAt:   time.Now(),
 	}
+	share.UpdatedAt = share.CreatedAt
 
+	if userId != nil && groupId != nil {
+		return nil, fmt.Errorf("Failed::Specify either userId or groupId")
+	}
 	if userId != nil {
+		if _, err := r.orgMemberForSharing(*userId, orgID); err != nil {
+			return nil, err
+		}
 		sharedWithUserID := *userId
 		share.SharedWithUserID = &sharedWithUserID
 	}
+	if groupId != nil {
+		group, err := r.groupForSharing(ctx, *groupId, currentUserID, orgID)
+		if err != nil {
+			return nil, err
+		}
+		share.ShareType = models.ShareTypeGroup
+		share.SharedWithGroupID = &group.ID
+		share.SharedWithGroup = group
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer tx.Rollback()
 
 	query := `
-		INSERT INTO file_shares (id, file_id, shared_with_user_id, share_type, created_at)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO file_shares (id, file_id, shared_with_user_id, shared_with_group_id, share_type, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`
-	_, err = r.DB.Exec(query, share.ID, share.FileID, share.SharedWithUserID,
+	_, err = tx.Exec(query, share.ID, share.FileID, share.SharedWithUserID, share.SharedWithGroupID,
 		share.ShareType, share.CreatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file share: %w", err)
@@ -399,12 +563,62 @@ func (r *mutationResolver) ShareFile(ctx context.Context, fileId uuid.UUID, shar
 
 	// Update file visibility if public
 	if shareType == models.ShareTypePublic {
-		_, err = r.DB.Exec("UPDATE user_files SET is_public = true WHERE id = $1", fileId)
+		_, err = tx.Exec("UPDATE user_files SET is_public = true WHERE id = $1", fileId)
 		if err != nil {
 			return nil, fmt.Errorf("failed to update file visibility: %w", err)
 		}
 	}
 
+	err = r.Audit.Record(ctx, tx, services.AuditEvent{
+		UserID: currentUserID,
+		Action: models.AuditActionShare,
+		FileID: &fileId,
+		Details: services.AuditDetails{
+			"share_id":            share.ID,
+			"share_type":          share.ShareType,
+			"shared_with_user_id": share.SharedWithUserID,
+			"group_id":            share.SharedWithGroupID,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = r.WebhookService.Enqueue(ctx, tx, services.WebhookEvent{
+		Type:   models.FileEventShared,
+		FileID: fileId,
+		Data: map[string]interface{}{
+			"share_id":            share.ID,
+			"share_type":          share.ShareType,
+			"shared_with_user_id": share.SharedWithUserID,
+			"group_id":            share.SharedWithGroupID,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []uuid.UUID
+	if share.SharedWithUserID != nil {
+		recipients = append(recipients, *share.SharedWithUserID)
+	}
+	if share.SharedWithGroupID != nil {
+		members, err := r.GroupService.Members(*share.SharedWithGroupID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load group members: %w", err)
+		}
+		for _, member := range members {
+			recipients = append(recipients, member.ID)
+		}
+	}
+	event := models.FileEvent{Type: models.FileEventShared, FileID: fileId, OwnerID: uuid.MustParse(currentUserID)}
+	err = r.Outbox.Add(tx, services.TopicFileEvent, services.FileEventMessage{Event: event, Recipients: recipients})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create file share: %w", err)
+	}
+
 	return fileShareToGraphQL(share), nil
 }
 
@@ -415,55 +629,92 @@ func (r *mutationResolver) UnshareFile(ctx context.Context, fileID uuid.UUID) (b
 
 // UpdateUserQuota is the resolver for the updateUserQuota field.
 func (r *mutationResolver) UpdateUserQuota(ctx context.Context, userID uuid.UUID, quota int) (*models.User, error) {
-	panic("not implemented updateUserQuota")
+	if _, err := r.Authz.Authorize(ctx, models.PermissionStorageManageQuota); err != nil {
+		return nil, fmt.Errorf("Failed::Access denied: %w", err)
+	}
+	if quota < 0 {
+		return nil, fmt.Errorf("Failed::Quota must not be negative")
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	defer tx.Rollback()
+
+	var previous int64
+	err = tx.QueryRow(`SELECT storage_quota FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Failed::User not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE users SET storage_quota = $1, updated_at = NOW() WHERE id = $2`, quota, userID); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	details := services.AuditChange(previous, quota)
+	details["target_user_id"] = userID
+	err = r.Audit.Record(ctx, tx, services.AuditEvent{Action: models.AuditActionUserQuotaChanged, Details: details})
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+
+	user, err := r.loadUserByID(userID.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return userToGraphQL(user), nil
 }
 
 // DeleteUser is the resolver for the deleteUser field.
-func (r *mutationResolver) DeleteUser(ctx context.Context, userID uuid.UUID) (bool, error) {
+func (r *mutationResolver) DeleteUser(ctx context.Context, userID uuid.UUID, transferFilesTo *uuid.UUID) (bool, error) {
 	userId, err := auth.RequireAuth(ctx)
 	if err != nil {
 		return false, fmt.Errorf("authentication required")
 	}
-	if userId != userID.String() {
-		return false, fmt.Errorf("unauthorized")
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return false, err
+	}
+	// users may delete themselves, transfers and other accounts are for admins
+	if userId != userID.String() || transferFilesTo != nil {
+		if _, err := r.Authz.Authorize(ctx, models.PermissionUsersManage); err != nil {
+			return false, fmt.Errorf("unauthorized")
+		}
 	}
 
-	query := `DELETE FROM users WHERE id = $1`
-	_, err = r.DB.Exec(query, userID)
-	if err != nil {
-		return false, fmt.Errorf("failed to delete user: %w", err)
+	if err := r.Users.Delete(ctx, userID, transferFilesTo); err != nil {
+		return false, userLifecycleError(err)
 	}
 	return true, nil
 }
 
 // Me is the resolver for the me field.
 func (r *queryResolver) Me(ctx context.Context) (*models.User, error) {
-	fmt.Printf(" Me: Starting Me query\n")
 	userID, err := auth.RequireAuth(ctx)
 	if err != nil {
-		fmt.Printf(" Me: Authentication failed: %v\n", err)
 		return nil, fmt.Errorf("Failed::Authentication required: %w", err)
 	}
-	fmt.Printf(" Me: Authenticated user ID: %v\n", userID)
 
 	var user models.User
-	query := `SELECT id, username, email, password_hash, role, storage_quota, created_at, updated_at FROM users WHERE id = $1`
-	err = r.DB.QueryRow(query, userID).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role, &user.StorageQuota, &user.CreatedAt, &user.UpdatedAt)
+	query := `SELECT id, username, email, email_verified, password_hash, role, storage_quota, totp_enabled, created_at, updated_at FROM users WHERE id = $1`
+	err = r.DB.QueryRow(query, userID).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.PasswordHash, &user.Role, &user.StorageQuota, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
-		fmt.Printf(" Me: Database error: %v\n", err)
 		return nil, fmt.Errorf("Failed::User not found: %w", err)
 	}
 
-	fmt.Printf(" Me: Found user: %v\n", user.Username)
 	return userToGraphQL(&user), nil
 }
 
 // Users is the resolver for the users field.
 func (r *queryResolver) Users(ctx context.Context, limit *int, offset *int) ([]*models.User, error) {
-	// Require admin authentication
-	_, err := auth.RequireAdmin(ctx)
+	// Require admin authentication, organization admins only see their members
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionUsersRead)
 	if err != nil {
-		return nil, fmt.Errorf("admin authentication required: %w", err)
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
 	// Set default values
@@ -477,13 +728,14 @@ func (r *queryResolver) Users(ctx context.Context, limit *int, offset *int) ([]*
 	}
 
 	query := `
-		SELECT id, username, email, password_hash, role, storage_quota, created_at, updated_at 
+		SELECT id, username, email, password_hash, role, storage_quota, created_at, updated_at, suspended_at, suspended_reason
 		FROM users 
+		WHERE $3 OR id IN (SELECT user_id FROM organization_members WHERE org_id = $4)
 		ORDER BY created_at DESC 
 		LIMIT $1 OFFSET $2
 	`
 
-	rows, err := r.DB.Query(query, limitValue, offsetValue)
+	rows, err := r.DB.Query(query, limitValue, offsetValue, scope.AllOrgs, scope.OrgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query users: %w", err)
 	}
@@ -495,6 +747,7 @@ func (r *queryResolver) Users(ctx context.Context, limit *int, offset *int) ([]*
 		err := rows.Scan(
 			&user.ID, &user.Username, &user.Email, &user.PasswordHash,
 			&user.Role, &user.StorageQuota, &user.CreatedAt, &user.UpdatedAt,
+			&user.SuspendedAt, &user.SuspendedReason,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan user: %w", err)
@@ -508,10 +761,9 @@ func (r *queryResolver) Users(ctx context.Context, limit *int, offset *int) ([]*
 // Files is the resolver for the files field.
 func (r *queryResolver) Files(ctx context.Context, filters *backend.FileFiltersInput, limit *int, offset *int) ([]*models.UserFile, error) {
 	// panic("not implemented Files")
-	fmt.Printf(" Files: Starting Files query\n")
-	userID, err := auth.RequireAuth(ctx)
+	scope, err := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesRead)
 	if err != nil {
-		return nil, fmt.Errorf("authentication required")
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
 	// Build query with filters
@@ -520,18 +772,14 @@ func (r *queryResolver) Files(ctx context.Context, filters *backend.FileFiltersI
 			   uf.is_public, uf.download_count, uf.tags, uf.created_at, uf.updated_at
 		FROM user_files uf
 		JOIN file_contents fc ON uf.file_content_id = fc.id
-		WHERE uf.user_id = $1
+		WHERE uf.user_id = $1 AND uf.org_id = $2
 	`
 
-	args := []interface{}{userID}
-	argCount := 1
+	args := []interface{}{scope.UserID, scope.OrgID}
+	argCount := 2
 	conditions := []string{}
 
 	if filters != nil {
-		fmt.Printf("Filter request\n")
-		if filters.Search != nil {
-			fmt.Printf("Search: %s\n", *filters.Search)
-		}
 		if filters.Search != nil && *filters.Search != "" {
 			argCount++
 			conditions = append(conditions, fmt.Sprintf("uf.filename ILIKE $%d", argCount))
@@ -609,39 +857,25 @@ func (r *queryResolver) Files(ctx context.Context, filters *backend.FileFiltersI
 	baseQuery += fmt.Sprintf(" OFFSET $%d", argCount)
 	args = append(args, offsetValue)
 
-	fmt.Printf("Final SQL Query: %s\n", baseQuery)
-	fmt.Printf("Query Args: %v\n", args)
+	slog.DebugContext(ctx, "Files query", "query", baseQuery, "args", args)
 
-	rows, err := r.DB.Query(baseQuery, args...)
+	rows, err := r.DB.QueryContext(ctx, baseQuery, args...)
 	if err != nil {
-		fmt.Printf("Database query error: %v\n", err)
-		fmt.Printf("Query: %s\n", baseQuery)
-		fmt.Printf("Args: %v\n", args)
 		return nil, fmt.Errorf("failed to query files: %w", err)
 	}
 	defer rows.Close()
 
+	// owner, content and folder are loaded in batches by the field resolvers
 	var files []*models.UserFile
 	for rows.Next() {
-		var file models.UserFile
-		err := rows.Scan(
-			&file.ID, &file.UserID, &file.FileContentID, &file.Filename,
-			&file.FolderID, &file.IsPublic, &file.DownloadCount,
-			pq.Array(&file.Tags), &file.CreatedAt, &file.UpdatedAt,
-		)
+		file, err := scanUserFile(rows)
 		if err != nil {
-			fmt.Printf("Row scan error: %v\n", err)
 			return nil, fmt.Errorf("failed to scan file: %w", err)
 		}
-
-		graphqlFile, err := r.loadUserFileWithRelations(file.ID.String())
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, graphqlFile)
+		files = append(files, file)
 	}
 
-	return files, nil
+	return files, rows.Err()
 }
 
 // File is the resolver for the file field.
@@ -656,12 +890,12 @@ func (r *queryResolver) PublicFile(ctx context.Context, id uuid.UUID) (*models.U
 
 // DownloadFile is the resolver for the downloadFile field.
 func (r *queryResolver) DownloadFile(ctx context.Context, id uuid.UUID) (string, error) {
-	userID, err := auth.RequireAuth(ctx)
+	userID, err := r.Authz.Authorize(ctx, models.PermissionFilesRead)
 	if err != nil {
-		return "", fmt.Errorf("authentication required")
+		return "", fmt.Errorf("access denied: %w", err)
 	}
 
-	// Get file information and verify ownership
+	// Get file information and verify the user owns it or it is shared with them
 	var fileContentID uuid.UUID
 	var filename string
 	var userFileID uuid.UUID
@@ -669,7 +903,7 @@ func (r *queryResolver) DownloadFile(ctx context.Context, id uuid.UUID) (string,
 	query := `
 		SELECT uf.file_content_id, uf.filename, uf.id, uf.user_id
 		FROM user_files uf
-		WHERE uf.id = $1 AND (uf.user_id = $2 OR uf.is_public = true)
+		WHERE uf.id = $1 AND can_access_file($2, uf.id)
 	`
 	err = r.DB.QueryRow(query, id, userID).Scan(&fileContentID, &filename, &userFileID, &ownerID)
 	if err != nil {
@@ -712,12 +946,17 @@ func (r *queryResolver) Folder(ctx context.Context, id uuid.UUID) (*models.Folde
 
 // StorageStats is the resolver for the storageStats field.
 func (r *queryResolver) StorageStats(ctx context.Context) (*models.StorageStats, error) {
-	_, err := auth.RequireAdmin(ctx)
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionStorageRead)
 	if err != nil {
-		return nil, fmt.Errorf("authentication required")
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
-	stats, err := r.StorageService.GetGlobalStats()
+	var stats *models.StorageStats
+	if scope.AllOrgs {
+		stats, err = r.StorageService.GetGlobalStats()
+	} else {
+		stats, err = r.StorageService.GetOrgStats(scope.OrgID.String())
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get storage stats: %w", err)
 	}
@@ -736,8 +975,19 @@ func (r *queryResolver) UserStorageStats(ctx context.Context, userId *uuid.UUID)
 	if userID == "" {
 		return nil, fmt.Errorf("Failed::User not found")
 	}
-	// fmt.Println("User Id:", userId)
-	// fmt.Println("User ID:", userID)
+	// stats of other users are for storage admins
+	if userId != nil && userId.String() != userID {
+		scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionStorageRead)
+		if err != nil {
+			return nil, fmt.Errorf("Failed::Access denied: %w", err)
+		}
+		if !scope.AllOrgs {
+			if member, err := r.Orgs.IsMember(scope.OrgID, userId.String()); err != nil || !member {
+				return nil, fmt.Errorf("Failed::User not found")
+			}
+		}
+		userID = userId.String()
+	}
 	stats, err := r.StorageService.GetUserStats(userID)
 	if err != nil {
 		return nil, fmt.Errorf("Failed::Failed to get user storage stats: %w", err)
@@ -746,11 +996,11 @@ func (r *queryResolver) UserStorageStats(ctx context.Context, userId *uuid.UUID)
 }
 
 // AuditLogs is the resolver for the auditLogs field.
-func (r *queryResolver) AuditLogs(ctx context.Context, limit *int, offset *int) ([]*models.AuditLog, error) {
-	// Require admin authentication
-	_, err := auth.RequireAdmin(ctx)
+func (r *queryResolver) AuditLogs(ctx context.Context, filter *backend.AuditLogFilter, limit *int, offset *int) ([]*models.AuditLog, error) {
+	// Require admin authentication, organization admins only see their organization
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionAuditRead)
 	if err != nil {
-		return nil, fmt.Errorf("admin authentication required: %w", err)
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
 	// Set default values
@@ -763,85 +1013,29 @@ func (r *queryResolver) AuditLogs(ctx context.Context, limit *int, offset *int)
 		offsetValue = *offset
 	}
 
-	fmt.Printf("AuditLogs: Querying audit logs with limit=%d, offset=%d\n", limitValue, offsetValue)
-
-	query := `
-		SELECT al.id, al.user_id, al.action, al.file_id, al.ip_address, al.user_agent, al.created_at
-		FROM audit_logs al
-		ORDER BY al.created_at DESC
-		LIMIT $1 OFFSET $2
-	`
-
-	rows, err := r.DB.Query(query, limitValue, offsetValue)
+	auditFilter := toAuditFilter(filter)
+	auditFilter.OrgID, auditFilter.AllOrgs = scope.OrgID, scope.AllOrgs
+	auditLogs, err := r.Audit.List(auditFilter, offsetValue, clampAuditLimit(limitValue))
 	if err != nil {
-		fmt.Printf("AuditLogs: Database query error: %v\n", err)
-		return nil, fmt.Errorf("failed to query audit logs: %w", err)
+		return nil, auditQueryError(err)
 	}
-	defer rows.Close()
-
-	var auditLogs []*models.AuditLog
-	rowCount := 0
-	for rows.Next() {
-		rowCount++
-		var auditLog models.AuditLog
-		var userID uuid.UUID
-		var fileID *uuid.UUID
-		err := rows.Scan(
-			&auditLog.ID, &userID, &auditLog.Action, &fileID,
-			&auditLog.IPAddress, &auditLog.UserAgent, &auditLog.CreatedAt,
-		)
-		if err != nil {
-			fmt.Printf("AuditLogs: Failed to scan row %d: %v\n", rowCount, err)
-			return nil, fmt.Errorf("failed to scan audit log: %w", err)
-		}
-		fmt.Printf("AuditLogs: Processing row %d - ID: %s, UserID: %s, Action: %s\n", rowCount, auditLog.ID, userID, auditLog.Action)
-
-		// Load user information
-		user, err := r.loadUserByID(userID.String())
-		if err != nil {
-			// If user doesn't exist (deleted), create a placeholder user
-			fmt.Printf("Warning: User %s not found for audit log, creating placeholder\n", userID.String())
-			auditLog.User = &models.User{
-				ID:       userID,
-				Username: "Deleted User",
-				Email:    "deleted@user.com",
-				Role:     models.UserRoleUser,
-			}
-		} else {
-			auditLog.User = user
-		}
-
-		// Load file information if file_id exists
-		if fileID != nil {
-			file, err := r.loadUserFileForAuditLog(fileID.String())
-			if err != nil {
-				// If file doesn't exist (deleted), we'll just skip it
-				fmt.Printf("AuditLogs: File %s not found for audit log: %v\n", fileID.String(), err)
-				auditLog.File = nil
-			} else {
-				auditLog.File = file
-			}
-		}
-
-		auditLogs = append(auditLogs, &auditLog)
-	}
-
-	fmt.Printf("AuditLogs: Successfully processed %d audit log entries\n", len(auditLogs))
 	return auditLogs, nil
 }
 
 // Helper function to load user by ID
-func (r *queryResolver) loadUserByID(userID string) (*models.User, error) {
+func (r *Resolver) loadUserByID(userID string) (*models.User, error) {
 	query := `
-		SELECT id, username, email, password_hash, role, storage_quota, created_at, updated_at
+		SELECT id, username, email, email_verified, password_hash, role, storage_quota, totp_enabled, created_at, updated_at,
+			suspended_at, suspended_reason
 		FROM users
 		WHERE id = $1
 	`
 
 	var user models.User
 	err := r.DB.QueryRow(query, userID).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.Role, &user.StorageQuota, &user.CreatedAt, &user.UpdatedAt,
+		&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.PasswordHash,
+		&user.Role, &user.StorageQuota, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt,
+		&user.SuspendedAt, &user.SuspendedReason,
 	)
 	if err != nil {
 		return nil, err
@@ -872,135 +1066,12 @@ func (r *queryResolver) loadUserFileByID(fileID string) (*models.UserFile, error
 	return &file, nil
 }
 
-// Helper function to load user file for audit logs (handles deleted files)
-func (r *queryResolver) loadUserFileForAuditLog(fileID string) (*models.UserFile, error) {
-	query := `
-		SELECT uf.id, uf.user_id, uf.file_content_id, uf.filename, uf.folder_id,
-			   uf.is_public, uf.download_count, uf.tags, uf.created_at, uf.updated_at,
-			   u.id, u.username, u.email, u.role, u.storage_quota, u.created_at, u.updated_at,
-			   fc.id, fc.sha256_hash, fc.file_path, fc.size, fc.mime_type, fc.reference_count, fc.created_at
-		FROM user_files uf
-		JOIN users u ON uf.user_id = u.id
-		LEFT JOIN file_contents fc ON uf.file_content_id = fc.id
-		WHERE uf.id = $1
-	`
-
-	var file models.UserFile
-	var user models.User
-	var fileContent models.FileContent
-	var fileContentID *uuid.UUID
-
-	err := r.DB.QueryRow(query, fileID).Scan(
-		&file.ID, &file.UserID, &fileContentID, &file.Filename,
-		&file.FolderID, &file.IsPublic, &file.DownloadCount,
-		pq.Array(&file.Tags), &file.CreatedAt, &file.UpdatedAt,
-		&user.ID, &user.Username, &user.Email, &user.Role,
-		&user.StorageQuota, &user.CreatedAt, &user.UpdatedAt,
-		&fileContent.ID, &fileContent.SHA256Hash, &fileContent.FilePath,
-		&fileContent.Size, &fileContent.MimeType, &fileContent.ReferenceCount,
-		&fileContent.CreatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	file.User = &user
-
-	// Only set file content if it exists (not deleted)
-	if fileContentID != nil && fileContent.ID != uuid.Nil {
-		file.FileContent = &fileContent
-	} else {
-		// Create a placeholder file content for deleted files
-		file.FileContent = &models.FileContent{
-			ID:             uuid.Nil,
-			SHA256Hash:     "deleted",
-			FilePath:       "deleted",
-			Size:           0,
-			MimeType:       "application/octet-stream",
-			ReferenceCount: 0,
-			CreatedAt:      time.Now(),
-		}
-	}
-
-	return &file, nil
-}
-
-// Helper function to create audit log entries
-func (r *queryResolver) createAuditLog(ctx context.Context, userID string, action models.AuditAction, fileID *string, ipAddress, userAgent string) error {
-	auditLogID := uuid.New()
-
-	query := `
-		INSERT INTO audit_logs (id, user_id, action, file_id, ip_address, user_agent, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, NOW())
-	`
-
-	var fileUUID *uuid.UUID
-	if fileID != nil {
-		parsedFileID, err := uuid.Parse(*fileID)
-		if err == nil {
-			fileUUID = &parsedFileID
-		}
-	}
-
-	fmt.Printf("createAuditLog: Inserting audit log - ID: %s, UserID: %s, Action: %s, FileID: %v, IP: %s, UserAgent: %s\n",
-		auditLogID, userID, action, fileUUID, ipAddress, userAgent)
-
-	_, err := r.DB.Exec(query, auditLogID, userID, action, fileUUID, ipAddress, userAgent)
-	if err != nil {
-		fmt.Printf("createAuditLog: Database error: %v\n", err)
-	}
-	return err
-}
-
-// Helper function to get client IP and User Agent from context
-func (r *queryResolver) getClientInfo(ctx context.Context) (string, string) {
-	// Default values
-	ipAddress := "127.0.0.1"
-	userAgent := "FileVault-Client"
-
-	// Try to extract from HTTP headers if available
-	if req := graphql.GetOperationContext(ctx); req != nil {
-		if headers := req.Headers; headers != nil {
-			// Extract User-Agent header
-			if ua := headers.Get("User-Agent"); ua != "" {
-				userAgent = ua
-				fmt.Printf("getClientInfo: Extracted User-Agent: %s\n", userAgent)
-			} else {
-				fmt.Printf("getClientInfo: No User-Agent header found\n")
-			}
-
-			// Extract IP address from various headers
-			if xff := headers.Get("X-Forwarded-For"); xff != "" {
-				// X-Forwarded-For can contain multiple IPs, take the first one
-				if ips := strings.Split(xff, ","); len(ips) > 0 {
-					ipAddress = strings.TrimSpace(ips[0])
-					fmt.Printf("getClientInfo: Extracted IP from X-Forwarded-For: %s\n", ipAddress)
-				}
-			} else if xri := headers.Get("X-Real-IP"); xri != "" {
-				ipAddress = xri
-				fmt.Printf("getClientInfo: Extracted IP from X-Real-IP: %s\n", ipAddress)
-			} else if xri := headers.Get("X-Forwarded"); xri != "" {
-				ipAddress = xri
-				fmt.Printf("getClientInfo: Extracted IP from X-Forwarded: %s\n", ipAddress)
-			} else {
-				fmt.Printf("getClientInfo: No IP headers found, using default: %s\n", ipAddress)
-			}
-		} else {
-			fmt.Printf("getClientInfo: No headers available in context\n")
-		}
-	} else {
-		fmt.Printf("getClientInfo: No operation context available\n")
-	}
-
-	return ipAddress, userAgent
-}
-
 // AllFiles is the resolver for the allFiles field.
 func (r *queryResolver) AllFiles(ctx context.Context, limit *int, offset *int) ([]*models.UserFile, error) {
-	// Require admin authentication
-	_, err := auth.RequireAdmin(ctx)
+	// Require admin authentication, organization admins only see their organization
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionFilesReadAll)
 	if err != nil {
-		return nil, fmt.Errorf("admin authentication required: %w", err)
+		return nil, fmt.Errorf("access denied: %w", err)
 	}
 
 	// Set default values
@@ -1017,37 +1088,64 @@ func (r *queryResolver) AllFiles(ctx context.Context, limit *int, offset *int) (
 		SELECT uf.id, uf.user_id, uf.file_content_id, uf.filename, uf.folder_id,
 			   uf.is_public, uf.download_count, uf.tags, uf.created_at, uf.updated_at
 		FROM user_files uf
+		WHERE $3 OR uf.org_id = $4
 		ORDER BY uf.created_at DESC
 		LIMIT $1 OFFSET $2
 	`
 
-	rows, err := r.DB.Query(query, limitValue, offsetValue)
+	rows, err := r.DB.QueryContext(ctx, query, limitValue, offsetValue, scope.AllOrgs, scope.OrgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query all files: %w", err)
 	}
 	defer rows.Close()
 
+	// owner, content and folder are loaded in batches by the field resolvers
 	var files []*models.UserFile
 	for rows.Next() {
-		var file models.UserFile
-		err := rows.Scan(
-			&file.ID, &file.UserID, &file.FileContentID, &file.Filename,
-			&file.FolderID, &file.IsPublic, &file.DownloadCount,
-			pq.Array(&file.Tags), &file.CreatedAt, &file.UpdatedAt,
-		)
+		file, err := scanUserFile(rows)
 		if err != nil {
-			fmt.Printf("Row scan error: %v\n", err)
 			return nil, fmt.Errorf("failed to scan file: %w", err)
 		}
+		files = append(files, file)
+	}
 
-		graphqlFile, err := r.loadUserFileWithRelations(file.ID.String())
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, graphqlFile)
+	return files, rows.Err()
+}
+
+// File is the resolver for the file field.
+func (r *fileShareResolver) File(ctx context.Context, obj *models.FileShare) (*models.UserFile, error) {
+	if obj.File != nil {
+		return obj.File, nil
+	}
+	file, err := r.loaders(ctx).UserFiles.Load(ctx, obj.FileID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file: %w", err)
+	}
+	if file == nil {
+		return nil, fmt.Errorf("file not found")
+	}
+	return file, nil
+}
+
+// SharedWithUser is the resolver for the sharedWithUser field.
+func (r *fileShareResolver) SharedWithUser(ctx context.Context, obj *models.FileShare) (*models.User, error) {
+	if obj.SharedWithUser != nil || obj.SharedWithUserID == nil {
+		return obj.SharedWithUser, nil
 	}
+	user, err := r.loaders(ctx).Users.Load(ctx, *obj.SharedWithUserID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
+	return user, nil
+}
 
-	return files, nil
+// Files is the resolver for the files field.
+func (r *folderResolver) Files(ctx context.Context, obj *models.Folder) ([]*models.UserFile, error) {
+	files, err := r.loaders(ctx).FilesByFolder.Load(ctx, obj.ID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load files: %w", err)
+	}
+	return nonNilFiles(files), nil
 }
 
 // TotalUsed is the resolver for the totalUsed field.
@@ -1065,16 +1163,6 @@ func (r *storageStatsResolver) SavedBytes(ctx context.Context, obj *models.Stora
 	return int(obj.SavedBytes), nil
 }
 
-// FileUploaded is the resolver for the fileUploaded field.
-func (r *subscriptionResolver) FileUploaded(ctx context.Context, userID uuid.UUID) (<-chan *models.UserFile, error) {
-	panic("not implemented fileUploaded")
-}
-
-// DownloadCountUpdated is the resolver for the downloadCountUpdated field.
-func (r *subscriptionResolver) DownloadCountUpdated(ctx context.Context, fileID uuid.UUID) (<-chan *models.UserFile, error) {
-	panic("not implemented downloadCountUpdated")
-}
-
 // StorageQuota is the resolver for the storageQuota field.
 func (r *userResolver) StorageQuota(ctx context.Context, obj *models.User) (int, error) {
 	return int(obj.StorageQuota), nil
@@ -1083,7 +1171,11 @@ func (r *userResolver) StorageQuota(ctx context.Context, obj *models.User) (int,
 
 // Files is the resolver for the files field.
 func (r *userResolver) Files(ctx context.Context, obj *models.User) ([]*models.UserFile, error) {
-	panic("not implemented files")
+	files, err := r.loaders(ctx).FilesByUser.Load(ctx, obj.ID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load files: %w", err)
+	}
+	return nonNilFiles(files), nil
 }
 
 // Folders is the resolver for the folders field.
@@ -1091,17 +1183,81 @@ func (r *userResolver) Folders(ctx context.Context, obj *models.User) ([]*models
 	panic("not implemented folders")
 }
 
+// User is the resolver for the user field.
+func (r *userFileResolver) User(ctx context.Context, obj *models.UserFile) (*models.User, error) {
+	if obj.User != nil {
+		return obj.User, nil
+	}
+	user, err := r.loaders(ctx).Users.Load(ctx, obj.UserID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file owner: %w", err)
+	}
+	if user == nil {
+		return nil, fmt.Errorf("file owner not found")
+	}
+	return user, nil
+}
+
+// FileContent is the resolver for the fileContent field.
+func (r *userFileResolver) FileContent(ctx context.Context, obj *models.UserFile) (*models.FileContent, error) {
+	if obj.FileContent != nil {
+		return obj.FileContent, nil
+	}
+	content, err := r.loaders(ctx).FileContents.Load(ctx, obj.FileContentID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file content: %w", err)
+	}
+	if content == nil {
+		return nil, fmt.Errorf("file content not found")
+	}
+	return content, nil
+}
+
+// Folder is the resolver for the folder field.
+func (r *userFileResolver) Folder(ctx context.Context, obj *models.UserFile) (*models.Folder, error) {
+	if obj.Folder != nil || obj.FolderID == nil {
+		return obj.Folder, nil
+	}
+	// nil as well when the folder is not visible to the caller, e.g. for a file shared on its own
+	folder, err := r.loaders(ctx).Folders.Load(ctx, *obj.FolderID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load folder: %w", err)
+	}
+	return folder, nil
+}
+
 // ShareURL is the resolver for the shareURL field.
 func (r *userFileResolver) ShareURL(ctx context.Context, obj *models.UserFile) (*string, error) {
 	return &obj.ShareURL, nil
 }
 
+// Shares is the resolver for the shares field.
+func (r *userFileResolver) Shares(ctx context.Context, obj *models.UserFile) ([]*models.FileShare, error) {
+	shares, err := r.loaders(ctx).Shares.Load(ctx, obj.ID)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shares: %w", err)
+	}
+	if shares == nil {
+		shares = []*models.FileShare{}
+	}
+	return shares, nil
+}
+
 // FileContent returns generated.FileContentResolver implementation.
 func (r *Resolver) FileContent() generated.FileContentResolver { return &fileContentResolver{r} }
 
+// FileShare returns generated.FileShareResolver implementation.
+func (r *Resolver) FileShare() generated.FileShareResolver { return &fileShareResolver{r} }
+
+// Folder returns generated.FolderResolver implementation.
+func (r *Resolver) Folder() generated.FolderResolver { return &folderResolver{r} }
+
 // Mutation returns generated.MutationResolver implementation.
 func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
 
+// Organization returns generated.OrganizationResolver implementation.
+func (r *Resolver) Organization() generated.OrganizationResolver { return &organizationResolver{r} }
+
 // Query returns generated.QueryResolver implementation.
 func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 
@@ -1118,7 +1274,10 @@ func (r *Resolver) User() generated.UserResolver { return &userResolver{r} }
 func (r *Resolver) UserFile() generated.UserFileResolver { return &userFileResolver{r} }
 
 type fileContentResolver struct{ *Resolver }
+type fileShareResolver struct{ *Resolver }
+type folderResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
+type organizationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
 type storageStatsResolver struct{ *Resolver }
 type subscriptionResolver struct{ *Resolver }
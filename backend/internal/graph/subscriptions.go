@@ -0,0 +1,216 @@
+package graph
+
+import (
+	"context"
+	"database/sql"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/uuid"
+)
+
+// FileUploaded is the resolver for the fileUploaded field.
+func (r *subscriptionResolver) FileUploaded(ctx context.Context, userID uuid.UUID) (<-chan *models.UserFile, error) {
+	watcher, err := r.newFileWatcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if userID != watcher.userID {
+		// staff with files:read_all may watch the users in their scope
+		reachable := watcher.scope != nil && watcher.scope.AllOrgs
+		if !reachable && watcher.scope != nil {
+			reachable, err = r.Orgs.IsMember(watcher.scope.OrgID, userID.String())
+			if err != nil {
+				return nil, fmt.Errorf("Failed::Database Error: %w", err)
+			}
+		}
+		if !reachable {
+			return nil, fmt.Errorf("access denied")
+		}
+	}
+
+	events, err := r.Events.Subscribe(ctx, services.UserEventChannel(userID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Subscribe: %w", err)
+	}
+	files := make(chan *models.UserFile)
+	go func() {
+		defer close(files)
+		for event := range events {
+			if event.Type != models.FileEventUploaded || event.OwnerID != userID {
+				continue
+			}
+			file := watcher.load(event.FileID)
+			if file == nil {
+				continue
+			}
+			select {
+			case files <- file:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return files, nil
+}
+
+// DownloadCountUpdated is the resolver for the downloadCountUpdated field.
+func (r *subscriptionResolver) DownloadCountUpdated(ctx context.Context, fileID uuid.UUID) (<-chan *models.UserFile, error) {
+	watcher, err := r.newFileWatcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !watcher.canSee(fileID) {
+		return nil, fmt.Errorf("file not found or access denied")
+	}
+
+	events, err := r.Events.Subscribe(ctx, services.FileEventChannel(fileID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Subscribe: %w", err)
+	}
+	files := make(chan *models.UserFile)
+	go func() {
+		defer close(files)
+		for event := range events {
+			// closing the stream tells the client the file is gone
+			if event.Type == models.FileEventDeleted {
+				return
+			}
+			if event.Type != models.FileEventDownloadCountUpdated {
+				continue
+			}
+			file := watcher.load(fileID)
+			if file == nil {
+				continue
+			}
+			select {
+			case files <- file:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return files, nil
+}
+
+// FileEvents is the resolver for the fileEvents field.
+func (r *subscriptionResolver) FileEvents(ctx context.Context) (<-chan *models.FileEvent, error) {
+	watcher, err := r.newFileWatcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := r.Events.Subscribe(ctx, services.UserEventChannel(watcher.userID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Subscribe: %w", err)
+	}
+	out := make(chan *models.FileEvent)
+	go func() {
+		defer close(out)
+		for event := range events {
+			if event.Type != models.FileEventDeleted {
+				event.File = watcher.load(event.FileID)
+				if event.File == nil {
+					continue
+				}
+			}
+			select {
+			case out <- &event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// fileWatcher decides which file events a subscriber gets. Access is checked again for
+// every event, shares can be removed while the subscription is open.
+type fileWatcher struct {
+	r      *Resolver
+	userID uuid.UUID
+	// scope of files:read_all, nil when the subscriber lacks it
+	scope *services.Scope
+}
+
+func (r *Resolver) newFileWatcher(ctx context.Context) (*fileWatcher, error) {
+	userID, err := r.Authz.Authorize(ctx, models.PermissionFilesRead)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+	watcher := &fileWatcher{r: r, userID: uuid.MustParse(userID)}
+
+	if scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionFilesReadAll); err == nil {
+		watcher.scope = scope
+	}
+	return watcher, nil
+}
+
+// canSee reports whether the subscriber may see fileID: files they can access and, with
+// files:read_all, the files in its scope
+func (w *fileWatcher) canSee(fileID uuid.UUID) bool {
+	allOrgs := w.scope != nil && w.scope.AllOrgs
+	var orgID *uuid.UUID
+	if w.scope != nil {
+		orgID = &w.scope.OrgID
+	}
+
+	var visible bool
+	err := w.r.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_files uf
+			WHERE uf.id = $1 AND (can_access_file($2, uf.id) OR $3 OR uf.org_id = $4)
+		)
+	`, fileID, w.userID, allOrgs, orgID).Scan(&visible)
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("Failed to check subscriber access to file", "file_id", fileID, "user_id", w.userID, "error", err)
+		return false
+	}
+	return visible
+}
+
+// load returns fileID when the subscriber may see it, nil otherwise or when it is gone
+func (w *fileWatcher) load(fileID uuid.UUID) *models.UserFile {
+	if !w.canSee(fileID) {
+		return nil
+	}
+	file, err := w.r.loadUserFileWithRelations(context.Background(), fileID.String())
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+// queryer is a *sql.DB or *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// shareRecipients returns the users fileID is shared with directly or through a group.
+// Users reaching it through a shared folder are not included.
+func shareRecipients(q queryer, fileID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := q.Query(`
+		SELECT fs.shared_with_user_id FROM file_shares fs
+		WHERE fs.file_id = $1 AND fs.shared_with_user_id IS NOT NULL
+		UNION
+		SELECT gm.user_id FROM file_shares fs
+		JOIN group_members gm ON gm.group_id = fs.shared_with_group_id
+		WHERE fs.file_id = $1
+	`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, userID)
+	}
+	return recipients, rows.Err()
+}
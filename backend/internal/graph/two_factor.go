@@ -0,0 +1,173 @@
+package graph
+
+import (
+	"context"
+	backend "file-vault"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+	"strconv"
+)
+
+// BeginTwoFactorEnrollment is the resolver for the beginTwoFactorEnrollment field.
+func (r *mutationResolver) BeginTwoFactorEnrollment(ctx context.Context) (*backend.TwoFactorEnrollment, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("authentication required")
+	}
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return nil, err
+	}
+
+	enrollment, err := r.TwoFactorService.BeginEnrollment(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.TwoFactorEnrollment{
+		Secret:     enrollment.Secret,
+		OtpauthURI: enrollment.OtpauthURI,
+	}, nil
+}
+
+// ConfirmTwoFactorEnrollment is the resolver for the confirmTwoFactorEnrollment field.
+func (r *mutationResolver) ConfirmTwoFactorEnrollment(ctx context.Context, code string) (*backend.TwoFactorActivation, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("authentication required")
+	}
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return nil, err
+	}
+
+	codes, err := r.TwoFactorService.ConfirmEnrollment(ctx, userID, code)
+	if err != nil {
+		return nil, err
+	}
+
+	// the caller may hold a setup-only token, replace it with a full one
+	user, err := r.loadUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::User not found: %w", err)
+	}
+	payload, err := r.issueAuthPayload(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.TwoFactorActivation{
+		RecoveryCodes: codes,
+		Auth:          payload,
+	}, nil
+}
+
+// VerifyTwoFactor is the resolver for the verifyTwoFactor field.
+func (r *mutationResolver) VerifyTwoFactor(ctx context.Context, challengeToken string, code string) (*backend.AuthPayload, error) {
+	claims, err := auth.ValidateChallengeToken(challengeToken, r.TokenKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Invalid or expired challenge: %w", err)
+	}
+
+	user, err := r.loadUserByID(claims.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::User not found: %w", err)
+	}
+	if err := r.Users.EnsureActive(claims.UserID); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+
+	ipAddress, userAgent := r.getClientInfo(ctx)
+	if err := r.LoginGuard.Check(ctx, user.Email, ipAddress); err != nil {
+		return nil, fmt.Errorf("Failed::%w", err)
+	}
+
+	ok, err := r.TwoFactorService.Verify(claims.UserID, code)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if !ok {
+		r.recordLoginFailure(ctx, user, user.Email, ipAddress, userAgent)
+		return nil, fmt.Errorf("Failed::Invalid two-factor code")
+	}
+
+	r.recordLoginSuccess(ctx, user, ipAddress, userAgent)
+	return r.issueAuthPayload(ctx, user)
+}
+
+// DisableTwoFactor is the resolver for the disableTwoFactor field.
+func (r *mutationResolver) DisableTwoFactor(ctx context.Context, code string) (bool, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return false, fmt.Errorf("authentication required")
+	}
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return false, err
+	}
+
+	required, err := r.LoginTokens.TwoFactorRequired(models.UserRole(auth.GetUserRoleFromContext(ctx)))
+	if err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if required {
+		return false, fmt.Errorf("Failed::Two-factor authentication is required for your role")
+	}
+
+	ok, err := r.TwoFactorService.Verify(userID, code)
+	if err != nil {
+		return false, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if !ok {
+		return false, fmt.Errorf("Failed::Invalid two-factor code")
+	}
+
+	if err := r.TwoFactorService.Disable(ctx, userID); err != nil {
+		return false, fmt.Errorf("Failed::Disable two-factor authentication: %w", err)
+	}
+
+	return true, nil
+}
+
+// RegenerateRecoveryCodes is the resolver for the regenerateRecoveryCodes field.
+func (r *mutationResolver) RegenerateRecoveryCodes(ctx context.Context, code string) ([]string, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("authentication required")
+	}
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return nil, err
+	}
+
+	ok, err := r.TwoFactorService.Verify(userID, code)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Failed::Invalid two-factor code")
+	}
+
+	return r.TwoFactorService.RegenerateRecoveryCodes(ctx, userID)
+}
+
+// SetAdminTwoFactorRequired is the resolver for the setAdminTwoFactorRequired field.
+func (r *mutationResolver) SetAdminTwoFactorRequired(ctx context.Context, required bool) (bool, error) {
+	_, err := r.Authz.Authorize(ctx, models.PermissionSettingsManage)
+	if err != nil {
+		return false, fmt.Errorf("access denied: %w", err)
+	}
+
+	if err := r.SettingsService.Set(ctx, services.SettingAdminTwoFactorRequired, strconv.FormatBool(required)); err != nil {
+		return false, fmt.Errorf("Failed::Update setting: %w", err)
+	}
+	return required, nil
+}
+
+// AdminTwoFactorRequired is the resolver for the adminTwoFactorRequired field.
+func (r *queryResolver) AdminTwoFactorRequired(ctx context.Context) (bool, error) {
+	_, err := r.Authz.Authorize(ctx, models.PermissionSettingsManage)
+	if err != nil {
+		return false, fmt.Errorf("access denied: %w", err)
+	}
+
+	return r.SettingsService.GetBool(services.SettingAdminTwoFactorRequired)
+}
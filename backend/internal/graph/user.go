@@ -1 +1,77 @@
 package graph
+
+import (
+	"context"
+	"errors"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// SuspendUser is the resolver for the suspendUser field.
+func (r *mutationResolver) SuspendUser(ctx context.Context, userID uuid.UUID, reason *string) (*models.User, error) {
+	adminID, err := r.Authz.Authorize(ctx, models.PermissionUsersManage)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+	if adminID == userID.String() {
+		return nil, fmt.Errorf("Failed::You can't suspend your own account")
+	}
+
+	why := ""
+	if reason != nil {
+		why = *reason
+	}
+	if err := r.Users.Suspend(ctx, userID, why); err != nil {
+		return nil, userLifecycleError(err)
+	}
+	return r.reloadUser(userID)
+}
+
+// ReactivateUser is the resolver for the reactivateUser field.
+func (r *mutationResolver) ReactivateUser(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	if _, err := r.Authz.Authorize(ctx, models.PermissionUsersManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	if err := r.Users.Reactivate(ctx, userID); err != nil {
+		return nil, userLifecycleError(err)
+	}
+	return r.reloadUser(userID)
+}
+
+// SetUserRole is the resolver for the setUserRole field.
+func (r *mutationResolver) SetUserRole(ctx context.Context, userID uuid.UUID, role models.UserRole) (*models.User, error) {
+	// handing out roles is handing out their permissions
+	if _, err := r.Authz.Authorize(ctx, models.PermissionUsersManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+	if _, err := r.Authz.Authorize(ctx, models.PermissionRolesManage); err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	if err := r.Users.SetRole(ctx, userID, role); err != nil {
+		return nil, userLifecycleError(err)
+	}
+	return r.reloadUser(userID)
+}
+
+func (r *mutationResolver) reloadUser(userID uuid.UUID) (*models.User, error) {
+	user, err := r.loadUserByID(userID.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return userToGraphQL(user), nil
+}
+
+func userLifecycleError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		return fmt.Errorf("Failed::User not found")
+	case errors.Is(err, services.ErrLastAdmin), errors.Is(err, services.ErrSelfTransfer):
+		return fmt.Errorf("Failed::%w", err)
+	}
+	return fmt.Errorf("Failed::Database Error: %w", err)
+}
@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"file-vault/internal/models"
@@ -17,7 +18,7 @@ import (
 // 		// SELECT id, user_id, name, parent_folder_id, is_public, created_at, updated_at, `
 // }
 
-func (r *Resolver) loadUserFileWithRelations(fileID string) (*models.UserFile, error) {
+func (r *Resolver) loadUserFileWithRelations(ctx context.Context, fileID string) (*models.UserFile, error) {
 	query := `
 		SELECT uf.id, uf.user_id, uf.file_content_id, uf.filename, uf.folder_id,
 			   uf.is_public, uf.download_count, uf.tags, uf.created_at, uf.updated_at,
@@ -33,7 +34,7 @@ func (r *Resolver) loadUserFileWithRelations(fileID string) (*models.UserFile, e
 	var user models.User
 	var fileContent models.FileContent
 
-	err := r.DB.QueryRow(query, fileID).Scan(
+	err := r.DB.QueryRowContext(ctx, query, fileID).Scan(
 		&file.ID, &file.UserID, &file.FileContentID, &file.Filename,
 		&file.FolderID, &file.IsPublic, &file.DownloadCount,
 		pq.Array(&file.Tags), &file.CreatedAt, &file.UpdatedAt,
@@ -44,7 +45,6 @@ func (r *Resolver) loadUserFileWithRelations(fileID string) (*models.UserFile, e
 		&fileContent.CreatedAt,
 	)
 	if err != nil {
-		fmt.Printf("loadUserFileWithRelations error for fileID %s: %v\n", fileID, err)
 		return nil, fmt.Errorf("failed to load file: %w", err)
 	}
 
@@ -58,19 +58,26 @@ func (r *Resolver) loadUserFileWithRelations(fileID string) (*models.UserFile, e
 // Type conversion functions
 func userToGraphQL(user *models.User) *models.User {
 	return &models.User{
-		ID:           user.ID,
-		Username:     user.Username,
-		Email:        user.Email,
-		Role:         models.UserRole(user.Role),
-		StorageQuota: user.StorageQuota,
-		CreatedAt:    user.CreatedAt,
-		UpdatedAt:    user.UpdatedAt,
+		ID:               user.ID,
+		Username:         user.Username,
+		Email:            user.Email,
+		EmailVerified:    user.EmailVerified,
+		Role:             models.UserRole(user.Role),
+		StorageQuota:     user.StorageQuota,
+		TwoFactorEnabled: user.TwoFactorEnabled,
+		CreatedAt:        user.CreatedAt,
+		UpdatedAt:        user.UpdatedAt,
+		SuspendedAt:      user.SuspendedAt,
+		SuspendedReason:  user.SuspendedReason,
 	}
 }
 
 func userFileToGraphQL(file *models.UserFile) *models.UserFile {
 	result := &models.UserFile{
 		ID:            file.ID,
+		UserID:        file.UserID,
+		FileContentID: file.FileContentID,
+		FolderID:      file.FolderID,
 		Filename:      file.Filename,
 		IsPublic:      file.IsPublic,
 		DownloadCount: file.DownloadCount,
@@ -101,6 +108,14 @@ func userFileToGraphQL(file *models.UserFile) *models.UserFile {
 	return result
 }
 
+// nonNilFiles turns a missing list into an empty one for non-null list fields
+func nonNilFiles(files []*models.UserFile) []*models.UserFile {
+	if files == nil {
+		return []*models.UserFile{}
+	}
+	return files
+}
+
 func folderToGraphQL(folder *models.Folder) *models.Folder {
 	return &models.Folder{
 		ID:        folder.ID,
@@ -113,9 +128,15 @@ func folderToGraphQL(folder *models.Folder) *models.Folder {
 
 func fileShareToGraphQL(share *models.FileShare) *models.FileShare {
 	return &models.FileShare{
-		ID:        share.ID,
-		ShareType: models.ShareType(share.ShareType),
-		CreatedAt: share.CreatedAt,
+		ID:                share.ID,
+		FileID:            share.FileID,
+		SharedWithUserID:  share.SharedWithUserID,
+		SharedWithGroupID: share.SharedWithGroupID,
+		ShareType:         models.ShareType(share.ShareType),
+		SharePeriod:       share.SharePeriod,
+		SharedWithGroup:   share.SharedWithGroup,
+		CreatedAt:         share.CreatedAt,
+		UpdatedAt:         share.UpdatedAt,
 	}
 }
 
@@ -0,0 +1,226 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	backend "file-vault"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Webhooks is the resolver for the webhooks field.
+func (r *queryResolver) Webhooks(ctx context.Context, organization *bool) ([]*models.Webhook, error) {
+	var webhooks []*models.Webhook
+	var err error
+	if organization != nil && *organization {
+		scope, scopeErr := r.Authz.AuthorizeScope(ctx, models.PermissionWebhooksManage)
+		if scopeErr != nil {
+			return nil, fmt.Errorf("access denied: %w", scopeErr)
+		}
+		webhooks, err = r.WebhookService.List(scope.OrgID, nil)
+	} else {
+		scope, scopeErr := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesRead)
+		if scopeErr != nil {
+			return nil, fmt.Errorf("access denied: %w", scopeErr)
+		}
+		userID := uuid.MustParse(scope.UserID)
+		webhooks, err = r.WebhookService.List(scope.OrgID, &userID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return webhooks, nil
+}
+
+// WebhookDeliveries is the resolver for the webhookDeliveries field.
+func (r *queryResolver) WebhookDeliveries(ctx context.Context, webhookID uuid.UUID, status *models.WebhookDeliveryStatus, limit *int) ([]*models.WebhookDelivery, error) {
+	if _, err := r.webhookForCaller(ctx, webhookID); err != nil {
+		return nil, err
+	}
+
+	n := 50
+	if limit != nil && *limit > 0 && *limit <= 200 {
+		n = *limit
+	}
+	deliveries, err := r.WebhookService.Deliveries(webhookID, status, n)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Database Error: %w", err)
+	}
+	return deliveries, nil
+}
+
+// CreateWebhook is the resolver for the createWebhook field.
+func (r *mutationResolver) CreateWebhook(ctx context.Context, input backend.WebhookInput, organization *bool, secret *string) (*backend.CreatedWebhook, error) {
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return nil, err
+	}
+
+	var orgID uuid.UUID
+	var ownerID *uuid.UUID
+	if organization != nil && *organization {
+		scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionWebhooksManage)
+		if err != nil {
+			return nil, fmt.Errorf("access denied: %w", err)
+		}
+		orgID = scope.OrgID
+	} else {
+		scope, err := r.Authz.AuthorizeInOrg(ctx, models.PermissionFilesWrite)
+		if err != nil {
+			return nil, fmt.Errorf("access denied: %w", err)
+		}
+		userID := uuid.MustParse(scope.UserID)
+		orgID, ownerID = scope.OrgID, &userID
+	}
+	if err := r.checkWebhookFolder(input.FolderID, orgID, ownerID); err != nil {
+		return nil, err
+	}
+
+	signingSecret := ""
+	if secret != nil {
+		signingSecret = *secret
+		if len(signingSecret) < 16 {
+			return nil, fmt.Errorf("Failed::Webhook secrets must be at least 16 characters")
+		}
+	}
+	webhook, err := r.WebhookService.Create(ctx, orgID, ownerID, webhookInput(input), signingSecret)
+	if err != nil {
+		return nil, webhookError(err)
+	}
+	return &backend.CreatedWebhook{Webhook: webhook, Secret: webhook.Secret}, nil
+}
+
+// UpdateWebhook is the resolver for the updateWebhook field.
+func (r *mutationResolver) UpdateWebhook(ctx context.Context, webhookID uuid.UUID, input backend.WebhookInput) (*models.Webhook, error) {
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return nil, err
+	}
+	webhook, err := r.webhookForCaller(ctx, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkWebhookFolder(input.FolderID, webhook.OrgID, webhook.UserID); err != nil {
+		return nil, err
+	}
+
+	webhook, err = r.WebhookService.Update(ctx, webhookID, webhookInput(input))
+	if err != nil {
+		return nil, webhookError(err)
+	}
+	return webhook, nil
+}
+
+// SetWebhookEnabled is the resolver for the setWebhookEnabled field.
+func (r *mutationResolver) SetWebhookEnabled(ctx context.Context, webhookID uuid.UUID, enabled bool) (*models.Webhook, error) {
+	if _, err := r.webhookForCaller(ctx, webhookID); err != nil {
+		return nil, err
+	}
+
+	webhook, err := r.WebhookService.SetEnabled(ctx, webhookID, enabled)
+	if err != nil {
+		return nil, webhookError(err)
+	}
+	return webhook, nil
+}
+
+// RotateWebhookSecret is the resolver for the rotateWebhookSecret field.
+func (r *mutationResolver) RotateWebhookSecret(ctx context.Context, webhookID uuid.UUID) (string, error) {
+	if err := forbidWhileImpersonating(ctx); err != nil {
+		return "", err
+	}
+	if _, err := r.webhookForCaller(ctx, webhookID); err != nil {
+		return "", err
+	}
+
+	secret, err := r.WebhookService.RotateSecret(ctx, webhookID)
+	if err != nil {
+		return "", webhookError(err)
+	}
+	return secret, nil
+}
+
+// DeleteWebhook is the resolver for the deleteWebhook field.
+func (r *mutationResolver) DeleteWebhook(ctx context.Context, webhookID uuid.UUID) (bool, error) {
+	if _, err := r.webhookForCaller(ctx, webhookID); err != nil {
+		return false, err
+	}
+
+	if err := r.WebhookService.Delete(ctx, webhookID); err != nil {
+		return false, webhookError(err)
+	}
+	return true, nil
+}
+
+// ReplayWebhookDelivery is the resolver for the replayWebhookDelivery field.
+func (r *mutationResolver) ReplayWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*models.WebhookDelivery, error) {
+	delivery, err := r.WebhookService.GetDelivery(deliveryID)
+	if err != nil {
+		return nil, webhookError(err)
+	}
+	if _, err := r.webhookForCaller(ctx, delivery.WebhookID); err != nil {
+		return nil, err
+	}
+
+	replay, err := r.WebhookService.Replay(deliveryID)
+	if err != nil {
+		return nil, webhookError(err)
+	}
+	return replay, nil
+}
+
+// webhookForCaller loads a webhook the caller may manage: one of their own, or an
+// organization webhook within the scope of webhooks:manage
+func (r *Resolver) webhookForCaller(ctx context.Context, webhookID uuid.UUID) (*models.Webhook, error) {
+	userID, err := r.Authz.Authorize(ctx, models.PermissionFilesRead)
+	if err != nil {
+		return nil, fmt.Errorf("access denied: %w", err)
+	}
+
+	webhook, err := r.WebhookService.Get(webhookID)
+	if err != nil {
+		return nil, webhookError(err)
+	}
+	if webhook.UserID != nil {
+		if webhook.UserID.String() != userID {
+			return nil, webhookError(services.ErrWebhookNotFound)
+		}
+		return webhook, nil
+	}
+	scope, err := r.Authz.AuthorizeScope(ctx, models.PermissionWebhooksManage)
+	if err != nil || !scope.Includes(webhook.OrgID) {
+		return nil, webhookError(services.ErrWebhookNotFound)
+	}
+	return webhook, nil
+}
+
+// checkWebhookFolder makes sure a webhook only filters on folders of its organization, and
+// a user's webhook only on their own folders
+func (r *Resolver) checkWebhookFolder(folderID *uuid.UUID, orgID uuid.UUID, ownerID *uuid.UUID) error {
+	if folderID == nil {
+		return nil
+	}
+	folder, err := r.loadFolder(*folderID)
+	if err != nil || folder.OrgID != orgID || (ownerID != nil && folder.UserID != *ownerID) {
+		return fmt.Errorf("folder not found or access denied")
+	}
+	return nil
+}
+
+func webhookInput(input backend.WebhookInput) services.WebhookInput {
+	return services.WebhookInput{URL: input.URL, Events: input.Events, FolderID: input.FolderID}
+}
+
+func webhookError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrWebhookNotFound):
+		return fmt.Errorf("Failed::Webhook not found")
+	case errors.Is(err, services.ErrWebhookDeliveryNotFound):
+		return fmt.Errorf("Failed::Webhook delivery not found")
+	case errors.Is(err, services.ErrInvalidWebhookURL), errors.Is(err, services.ErrInvalidWebhookEvents):
+		return fmt.Errorf("Failed::%w", err)
+	default:
+		return fmt.Errorf("Failed::Database Error: %w", err)
+	}
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExportAuditLogs streams the audit entries matching the query as CSV or NDJSON
+// (format=csv|ndjson). It takes the filters of the auditLogs query: user_id, actor_id,
+// action (repeatable), file_id, ip, from and to as RFC 3339 times. With mine=true users
+// export their own activity without audit:read.
+func ExportAuditLogs(w http.ResponseWriter, r *http.Request, audit *services.AuditService, authz *services.AuthorizationService) {
+	params := r.URL.Query()
+	filter, err := parseAuditFilter(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if params.Get("mine") == "true" {
+		userID, err := auth.RequireAuth(r.Context())
+		if err != nil {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		self := uuid.MustParse(userID)
+		filter.UserID = &self
+		filter.AllOrgs = true
+	} else {
+		scope, ok := authorizeScope(w, r, authz, models.PermissionAuditRead)
+		if !ok {
+			return
+		}
+		filter.OrgID, filter.AllOrgs = scope.OrgID, scope.AllOrgs
+	}
+
+	format := params.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	// exports outlive the server's write timeout
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+
+	// the download starts with the first row, until then a failure still gets a plain error
+	var write func(*models.AuditLog) error
+	var flush func()
+	start := func() {
+		filename := fmt.Sprintf("audit-logs-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			csvWriter := csv.NewWriter(w)
+			csvWriter.Write([]string{"id", "created_at", "action", "user_id", "username", "actor_id", "actor_username",
+				"impersonation_id", "file_id", "filename", "ip_address", "user_agent", "org_id", "details", "request_id"})
+			write = func(entry *models.AuditLog) error {
+				return csvWriter.Write(auditRecord(entry))
+			}
+			flush = csvWriter.Flush
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			encoder := json.NewEncoder(w)
+			write = func(entry *models.AuditLog) error {
+				return encoder.Encode(auditExportEntry(entry))
+			}
+			flush = func() {}
+		}
+	}
+
+	rows := 0
+	err = audit.Each(filter, func(entry *models.AuditLog) error {
+		if write == nil {
+			start()
+		}
+		if err := write(entry); err != nil {
+			return err
+		}
+		rows++
+		if rows%500 == 0 {
+			flush()
+			controller.Flush()
+		}
+		return nil
+	})
+	if err != nil && write == nil {
+		slog.ErrorContext(r.Context(), "Audit log export failed", "rows", rows, "error", err)
+		if errors.Is(err, services.ErrInvalidIPRange) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Failed to export audit logs", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err != nil {
+		// the status is gone with the first row, a cut off file is all the client sees
+		slog.ErrorContext(r.Context(), "Audit log export failed", "rows", rows, "error", err)
+	}
+	if write == nil {
+		start()
+	}
+	flush()
+}
+
+func parseAuditFilter(params url.Values) (services.AuditFilter, error) {
+	var filter services.AuditFilter
+	ids := map[string]**uuid.UUID{"user_id": &filter.UserID, "actor_id": &filter.ActorID, "file_id": &filter.FileID}
+	for name, target := range ids {
+		if value := params.Get(name); value != "" {
+			id, err := uuid.Parse(value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s", name)
+			}
+			*target = &id
+		}
+	}
+	times := map[string]**time.Time{"from": &filter.From, "to": &filter.To}
+	for name, target := range times {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s, expected an RFC 3339 time", name)
+			}
+			*target = &t
+		}
+	}
+	for _, value := range params["action"] {
+		for _, action := range strings.Split(value, ",") {
+			filter.Actions = append(filter.Actions, models.AuditAction(strings.ToUpper(strings.TrimSpace(action))))
+		}
+	}
+	filter.IPRange = params.Get("ip")
+	return filter, nil
+}
+
+type auditExport struct {
+	ID              uuid.UUID          `json:"id"`
+	CreatedAt       time.Time          `json:"created_at"`
+	Action          models.AuditAction `json:"action"`
+	UserID          uuid.UUID          `json:"user_id"`
+	Username        string             `json:"username"`
+	ActorID         *uuid.UUID         `json:"actor_id,omitempty"`
+	ActorUsername   string             `json:"actor_username,omitempty"`
+	ImpersonationID *uuid.UUID         `json:"impersonation_id,omitempty"`
+	FileID          *uuid.UUID         `json:"file_id,omitempty"`
+	Filename        string             `json:"filename,omitempty"`
+	IPAddress       string             `json:"ip_address"`
+	UserAgent       string             `json:"user_agent"`
+	OrgID           *uuid.UUID         `json:"org_id,omitempty"`
+	Details         json.RawMessage    `json:"details,omitempty"`
+	RequestID       string             `json:"request_id,omitempty"`
+}
+
+func auditExportEntry(entry *models.AuditLog) auditExport {
+	export := auditExport{
+		ID: entry.ID, CreatedAt: entry.CreatedAt, Action: entry.Action, UserID: entry.UserID,
+		ActorID: entry.ActorID, ImpersonationID: entry.ImpersonationID, FileID: entry.FileID,
+		IPAddress: entry.IPAddress, UserAgent: entry.UserAgent, OrgID: entry.OrgID,
+	}
+	if entry.User != nil {
+		export.Username = entry.User.Username
+	}
+	if entry.Actor != nil {
+		export.ActorUsername = entry.Actor.Username
+	}
+	if entry.File != nil {
+		export.Filename = entry.File.Filename
+	}
+	if entry.Details != nil {
+		export.Details = json.RawMessage(*entry.Details)
+	}
+	if entry.RequestID != nil {
+		export.RequestID = *entry.RequestID
+	}
+	return export
+}
+
+func auditRecord(entry *models.AuditLog) []string {
+	export := auditExportEntry(entry)
+	optional := func(id *uuid.UUID) string {
+		if id == nil {
+			return ""
+		}
+		return id.String()
+	}
+	return []string{
+		export.ID.String(), export.CreatedAt.UTC().Format(time.RFC3339Nano), string(export.Action),
+		export.UserID.String(), spreadsheetSafe(export.Username), optional(export.ActorID), spreadsheetSafe(export.ActorUsername),
+		optional(export.ImpersonationID), optional(export.FileID), spreadsheetSafe(export.Filename),
+		spreadsheetSafe(export.IPAddress), spreadsheetSafe(export.UserAgent), optional(export.OrgID), string(export.Details),
+		spreadsheetSafe(export.RequestID),
+	}
+}
+
+// spreadsheetSafe keeps spreadsheets from running user controlled cells as formulas by
+// prefixing the characters that start one with a quote
+func spreadsheetSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestExportAuditLogsFailsBeforeDownload(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/audit-logs/export?mine=true&ip=not-an-ip", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.UserIDKey, uuid.NewString()))
+	rec := httptest.NewRecorder()
+
+	ExportAuditLogs(rec, req, services.NewAuditService(nil), nil)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != "" {
+		t.Errorf("error is sent as a download: %q", disposition)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "created_at") {
+		t.Errorf("error body carries the CSV header: %q", body)
+	}
+}
+
+func TestAuditRecordIsSpreadsheetSafe(t *testing.T) {
+	entry := &models.AuditLog{
+		ID:        uuid.New(),
+		UserID:    uuid.New(),
+		Action:    models.AuditActionUpload,
+		IPAddress: "203.0.113.7",
+		UserAgent: "=HYPERLINK(\"http://evil.example\")",
+		File:      &models.UserFile{Filename: "@SUM(A1:A9).csv"},
+		User:      &models.User{Username: "ada"},
+	}
+
+	var out strings.Builder
+	writer := csv.NewWriter(&out)
+	writer.Write(auditRecord(entry))
+	writer.Flush()
+	record, err := csv.NewReader(strings.NewReader(out.String())).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := record[9]; got != "'@SUM(A1:A9).csv" {
+		t.Errorf("filename cell = %q", got)
+	}
+	if got := record[11]; got != "'=HYPERLINK(\"http://evil.example\")" {
+		t.Errorf("user agent cell = %q", got)
+	}
+	if got := record[4]; got != "ada" {
+		t.Errorf("username cell = %q, want it unchanged", got)
+	}
+}
+
+func TestSpreadsheetSafe(t *testing.T) {
+	tests := map[string]string{
+		"":               "",
+		"report.pdf":     "report.pdf",
+		"=1+1":           "'=1+1",
+		"+1":             "'+1",
+		"-1":             "'-1",
+		"@cmd":           "'@cmd",
+		"\t=1":           "'\t=1",
+		"\r=1":           "'\r=1",
+		"Mozilla/5.0 =1": "Mozilla/5.0 =1",
+	}
+	for cell, want := range tests {
+		if got := spreadsheetSafe(cell); got != want {
+			t.Errorf("spreadsheetSafe(%q) = %q, want %q", cell, got, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"net/http"
+)
+
+// authorize checks permission for a REST request and writes the error response itself.
+// The caller returns when ok is false.
+func authorize(w http.ResponseWriter, r *http.Request, authz *services.AuthorizationService, permission models.Permission) (string, bool) {
+	userID, err := authz.Authorize(r.Context(), permission)
+	if err == nil {
+		return userID, true
+	}
+
+	if errors.Is(err, services.ErrPermissionDenied) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	} else {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	}
+	return "", false
+}
+
+// authorizeInOrg is authorize for requests working inside the caller's current organization
+func authorizeInOrg(w http.ResponseWriter, r *http.Request, authz *services.AuthorizationService, permission models.Permission) (*services.Scope, bool) {
+	scope, err := authz.AuthorizeInOrg(r.Context(), permission)
+	if err == nil {
+		return scope, true
+	}
+
+	switch {
+	case errors.Is(err, services.ErrPermissionDenied):
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	case errors.Is(err, services.ErrNotOrgMember), errors.Is(err, services.ErrOrgNotFound), errors.Is(err, services.ErrNoOrganization):
+		http.Error(w, "Organization not found", http.StatusForbidden)
+	default:
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	}
+	return nil, false
+}
+
+// authorizeScope is authorize for admin requests that may span organizations, see
+// AuthorizationService.AuthorizeScope
+func authorizeScope(w http.ResponseWriter, r *http.Request, authz *services.AuthorizationService, permission models.Permission) (*services.Scope, bool) {
+	scope, err := authz.AuthorizeScope(r.Context(), permission)
+	if err == nil {
+		return scope, true
+	}
+
+	switch {
+	case errors.Is(err, services.ErrPermissionDenied):
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	case errors.Is(err, services.ErrNotOrgMember), errors.Is(err, services.ErrOrgNotFound), errors.Is(err, services.ErrNoOrganization):
+		http.Error(w, "Organization not found", http.StatusForbidden)
+	default:
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	}
+	return nil, false
+}
@@ -2,17 +2,22 @@ package handlers
 
 import (
 	"database/sql"
+	"file-vault/internal/models"
 	"file-vault/internal/services"
-	"fmt"
+	"log/slog"
 	"net/http"
 
 	"github.com/google/uuid"
 )
 
-func FilePreviewHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, fileService *services.FileService) {
-	fmt.Println("file preview handler request")
+// FilePreviewHandler serves a download record inline. The record must belong to the caller,
+// the user ID in the URL is ignored in favour of the token's.
+func FilePreviewHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, fileService *services.FileService, authz *services.AuthorizationService, audit *services.AuditService) {
+	userID, ok := authorize(w, r, authz, models.PermissionFilesRead)
+	if !ok {
+		return
+	}
 	downloadID := r.PathValue("downloadID")
-	userID := r.PathValue("userID")
 
 	var fileContentID uuid.UUID
 	var fileName string
@@ -21,26 +26,48 @@ func FilePreviewHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, file
 	query := `SELECT user_file_id, file_name, file_content_id, owner_id FROM file_downloads WHERE id = $1 AND user_id = $2`
 	err := db.QueryRow(query, downloadID, userID).Scan(&userFileID, &fileName, &fileContentID, &ownerID)
 	if err != nil {
-		fmt.Printf("PreviewHandler: Failed to get download record: %v\n", err)
+		slog.DebugContext(r.Context(), "Preview download record not found", "download_id", downloadID, "error", err)
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
 	var mimeType string
 	var filePath string
-	query = `SELECT mime_type, file_path FROM file_contents WHERE id = $1`
-	err = db.QueryRow(query, fileContentID).Scan(&mimeType, &filePath)
+	var thumbnailPath *string
+	query = `SELECT mime_type, file_path, thumbnail_path FROM file_contents WHERE id = $1`
+	err = db.QueryRow(query, fileContentID).Scan(&mimeType, &filePath, &thumbnailPath)
 	if err != nil {
-		fmt.Printf("PreviewHandler: Failed to get file content: %v\n", err)
+		slog.ErrorContext(r.Context(), "Failed to get file content for preview", "file_content_id", fileContentID, "error", err)
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
-	fmt.Printf("PreviewHandler: File path from DB: %s, File name: %s, MIME type: %s\n", filePath, fileName, mimeType)
+	// ?thumbnail=true serves the scaled down image, once the thumbnail job generated it
+	if r.URL.Query().Get("thumbnail") == "true" {
+		if thumbnailPath == nil {
+			http.Error(w, "Thumbnail not available", http.StatusNotFound)
+			return
+		}
+		if err := fileService.PreviewFile(r.Context(), &w, *thumbnailPath, fileName, "image/jpeg"); err != nil {
+			slog.WarnContext(r.Context(), "Failed to serve thumbnail", "file_content_id", fileContentID, "error", err)
+			http.Error(w, "Thumbnail not available", http.StatusNotFound)
+		}
+		return
+	}
 
-	if err := fileService.PreviewFile(&w, filePath, fileName, mimeType); err != nil {
-		fmt.Printf("PreviewHandler: Failed to preview file: %v\n", err)
+	if err := fileService.PreviewFile(r.Context(), &w, filePath, fileName, mimeType); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to preview file", "file_content_id", fileContentID, "error", err)
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+
+	err = audit.Record(r.Context(), nil, services.AuditEvent{
+		UserID:  userID,
+		Action:  models.AuditActionDownload,
+		FileID:  &userFileID,
+		Details: services.AuditDetails{"mode": "preview"},
+	})
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to create audit log for preview", "error", err)
+	}
 }
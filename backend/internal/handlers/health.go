@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"file-vault/internal/lifecycle"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"net/http"
+)
+
+// Liveness answers as long as the process serves HTTP, it checks no dependencies so an
+// outage of Postgres or Redis does not get the server restarted
+func Liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "ok"}`))
+}
+
+// Readiness reports whether the server takes traffic: it is not shutting down and its
+// dependencies pass their checks. Details of failures are only in SystemStatus.
+func Readiness(w http.ResponseWriter, r *http.Request, state *lifecycle.State, health *services.HealthService) {
+	if !state.Ready() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+
+	report := health.Readiness(r.Context())
+	code := http.StatusOK
+	if !report.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, report)
+}
+
+// SystemStatus is the detailed status for administrators, it answers 200 while components
+// are down so the report itself can be read
+func SystemStatus(w http.ResponseWriter, r *http.Request, health *services.HealthService, authz *services.AuthorizationService) {
+	if _, ok := authorize(w, r, authz, models.PermissionSystemStatus); !ok {
+		return
+	}
+	writeHealth(w, http.StatusOK, health.Status(r.Context()))
+}
+
+func writeHealth(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"encoding/json"
+	"file-vault/internal/auth"
+	"net/http"
+)
+
+// JWKS publishes the public token verification keys so other services can validate
+// FileVault access tokens without sharing a secret.
+func JWKS(w http.ResponseWriter, r *http.Request, keys *auth.KeySet) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(keys.JWKS()); err != nil {
+		http.Error(w, "Failed to encode keys", http.StatusInternalServerError)
+	}
+}
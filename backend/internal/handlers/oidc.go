@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/config"
+	"file-vault/internal/models"
+	"file-vault/internal/services"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// oidcStateCookie ties a login to the browser that started it, without it anyone could
+// finish their own login in a victim's browser
+const oidcStateCookie = "oidc_state"
+
+// OIDCLogin redirects the browser to the identity provider
+func OIDCLogin(w http.ResponseWriter, r *http.Request, cfg *config.Config, oidcService *services.OIDCService) {
+	authURL, binding, err := oidcService.AuthCodeURL(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC login unavailable", "error", err)
+		http.Error(w, "Single sign-on is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	setOIDCStateCookie(w, r, cfg, binding, int(services.OIDCStateTTL.Seconds()))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// setOIDCStateCookie stores binding for the callback, a negative maxAge removes it. Lax
+// still sends it on the top-level redirect back from the provider.
+func setOIDCStateCookie(w http.ResponseWriter, r *http.Request, cfg *config.Config, binding string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    binding,
+		Path:     "/api/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   cfg.IsProduction() || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCCallback finishes the login and hands the FileVault token to the frontend.
+// The token travels in the URL fragment so it never reaches server or proxy logs.
+func OIDCCallback(w http.ResponseWriter, r *http.Request, cfg *config.Config,
+	oidcService *services.OIDCService, identityService *services.IdentityService, loginTokens *services.LoginTokenService,
+	users *services.UserService, audit *services.AuditService) {
+	// the callback runs outside the auth middleware, the audit entries still need the client
+	r = auth.WithClientInfo(r)
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		slog.WarnContext(r.Context(), "OIDC provider returned an error", "error", providerErr, "description", query.Get("error_description"))
+		redirectSSOError(w, r, cfg, "sso_denied")
+		return
+	}
+
+	var binding string
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+		binding = cookie.Value
+	}
+	setOIDCStateCookie(w, r, cfg, "", -1)
+
+	identity, err := oidcService.Exchange(r.Context(), query.Get("state"), query.Get("code"), binding)
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC code exchange failed", "error", err)
+		redirectSSOError(w, r, cfg, "sso_failed")
+		return
+	}
+
+	user, _, err := identityService.ResolveUser(r.Context(), *identity, oidcService.AllowProvisioning())
+	if errors.Is(err, services.ErrProvisioningDisabled) {
+		redirectSSOError(w, r, cfg, "sso_no_account")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to resolve OIDC user", "error", err)
+		redirectSSOError(w, r, cfg, "sso_failed")
+		return
+	}
+
+	if err := users.EnsureActive(user.ID.String()); err != nil {
+		slog.InfoContext(r.Context(), "OIDC login refused", "user_id", user.ID, "error", err)
+		redirectSSOError(w, r, cfg, "sso_account_suspended")
+		return
+	}
+
+	tokens, err := loginTokens.AfterFirstFactor(user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to issue token after OIDC login", "error", err)
+		redirectSSOError(w, r, cfg, "sso_failed")
+		return
+	}
+	// same second factor rules as the password login: enrolled users still get a TOTP
+	// challenge and admins may be forced to enroll first
+	fragment := url.Values{}
+	if tokens.ChallengeToken != "" {
+		fragment.Set("challengeToken", tokens.ChallengeToken)
+	} else {
+		fragment.Set("token", tokens.Token)
+		if tokens.TwoFactorSetupRequired {
+			fragment.Set("twoFactorSetupRequired", "true")
+		}
+		err := audit.Record(r.Context(), nil, services.AuditEvent{
+			UserID:  user.ID.String(),
+			Action:  models.AuditActionLogin,
+			Details: services.AuditDetails{"provider": identity.Provider},
+		})
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed to create audit log for login", "error", err)
+		}
+	}
+
+	http.Redirect(w, r, cfg.AppBaseURL+"/auth/callback#"+fragment.Encode(), http.StatusFound)
+}
+
+func redirectSSOError(w http.ResponseWriter, r *http.Request, cfg *config.Config, code string) {
+	http.Redirect(w, r, cfg.AppBaseURL+"/login?error="+url.QueryEscape(code), http.StatusFound)
+}
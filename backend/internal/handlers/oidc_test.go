@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"file-vault/internal/config"
+	"file-vault/internal/services"
+	"file-vault/internal/services/oidctest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestOIDC(t *testing.T) (*config.Config, *services.OIDCService, *oidctest.Provider) {
+	t.Helper()
+	idp := oidctest.NewProvider(t, "file-vault", "client-secret")
+	redisClient := services.NewRedisClient("redis://" + miniredis.RunT(t).Addr())
+	t.Cleanup(func() { redisClient.Close() })
+
+	cfg := &config.Config{Environment: "development", AppBaseURL: "https://app.example.com"}
+	oidcService := services.NewOIDCService(redisClient, services.OIDCConfig{
+		IssuerURL:    idp.URL,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  "https://files.example.com/api/auth/oidc/callback",
+	})
+	return cfg, oidcService, idp
+}
+
+func TestOIDCLoginSetsStateCookie(t *testing.T) {
+	cfg, oidcService, idp := newTestOIDC(t)
+	rec := httptest.NewRecorder()
+	OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil), cfg, oidcService)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want a redirect to the provider", rec.Code)
+	}
+	callback, err := idp.Login(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("login at provider: %v", err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got cookies %v, want the state cookie", cookies)
+	}
+	cookie := cookies[0]
+	if cookie.Name != oidcStateCookie || cookie.Path != "/api/auth/oidc" || !cookie.HttpOnly ||
+		cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge != int(services.OIDCStateTTL.Seconds()) {
+		t.Errorf("state cookie = %+v", cookie)
+	}
+	if cookie.Value != services.OIDCStateBinding(callback.Query().Get("state")) {
+		t.Errorf("cookie value %q does not bind state %q", cookie.Value, callback.Query().Get("state"))
+	}
+}
+
+func TestOIDCCallbackInAnotherBrowser(t *testing.T) {
+	cfg, oidcService, idp := newTestOIDC(t)
+	login := httptest.NewRecorder()
+	OIDCLogin(login, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil), cfg, oidcService)
+	callback, err := idp.Login(login.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("login at provider: %v", err)
+	}
+
+	// the victim's browser follows the attacker's callback URL without the attacker's cookie,
+	// the login stops before a user is looked up
+	rec := httptest.NewRecorder()
+	OIDCCallback(rec, httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil), cfg, oidcService, nil, nil, nil, nil)
+
+	if got, want := rec.Header().Get("Location"), "https://app.example.com/login?error=sso_failed"; rec.Code != http.StatusFound || got != want {
+		t.Errorf("callback = %d to %q, want a redirect to %q", rec.Code, got, want)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("got cookies %v, want the state cookie cleared", cookies)
+	}
+}
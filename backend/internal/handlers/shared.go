@@ -3,18 +3,20 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"file-vault/internal/auth"
+	"errors"
+	"file-vault/internal/models"
 	"file-vault/internal/services"
-	"fmt"
+	"log/slog"
 	"net/http"
+
+	"github.com/google/uuid"
 )
 
 // UnshareFile handles unsharing a file
-func UnshareFile(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func UnshareFile(w http.ResponseWriter, r *http.Request, db *sql.DB, authz *services.AuthorizationService, audit *services.AuditService) {
 	// Get user ID from context (set by auth middleware)
-	userID, err := auth.RequireAuth(r.Context())
-	if err != nil {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	userID, ok := authorize(w, r, authz, models.PermissionFilesShare)
+	if !ok {
 		return
 	}
 
@@ -26,6 +28,11 @@ func UnshareFile(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		http.Error(w, "File ID is required", http.StatusBadRequest)
 		return
 	}
+	fileUUID, err := uuid.Parse(fileID)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
 
 	// Start transaction
 	tx, err := db.Begin()
@@ -42,7 +49,7 @@ func UnshareFile(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			SELECT 1 FROM user_files uf 
 			WHERE uf.id = $1 AND uf.user_id = $2
 		)
-	`, fileID, userID).Scan(&fileExists)
+	`, fileUUID, userID).Scan(&fileExists)
 
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
@@ -55,16 +62,28 @@ func UnshareFile(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 
 	// Delete all shares for this file
-	_, err = tx.Exec(`
+	result, err := tx.Exec(`
 		DELETE FROM file_shares 
 		WHERE file_id = $1
-	`, fileID)
+	`, fileUUID)
 
 	if err != nil {
 		http.Error(w, "Failed to unshare file", http.StatusInternalServerError)
 		return
 	}
 
+	removed, _ := result.RowsAffected()
+	err = audit.Record(r.Context(), tx, services.AuditEvent{
+		UserID:  userID,
+		Action:  models.AuditActionUnshare,
+		FileID:  &fileUUID,
+		Details: services.AuditDetails{"shares_removed": removed},
+	})
+	if err != nil {
+		http.Error(w, "Failed to unshare file", http.StatusInternalServerError)
+		return
+	}
+
 	// Commit transaction
 	err = tx.Commit()
 	if err != nil {
@@ -84,9 +103,18 @@ func UnshareFile(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 }
 
 // DownloadSharedFile handles downloading a shared file
-func DownloadSharedFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fs *services.FileService) {
+func DownloadSharedFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fs *services.FileService, authz *services.AuthorizationService, audit *services.AuditService, jobs *services.JobQueue) {
 	// Get user ID from context (set by auth middleware)
-	userID, err1 := auth.RequireAuth(r.Context())
+	userID, err1 := authz.Authorize(r.Context(), models.PermissionFilesRead)
+	if errors.Is(err1, services.ErrPermissionDenied) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "Permission denied",
+		})
+		return
+	}
 	if err1 != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -110,6 +138,17 @@ func DownloadSharedFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fs *
 		})
 		return
 	}
+	// parsed before anything is served, Postgres accepts spellings uuid.Parse rejects
+	fileUUID, err := uuid.Parse(fileID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "Invalid file ID",
+		})
+		return
+	}
 
 	// Check if the file is shared with this user or is public
 	var filePath, filename, mimeType string
@@ -123,20 +162,11 @@ func DownloadSharedFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fs *
 		FROM user_files uf
 		JOIN file_contents fc ON uf.file_content_id = fc.id
 		WHERE uf.id = $1 
-		AND (
-			uf.user_id = $2 OR  -- User owns the file
-			uf.is_public = true OR  -- File is publicly shared
-			EXISTS (
-				SELECT 1 FROM file_shares fs 
-				WHERE fs.file_id = uf.id 
-				AND fs.share_type = 'USER_SPECIFIC' 
-				AND fs.shared_with_user_id = $2
-			)  -- File is specifically shared with user
-		)
+		AND can_access_file($2, uf.id)  -- owner, public, shared with the user, one of their groups or a shared folder
 		LIMIT 1
 	`
 
-	err := db.QueryRow(query, fileID, userID).Scan(&filePath, &filename, &mimeType, &fileSize, &isOwner)
+	err = db.QueryRow(query, fileUUID, userID).Scan(&filePath, &filename, &mimeType, &fileSize, &isOwner)
 
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -155,7 +185,7 @@ func DownloadSharedFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fs *
 		return
 	}
 
-	err = fs.DownloadFile(&w, filePath, filename, mimeType)
+	err = fs.DownloadFile(r.Context(), &w, filePath, filename, mimeType)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -166,17 +196,16 @@ func DownloadSharedFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fs *
 		return
 	}
 
-	// Update download count asynchronously (only if not the owner)
+	err = audit.Record(r.Context(), nil, services.AuditEvent{UserID: userID, Action: models.AuditActionDownload, FileID: &fileUUID})
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to create audit log for download", "error", err)
+	}
+
+	// Download count is updated in the background (only if not the owner)
 	if !isOwner {
-		go func() {
-			_, err := db.Exec(`
-				UPDATE user_files 
-				SET download_count = download_count + 1 
-				WHERE id = $1
-			`, fileID)
-			if err != nil {
-				fmt.Printf("Failed to update download count: %v\n", err)
-			}
-		}()
+		err := jobs.Enqueue(nil, services.JobCountDownload, services.CountDownloadJob{FileID: fileUUID}, services.JobOptions{})
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed to queue download count update", "file_id", fileUUID, "error", err)
+		}
 	}
 }
@@ -3,19 +3,19 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"file-vault/internal/auth"
 	"file-vault/internal/models"
+	"file-vault/internal/services"
 	"net/http"
 	"strconv"
 	"time"
 )
 
-func SearchUsers(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	userID, err := auth.RequireAuth(r.Context())
-	if err != nil {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+func SearchUsers(w http.ResponseWriter, r *http.Request, db *sql.DB, authz *services.AuthorizationService) {
+	scope, ok := authorizeInOrg(w, r, authz, models.PermissionUsersSearch)
+	if !ok {
 		return
 	}
+	userID := scope.UserID
 	username := r.URL.Query().Get("username")
 	limitStr := r.URL.Query().Get("limit")
 	offsetStr := r.URL.Query().Get("offset")
@@ -36,16 +36,17 @@ func SearchUsers(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		}
 	}
 
-	// Query the database
+	// Query the database, only members of the caller's organization can be found
 	query := `
-		SELECT id, username, email
-		FROM users 
-		WHERE username ILIKE $1 
-		ORDER BY username 
+		SELECT u.id, u.username, u.email
+		FROM users u
+		JOIN organization_members om ON om.user_id = u.id AND om.org_id = $4
+		WHERE u.username ILIKE $1 
+		ORDER BY u.username 
 		LIMIT $2 OFFSET $3
 	`
 
-	rows, err := db.Query(query, "%"+username+"%", limit, offset)
+	rows, err := db.Query(query, "%"+username+"%", limit, offset, scope.OrgID)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		return
@@ -91,7 +92,7 @@ func SearchUsers(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	})
 }
 
-func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB, authz *services.AuthorizationService) {
 	limitStr := r.URL.Query().Get("limit")
 	offsetStr := r.URL.Query().Get("offset")
 
@@ -112,11 +113,11 @@ func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 
 	// Get user ID from context (set by auth middleware)
-	userID, err := auth.RequireAuth(r.Context())
-	if err != nil {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	scope, ok := authorizeInOrg(w, r, authz, models.PermissionFilesRead)
+	if !ok {
 		return
 	}
+	userID := scope.UserID
 
 	// Query the database for files shared by this user
 	query := `
@@ -125,18 +126,20 @@ func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			uf.id, uf.filename, uf.is_public, uf.download_count, uf.created_at, uf.updated_at,
 			fc.id, fc.size, fc.mime_type,
 			u.id, u.username, u.email,
-			shared_user.id, shared_user.username, shared_user.email
+			shared_user.id, shared_user.username, shared_user.email,
+			g.id, g.name
 		FROM file_shares fs
 		JOIN user_files uf ON fs.file_id = uf.id
 		JOIN file_contents fc ON uf.file_content_id = fc.id
 		JOIN users u ON uf.user_id = u.id
 		LEFT JOIN users shared_user ON fs.shared_with_user_id = shared_user.id
-		WHERE uf.user_id = $1
+		LEFT JOIN user_groups g ON fs.shared_with_group_id = g.id
+		WHERE uf.user_id = $1 AND uf.org_id = $4
 		ORDER BY fs.created_at DESC
 		LIMIT $2 OFFSET $3
 	`
 
-	rows, err := db.Query(query, userID, limit, offset)
+	rows, err := db.Query(query, userID, limit, offset, scope.OrgID)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		return
@@ -155,6 +158,7 @@ func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		var isPublic bool
 		var downloadCount, fileSize int64
 		var sharedUserID, sharedUsername, sharedEmail sql.NullString
+		var groupID, groupName sql.NullString
 
 		err := rows.Scan(
 			&shareID, &shareType, &sharePeriod, &createdAt,
@@ -162,6 +166,7 @@ func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			&fileContentID, &fileSize, &mimeType,
 			&userID, &username, &email,
 			&sharedUserID, &sharedUsername, &sharedEmail,
+			&groupID, &groupName,
 		)
 		if err != nil {
 			http.Error(w, "Failed to scan share data", http.StatusInternalServerError)
@@ -201,6 +206,12 @@ func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 				"email":    sharedEmail.String,
 			}
 		}
+		if groupID.Valid {
+			share["sharedWithGroup"] = map[string]interface{}{
+				"id":   groupID.String,
+				"name": groupName.String,
+			}
+		}
 
 		shares = append(shares, share)
 	}
@@ -224,7 +235,7 @@ func GetMySharedFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	})
 }
 
-func GetFilesSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func GetFilesSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB, authz *services.AuthorizationService) {
 	limitStr := r.URL.Query().Get("limit")
 	offsetStr := r.URL.Query().Get("offset")
 
@@ -245,31 +256,54 @@ func GetFilesSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 
 	// Get user ID from context (set by auth middleware)
-	userID, err := auth.RequireAuth(r.Context())
-	if err != nil {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	scope, ok := authorizeInOrg(w, r, authz, models.PermissionFilesRead)
+	if !ok {
 		return
 	}
+	userID := scope.UserID
 
-	// Query the database for files shared with this user
+	// Query the database for files shared with this user, directly, through one of their
+	// groups or by being inside a folder shared with them
 	query := `
+		WITH my_groups AS (
+			SELECT group_id FROM group_members WHERE user_id = $1
+		),
+		shares AS (
+			SELECT fs.id, fs.share_type::text AS share_type, fs.share_period::text AS share_period, fs.created_at,
+				fs.file_id, fs.shared_with_user_id, fs.shared_with_group_id, NULL::uuid AS folder_id
+			FROM file_shares fs
+			JOIN user_files uf ON fs.file_id = uf.id
+			WHERE fs.shared_with_user_id = $1
+			   OR fs.shared_with_group_id IN (SELECT group_id FROM my_groups)
+			   OR (fs.share_type = 'PUBLIC' AND uf.user_id != $1)
+			UNION ALL
+			SELECT fos.id, CASE WHEN fos.shared_with_group_id IS NULL THEN 'USER_SPECIFIC' ELSE 'GROUP' END,
+				'PERMANENT', fos.created_at,
+				uf.id, fos.shared_with_user_id, fos.shared_with_group_id, fos.folder_id
+			FROM shared_folders_for_user($1) sf
+			JOIN folder_shares fos ON fos.id = sf.folder_share_id
+			JOIN user_files uf ON uf.folder_id = sf.folder_id
+			WHERE uf.user_id != $1
+		)
 		SELECT 
-			fs.id, fs.share_type, fs.share_period, fs.created_at,
+			s.id, s.share_type, s.share_period, s.created_at,
 			uf.id, uf.filename, uf.is_public, uf.download_count, uf.created_at, uf.updated_at,
 			fc.id, fc.size, fc.mime_type,
 			u.id, u.username, u.email,
-			shared_user.id, shared_user.username, shared_user.email
-		FROM file_shares fs
-		JOIN user_files uf ON fs.file_id = uf.id
+			shared_user.id, shared_user.username, shared_user.email,
+			g.id, g.name, s.folder_id
+		FROM shares s
+		JOIN user_files uf ON s.file_id = uf.id
 		JOIN file_contents fc ON uf.file_content_id = fc.id
 		JOIN users u ON uf.user_id = u.id
-		LEFT JOIN users shared_user ON fs.shared_with_user_id = shared_user.id
-		WHERE (fs.shared_with_user_id = $1 OR (fs.share_type = 'PUBLIC' AND uf.user_id != $1))
-		ORDER BY fs.created_at DESC
+		LEFT JOIN users shared_user ON s.shared_with_user_id = shared_user.id
+		LEFT JOIN user_groups g ON s.shared_with_group_id = g.id
+		WHERE uf.org_id = $4
+		ORDER BY s.created_at DESC
 		LIMIT $2 OFFSET $3
 	`
 
-	rows, err := db.Query(query, userID, limit, offset)
+	rows, err := db.Query(query, userID, limit, offset, scope.OrgID)
 	if err != nil {
 		http.Error(w, "Database query failed", http.StatusInternalServerError)
 		return
@@ -288,6 +322,7 @@ func GetFilesSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		var isPublic bool
 		var downloadCount, fileSize int64
 		var sharedUserID, sharedUsername, sharedEmail sql.NullString
+		var groupID, groupName, folderID sql.NullString
 
 		err := rows.Scan(
 			&shareID, &shareType, &sharePeriod, &createdAt,
@@ -295,6 +330,7 @@ func GetFilesSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			&fileContentID, &fileSize, &mimeType,
 			&userID, &username, &email,
 			&sharedUserID, &sharedUsername, &sharedEmail,
+			&groupID, &groupName, &folderID,
 		)
 		if err != nil {
 			http.Error(w, "Failed to scan share data", http.StatusInternalServerError)
@@ -334,6 +370,15 @@ func GetFilesSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 				"email":    sharedEmail.String,
 			}
 		}
+		if groupID.Valid {
+			share["sharedWithGroup"] = map[string]interface{}{
+				"id":   groupID.String,
+				"name": groupName.String,
+			}
+		}
+		if folderID.Valid {
+			share["sharedFolderId"] = folderID.String
+		}
 
 		shares = append(shares, share)
 	}
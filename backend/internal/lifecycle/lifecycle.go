@@ -0,0 +1,50 @@
+package lifecycle
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// State tracks where the server is in its shutdown. It stops being ready first, so load
+// balancers take it out of rotation, and then drains: requests in flight finish while new
+// ones are turned away.
+type State struct {
+	notReady atomic.Bool
+	draining atomic.Bool
+}
+
+func NewState() *State {
+	return &State{}
+}
+
+// SetNotReady makes readiness checks fail, requests are still served
+func (s *State) SetNotReady() {
+	s.notReady.Store(true)
+}
+
+// StartDraining turns away new requests with 503
+func (s *State) StartDraining() {
+	s.notReady.Store(true)
+	s.draining.Store(true)
+}
+
+func (s *State) Ready() bool {
+	return !s.notReady.Load()
+}
+
+func (s *State) Draining() bool {
+	return s.draining.Load()
+}
+
+// Middleware answers 503 while the server drains and asks clients to reconnect elsewhere
+func Middleware(next http.Handler, state *State) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state.Draining() {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,201 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates/*
+var templateFiles embed.FS
+
+const (
+	TLSModeNone     = "none"     // plain SMTP, e.g. MailHog on localhost:1025
+	TLSModeStartTLS = "starttls" // upgrade after connecting, usually port 587
+	TLSModeTLS      = "tls"      // implicit TLS, usually port 465
+)
+
+const (
+	TemplateVerifyEmail   = "verify_email"
+	TemplatePasswordReset = "password_reset"
+)
+
+type Config struct {
+	Host               string
+	Port               string
+	Username           string
+	Password           string
+	From               string
+	TLSMode            string
+	InsecureSkipVerify bool
+}
+
+type Mailer struct {
+	config Config
+	text   *texttemplate.Template
+	html   *htmltemplate.Template
+}
+
+func NewMailer(config Config) (*Mailer, error) {
+	text, err := texttemplate.ParseFS(templateFiles, "templates/*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Parse text mail templates: %w", err)
+	}
+	html, err := htmltemplate.ParseFS(templateFiles, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Parse html mail templates: %w", err)
+	}
+	if config.TLSMode == "" {
+		config.TLSMode = TLSModeStartTLS
+	}
+	return &Mailer{config: config, text: text, html: html}, nil
+}
+
+// Enabled reports whether an SMTP server is configured. Without one messages are only logged.
+func (m *Mailer) Enabled() bool {
+	return m.config.Host != ""
+}
+
+// Send renders the named template with data and delivers it to a single recipient.
+// Each template name has a "<name>.txt" file defining "subject" and "text" blocks and a "<name>.html" body.
+func (m *Mailer) Send(to, templateName string, data any) error {
+	subject, textBody, htmlBody, err := m.render(templateName, data)
+	if err != nil {
+		return err
+	}
+
+	if !m.Enabled() {
+		slog.Info("SMTP not configured, skipping mail", "template", templateName)
+		return nil
+	}
+
+	message, err := m.buildMessage(to, subject, textBody, htmlBody)
+	if err != nil {
+		return err
+	}
+	return m.deliver(to, message)
+}
+
+func (m *Mailer) render(templateName string, data any) (string, string, string, error) {
+	var subject, text, html bytes.Buffer
+
+	textTemplate := m.text.Lookup(templateName + ".txt")
+	htmlTemplate := m.html.Lookup(templateName + ".html")
+	if textTemplate == nil || htmlTemplate == nil {
+		return "", "", "", fmt.Errorf("Failed::Unknown mail template %q", templateName)
+	}
+
+	if err := textTemplate.ExecuteTemplate(&subject, templateName+".subject", data); err != nil {
+		return "", "", "", fmt.Errorf("Failed::Render mail subject: %w", err)
+	}
+	if err := textTemplate.Execute(&text, data); err != nil {
+		return "", "", "", fmt.Errorf("Failed::Render mail text: %w", err)
+	}
+	if err := htmlTemplate.Execute(&html, data); err != nil {
+		return "", "", "", fmt.Errorf("Failed::Render mail html: %w", err)
+	}
+
+	return strings.TrimSpace(subject.String()), text.String(), html.String(), nil
+}
+
+func (m *Mailer) buildMessage(to, subject, textBody, htmlBody string) ([]byte, error) {
+	boundaryBytes := make([]byte, 12)
+	if _, err := rand.Read(boundaryBytes); err != nil {
+		return nil, err
+	}
+	boundary := "filevault-" + hex.EncodeToString(boundaryBytes)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, textBody)
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", boundary, htmlBody)
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+
+	return msg.Bytes(), nil
+}
+
+func (m *Mailer) deliver(to string, message []byte) error {
+	addr := net.JoinHostPort(m.config.Host, m.config.Port)
+	tlsConfig := &tls.Config{
+		ServerName:         m.config.Host,
+		InsecureSkipVerify: m.config.InsecureSkipVerify,
+	}
+
+	var client *smtp.Client
+	var err error
+	if m.config.TLSMode == TLSModeTLS {
+		conn, dialErr := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, tlsConfig)
+		if dialErr != nil {
+			return fmt.Errorf("Failed::Connect SMTP server: %w", dialErr)
+		}
+		client, err = smtp.NewClient(conn, m.config.Host)
+	} else {
+		conn, dialErr := net.DialTimeout("tcp", addr, 10*time.Second)
+		if dialErr != nil {
+			return fmt.Errorf("Failed::Connect SMTP server: %w", dialErr)
+		}
+		client, err = smtp.NewClient(conn, m.config.Host)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed::SMTP handshake: %w", err)
+	}
+	defer client.Close()
+
+	if m.config.TLSMode == TLSModeStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("Failed::SMTP STARTTLS: %w", err)
+		}
+	}
+
+	if m.config.Username != "" {
+		auth := smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("Failed::SMTP authentication: %w", err)
+		}
+	}
+
+	if err := client.Mail(envelopeAddress(m.config.From)); err != nil {
+		return fmt.Errorf("Failed::SMTP MAIL FROM: %w", err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("Failed::SMTP RCPT TO: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("Failed::SMTP DATA: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("Failed::Write mail body: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Failed::Write mail body: %w", err)
+	}
+	return client.Quit()
+}
+
+// envelopeAddress extracts "vault@example.com" from "FileVault <vault@example.com>"
+func envelopeAddress(from string) string {
+	if start := strings.LastIndex(from, "<"); start >= 0 {
+		if end := strings.LastIndex(from, ">"); end > start {
+			return from[start+1 : end]
+		}
+	}
+	return strings.TrimSpace(from)
+}
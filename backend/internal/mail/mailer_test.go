@@ -0,0 +1,450 @@
+package mail
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// caughtMail is a message as an SMTP catcher like MailHog stores it
+type caughtMail struct {
+	From     string
+	To       []string
+	Data     []byte
+	TLS      bool   // the message was sent over TLS
+	AuthUser string // the user that authenticated, empty without AUTH
+}
+
+// smtpCatcher is a minimal in-process SMTP server in the spirit of MailHog: it accepts
+// every message and keeps it. With a TLS config it offers STARTTLS, or speaks TLS from the
+// start when implicit is set, and with a username it requires AUTH PLAIN over TLS.
+type smtpCatcher struct {
+	listener net.Listener
+	tls      *tls.Config
+	implicit bool
+	username string
+	password string
+
+	mu       sync.Mutex
+	messages []caughtMail
+}
+
+func newSMTPCatcher(t *testing.T, tlsConfig *tls.Config, implicit bool) *smtpCatcher {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	catcher := &smtpCatcher{listener: listener, tls: tlsConfig, implicit: implicit}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go catcher.serve(conn)
+		}
+	}()
+	return catcher
+}
+
+func (c *smtpCatcher) config() Config {
+	host, port, _ := net.SplitHostPort(c.listener.Addr().String())
+	return Config{Host: host, Port: port, From: "FileVault <no-reply@filevault.local>", TLSMode: TLSModeNone}
+}
+
+func (c *smtpCatcher) caught() []caughtMail {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]caughtMail(nil), c.messages...)
+}
+
+func (c *smtpCatcher) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	secure := c.implicit
+	var current caughtMail
+
+	reply := func(format string, args ...any) { text.PrintfLine(format, args...) }
+	reply("220 catcher ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			extensions := []string{"catcher", "8BITMIME"}
+			if c.tls != nil && !secure {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if c.username != "" && secure {
+				extensions = append(extensions, "AUTH PLAIN")
+			}
+			for i, ext := range extensions {
+				sep := "-"
+				if i == len(extensions)-1 {
+					sep = " "
+				}
+				reply("250%s%s", sep, ext)
+			}
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, c.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			decoded, err := base64.StdEncoding.DecodeString(initial)
+			parts := strings.Split(string(decoded), "\x00")
+			if !secure || mechanism != "PLAIN" || err != nil || len(parts) != 3 || parts[1] != c.username || parts[2] != c.password {
+				reply("535 authentication failed")
+				continue
+			}
+			current.AuthUser = parts[1]
+			reply("235 authenticated")
+		case "MAIL":
+			if c.username != "" && current.AuthUser == "" {
+				reply("530 authentication required")
+				continue
+			}
+			current.From = addressArg(arg, "FROM:")
+			current.TLS = secure
+			reply("250 ok")
+		case "RCPT":
+			current.To = append(current.To, addressArg(arg, "TO:"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			current.Data = data
+			c.mu.Lock()
+			c.messages = append(c.messages, current)
+			c.mu.Unlock()
+			current = caughtMail{AuthUser: current.AuthUser}
+			reply("250 queued")
+		case "RSET", "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// addressArg returns the address of "FROM:<a@b> BODY=8BITMIME"
+func addressArg(arg, prefix string) string {
+	arg, _, _ = strings.Cut(strings.TrimPrefix(arg, prefix), " ")
+	return strings.Trim(arg, "<>")
+}
+
+// selfSignedTLS is a server certificate for 127.0.0.1 the mailer accepts with
+// InsecureSkipVerify
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "catcher"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+type verifyData struct {
+	Username  string
+	Link      string
+	ExpiresIn string
+}
+
+var testVerifyData = verifyData{
+	Username:  "ada",
+	Link:      "http://localhost:3000/verify-email?token=abc123",
+	ExpiresIn: "2 days",
+}
+
+// parsedMail is a caught message split into the parts of its multipart/alternative body
+type parsedMail struct {
+	Header mail.Header
+	Parts  map[string]string // body by media type
+}
+
+func parseMail(t *testing.T, data []byte) parsedMail {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("message does not parse: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", msg.Header.Get("Content-Type"))
+	}
+
+	parsed := parsedMail{Header: msg.Header, Parts: map[string]string{}}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("multipart body: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parsed.Parts[partType] = string(body)
+	}
+	return parsed
+}
+
+func TestSendDeliversToCatcher(t *testing.T) {
+	catcher := newSMTPCatcher(t, nil, false)
+	mailer, err := NewMailer(catcher.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mailer.Send("ada@example.com", TemplateVerifyEmail, testVerifyData); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	caught := catcher.caught()
+	if len(caught) != 1 {
+		t.Fatalf("catcher got %d messages, want 1", len(caught))
+	}
+	if caught[0].From != "no-reply@filevault.local" {
+		t.Errorf("MAIL FROM = %q, want the bare address", caught[0].From)
+	}
+	if len(caught[0].To) != 1 || caught[0].To[0] != "ada@example.com" {
+		t.Errorf("RCPT TO = %v", caught[0].To)
+	}
+
+	msg := parseMail(t, caught[0].Data)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Verify your FileVault email address" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+	if msg.Header.Get("To") != "ada@example.com" || msg.Header.Get("From") != "FileVault <no-reply@filevault.local>" {
+		t.Errorf("From %q To %q", msg.Header.Get("From"), msg.Header.Get("To"))
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date header: %v", err)
+	}
+	for _, mediaType := range []string{"text/plain", "text/html"} {
+		body, ok := msg.Parts[mediaType]
+		if !ok {
+			t.Errorf("no %s part", mediaType)
+			continue
+		}
+		if !strings.Contains(body, testVerifyData.Link) || !strings.Contains(body, "ada") {
+			t.Errorf("%s part misses the link or the name:\n%s", mediaType, body)
+		}
+	}
+}
+
+func TestSendEscapesHTMLPart(t *testing.T) {
+	catcher := newSMTPCatcher(t, nil, false)
+	mailer, err := NewMailer(catcher.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testVerifyData
+	data.Username = "<script>alert(1)</script>"
+	if err := mailer.Send("ada@example.com", TemplateVerifyEmail, data); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg := parseMail(t, catcher.caught()[0].Data)
+	if strings.Contains(msg.Parts["text/html"], "<script>") {
+		t.Errorf("user input is not escaped in the html part:\n%s", msg.Parts["text/html"])
+	}
+}
+
+func TestSendStartTLSWithAuth(t *testing.T) {
+	catcher := newSMTPCatcher(t, selfSignedTLS(t), false)
+	catcher.username, catcher.password = "vault", "s3cret"
+	config := catcher.config()
+	config.TLSMode = TLSModeStartTLS
+	config.InsecureSkipVerify = true
+	config.Username, config.Password = "vault", "s3cret"
+	mailer, err := NewMailer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mailer.Send("ada@example.com", TemplatePasswordReset, testVerifyData); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	caught := catcher.caught()
+	if len(caught) != 1 || !caught[0].TLS || caught[0].AuthUser != "vault" {
+		t.Fatalf("caught %+v, want one message sent over TLS after authenticating", caught)
+	}
+}
+
+func TestSendRejectedCredentials(t *testing.T) {
+	catcher := newSMTPCatcher(t, selfSignedTLS(t), false)
+	catcher.username, catcher.password = "vault", "s3cret"
+	config := catcher.config()
+	config.TLSMode = TLSModeStartTLS
+	config.InsecureSkipVerify = true
+	config.Username, config.Password = "vault", "wrong"
+	mailer, err := NewMailer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mailer.Send("ada@example.com", TemplateVerifyEmail, testVerifyData)
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed::SMTP authentication") {
+		t.Errorf("Send = %v, want an authentication error", err)
+	}
+	if len(catcher.caught()) != 0 {
+		t.Errorf("message was accepted without authentication")
+	}
+}
+
+func TestSendImplicitTLS(t *testing.T) {
+	catcher := newSMTPCatcher(t, selfSignedTLS(t), true)
+	config := catcher.config()
+	config.TLSMode = TLSModeTLS
+	config.InsecureSkipVerify = true
+	mailer, err := NewMailer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mailer.Send("ada@example.com", TemplateVerifyEmail, testVerifyData); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if caught := catcher.caught(); len(caught) != 1 || !caught[0].TLS {
+		t.Fatalf("caught %+v, want one message over TLS", caught)
+	}
+}
+
+func TestSendVerifiesCertificate(t *testing.T) {
+	catcher := newSMTPCatcher(t, selfSignedTLS(t), true)
+	config := catcher.config()
+	config.TLSMode = TLSModeTLS
+	mailer, err := NewMailer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mailer.Send("ada@example.com", TemplateVerifyEmail, testVerifyData); err == nil {
+		t.Errorf("Send accepted a self-signed certificate without InsecureSkipVerify")
+	}
+}
+
+func TestSendWithoutHostOnlyRenders(t *testing.T) {
+	mailer, err := NewMailer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mailer.Enabled() {
+		t.Fatal("mailer without a host is enabled")
+	}
+	if err := mailer.Send("ada@example.com", TemplateVerifyEmail, testVerifyData); err != nil {
+		t.Errorf("Send = %v, want nil", err)
+	}
+	if err := mailer.Send("ada@example.com", "missing", testVerifyData); err == nil {
+		t.Errorf("Send of an unknown template succeeded")
+	}
+}
+
+func TestEnvelopeAddress(t *testing.T) {
+	tests := map[string]string{
+		"FileVault <no-reply@filevault.local>": "no-reply@filevault.local",
+		"no-reply@filevault.local":             "no-reply@filevault.local",
+		"  vault@example.com ":                 "vault@example.com",
+		`"Vault <team>" <vault@example.com>`:   "vault@example.com",
+	}
+	for from, want := range tests {
+		if got := envelopeAddress(from); got != want {
+			t.Errorf("envelopeAddress(%q) = %q, want %q", from, got, want)
+		}
+	}
+}
+
+// TestSendToMailHog delivers through a running MailHog, e.g.
+// MAILHOG_URL=http://localhost:8025 with SMTP on localhost:1025, and finds the message
+// through its API
+func TestSendToMailHog(t *testing.T) {
+	apiURL := os.Getenv("MAILHOG_URL")
+	if apiURL == "" {
+		t.Skip("MAILHOG_URL is not set")
+	}
+	smtpAddr := os.Getenv("MAILHOG_SMTP_ADDR")
+	if smtpAddr == "" {
+		smtpAddr = "localhost:1025"
+	}
+	host, port, err := net.SplitHostPort(smtpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := NewMailer(Config{Host: host, Port: port, From: "FileVault <no-reply@filevault.local>", TLSMode: TLSModeNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := fmt.Sprintf("mailer-test-%d@example.com", time.Now().UnixNano())
+	if err := mailer.Send(to, TemplateVerifyEmail, testVerifyData); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	resp, err := http.Get(apiURL + "/api/v2/search?kind=to&query=" + url.QueryEscape(to))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var found struct {
+		Total int `json:"total"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		t.Fatal(err)
+	}
+	if found.Total != 1 {
+		t.Errorf("MailHog has %d messages to %s, want 1", found.Total, to)
+	}
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// GraphQL is a gqlgen extension recording queries and mutations per root field. The
+// operation name is chosen by the client and would make an unbounded label, the root field
+// is checked against the schema before the operation runs. Subscriptions respond once per
+// event and are not recorded.
+type GraphQL struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.ResponseInterceptor
+} = GraphQL{}
+
+func (GraphQL) ExtensionName() string {
+	return "Metrics"
+}
+
+func (GraphQL) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (GraphQL) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	if !graphql.HasOperationContext(ctx) {
+		return next(ctx)
+	}
+	oc := graphql.GetOperationContext(ctx)
+	if oc.Operation != nil && oc.Operation.Operation == ast.Subscription {
+		return next(ctx)
+	}
+
+	started := oc.Stats.OperationStart
+	if started.IsZero() {
+		started = time.Now()
+	}
+	resp := next(ctx)
+
+	operation, kind := rootField(oc.Operation), "unknown"
+	if oc.Operation != nil {
+		kind = string(oc.Operation.Operation)
+	}
+	outcome := "success"
+	if resp == nil || len(resp.Errors) > 0 {
+		outcome = "error"
+	}
+	GraphQLOperations.WithLabelValues(operation, kind, outcome).Inc()
+	GraphQLDuration.WithLabelValues(operation, kind).Observe(time.Since(started).Seconds())
+	return resp
+}
+
+// rootField names an operation after its first top-level field. Operations starting with a
+// fragment are grouped together, fragment names are chosen by the client too.
+func rootField(op *ast.OperationDefinition) string {
+	if op == nil || len(op.SelectionSet) == 0 {
+		return "unknown"
+	}
+	if field, ok := op.SelectionSet[0].(*ast.Field); ok {
+		return field.Name
+	}
+	return "fragment"
+}
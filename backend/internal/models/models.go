@@ -9,8 +9,46 @@ import (
 type UserRole string
 
 const (
-	UserRoleUser  UserRole = "USER"
-	UserRoleAdmin UserRole = "ADMIN"
+	UserRoleUser         UserRole = "USER"
+	UserRoleAdmin        UserRole = "ADMIN"
+	UserRoleAuditor      UserRole = "AUDITOR"
+	UserRoleSupport      UserRole = "SUPPORT"
+	UserRoleStorageAdmin UserRole = "STORAGE_ADMIN"
+)
+
+type Permission string
+
+const (
+	PermissionFilesRead          Permission = "files:read"
+	PermissionFilesWrite         Permission = "files:write"
+	PermissionFilesShare         Permission = "files:share"
+	PermissionUsersSearch        Permission = "users:search"
+	PermissionUsersRead          Permission = "users:read"
+	PermissionUsersUnlock        Permission = "users:unlock"
+	PermissionUsersImpersonate   Permission = "users:impersonate"
+	PermissionUsersManage        Permission = "users:manage"
+	PermissionFilesReadAll       Permission = "files:read_all"
+	PermissionFilesDeleteAll     Permission = "files:delete_all"
+	PermissionAuditRead          Permission = "audit:read"
+	PermissionStorageRead        Permission = "storage:read"
+	PermissionStorageManageQuota Permission = "storage:manage_quota"
+	PermissionStorageGC          Permission = "storage:gc"
+	PermissionSettingsManage     Permission = "settings:manage"
+	PermissionRolesManage        Permission = "roles:manage"
+	PermissionGroupsManage       Permission = "groups:manage"
+	PermissionOrgsManage         Permission = "orgs:manage"
+	PermissionOrgsCreate         Permission = "orgs:create"
+	PermissionWebhooksManage     Permission = "webhooks:manage"
+	PermissionJobsManage         Permission = "jobs:manage"
+	PermissionSystemStatus       Permission = "system:status"
+)
+
+type OrgRole string
+
+const (
+	OrgRoleOwner  OrgRole = "OWNER"
+	OrgRoleAdmin  OrgRole = "ADMIN"
+	OrgRoleMember OrgRole = "MEMBER"
 )
 
 type ShareType string
@@ -19,6 +57,7 @@ const (
 	ShareTypePublic       ShareType = "PUBLIC"
 	ShareTypePrivate      ShareType = "PRIVATE"
 	ShareTypeUserSpecific ShareType = "USER_SPECIFIC"
+	ShareTypeGroup        ShareType = "GROUP"
 )
 
 type SharePeriod string
@@ -28,6 +67,32 @@ const (
 	SharePeriodTemporary SharePeriod = "TEMPORARY"
 )
 
+type FileEventType string
+
+const (
+	FileEventUploaded             FileEventType = "UPLOADED"
+	FileEventDeleted              FileEventType = "DELETED"
+	FileEventShared               FileEventType = "SHARED"
+	FileEventDownloadCountUpdated FileEventType = "DOWNLOAD_COUNT_UPDATED"
+)
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "PENDING"
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "SUCCEEDED"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "FAILED"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "QUEUED"
+	JobStatusRunning   JobStatus = "RUNNING"
+	JobStatusSucceeded JobStatus = "SUCCEEDED"
+	JobStatusDead      JobStatus = "DEAD"
+)
+
 type AuditAction string
 
 const (
@@ -37,17 +102,63 @@ const (
 	AuditActionShare    AuditAction = "SHARE"
 	AuditActionUnshare  AuditAction = "UNSHARE"
 	AuditActionRegister AuditAction = "REGISTER"
+
+	AuditActionTwoFactorEnabled  AuditAction = "TWO_FACTOR_ENABLED"
+	AuditActionTwoFactorDisabled AuditAction = "TWO_FACTOR_DISABLED"
+
+	AuditActionLogin           AuditAction = "LOGIN"
+	AuditActionLoginFailed     AuditAction = "LOGIN_FAILED"
+	AuditActionAccountUnlocked AuditAction = "ACCOUNT_UNLOCKED"
+
+	AuditActionImpersonationStarted AuditAction = "IMPERSONATION_STARTED"
+	AuditActionImpersonationEnded   AuditAction = "IMPERSONATION_ENDED"
+
+	AuditActionFileUpdated              AuditAction = "FILE_UPDATED"
+	AuditActionFolderCreated            AuditAction = "FOLDER_CREATED"
+	AuditActionFolderShared             AuditAction = "FOLDER_SHARED"
+	AuditActionFolderUnshared           AuditAction = "FOLDER_UNSHARED"
+	AuditActionEmailVerified            AuditAction = "EMAIL_VERIFIED"
+	AuditActionPasswordReset            AuditAction = "PASSWORD_RESET"
+	AuditActionRecoveryCodesRegenerated AuditAction = "RECOVERY_CODES_REGENERATED"
+	AuditActionSettingChanged           AuditAction = "SETTING_CHANGED"
+	AuditActionUserSuspended            AuditAction = "USER_SUSPENDED"
+	AuditActionUserReactivated          AuditAction = "USER_REACTIVATED"
+	AuditActionUserRoleChanged          AuditAction = "USER_ROLE_CHANGED"
+	AuditActionUserQuotaChanged         AuditAction = "USER_QUOTA_CHANGED"
+	AuditActionUserDeleted              AuditAction = "USER_DELETED"
+	AuditActionRolePermissionsChanged   AuditAction = "ROLE_PERMISSIONS_CHANGED"
+	AuditActionGroupCreated             AuditAction = "GROUP_CREATED"
+	AuditActionGroupDeleted             AuditAction = "GROUP_DELETED"
+	AuditActionGroupMemberAdded         AuditAction = "GROUP_MEMBER_ADDED"
+	AuditActionGroupMemberRemoved       AuditAction = "GROUP_MEMBER_REMOVED"
+	AuditActionOrgCreated               AuditAction = "ORG_CREATED"
+	AuditActionOrgMemberAdded           AuditAction = "ORG_MEMBER_ADDED"
+	AuditActionOrgMemberRemoved         AuditAction = "ORG_MEMBER_REMOVED"
+	AuditActionOrgSettingsChanged       AuditAction = "ORG_SETTINGS_CHANGED"
+	AuditActionOrgQuotaChanged          AuditAction = "ORG_QUOTA_CHANGED"
+	AuditActionWebhookCreated           AuditAction = "WEBHOOK_CREATED"
+	AuditActionWebhookUpdated           AuditAction = "WEBHOOK_UPDATED"
+	AuditActionWebhookDeleted           AuditAction = "WEBHOOK_DELETED"
 )
 
 type User struct {
-	ID           uuid.UUID `json:"id" db:"id"`
-	Username     string    `json:"username" db:"username"`
-	Email        string    `json:"email" db:"email"`
-	PasswordHash string    `json:"-" db:"password_hash"`
-	Role         UserRole  `json:"role" db:"role"`
-	StorageQuota int64     `json:"storage_quota" db:"storage_quota"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	ID               uuid.UUID `json:"id" db:"id"`
+	Username         string    `json:"username" db:"username"`
+	Email            string    `json:"email" db:"email"`
+	EmailVerified    bool      `json:"email_verified" db:"email_verified"`
+	PasswordHash     string    `json:"-" db:"password_hash"`
+	Role             UserRole  `json:"role" db:"role"`
+	StorageQuota     int64     `json:"storage_quota" db:"storage_quota"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled" db:"totp_enabled"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
+
+	SuspendedAt     *time.Time `json:"suspended_at,omitempty" db:"suspended_at"`
+	SuspendedReason *string    `json:"suspended_reason,omitempty" db:"suspended_reason"`
+}
+
+func (u *User) Suspended() bool {
+	return u.SuspendedAt != nil
 }
 
 type FileContent struct {
@@ -81,6 +192,7 @@ type UserFile struct {
 type Folder struct {
 	ID             uuid.UUID  `json:"id" db:"id"`
 	UserID         uuid.UUID  `json:"user_id" db:"user_id"`
+	OrgID          uuid.UUID  `json:"org_id" db:"org_id"`
 	Name           string     `json:"name" db:"name"`
 	ParentFolderID *uuid.UUID `json:"parent_folder_id,omitempty" db:"parent_folder_id"`
 	IsPublic       bool       `json:"is_public" db:"is_public"`
@@ -94,16 +206,77 @@ type Folder struct {
 }
 
 type FileShare struct {
-	ID               uuid.UUID   `json:"id" db:"id"`
-	FileID           uuid.UUID   `json:"file_id" db:"file_id"`
-	SharedWithUserID *uuid.UUID  `json:"shared_with_user_id,omitempty" db:"shared_with_user_id"`
-	ShareType        ShareType   `json:"share_type" db:"share_type"`
-	SharePeriod      SharePeriod `json:"share_period" db:"share_period"`
-	CreatedAt        time.Time   `json:"created_at" db:"created_at"`
-	UpdatedAt        time.Time   `json:"updated_at" db:"updated_at"`
+	ID                uuid.UUID   `json:"id" db:"id"`
+	FileID            uuid.UUID   `json:"file_id" db:"file_id"`
+	SharedWithUserID  *uuid.UUID  `json:"shared_with_user_id,omitempty" db:"shared_with_user_id"`
+	SharedWithGroupID *uuid.UUID  `json:"shared_with_group_id,omitempty" db:"shared_with_group_id"`
+	ShareType         ShareType   `json:"share_type" db:"share_type"`
+	SharePeriod       SharePeriod `json:"share_period" db:"share_period"`
+	CreatedAt         time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time   `json:"updated_at" db:"updated_at"`
+
+	File            *UserFile `json:"file,omitempty"`
+	SharedWithUser  *User     `json:"shared_with_user,omitempty"`
+	SharedWithGroup *Group    `json:"shared_with_group,omitempty"`
+}
+
+// Group is a list of users files and folders can be shared with. Groups without an
+// owner are managed by admins.
+type Group struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	Name        string     `json:"name" db:"name"`
+	Description string     `json:"description" db:"description"`
+	OrgID       uuid.UUID  `json:"org_id" db:"org_id"`
+	OwnerID     *uuid.UUID `json:"owner_id,omitempty" db:"owner_id"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+
+	Owner   *User   `json:"owner,omitempty"`
+	Members []*User `json:"members,omitempty"`
+}
+
+func (g *Group) AdminManaged() bool {
+	return g.OwnerID == nil
+}
+
+// Organization is the tenant boundary for files, folders, groups, quotas and audit logs
+type Organization struct {
+	ID           uuid.UUID `json:"id" db:"id"`
+	Name         string    `json:"name" db:"name"`
+	Slug         string    `json:"slug" db:"slug"`
+	StorageQuota *int64    `json:"storage_quota,omitempty" db:"storage_quota"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+
+	// Role of the requesting user, nil when they are not a member
+	Role     *OrgRole               `json:"role,omitempty"`
+	Settings []*OrganizationSetting `json:"settings,omitempty"`
+}
+
+type OrganizationMember struct {
+	OrgID    uuid.UUID `json:"org_id" db:"org_id"`
+	UserID   uuid.UUID `json:"user_id" db:"user_id"`
+	Role     OrgRole   `json:"role" db:"role"`
+	JoinedAt time.Time `json:"joined_at" db:"joined_at"`
+
+	User *User `json:"user,omitempty"`
+}
 
-	File           *UserFile `json:"file,omitempty"`
-	SharedWithUser *User     `json:"shared_with_user,omitempty"`
+type OrganizationSetting struct {
+	Key   string `json:"key" db:"key"`
+	Value string `json:"value" db:"value"`
+}
+
+type FolderShare struct {
+	ID                uuid.UUID  `json:"id" db:"id"`
+	FolderID          uuid.UUID  `json:"folder_id" db:"folder_id"`
+	SharedWithUserID  *uuid.UUID `json:"shared_with_user_id,omitempty" db:"shared_with_user_id"`
+	SharedWithGroupID *uuid.UUID `json:"shared_with_group_id,omitempty" db:"shared_with_group_id"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+
+	Folder          *Folder `json:"folder,omitempty"`
+	SharedWithUser  *User   `json:"shared_with_user,omitempty"`
+	SharedWithGroup *Group  `json:"shared_with_group,omitempty"`
 }
 
 type AuditLog struct {
@@ -114,9 +287,159 @@ type AuditLog struct {
 	IPAddress string      `json:"ip_address" db:"ip_address"`
 	UserAgent string      `json:"user_agent" db:"user_agent"`
 	CreatedAt time.Time   `json:"created_at" db:"created_at"`
+	// ActorID is the staff member who acted as UserID during an impersonation
+	ActorID         *uuid.UUID `json:"actor_id,omitempty" db:"actor_id"`
+	ImpersonationID *uuid.UUID `json:"impersonation_id,omitempty" db:"impersonation_id"`
+	OrgID           *uuid.UUID `json:"org_id,omitempty" db:"org_id"`
+	// Details is a JSON object, usually with the state before and after the change
+	Details *string `json:"details,omitempty" db:"details"`
+	// RequestID is the ID of the request that wrote the entry, also found in the server logs
+	RequestID *string `json:"request_id,omitempty" db:"request_id"`
+	// Username, ActorUsername and Filename are the names at the time of the entry, they
+	// stay when the user or file is deleted
+	Username      *string `json:"username,omitempty" db:"username"`
+	ActorUsername *string `json:"actor_username,omitempty" db:"actor_username"`
+	Filename      *string `json:"filename,omitempty" db:"filename"`
+
+	User  *User     `json:"user,omitempty"`
+	Actor *User     `json:"actor,omitempty"`
+	File  *UserFile `json:"file,omitempty"`
+}
+
+// AuditChainVerification is the result of checking one audit log hash chain
+type AuditChainVerification struct {
+	ChainID            string           `json:"chain_id"`
+	Valid              bool             `json:"valid"`
+	EntriesChecked     int              `json:"entries_checked"`
+	EntriesArchived    int              `json:"entries_archived"`
+	CheckpointsChecked int              `json:"checkpoints_checked"`
+	FirstBroken        *AuditChainBreak `json:"first_broken,omitempty"`
+}
+
+// AuditChainBreak is the first position at which a chain fails verification. EntryID is
+// nil when the entry itself is missing.
+type AuditChainBreak struct {
+	ChainSeq int        `json:"chain_seq"`
+	EntryID  *uuid.UUID `json:"entry_id,omitempty"`
+	Reason   string     `json:"reason"`
+}
+
+// ImpersonationSession is a time-boxed period in which ActorID acts as TargetID
+type ImpersonationSession struct {
+	ID        uuid.UUID  `json:"id" db:"id"`
+	ActorID   uuid.UUID  `json:"actor_id" db:"actor_id"`
+	TargetID  uuid.UUID  `json:"target_id" db:"target_id"`
+	Reason    string     `json:"reason" db:"reason"`
+	StartedAt time.Time  `json:"started_at" db:"started_at"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty" db:"ended_at"`
+
+	Actor  *User `json:"actor,omitempty"`
+	Target *User `json:"target,omitempty"`
+}
+
+func (s *ImpersonationSession) Active() bool {
+	return s.EndedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// FileEvent is published when a file changes. Only the IDs go over the event bus, each
+// subscriber loads File itself.
+type FileEvent struct {
+	Type    FileEventType `json:"type"`
+	FileID  uuid.UUID     `json:"file_id"`
+	OwnerID uuid.UUID     `json:"owner_id"`
+	File    *UserFile     `json:"-"`
+}
+
+// Webhook posts file events of an organization to URL. UserID is set for a user's own
+// webhook, which only sees that user's files.
+type Webhook struct {
+	ID                  uuid.UUID       `json:"id" db:"id"`
+	OrgID               uuid.UUID       `json:"org_id" db:"org_id"`
+	UserID              *uuid.UUID      `json:"user_id,omitempty" db:"user_id"`
+	URL                 string          `json:"url" db:"url"`
+	Events              []FileEventType `json:"events" db:"events"`
+	FolderID            *uuid.UUID      `json:"folder_id,omitempty" db:"folder_id"`
+	Secret              string          `json:"-" db:"secret"`
+	Enabled             bool            `json:"enabled" db:"enabled"`
+	ConsecutiveFailures int             `json:"consecutive_failures" db:"consecutive_failures"`
+	DisabledReason      *string         `json:"disabled_reason,omitempty" db:"disabled_reason"`
+	CreatedBy           *uuid.UUID      `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt           time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt           time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+type WebhookDelivery struct {
+	ID             uuid.UUID             `json:"id" db:"id"`
+	WebhookID      uuid.UUID             `json:"webhook_id" db:"webhook_id"`
+	EventType      FileEventType         `json:"event_type" db:"event_type"`
+	Payload        string                `json:"payload" db:"payload"`
+	Status         WebhookDeliveryStatus `json:"status" db:"status"`
+	Attempts       int                   `json:"attempts" db:"attempts"`
+	NextAttemptAt  *time.Time            `json:"next_attempt_at,omitempty" db:"next_attempt_at"`
+	LastStatusCode *int                  `json:"last_status_code,omitempty" db:"last_status_code"`
+	LastError      *string               `json:"last_error,omitempty" db:"last_error"`
+	ReplayOf       *uuid.UUID            `json:"replay_of,omitempty" db:"replay_of"`
+	CreatedAt      time.Time             `json:"created_at" db:"created_at"`
+	DeliveredAt    *time.Time            `json:"delivered_at,omitempty" db:"delivered_at"`
+}
+
+// Job is background work in the job queue
+type Job struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	Kind        string     `json:"kind" db:"kind"`
+	Payload     string     `json:"payload" db:"payload"`
+	Status      JobStatus  `json:"status" db:"status"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	MaxAttempts int        `json:"max_attempts" db:"max_attempts"`
+	RunAt       time.Time  `json:"run_at" db:"run_at"`
+	LockedBy    *string    `json:"locked_by,omitempty" db:"locked_by"`
+	LastError   *string    `json:"last_error,omitempty" db:"last_error"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty" db:"finished_at"`
+}
+
+type ScheduledTaskTrigger string
+
+const (
+	ScheduledTaskTriggerSchedule ScheduledTaskTrigger = "SCHEDULE"
+	ScheduledTaskTriggerManual   ScheduledTaskTrigger = "MANUAL"
+)
+
+type ScheduledTaskRunStatus string
+
+const (
+	ScheduledTaskRunRunning   ScheduledTaskRunStatus = "RUNNING"
+	ScheduledTaskRunSucceeded ScheduledTaskRunStatus = "SUCCEEDED"
+	ScheduledTaskRunFailed    ScheduledTaskRunStatus = "FAILED"
+)
+
+// ScheduledTask is periodic maintenance run by the scheduler
+type ScheduledTask struct {
+	Name      string            `json:"name" db:"name"`
+	Schedule  string            `json:"schedule" db:"schedule"`
+	NextRunAt time.Time         `json:"next_run_at" db:"next_run_at"`
+	LastRunAt *time.Time        `json:"last_run_at,omitempty" db:"last_run_at"`
+	LastRun   *ScheduledTaskRun `json:"last_run,omitempty"`
+}
+
+type ScheduledTaskRun struct {
+	ID          uuid.UUID              `json:"id" db:"id"`
+	TaskName    string                 `json:"task_name" db:"task_name"`
+	Trigger     ScheduledTaskTrigger   `json:"trigger" db:"trigger"`
+	TriggeredBy *uuid.UUID             `json:"triggered_by,omitempty" db:"triggered_by"`
+	Instance    string                 `json:"instance" db:"instance"`
+	Status      ScheduledTaskRunStatus `json:"status" db:"status"`
+	Error       *string                `json:"error,omitempty" db:"error"`
+	StartedAt   time.Time              `json:"started_at" db:"started_at"`
+	FinishedAt  *time.Time             `json:"finished_at,omitempty" db:"finished_at"`
+}
 
-	User *User     `json:"user,omitempty"`
-	File *UserFile `json:"file,omitempty"`
+type JobCount struct {
+	Kind   string    `json:"kind"`
+	Status JobStatus `json:"status"`
+	Count  int       `json:"count"`
 }
 
 type StorageStats struct {
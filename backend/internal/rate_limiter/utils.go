@@ -1,18 +0,0 @@
-package rate_limiter
-
-import (
-	"net"
-	"net/http"
-	"strings"
-)
-
-func getClientIP(r *http.Request) string {
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		return strings.Split(ip, ",")[0]
-	}
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
-	}
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
-}
\ No newline at end of file
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+type AccountTokenPurpose string
+
+const (
+	AccountTokenEmailVerification AccountTokenPurpose = "EMAIL_VERIFICATION"
+	AccountTokenPasswordReset     AccountTokenPurpose = "PASSWORD_RESET"
+)
+
+var ErrInvalidAccountToken = errors.New("token is invalid, expired or already used")
+
+// AccountTokenService issues and redeems the single-use tokens sent in verification and reset mails
+type AccountTokenService struct {
+	db *sql.DB
+}
+
+func NewAccountTokenService(db *sql.DB) *AccountTokenService {
+	return &AccountTokenService{db: db}
+}
+
+// Issue creates a new token and invalidates any earlier unused token with the same purpose.
+// The plaintext token is returned once and only its hash is stored.
+func (ats *AccountTokenService) Issue(userID string, purpose AccountTokenPurpose, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	tx, err := ats.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE account_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`, userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO account_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, purpose, hashAccountToken(token), time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// Consume marks the token as used inside tx and returns the user it belongs to,
+// so the caller can apply the change the token authorizes in the same transaction.
+func (ats *AccountTokenService) Consume(tx *sql.Tx, token string, purpose AccountTokenPurpose) (string, error) {
+	var userID string
+	err := tx.QueryRow(`
+		UPDATE account_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashAccountToken(token), purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidAccountToken
+	}
+	return userID, err
+}
+
+func hashAccountToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
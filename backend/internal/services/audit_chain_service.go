@@ -0,0 +1,362 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PlatformAuditChain is the chain of audit entries that belong to no organization
+const PlatformAuditChain = "platform"
+
+const genesisAuditHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+var ErrCheckpointsDisabled = errors.New("audit checkpoints are disabled, no signing key is configured")
+
+// AuditChainService signs checkpoints of the audit log hash chains and verifies them. The
+// chains themselves are written by the audit_log_chain trigger.
+type AuditChainService struct {
+	db     *sql.DB
+	signer crypto.Signer
+	keyID  string
+	keys   map[string]crypto.PublicKey
+}
+
+// NewAuditChainService signs checkpoints with signer and accepts checkpoints of signer and
+// verificationKeys. Without a signer no checkpoints are written, chains are still verified.
+func NewAuditChainService(db *sql.DB, signer crypto.Signer, verificationKeys ...crypto.PublicKey) (*AuditChainService, error) {
+	acs := &AuditChainService{db: db, signer: signer, keys: map[string]crypto.PublicKey{}}
+	if signer != nil {
+		verificationKeys = append(verificationKeys, signer.Public())
+	}
+	for _, public := range verificationKeys {
+		kid, err := auth.KeyID(public)
+		if err != nil {
+			return nil, err
+		}
+		acs.keys[kid] = public
+	}
+	if signer != nil {
+		acs.keyID, _ = auth.KeyID(signer.Public())
+	}
+	return acs, nil
+}
+
+// Checkpoint signs the head of every chain that grew since its last checkpoint
+func (acs *AuditChainService) Checkpoint() error {
+	if acs.signer == nil {
+		return ErrCheckpointsDisabled
+	}
+
+	query := `
+		SELECT DISTINCT ON (al.chain_id) al.chain_id, al.chain_seq, al.entry_hash
+		FROM audit_logs al
+		WHERE NOT EXISTS (
+			SELECT 1 FROM audit_checkpoints c WHERE c.chain_id = al.chain_id AND c.chain_seq >= al.chain_seq
+		)
+		ORDER BY al.chain_id, al.chain_seq DESC
+	`
+	rows, err := acs.db.Query(query)
+	if err != nil {
+		return err
+	}
+	type head struct {
+		chain string
+		seq   int64
+		hash  string
+	}
+	var heads []head
+	for rows.Next() {
+		var h head
+		if err := rows.Scan(&h.chain, &h.seq, &h.hash); err != nil {
+			rows.Close()
+			return err
+		}
+		heads = append(heads, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range heads {
+		signature, err := acs.sign(checkpointMessage(h.chain, h.seq, h.hash))
+		if err != nil {
+			return fmt.Errorf("failed to sign checkpoint: %w", err)
+		}
+		_, err = acs.db.Exec(`
+			INSERT INTO audit_checkpoints (chain_id, chain_seq, entry_hash, key_id, signature)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (chain_id, chain_seq) DO NOTHING
+		`, h.chain, h.seq, h.hash, acs.keyID, signature)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chains returns the IDs of every chain, the platform chain first
+func (acs *AuditChainService) Chains() ([]string, error) {
+	rows, err := acs.db.Query(`SELECT DISTINCT chain_id FROM audit_logs ORDER BY chain_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chains := []string{}
+	platform := false
+	for rows.Next() {
+		var chain string
+		if err := rows.Scan(&chain); err != nil {
+			return nil, err
+		}
+		if chain == PlatformAuditChain {
+			platform = true
+			continue
+		}
+		chains = append(chains, chain)
+	}
+	if platform {
+		chains = append([]string{PlatformAuditChain}, chains...)
+	}
+	return chains, rows.Err()
+}
+
+// Verify walks a chain from its first entry and reports the first entry whose content, link
+// or checkpoint doesn't hold. Of entries pruned by retention only the tombstone is left, its
+// hashes are checked to link up but the content is in the archive.
+func (acs *AuditChainService) Verify(chainID string) (*models.AuditChainVerification, error) {
+	report := &models.AuditChainVerification{ChainID: chainID, Valid: true}
+	checkpoints, err := acs.loadCheckpoints(chainID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, chain_seq, user_id, action::text, file_id, host(ip_address), user_agent, created_at,
+			org_id, actor_id, impersonation_id, details::text, prev_hash, entry_hash, false
+		FROM audit_logs
+		WHERE chain_id = $1
+		UNION ALL
+		SELECT entry_id, chain_seq, NULL, NULL, NULL, NULL, NULL, NULL,
+			NULL, NULL, NULL, NULL, prev_hash, entry_hash, true
+		FROM audit_log_tombstones
+		WHERE chain_id = $1
+		ORDER BY 2
+	`
+	rows, err := acs.db.Query(query, chainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fail := func(seq int64, entryID *uuid.UUID, reason string) {
+		report.Valid = false
+		report.FirstBroken = &models.AuditChainBreak{ChainSeq: int(seq), EntryID: entryID, Reason: reason}
+	}
+
+	var lastSeq int64
+	var lastHash string
+	for rows.Next() {
+		var entry auditChainEntry
+		var userID uuid.NullUUID
+		var action, ip, userAgent sql.NullString
+		var createdAt sql.NullTime
+		var archived bool
+		err := rows.Scan(&entry.id, &entry.seq, &userID, &action, &entry.fileID, &ip, &userAgent, &createdAt,
+			&entry.orgID, &entry.actorID, &entry.impersonationID, &entry.details, &entry.prevHash, &entry.entryHash, &archived)
+		if err != nil {
+			return nil, err
+		}
+		entry.userID, entry.action, entry.ip, entry.userAgent = userID.UUID, action.String, ip.String, userAgent.String
+		entry.createdAt = createdAt.Time
+		entryID := entry.id
+
+		switch {
+		case lastSeq == 0 && entry.seq != 1:
+			fail(1, nil, fmt.Sprintf("entries 1 to %d are missing", entry.seq-1))
+		case lastSeq == 0 && entry.prevHash != genesisAuditHash:
+			fail(entry.seq, &entryID, "first entry does not start the chain")
+		case lastSeq != 0 && entry.seq != lastSeq+1:
+			fail(lastSeq+1, nil, fmt.Sprintf("entries %d to %d are missing", lastSeq+1, entry.seq-1))
+		case lastSeq != 0 && entry.prevHash != lastHash:
+			fail(entry.seq, &entryID, "previous hash does not match the previous entry")
+		case !archived && entry.hash(chainID) != entry.entryHash:
+			fail(entry.seq, &entryID, "content does not match the entry hash")
+		}
+		if !report.Valid {
+			return report, nil
+		}
+
+		if checkpoint, found := checkpoints[entry.seq]; found {
+			report.CheckpointsChecked++
+			if reason := acs.checkCheckpoint(chainID, entry.seq, checkpoint, entry.entryHash); reason != "" {
+				fail(entry.seq, &entryID, reason)
+				return report, nil
+			}
+		}
+		lastSeq, lastHash = entry.seq, entry.entryHash
+		if archived {
+			report.EntriesArchived++
+		} else {
+			report.EntriesChecked++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// a checkpoint past the end means entries were cut off the chain
+	var lastCheckpoint int64
+	for seq := range checkpoints {
+		lastCheckpoint = max(lastCheckpoint, seq)
+	}
+	if lastCheckpoint > lastSeq {
+		fail(lastSeq+1, nil, fmt.Sprintf("entries %d to %d covered by a checkpoint are missing", lastSeq+1, lastCheckpoint))
+	}
+	return report, nil
+}
+
+type auditCheckpoint struct {
+	hash      string
+	keyID     string
+	signature string
+}
+
+func (acs *AuditChainService) loadCheckpoints(chainID string) (map[int64]auditCheckpoint, error) {
+	rows, err := acs.db.Query(`SELECT chain_seq, entry_hash, key_id, signature FROM audit_checkpoints WHERE chain_id = $1`, chainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := map[int64]auditCheckpoint{}
+	for rows.Next() {
+		var seq int64
+		var checkpoint auditCheckpoint
+		if err := rows.Scan(&seq, &checkpoint.hash, &checkpoint.keyID, &checkpoint.signature); err != nil {
+			return nil, err
+		}
+		checkpoints[seq] = checkpoint
+	}
+	return checkpoints, rows.Err()
+}
+
+// checkCheckpoint returns why checkpoint doesn't vouch for an entry with entryHash, or ""
+func (acs *AuditChainService) checkCheckpoint(chainID string, seq int64, checkpoint auditCheckpoint, entryHash string) string {
+	if checkpoint.hash != entryHash {
+		return "entry hash differs from its checkpoint"
+	}
+	public, found := acs.keys[checkpoint.keyID]
+	if !found {
+		return "checkpoint is signed with an unknown key"
+	}
+	signature, err := base64.StdEncoding.DecodeString(checkpoint.signature)
+	if err != nil {
+		return "checkpoint signature is invalid"
+	}
+
+	message := checkpointMessage(chainID, seq, checkpoint.hash)
+	valid := false
+	switch key := public.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, message, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return "checkpoint signature is invalid"
+	}
+	return ""
+}
+
+func (acs *AuditChainService) sign(message []byte) (string, error) {
+	var signature []byte
+	var err error
+	if _, ok := acs.signer.Public().(ed25519.PublicKey); ok {
+		signature, err = acs.signer.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		signature, err = acs.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func checkpointMessage(chainID string, seq int64, hash string) []byte {
+	return []byte("filevault-audit-checkpoint\n" + chainID + "\n" + strconv.FormatInt(seq, 10) + "\n" + hash)
+}
+
+// auditChainEntry holds the columns an entry hash covers
+type auditChainEntry struct {
+	id              uuid.UUID
+	seq             int64
+	userID          uuid.UUID
+	action          string
+	fileID          *uuid.UUID
+	ip              string
+	userAgent       string
+	createdAt       time.Time
+	orgID           *uuid.UUID
+	actorID         *uuid.UUID
+	impersonationID *uuid.UUID
+	details         *string
+	prevHash        string
+	entryHash       string
+}
+
+// hash rebuilds the entry hash the way audit_log_hash computes it, see audit_log_canonical
+// in migrations 016 and 017
+func (e *auditChainEntry) hash(chainID string) string {
+	var b strings.Builder
+	field := func(value string) {
+		b.WriteString(strconv.Itoa(len(value)))
+		b.WriteString(":")
+		b.WriteString(value)
+	}
+	optional := func(id *uuid.UUID) {
+		if id == nil {
+			b.WriteString("-")
+			return
+		}
+		field(id.String())
+	}
+
+	b.WriteString(e.prevHash)
+	field(e.id.String())
+	field(chainID)
+	field(strconv.FormatInt(e.seq, 10))
+	field(e.userID.String())
+	field(e.action)
+	optional(e.fileID)
+	field(e.ip)
+	field(e.userAgent)
+	field(e.createdAt.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	optional(e.orgID)
+	optional(e.actorID)
+	optional(e.impersonationID)
+	if e.details != nil {
+		field(*e.details)
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"file-vault/internal/models"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const auditArchiveBatchSize = 5000
+
+// AuditRetention is how long audit entries are kept before they are archived and pruned.
+// Actions without their own entry in Actions use Default. A zero duration keeps entries
+// forever.
+type AuditRetention struct {
+	Default     time.Duration
+	Actions     map[models.AuditAction]time.Duration
+	ArchivePath string
+}
+
+// auditArchiveEntry is one line of an archive file. It has every column the entry hash
+// covers, so archived entries can still be checked against their tombstones.
+type auditArchiveEntry struct {
+	ID              uuid.UUID       `json:"id"`
+	ChainID         string          `json:"chain_id"`
+	ChainSeq        int64           `json:"chain_seq"`
+	PrevHash        string          `json:"prev_hash"`
+	EntryHash       string          `json:"entry_hash"`
+	UserID          uuid.UUID       `json:"user_id"`
+	Username        *string         `json:"username,omitempty"`
+	Action          string          `json:"action"`
+	FileID          *uuid.UUID      `json:"file_id,omitempty"`
+	Filename        *string         `json:"filename,omitempty"`
+	IPAddress       string          `json:"ip_address"`
+	UserAgent       string          `json:"user_agent"`
+	CreatedAt       time.Time       `json:"created_at"`
+	OrgID           *uuid.UUID      `json:"org_id,omitempty"`
+	ActorID         *uuid.UUID      `json:"actor_id,omitempty"`
+	ActorUsername   *string         `json:"actor_username,omitempty"`
+	ImpersonationID *uuid.UUID      `json:"impersonation_id,omitempty"`
+	Details         json.RawMessage `json:"details,omitempty"`
+}
+
+// ArchiveExpired writes the entries past their retention to gzipped NDJSON files in the
+// archive path and prunes them. Each pruned entry leaves a tombstone with its hashes in the
+// chain. The newest entry of a chain is always kept, new entries link to it.
+func (as *AuditService) ArchiveExpired(retention AuditRetention) (int, error) {
+	expired, args := retention.expired(time.Now())
+	if expired == "" {
+		return 0, nil
+	}
+	if err := os.MkdirAll(retention.ArchivePath, 0o750); err != nil {
+		return 0, fmt.Errorf("failed to create audit archive directory: %w", err)
+	}
+
+	total := 0
+	for {
+		archived, err := as.archiveBatch(retention.ArchivePath, expired, args)
+		total += archived
+		if err != nil || archived < auditArchiveBatchSize {
+			return total, err
+		}
+	}
+}
+
+// expired returns the condition matching entries past their retention on audit_logs al
+func (r AuditRetention) expired(now time.Time) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	own := []string{}
+	for action, keep := range r.Actions {
+		own = append(own, string(action))
+		if keep <= 0 {
+			continue
+		}
+		args = append(args, string(action), now.Add(-keep))
+		conditions = append(conditions, fmt.Sprintf("(al.action::text = $%d AND al.created_at < $%d)", len(args)-1, len(args)))
+	}
+	if r.Default > 0 {
+		args = append(args, pq.Array(own), now.Add(-r.Default))
+		conditions = append(conditions, fmt.Sprintf("(NOT al.action::text = ANY($%d) AND al.created_at < $%d)", len(args)-1, len(args)))
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+func (as *AuditService) archiveBatch(dir, expired string, args []interface{}) (int, error) {
+	tx, err := as.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT al.id, al.chain_id, al.chain_seq, al.prev_hash, al.entry_hash, al.user_id, al.username, al.action,
+			al.file_id, al.filename, host(al.ip_address), al.user_agent, al.created_at, al.org_id, al.actor_id,
+			al.actor_username, al.impersonation_id, al.details::text
+		FROM audit_logs al
+		WHERE ` + expired + `
+		AND al.chain_seq < (SELECT MAX(head.chain_seq) FROM audit_logs head WHERE head.chain_id = al.chain_id)
+		ORDER BY al.created_at, al.id
+		LIMIT ` + fmt.Sprint(auditArchiveBatchSize) + `
+		FOR UPDATE OF al SKIP LOCKED
+	`
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	var entries []auditArchiveEntry
+	for rows.Next() {
+		var entry auditArchiveEntry
+		var details *string
+		err := rows.Scan(&entry.ID, &entry.ChainID, &entry.ChainSeq, &entry.PrevHash, &entry.EntryHash, &entry.UserID,
+			&entry.Username, &entry.Action, &entry.FileID, &entry.Filename, &entry.IPAddress, &entry.UserAgent,
+			&entry.CreatedAt, &entry.OrgID, &entry.ActorID, &entry.ActorUsername, &entry.ImpersonationID, &details)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if details != nil {
+			entry.Details = json.RawMessage(*details)
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	archiveID := uuid.New()
+	path := filepath.Join(dir, fmt.Sprintf("audit-%s-%s.ndjson.gz", time.Now().UTC().Format("20060102T150405Z"), archiveID))
+	checksum, err := writeAuditArchive(path, entries)
+	if err != nil {
+		return 0, err
+	}
+	// the file is only kept when the entries are actually pruned
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(path)
+		}
+	}()
+
+	_, err = tx.Exec(`
+		INSERT INTO audit_archives (id, path, sha256, entries, first_created_at, last_created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, archiveID, path, checksum, len(entries), entries[0].CreatedAt, entries[len(entries)-1].CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID.String()
+	}
+	_, err = tx.Exec(`
+		INSERT INTO audit_log_tombstones (chain_id, chain_seq, entry_id, prev_hash, entry_hash, archive_id)
+		SELECT chain_id, chain_seq, id, prev_hash, entry_hash, $1 FROM audit_logs WHERE id = ANY($2)
+	`, archiveID, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM audit_logs WHERE id = ANY($1)`, pq.Array(ids)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	committed = true
+	return len(entries), nil
+}
+
+// writeAuditArchive writes entries to path and returns the SHA-256 of the file
+func writeAuditArchive(path string, entries []auditArchiveEntry) (string, error) {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return "", fmt.Errorf("failed to create audit archive: %w", err)
+	}
+	defer os.Remove(temp)
+	defer file.Close()
+
+	hash := sha256.New()
+	compressed := gzip.NewWriter(io.MultiWriter(file, hash))
+	encoder := json.NewEncoder(compressed)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return "", fmt.Errorf("failed to write audit archive: %w", err)
+		}
+	}
+	if err := compressed.Close(); err != nil {
+		return "", fmt.Errorf("failed to write audit archive: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return "", fmt.Errorf("failed to write audit archive: %w", err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return "", fmt.Errorf("failed to write audit archive: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
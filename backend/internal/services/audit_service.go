@@ -0,0 +1,454 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/logging"
+	"file-vault/internal/models"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidAuditCursor = errors.New("invalid cursor")
+	ErrInvalidIPRange     = errors.New("invalid IP range")
+)
+
+// AuditFilter narrows audit log queries. Nil and empty fields don't filter. Entries are
+// limited to OrgID unless AllOrgs is set.
+type AuditFilter struct {
+	UserID  *uuid.UUID
+	ActorID *uuid.UUID
+	Actions []models.AuditAction
+	FileID  *uuid.UUID
+	// IPRange is a CIDR block or a single address
+	IPRange string
+	From    *time.Time
+	To      *time.Time
+
+	OrgID   uuid.UUID
+	AllOrgs bool
+}
+
+// AuditService is the only writer of the audit log. It also reads it for the admin views,
+// the activity page of users and compliance exports.
+type AuditService struct {
+	db *sql.DB
+}
+
+func NewAuditService(db *sql.DB) *AuditService {
+	return &AuditService{db: db}
+}
+
+// AuditEvent is an entry to record. UserID is the user acting, under impersonation the
+// impersonated one, and defaults to the user of the request. OrgID defaults to the file's
+// organization, else the organization of the request when the user belongs to it, else
+// the user's default organization.
+type AuditEvent struct {
+	UserID  string
+	Action  models.AuditAction
+	FileID  *uuid.UUID
+	OrgID   *uuid.UUID
+	Details AuditDetails
+}
+
+// AuditDetails are stored as a JSON object with the entry
+type AuditDetails map[string]interface{}
+
+// AuditChange is the details of a change from before to after
+func AuditChange(before, after interface{}) AuditDetails {
+	return AuditDetails{"before": before, "after": after}
+}
+
+// AuditExecutor is a *sql.DB or, to record an entry together with a change, a *sql.Tx
+type AuditExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Record writes event with the client, organization and impersonation of the request in
+// ctx. Entries about a change go through the transaction making it, so neither is kept
+// without the other.
+func (as *AuditService) Record(ctx context.Context, exec AuditExecutor, event AuditEvent) error {
+	if exec == nil {
+		exec = as.db
+	}
+	if event.UserID == "" {
+		event.UserID = auth.GetUserIDFromContext(ctx)
+	}
+	var details interface{}
+	if event.Details != nil {
+		encoded, err := json.Marshal(event.Details)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit details: %w", err)
+		}
+		details = string(encoded)
+	}
+
+	query := `
+		INSERT INTO audit_logs (user_id, action, file_id, ip_address, user_agent, org_id, actor_id, impersonation_id, details,
+			username, actor_username, filename, request_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, COALESCE(
+			$6::uuid,
+			(SELECT org_id FROM user_files WHERE id = $3),
+			(SELECT org_id FROM organization_members WHERE user_id = $1 AND org_id::text = $7),
+			(SELECT default_org_id FROM users WHERE id = $1)
+		), NULLIF($8, '')::uuid, NULLIF($9, '')::uuid, $10::jsonb,
+			(SELECT username FROM users WHERE id = $1),
+			(SELECT username FROM users WHERE id = NULLIF($8, '')::uuid),
+			(SELECT filename FROM user_files WHERE id = $3), NULLIF($11, ''), NOW())
+	`
+	client := auth.GetClientInfo(ctx)
+	_, err := exec.Exec(query, event.UserID, event.Action, event.FileID, client.IPAddress, client.UserAgent, event.OrgID,
+		auth.GetOrgIDFromContext(ctx), auth.GetActorIDFromContext(ctx), auth.GetImpersonationIDFromContext(ctx), details,
+		logging.RequestID(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to record %s audit entry: %w", event.Action, err)
+	}
+	return nil
+}
+
+// Page returns up to limit entries after cursor, newest first, with their user, actor and
+// file loaded. The returned cursor is empty on the last page.
+func (as *AuditService) Page(filter AuditFilter, cursor string, limit int) ([]*models.AuditLog, string, error) {
+	where, args, err := filter.where()
+	if err != nil {
+		return nil, "", err
+	}
+	if cursor != "" {
+		createdAt, id, err := decodeAuditCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, createdAt, id)
+		where = append(where, fmt.Sprintf("(al.created_at, al.id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	// one extra row tells whether another page follows
+	args = append(args, limit+1)
+	entries, err := as.list(where, fmt.Sprintf("LIMIT $%d", len(args)), args)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		next = encodeAuditCursor(last.CreatedAt, last.ID)
+	}
+	if err := as.loadRelations(entries); err != nil {
+		return nil, "", err
+	}
+	return entries, next, nil
+}
+
+// List is Page with offset pagination, kept for the existing admin views
+func (as *AuditService) List(filter AuditFilter, offset, limit int) ([]*models.AuditLog, error) {
+	where, args, err := filter.where()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, limit, offset)
+	entries, err := as.list(where, fmt.Sprintf("LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args)
+	if err != nil {
+		return nil, err
+	}
+	if err := as.loadRelations(entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Each streams every entry matching filter to fn, newest first, without holding them in
+// memory. User, actor and file only carry their ID and name.
+func (as *AuditService) Each(filter AuditFilter, fn func(*models.AuditLog) error) error {
+	where, args, err := filter.where()
+	if err != nil {
+		return err
+	}
+	query := `
+		SELECT al.id, al.user_id, al.action, al.file_id, host(al.ip_address), al.user_agent, al.created_at,
+			al.actor_id, al.impersonation_id, al.org_id, al.details::text, al.request_id,
+			COALESCE(u.username, al.username), COALESCE(a.username, al.actor_username), COALESCE(uf.filename, al.filename)
+		FROM audit_logs al
+		LEFT JOIN users u ON u.id = al.user_id
+		LEFT JOIN users a ON a.id = al.actor_id
+		LEFT JOIN user_files uf ON uf.id = al.file_id
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY al.created_at DESC, al.id DESC
+	`
+	rows, err := as.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry models.AuditLog
+		var username, actorName, filename sql.NullString
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &entry.FileID, &entry.IPAddress, &entry.UserAgent,
+			&entry.CreatedAt, &entry.ActorID, &entry.ImpersonationID, &entry.OrgID, &entry.Details, &entry.RequestID, &username, &actorName,
+			&filename)
+		if err != nil {
+			return err
+		}
+		entry.User = &models.User{ID: entry.UserID, Username: username.String}
+		if entry.ActorID != nil {
+			entry.Actor = &models.User{ID: *entry.ActorID, Username: actorName.String}
+		}
+		if entry.FileID != nil {
+			entry.File = &models.UserFile{ID: *entry.FileID, Filename: filename.String}
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (as *AuditService) list(where []string, tail string, args []interface{}) ([]*models.AuditLog, error) {
+	query := `
+		SELECT al.id, al.user_id, al.action, al.file_id, host(al.ip_address), al.user_agent, al.created_at,
+			al.actor_id, al.impersonation_id, al.org_id, al.details::text, al.request_id, al.username, al.actor_username, al.filename
+		FROM audit_logs al
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY al.created_at DESC, al.id DESC
+		` + tail
+	rows, err := as.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*models.AuditLog{}
+	for rows.Next() {
+		var entry models.AuditLog
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &entry.FileID, &entry.IPAddress, &entry.UserAgent,
+			&entry.CreatedAt, &entry.ActorID, &entry.ImpersonationID, &entry.OrgID, &entry.Details, &entry.RequestID,
+			&entry.Username, &entry.ActorUsername, &entry.Filename)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// loadRelations loads the users and files of a page with one query each
+func (as *AuditService) loadRelations(entries []*models.AuditLog) error {
+	var userIDs, fileIDs []uuid.UUID
+	for _, entry := range entries {
+		userIDs = append(userIDs, entry.UserID)
+		if entry.ActorID != nil {
+			userIDs = append(userIDs, *entry.ActorID)
+		}
+		if entry.FileID != nil {
+			fileIDs = append(fileIDs, *entry.FileID)
+		}
+	}
+
+	users, err := as.loadUsers(userIDs)
+	if err != nil {
+		return fmt.Errorf("failed to load audit log users: %w", err)
+	}
+	files, err := as.loadFiles(fileIDs)
+	if err != nil {
+		return fmt.Errorf("failed to load audit log files: %w", err)
+	}
+
+	for _, entry := range entries {
+		entry.User = users[entry.UserID]
+		if entry.User == nil {
+			// entries outlive the users they are about
+			username := "Deleted User"
+			if entry.Username != nil {
+				username = *entry.Username
+			}
+			entry.User = &models.User{ID: entry.UserID, Username: username, Email: "deleted@user.com", Role: models.UserRoleUser}
+		}
+		if entry.ActorID != nil {
+			entry.Actor = users[*entry.ActorID]
+		}
+		if entry.FileID != nil {
+			entry.File = files[*entry.FileID]
+		}
+	}
+	return nil
+}
+
+func (as *AuditService) loadUsers(ids []uuid.UUID) (map[uuid.UUID]*models.User, error) {
+	users := map[uuid.UUID]*models.User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+	query := `
+		SELECT id, username, email, email_verified, role, storage_quota, totp_enabled, created_at, updated_at,
+			suspended_at, suspended_reason
+		FROM users
+		WHERE id = ANY($1)
+	`
+	rows, err := as.db.Query(query, pq.Array(uuidStrings(ids)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user models.User
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.Role, &user.StorageQuota,
+			&user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt, &user.SuspendedAt, &user.SuspendedReason)
+		if err != nil {
+			return nil, err
+		}
+		users[user.ID] = &user
+	}
+	return users, rows.Err()
+}
+
+func (as *AuditService) loadFiles(ids []uuid.UUID) (map[uuid.UUID]*models.UserFile, error) {
+	files := map[uuid.UUID]*models.UserFile{}
+	if len(ids) == 0 {
+		return files, nil
+	}
+	query := `
+		SELECT uf.id, uf.user_id, uf.file_content_id, uf.filename, uf.folder_id,
+			   uf.is_public, uf.download_count, uf.tags, uf.created_at, uf.updated_at,
+			   u.id, u.username, u.email, u.role, u.storage_quota, u.created_at, u.updated_at,
+			   fc.id, fc.sha256_hash, fc.file_path, fc.size, fc.mime_type, fc.reference_count, fc.created_at
+		FROM user_files uf
+		JOIN users u ON uf.user_id = u.id
+		JOIN file_contents fc ON uf.file_content_id = fc.id
+		WHERE uf.id = ANY($1)
+	`
+	rows, err := as.db.Query(query, pq.Array(uuidStrings(ids)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var file models.UserFile
+		var user models.User
+		var content models.FileContent
+		err := rows.Scan(
+			&file.ID, &file.UserID, &file.FileContentID, &file.Filename,
+			&file.FolderID, &file.IsPublic, &file.DownloadCount,
+			pq.Array(&file.Tags), &file.CreatedAt, &file.UpdatedAt,
+			&user.ID, &user.Username, &user.Email, &user.Role,
+			&user.StorageQuota, &user.CreatedAt, &user.UpdatedAt,
+			&content.ID, &content.SHA256Hash, &content.FilePath,
+			&content.Size, &content.MimeType, &content.ReferenceCount,
+			&content.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		file.User = &user
+		file.FileContent = &content
+		files[file.ID] = &file
+	}
+	return files, rows.Err()
+}
+
+// where turns the filter into SQL conditions on audit_logs al and their arguments
+func (f AuditFilter) where() ([]string, []interface{}, error) {
+	args := []interface{}{f.AllOrgs, f.OrgID}
+	where := []string{"($1 OR al.org_id = $2)"}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.UserID != nil {
+		add("al.user_id = $%d", *f.UserID)
+	}
+	if f.ActorID != nil {
+		add("al.actor_id = $%d", *f.ActorID)
+	}
+	if len(f.Actions) > 0 {
+		actions := make([]string, len(f.Actions))
+		for i, action := range f.Actions {
+			actions[i] = string(action)
+		}
+		add("al.action::text = ANY($%d)", pq.Array(actions))
+	}
+	if f.FileID != nil {
+		add("al.file_id = $%d", *f.FileID)
+	}
+	if f.IPRange != "" {
+		network, err := parseIPRange(f.IPRange)
+		if err != nil {
+			return nil, nil, err
+		}
+		add("al.ip_address <<= $%d::inet", network)
+	}
+	if f.From != nil {
+		add("al.created_at >= $%d", *f.From)
+	}
+	if f.To != nil {
+		add("al.created_at < $%d", *f.To)
+	}
+	return where, args, nil
+}
+
+// parseIPRange accepts a CIDR block or a single address and returns it as a CIDR block
+func parseIPRange(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", ErrInvalidIPRange
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", ErrInvalidIPRange
+	}
+	return network.String(), nil
+}
+
+// audit cursors carry the position of the last entry of a page, entries are ordered by
+// creation time and ID
+func encodeAuditCursor(createdAt time.Time, id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "|" + id.String()))
+}
+
+func decodeAuditCursor(cursor string) (time.Time, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	createdAt, id, found := strings.Cut(string(raw), "|")
+	if !found {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidAuditCursor
+	}
+	return t, parsed, nil
+}
+
+func uuidStrings(ids []uuid.UUID) []string {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = id.String()
+	}
+	return values
+}
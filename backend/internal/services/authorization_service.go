@@ -0,0 +1,277 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// role permissions rarely change, they are cached so every request doesn't hit the database
+const rolePermissionsCacheTTL = time.Minute
+
+// AuthorizationService is the single place deciding what a role may do. Permissions are
+// stored in role_permissions and every resolver and REST handler checks through here.
+type AuthorizationService struct {
+	db    *sql.DB
+	orgs  *OrganizationService
+	audit *AuditService
+
+	mu       sync.RWMutex
+	roles    map[models.UserRole]map[models.Permission]bool
+	loadedAt time.Time
+}
+
+func NewAuthorizationService(db *sql.DB, orgs *OrganizationService, audit *AuditService) *AuthorizationService {
+	return &AuthorizationService{db: db, orgs: orgs, audit: audit}
+}
+
+// Scope is what an authorized request may reach: one organization, or all of them when the
+// permission comes from the caller's platform role.
+type Scope struct {
+	UserID  string
+	OrgID   uuid.UUID
+	OrgRole models.OrgRole
+	AllOrgs bool
+}
+
+// Includes reports whether data of orgID is within the scope
+func (s *Scope) Includes(orgID uuid.UUID) bool {
+	return s.AllOrgs || s.OrgID == orgID
+}
+
+// Authorize returns the caller's user ID when the request is authenticated and the
+// caller's role holds permission.
+func (as *AuthorizationService) Authorize(ctx context.Context, permission models.Permission) (string, error) {
+	userID, err := auth.RequireAuth(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	allowed, err := as.HasPermission(models.UserRole(auth.GetUserRoleFromContext(ctx)), permission)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", fmt.Errorf("%w: %s", ErrPermissionDenied, permission)
+	}
+
+	if err := as.checkSetupToken(ctx, permission); err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// AuthorizeInOrg checks permission like Authorize and resolves the organization the request
+// acts in. Used for a user's own work, which always happens inside one organization.
+func (as *AuthorizationService) AuthorizeInOrg(ctx context.Context, permission models.Permission) (*Scope, error) {
+	userID, err := as.Authorize(ctx, permission)
+	if err != nil {
+		return nil, err
+	}
+
+	membership, err := as.orgs.Current(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &Scope{UserID: userID, OrgID: membership.OrgID, OrgRole: membership.Role}, nil
+}
+
+// AuthorizeScope checks an administrative permission. A platform role holding it reaches
+// every organization, otherwise the caller's role in the current organization must grant it
+// and only that organization is reachable.
+func (as *AuthorizationService) AuthorizeScope(ctx context.Context, permission models.Permission) (*Scope, error) {
+	if userID, err := as.Authorize(ctx, permission); err == nil {
+		scope := &Scope{UserID: userID, AllOrgs: true}
+		if membership, err := as.orgs.Current(ctx, userID); err == nil {
+			scope.OrgID, scope.OrgRole = membership.OrgID, membership.Role
+		}
+		return scope, nil
+	} else if !errors.Is(err, ErrPermissionDenied) {
+		return nil, err
+	}
+
+	scope, err := as.AuthorizeInOrg(ctx, models.PermissionFilesRead)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := as.orgs.HasPermission(scope.OrgRole, permission)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%w: %s", ErrPermissionDenied, permission)
+	}
+	if err := as.checkSetupToken(ctx, permission); err != nil {
+		return nil, err
+	}
+	return scope, nil
+}
+
+// Can reports whether the caller holds permission without failing the request
+func (as *AuthorizationService) Can(ctx context.Context, permission models.Permission) bool {
+	_, err := as.Authorize(ctx, permission)
+	return err == nil
+}
+
+func (as *AuthorizationService) HasPermission(role models.UserRole, permission models.Permission) (bool, error) {
+	roles, err := as.load()
+	if err != nil {
+		return false, err
+	}
+	return roles[role][permission], nil
+}
+
+// IsPrivileged reports whether role holds any permission the USER role lacks, which is what
+// the admin 2FA policy protects
+func (as *AuthorizationService) IsPrivileged(role models.UserRole) (bool, error) {
+	roles, err := as.load()
+	if err != nil {
+		return false, err
+	}
+	for permission := range roles[role] {
+		if !roles[models.UserRoleUser][permission] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RolePermissions returns the sorted permissions of role
+func (as *AuthorizationService) RolePermissions(role models.UserRole) ([]models.Permission, error) {
+	roles, err := as.load()
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := []models.Permission{}
+	for permission := range roles[role] {
+		permissions = append(permissions, permission)
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i] < permissions[j] })
+	return permissions, nil
+}
+
+// AllPermissions lists every permission known to the database
+func (as *AuthorizationService) AllPermissions() ([]models.Permission, error) {
+	rows, err := as.db.Query(`SELECT name FROM permissions ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []models.Permission{}
+	for rows.Next() {
+		var permission models.Permission
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// SetRolePermissions replaces the permissions granted to role
+func (as *AuthorizationService) SetRolePermissions(ctx context.Context, role models.UserRole, permissions []models.Permission) error {
+	previous, err := as.RolePermissions(role)
+	if err != nil {
+		return err
+	}
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role = $1`, role); err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		_, err := tx.Exec(`INSERT INTO role_permissions (role, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING`, role, permission)
+		if err != nil {
+			return fmt.Errorf("unknown permission %q: %w", permission, err)
+		}
+	}
+	details := AuditChange(previous, permissions)
+	details["role"] = role
+	if err := as.audit.Record(ctx, tx, AuditEvent{Action: models.AuditActionRolePermissionsChanged, Details: details}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	as.invalidate()
+	return nil
+}
+
+func (as *AuthorizationService) load() (map[models.UserRole]map[models.Permission]bool, error) {
+	as.mu.RLock()
+	if as.roles != nil && time.Since(as.loadedAt) < rolePermissionsCacheTTL {
+		roles := as.roles
+		as.mu.RUnlock()
+		return roles, nil
+	}
+	as.mu.RUnlock()
+
+	rows, err := as.db.Query(`SELECT role, permission FROM role_permissions`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load role permissions: %w", err)
+	}
+	defer rows.Close()
+
+	roles := map[models.UserRole]map[models.Permission]bool{}
+	for rows.Next() {
+		var role models.UserRole
+		var permission models.Permission
+		if err := rows.Scan(&role, &permission); err != nil {
+			return nil, err
+		}
+		if roles[role] == nil {
+			roles[role] = map[models.Permission]bool{}
+		}
+		roles[role][permission] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	as.mu.Lock()
+	as.roles = roles
+	as.loadedAt = time.Now()
+	as.mu.Unlock()
+	return roles, nil
+}
+
+func (as *AuthorizationService) invalidate() {
+	as.mu.Lock()
+	as.roles = nil
+	as.mu.Unlock()
+}
+
+// checkSetupToken keeps 2FA setup tokens to what the USER role may do, they only let an
+// admin enroll in 2FA
+func (as *AuthorizationService) checkSetupToken(ctx context.Context, permission models.Permission) error {
+	if setup, ok := ctx.Value(auth.TwoFactorSetupKey).(bool); !ok || !setup {
+		return nil
+	}
+	base, err := as.HasPermission(models.UserRoleUser, permission)
+	if err != nil {
+		return err
+	}
+	if !base {
+		return auth.ErrTwoFactorSetupRequired
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"testing"
+	"time"
+)
+
+// testAuthz serves role permissions from memory instead of role_permissions
+func testAuthz(roles map[models.UserRole][]models.Permission) *AuthorizationService {
+	as := &AuthorizationService{roles: map[models.UserRole]map[models.Permission]bool{}, loadedAt: time.Now()}
+	for role, permissions := range roles {
+		as.roles[role] = map[models.Permission]bool{}
+		for _, permission := range permissions {
+			as.roles[role][permission] = true
+		}
+	}
+	return as
+}
+
+func TestIsPrivilegedComparesWithUserRole(t *testing.T) {
+	base := []models.Permission{models.PermissionFilesRead, models.PermissionFilesWrite, models.PermissionOrgsCreate}
+	as := testAuthz(map[models.UserRole][]models.Permission{
+		models.UserRoleUser:    base,
+		models.UserRoleAuditor: append(base, models.PermissionAuditRead),
+		models.UserRoleSupport: base[:1],
+	})
+
+	tests := map[models.UserRole]bool{
+		models.UserRoleUser:    false,
+		models.UserRoleAuditor: true,
+		models.UserRoleSupport: false, // fewer permissions than USER
+		models.UserRoleAdmin:   false, // no permissions at all
+	}
+	for role, want := range tests {
+		if got, err := as.IsPrivileged(role); err != nil || got != want {
+			t.Errorf("IsPrivileged(%s) = %v, %v, want %v", role, got, err, want)
+		}
+	}
+}
+
+func TestSetupTokenLimitedToUserPermissions(t *testing.T) {
+	as := testAuthz(map[models.UserRole][]models.Permission{
+		models.UserRoleUser:  {models.PermissionFilesRead, models.PermissionOrgsCreate},
+		models.UserRoleAdmin: {models.PermissionFilesRead, models.PermissionOrgsCreate, models.PermissionAuditRead},
+	})
+	ctx := context.WithValue(context.Background(), auth.UserIDKey, "11111111-1111-1111-1111-111111111111")
+	ctx = context.WithValue(ctx, auth.UserRoleKey, string(models.UserRoleAdmin))
+	ctx = context.WithValue(ctx, auth.TwoFactorSetupKey, true)
+
+	for _, permission := range []models.Permission{models.PermissionFilesRead, models.PermissionOrgsCreate} {
+		if _, err := as.Authorize(ctx, permission); err != nil {
+			t.Errorf("Authorize(%s) with a setup token = %v, want allowed", permission, err)
+		}
+	}
+	if _, err := as.Authorize(ctx, models.PermissionAuditRead); !errors.Is(err, auth.ErrTwoFactorSetupRequired) {
+		t.Errorf("Authorize(audit:read) with a setup token = %v, want ErrTwoFactorSetupRequired", err)
+	}
+}
+
+// TestSeededRolesPrivilege checks the permissions the migrations grant
+func TestSeededRolesPrivilege(t *testing.T) {
+	db := testDB(t)
+	as := NewAuthorizationService(db, nil, nil)
+
+	tests := map[models.UserRole]bool{
+		models.UserRoleUser:    false,
+		models.UserRoleAuditor: true,
+		models.UserRoleAdmin:   true,
+	}
+	for role, want := range tests {
+		if got, err := as.IsPrivileged(role); err != nil || got != want {
+			t.Errorf("IsPrivileged(%s) = %v, %v, want %v", role, got, err, want)
+		}
+	}
+}
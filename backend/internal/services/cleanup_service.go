@@ -1,28 +1,53 @@
 package services
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"time"
 )
 
 type CleanUpService struct {
-	db *sql.DB
+	db             *sql.DB
+	audit          *AuditService
+	auditRetention AuditRetention
+	jobs           *JobQueue
+	jobRetention   time.Duration
 }
 
-func NewCleanUpService(db *sql.DB) *CleanUpService {
-	return &CleanUpService{db: db}
+func NewCleanUpService(db *sql.DB, audit *AuditService, auditRetention AuditRetention, jobs *JobQueue, jobRetention time.Duration) *CleanUpService {
+	return &CleanUpService{db: db, audit: audit, auditRetention: auditRetention, jobs: jobs, jobRetention: jobRetention}
 }
 
-func (cs *CleanUpService) CleanupExpiredDownloads() error {
-
-	ticker := time.NewTicker(time.Minute * 30)
+// Cleanup removes expired downloads and account tokens, archives expired audit entries and
+// purges finished jobs and scheduled task runs. The scheduler runs it.
+func (cs *CleanUpService) Cleanup(ctx context.Context) error {
 	query := `DELETE FROM file_downloads WHERE expires_at < NOW()`
-	for range ticker.C {
-		_, err := cs.db.Exec(query)
-		if err != nil {
-			fmt.Printf("Failed::Cleanup Expired Downloads: %v\n", err)
-		}
+	tokenQuery := `DELETE FROM account_tokens WHERE expires_at < NOW() OR used_at IS NOT NULL`
+	if _, err := cs.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to clean up expired downloads: %w", err)
+	}
+	if _, err := cs.db.ExecContext(ctx, tokenQuery); err != nil {
+		return fmt.Errorf("failed to clean up expired account tokens: %w", err)
+	}
+	archived, err := cs.audit.ArchiveExpired(cs.auditRetention)
+	if err != nil {
+		return fmt.Errorf("failed to archive expired audit logs: %w", err)
+	}
+	if archived > 0 {
+		slog.InfoContext(ctx, "Archived audit log entries", "count", archived)
+	}
+	purged, err := cs.jobs.PurgeSucceeded(cs.jobRetention)
+	if err != nil {
+		return fmt.Errorf("failed to purge finished jobs: %w", err)
+	}
+	if purged > 0 {
+		slog.InfoContext(ctx, "Purged finished jobs", "count", purged)
+	}
+	runQuery := `DELETE FROM scheduled_task_runs WHERE finished_at < NOW() - $1 * INTERVAL '1 second'`
+	if _, err := cs.db.ExecContext(ctx, runQuery, cs.jobRetention.Seconds()); err != nil {
+		return fmt.Errorf("failed to purge scheduled task runs: %w", err)
 	}
 	return nil
 }
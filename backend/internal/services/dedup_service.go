@@ -1,9 +1,10 @@
 package services
 
 import (
+	"context"
 	"database/sql"
+	"file-vault/internal/metrics"
 	"file-vault/internal/models"
-	"fmt"
 )
 
 type DeduplicationService struct {
@@ -50,18 +51,19 @@ func (ds *DeduplicationService) GetDeduplicationStats() (*models.StorageStats, e
 	}, nil
 }
 
-func (ds *DeduplicationService) CheckDuplicateFile(sha256Hash string) (string, error) {
-	fmt.Printf("Dedup check for %s \n", sha256Hash)
+func (ds *DeduplicationService) CheckDuplicateFile(ctx context.Context, sha256Hash string) (string, error) {
 	query := `SELECT file_path FROM file_contents WHERE sha256_hash = $1`
 	var filePath string
-	err := ds.db.QueryRow(query, sha256Hash).Scan(&filePath)
+	err := ds.db.QueryRowContext(ctx, query, sha256Hash).Scan(&filePath)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			metrics.DedupChecks.WithLabelValues("miss").Inc()
 			return filePath, nil
 		}
-		fmt.Printf("Dedup error\n %v\n", err)
+		metrics.DedupChecks.WithLabelValues("error").Inc()
 		return "", err
 	}
+	metrics.DedupChecks.WithLabelValues("hit").Inc()
 	return filePath, nil
 }
 
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"file-vault/internal/models"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/uuid"
+)
+
+const (
+	eventChannelPrefix = "filevault:events:"
+
+	// TopicFileEvent is the outbox topic of file events for the event bus
+	TopicFileEvent = "file.event"
+)
+
+// UserEventChannel carries the events of the files a user owns or was given access to
+func UserEventChannel(userID uuid.UUID) string {
+	return eventChannelPrefix + "user:" + userID.String()
+}
+
+// FileEventChannel carries the events of one file
+func FileEventChannel(fileID uuid.UUID) string {
+	return eventChannelPrefix + "file:" + fileID.String()
+}
+
+// EventBus fans file events out over Redis pub/sub, so subscribers on every server
+// instance see them. Events reach the bus through the outbox once their change committed.
+// Delivery to subscribers is best effort: events published while a subscriber is
+// reconnecting are lost.
+type EventBus struct {
+	redis *RedisClient
+}
+
+func NewEventBus(redis *RedisClient) *EventBus {
+	return &EventBus{redis: redis}
+}
+
+// FileEventMessage is a file event in the outbox, with the users besides the owner who
+// should see it
+type FileEventMessage struct {
+	Event      models.FileEvent `json:"event"`
+	Recipients []uuid.UUID      `json:"recipients,omitempty"`
+}
+
+// Relay publishes a FileEventMessage from the outbox
+func (eb *EventBus) Relay(ctx context.Context, payload json.RawMessage) error {
+	var message FileEventMessage
+	if err := json.Unmarshal(payload, &message); err != nil {
+		slog.ErrorContext(ctx, "Dropping undecodable file event", "error", err)
+		return nil
+	}
+	return eb.Publish(ctx, message.Event, message.Recipients...)
+}
+
+// Publish sends event to the file's channel, its owner and the users in recipients
+func (eb *EventBus) Publish(ctx context.Context, event models.FileEvent, recipients ...uuid.UUID) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	channels := []string{FileEventChannel(event.FileID), UserEventChannel(event.OwnerID)}
+	seen := map[uuid.UUID]bool{event.OwnerID: true}
+	for _, recipient := range recipients {
+		if !seen[recipient] {
+			seen[recipient] = true
+			channels = append(channels, UserEventChannel(recipient))
+		}
+	}
+
+	pipe := eb.redis.client.Pipeline()
+	for _, channel := range channels {
+		pipe.Publish(ctx, channel, payload)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to publish %s event for file %s: %w", event.Type, event.FileID, err)
+	}
+	return nil
+}
+
+// Subscribe delivers the events published to channel until ctx is done. The channel is
+// subscribed when Subscribe returns, later events are not missed.
+func (eb *EventBus) Subscribe(ctx context.Context, channel string) (<-chan models.FileEvent, error) {
+	pubsub := eb.redis.client.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", channel, err)
+	}
+
+	events := make(chan models.FileEvent)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				var event models.FileEvent
+				if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+					slog.ErrorContext(ctx, "Dropping undecodable file event", "channel", channel, "error", err)
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"file-vault/internal/models"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobDeleteBlob    = "storage.delete_blob"
+	JobThumbnail     = "files.thumbnail"
+	JobCountDownload = "files.count_download"
+)
+
+type DeleteBlobJob struct {
+	Path string `json:"path"`
+}
+
+type ThumbnailJob struct {
+	FileContentID uuid.UUID `json:"file_content_id"`
+}
+
+type CountDownloadJob struct {
+	FileID uuid.UUID `json:"file_id"`
+}
+
+// FileJobs runs the background work on stored files: removing blobs of deleted contents,
+// generating thumbnails and counting downloads of shared files
+type FileJobs struct {
+	db     *sql.DB
+	files  *FileService
+	jobs   *JobQueue
+	outbox *Outbox
+}
+
+func NewFileJobs(db *sql.DB, files *FileService, jobs *JobQueue, outbox *Outbox) *FileJobs {
+	fj := &FileJobs{db: db, files: files, jobs: jobs, outbox: outbox}
+	jobs.Register(JobDeleteBlob, fj.DeleteBlob)
+	jobs.Register(JobThumbnail, fj.Thumbnail)
+	jobs.Register(JobCountDownload, fj.CountDownload)
+	return fj
+}
+
+// EnqueueBlobDeletion queues the removal of the blobs of a deleted content, in the
+// transaction that deleted it
+func (fj *FileJobs) EnqueueBlobDeletion(exec JobExecutor, paths ...string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := fj.jobs.Enqueue(exec, JobDeleteBlob, DeleteBlobJob{Path: path}, JobOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnqueueThumbnail queues a thumbnail for a new content when it is an image
+func (fj *FileJobs) EnqueueThumbnail(exec JobExecutor, fileContentID uuid.UUID, mimeType string) error {
+	if !CanThumbnail(mimeType) {
+		return nil
+	}
+	return fj.jobs.Enqueue(exec, JobThumbnail, ThumbnailJob{FileContentID: fileContentID},
+		JobOptions{UniqueKey: JobThumbnail + ":" + fileContentID.String()})
+}
+
+// LockBlob takes the lock on a blob path until tx ends. DeleteBlob holds it from its check
+// to the removal and uploads while recording a content for the path, so an upload can't
+// reuse a blob that is deleted right after.
+func LockBlob(ctx context.Context, tx *sql.Tx, path string) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('blob:' || $1))`, path)
+	return err
+}
+
+// DeleteBlob removes a blob from storage unless a content uses the path again, which
+// happens when the same file was uploaded after the old content was deleted
+func (fj *FileJobs) DeleteBlob(ctx context.Context, payload json.RawMessage) error {
+	var job DeleteBlobJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	tx, err := fj.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := LockBlob(ctx, tx, job.Path); err != nil {
+		return err
+	}
+
+	var inUse bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM file_contents WHERE file_path = $1 OR thumbnail_path = $1)
+	`, job.Path).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return nil
+	}
+	if err := fj.files.DeleteFile(job.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Thumbnail generates the thumbnail of an image content
+func (fj *FileJobs) Thumbnail(ctx context.Context, payload json.RawMessage) error {
+	var job ThumbnailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	var filePath, hash, mimeType string
+	var thumbnailPath *string
+	err := fj.db.QueryRowContext(ctx, `
+		SELECT file_path, sha256_hash, mime_type, thumbnail_path FROM file_contents WHERE id = $1
+	`, job.FileContentID).Scan(&filePath, &hash, &mimeType, &thumbnailPath)
+	if err == sql.ErrNoRows || (err == nil && (thumbnailPath != nil || !CanThumbnail(mimeType))) {
+		return nil // deleted in the meantime or already done
+	}
+	if err != nil {
+		return err
+	}
+
+	path, err := fj.files.GenerateThumbnail(filePath, hash)
+	if err != nil {
+		return fmt.Errorf("failed to generate thumbnail of %s: %w", job.FileContentID, err)
+	}
+	result, err := fj.db.ExecContext(ctx, `UPDATE file_contents SET thumbnail_path = $2 WHERE id = $1`, job.FileContentID, path)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// the content went away while the thumbnail was generated
+		return fj.files.DeleteFile(path)
+	}
+	return nil
+}
+
+// CountDownload counts a download of a file by someone other than its owner and tells the
+// owner's subscribers
+func (fj *FileJobs) CountDownload(ctx context.Context, payload json.RawMessage) error {
+	var job CountDownloadJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	tx, err := fj.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ownerID uuid.UUID
+	err = tx.QueryRow(`
+		UPDATE user_files SET download_count = download_count + 1 WHERE id = $1 RETURNING user_id
+	`, job.FileID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return nil // the file was deleted
+	}
+	if err != nil {
+		return err
+	}
+	event := models.FileEvent{Type: models.FileEventDownloadCountUpdated, FileID: job.FileID, OwnerID: ownerID}
+	if err := fj.outbox.Add(tx, TopicFileEvent, FileEventMessage{Event: event}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
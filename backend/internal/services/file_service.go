@@ -1,11 +1,18 @@
 package services
 
 import (
+	"context"
+	"file-vault/internal/metrics"
+	"file-vault/internal/tracing"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type FileService struct {
@@ -30,7 +37,7 @@ func NewFileService(dedupService *DeduplicationService, storagePath string) *Fil
 
 func (fs *FileService) DeleteFile(filePath string) error {
 	// check refere
-	fmt.Printf("Deleting file path: %s\n", filePath)
+	slog.Debug("Deleting file", "path", filePath)
 	err := os.Remove(filePath)
 	if err != nil {
 		return err
@@ -38,47 +45,78 @@ func (fs *FileService) DeleteFile(filePath string) error {
 	return nil
 }
 
-func (fs *FileService) UploadFiles(files []*UploadFile) ([]string, error) {
+func (fs *FileService) UploadFiles(ctx context.Context, files []*UploadFile) ([]string, error) {
 	// change this process to handle reverting failed uploads
 	var filePaths []string
 	for _, file := range files {
-		// write file to location	on disk
-		path, err := fs.dedupService.CheckDuplicateFile(file.Hash)
+		path, err := fs.storeFile(ctx, file)
 		if err != nil {
 			return nil, err
 		}
-		if path != "" {
-			filePaths = append(filePaths, path)
-			continue
-		} else {
-			// write file to storage
-			fmt.Printf("Saving file\n")
-			extension := getFileExtensionFromMimeType(file.MimeType)
-			path := fs.storagePath + file.Hash + "." + extension
-			f, err := os.Create(path)
-			if err != nil {
-				fmt.Printf("Failed::Creating File: %v\n", err)
-				return nil, fmt.Errorf("Failed::Saving File")
-			}
-			fmt.Printf("Saving File: %s\n", path)
-			n, err := f.Write(file.Content)
-			if err != nil {
-				return nil, err
-			}
-			if n != len(file.Content) {
-				return nil, fmt.Errorf("Failed::Saving File")
-			}
-			fmt.Printf("Saved File: %s\n", path)
-			f.Close()
-			filePaths = append(filePaths, path)
-		}
+		filePaths = append(filePaths, path)
 	}
 	return filePaths, nil
 }
 
-func (fs *FileService) DownloadFile(w *http.ResponseWriter, filePath string, fileName string, mimeType string) error {
+// EnsureStored writes file to path again when the blob is gone. Uploads call it once they
+// hold LockBlob: a DeleteBlob that checked the path before the content was recorded may
+// have removed the blob storeFile reused.
+func (fs *FileService) EnsureStored(ctx context.Context, file *UploadFile, path string) error {
+	_, err := os.Stat(path)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	slog.DebugContext(ctx, "Restoring deleted blob", "path", path)
+	return os.WriteFile(path, file.Content, 0666)
+}
+
+// storeFile writes file to storage unless its content is already there and returns its path
+func (fs *FileService) storeFile(ctx context.Context, file *UploadFile) (path string, err error) {
+	ctx, span := tracing.Start(ctx, "storage.store",
+		attribute.String("file.hash", file.Hash),
+		attribute.Int64("file.size", file.Size),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	started := time.Now()
+	// write file to location	on disk
+	path, err = fs.dedupService.CheckDuplicateFile(ctx, file.Hash)
+	if err != nil {
+		return "", err
+	}
+	span.SetAttributes(attribute.Bool("file.deduplicated", path != ""))
+	if path != "" {
+		metrics.TransferBytes.WithLabelValues("upload", "deduplicated").Add(float64(file.Size))
+		metrics.TransferDuration.WithLabelValues("upload").Observe(time.Since(started).Seconds())
+		return path, nil
+	}
+
+	// write file to storage
+	extension := getFileExtensionFromMimeType(file.MimeType)
+	path = fs.storagePath + file.Hash + "." + extension
+	f, err := os.Create(path)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create file", "error", err)
+		return "", fmt.Errorf("Failed::Saving File")
+	}
+	n, err := f.Write(file.Content)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	if n != len(file.Content) {
+		f.Close()
+		return "", fmt.Errorf("Failed::Saving File")
+	}
+	slog.DebugContext(ctx, "Saved file", "path", path, "size", file.Size)
+	f.Close()
+	metrics.TransferBytes.WithLabelValues("upload", "stored").Add(float64(file.Size))
+	metrics.TransferDuration.WithLabelValues("upload").Observe(time.Since(started).Seconds())
+	return path, nil
+}
+
+func (fs *FileService) DownloadFile(ctx context.Context, w *http.ResponseWriter, filePath string, fileName string, mimeType string) error {
 	// check if file exists - filePath already includes the full path from database
-	fmt.Printf("Downloading file: %s\n", filePath)
 	if stat, err := os.Stat(filePath); os.IsNotExist(err) {
 		return fmt.Errorf("file not found")
 	} else if err != nil {
@@ -95,7 +133,12 @@ func (fs *FileService) DownloadFile(w *http.ResponseWriter, filePath string, fil
 			return fmt.Errorf("failed to open file: %w", err)
 		}
 		defer file.Close()
-		_, err = io.Copy(*w, file)
+		_, span := tracing.Start(ctx, "storage.read", attribute.String("transfer.direction", "download"), attribute.Int64("file.size", stat.Size()))
+		started := time.Now()
+		n, err := io.Copy(*w, file)
+		observeServed("download", n, started, err)
+		span.SetAttributes(attribute.Int64("transfer.bytes", n))
+		tracing.End(span, err)
 		if err != nil {
 			return fmt.Errorf("failed to copy file: %w", err)
 		}
@@ -106,9 +149,8 @@ func (fs *FileService) DownloadFile(w *http.ResponseWriter, filePath string, fil
 }
 
 // PreviewFile serves a file for inline preview (not download)
-func (fs *FileService) PreviewFile(w *http.ResponseWriter, filePath string, fileName string, mimeType string) error {
+func (fs *FileService) PreviewFile(ctx context.Context, w *http.ResponseWriter, filePath string, fileName string, mimeType string) error {
 	// check if file exists - filePath already includes the full path from database
-	fmt.Printf("Previewing file: %s\n", filePath)
 	if stat, err := os.Stat(filePath); os.IsNotExist(err) {
 		return fmt.Errorf("file not found at %s", filePath)
 	} else if err != nil {
@@ -124,7 +166,12 @@ func (fs *FileService) PreviewFile(w *http.ResponseWriter, filePath string, file
 			return fmt.Errorf("failed to open file: %w", err)
 		}
 		defer file.Close()
-		_, err = io.Copy(*w, file)
+		_, span := tracing.Start(ctx, "storage.read", attribute.String("transfer.direction", "preview"), attribute.Int64("file.size", stat.Size()))
+		started := time.Now()
+		n, err := io.Copy(*w, file)
+		observeServed("preview", n, started, err)
+		span.SetAttributes(attribute.Int64("transfer.bytes", n))
+		tracing.End(span, err)
 		if err != nil {
 			return fmt.Errorf("failed to copy file: %w", err)
 		}
@@ -132,3 +179,13 @@ func (fs *FileService) PreviewFile(w *http.ResponseWriter, filePath string, file
 		return nil
 	}
 }
+
+// observeServed records a file body sent to a client, aborted ones with the bytes that made it
+func observeServed(direction string, n int64, started time.Time, err error) {
+	result := "complete"
+	if err != nil {
+		result = "aborted"
+	}
+	metrics.TransferBytes.WithLabelValues(direction, result).Add(float64(n))
+	metrics.TransferDuration.WithLabelValues(direction).Observe(time.Since(started).Seconds())
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// GarbageCollector removes deduplicated contents no user file points to anymore.
+// DeleteFile already does this inline, the collector catches what failed or was left behind.
+type GarbageCollector struct {
+	db       *sql.DB
+	fileJobs *FileJobs
+}
+
+func NewGarbageCollector(db *sql.DB, fileJobs *FileJobs) *GarbageCollector {
+	return &GarbageCollector{db: db, fileJobs: fileJobs}
+}
+
+// Run is the scheduled garbage collection
+func (gc *GarbageCollector) Run(ctx context.Context) error {
+	_, err := gc.Collect(ctx)
+	return err
+}
+
+// Collect deletes orphaned file_contents rows and queues the removal of their blobs,
+// returning how many were removed
+func (gc *GarbageCollector) Collect(ctx context.Context) (int, error) {
+	tx, err := gc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM file_contents fc
+		WHERE NOT EXISTS (SELECT 1 FROM user_files uf WHERE uf.file_content_id = fc.id)
+		  AND fc.created_at < NOW() - INTERVAL '1 hour' -- leave in-flight uploads alone
+		RETURNING fc.file_path, COALESCE(fc.thumbnail_path, '')
+	`
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete orphaned contents: %w", err)
+	}
+
+	var paths []string
+	for rows.Next() {
+		var path, thumbnailPath string
+		if err := rows.Scan(&path, &thumbnailPath); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		paths = append(paths, path, thumbnailPath)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := gc.fileJobs.EnqueueBlobDeletion(tx, paths...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	removed := len(paths) / 2
+	slog.InfoContext(ctx, "Removed orphaned file contents", "count", removed)
+	return removed, nil
+}
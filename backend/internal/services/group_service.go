@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"file-vault/internal/models"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+var ErrGroupNotFound = errors.New("group not found")
+
+// GroupService manages user groups. Access through a group is resolved from
+// group_members on every check, so membership changes apply immediately.
+type GroupService struct {
+	db    *sql.DB
+	audit *AuditService
+}
+
+func NewGroupService(db *sql.DB, audit *AuditService) *GroupService {
+	return &GroupService{db: db, audit: audit}
+}
+
+// Create adds a group of orgID owned by ownerID, or an admin managed group when ownerID is
+// nil. The owner is added as the first member.
+func (gs *GroupService) Create(ctx context.Context, orgID uuid.UUID, ownerID *uuid.UUID, name, description string) (*models.Group, error) {
+	tx, err := gs.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	group := &models.Group{Name: name, Description: description, OrgID: orgID, OwnerID: ownerID}
+	query := `
+		INSERT INTO user_groups (name, description, owner_id, org_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at
+	`
+	if err := tx.QueryRow(query, name, description, ownerID, orgID).Scan(&group.ID, &group.CreatedAt, &group.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if ownerID != nil {
+		if _, err := tx.Exec(`INSERT INTO group_members (group_id, user_id) VALUES ($1, $2)`, group.ID, *ownerID); err != nil {
+			return nil, err
+		}
+	}
+	err = gs.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionGroupCreated,
+		OrgID:   &orgID,
+		Details: AuditDetails{"group_id": group.ID, "name": name, "admin_managed": ownerID == nil},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return group, tx.Commit()
+}
+
+func (gs *GroupService) Get(groupID uuid.UUID) (*models.Group, error) {
+	var group models.Group
+	query := `SELECT id, name, description, org_id, owner_id, created_at, updated_at FROM user_groups WHERE id = $1`
+	err := gs.db.QueryRow(query, groupID).Scan(
+		&group.ID, &group.Name, &group.Description, &group.OrgID, &group.OwnerID, &group.CreatedAt, &group.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// ListForUser returns the groups of orgID that userID owns or is a member of
+func (gs *GroupService) ListForUser(userID string, orgID uuid.UUID) ([]*models.Group, error) {
+	query := `
+		SELECT g.id, g.name, g.description, g.org_id, g.owner_id, g.created_at, g.updated_at
+		FROM user_groups g
+		WHERE g.org_id = $2
+		  AND (g.owner_id = $1
+		   OR EXISTS (SELECT 1 FROM group_members gm WHERE gm.group_id = g.id AND gm.user_id = $1))
+		ORDER BY g.name
+	`
+	rows, err := gs.db.Query(query, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*models.Group{}
+	for rows.Next() {
+		var group models.Group
+		if err := rows.Scan(&group.ID, &group.Name, &group.Description, &group.OrgID, &group.OwnerID, &group.CreatedAt, &group.UpdatedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, &group)
+	}
+	return groups, rows.Err()
+}
+
+func (gs *GroupService) Members(groupID uuid.UUID) ([]*models.User, error) {
+	query := `
+		SELECT u.id, u.username, u.email, u.email_verified, u.role, u.storage_quota, u.totp_enabled, u.created_at, u.updated_at
+		FROM group_members gm
+		JOIN users u ON u.id = gm.user_id
+		WHERE gm.group_id = $1
+		ORDER BY u.username
+	`
+	rows, err := gs.db.Query(query, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*models.User{}
+	for rows.Next() {
+		var user models.User
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.Role,
+			&user.StorageQuota, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &user)
+	}
+	return members, rows.Err()
+}
+
+func (gs *GroupService) IsMember(groupID uuid.UUID, userID string) (bool, error) {
+	var member bool
+	query := `SELECT EXISTS(SELECT 1 FROM group_members WHERE group_id = $1 AND user_id = $2)`
+	err := gs.db.QueryRow(query, groupID, userID).Scan(&member)
+	return member, err
+}
+
+func (gs *GroupService) AddMember(ctx context.Context, groupID, userID uuid.UUID) error {
+	tx, err := gs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO group_members (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	if _, err := tx.Exec(query, groupID, userID); err != nil {
+		return fmt.Errorf("failed to add member: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE user_groups SET updated_at = NOW() WHERE id = $1`, groupID); err != nil {
+		return err
+	}
+	if err := gs.auditMember(ctx, tx, models.AuditActionGroupMemberAdded, groupID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember drops userID from the group and revokes download links they can no longer use
+func (gs *GroupService) RemoveMember(ctx context.Context, groupID, userID uuid.UUID) error {
+	tx, err := gs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM group_members WHERE group_id = $1 AND user_id = $2`, groupID, userID); err != nil {
+		return fmt.Errorf("failed to remove member: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE user_groups SET updated_at = NOW() WHERE id = $1`, groupID); err != nil {
+		return err
+	}
+	if err := RevokeStaleDownloads(tx, userID); err != nil {
+		return err
+	}
+	if err := gs.auditMember(ctx, tx, models.AuditActionGroupMemberRemoved, groupID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (gs *GroupService) auditMember(ctx context.Context, tx *sql.Tx, action models.AuditAction, groupID, userID uuid.UUID) error {
+	var orgID uuid.UUID
+	if err := tx.QueryRow(`SELECT org_id FROM user_groups WHERE id = $1`, groupID).Scan(&orgID); err != nil {
+		return err
+	}
+	return gs.audit.Record(ctx, tx, AuditEvent{
+		Action:  action,
+		OrgID:   &orgID,
+		Details: AuditDetails{"group_id": groupID, "target_user_id": userID},
+	})
+}
+
+// Delete removes the group with its shares and revokes what its members lose access to
+func (gs *GroupService) Delete(ctx context.Context, groupID uuid.UUID) error {
+	tx, err := gs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM group_members WHERE group_id = $1 RETURNING user_id`, groupID)
+	if err != nil {
+		return err
+	}
+	var members []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		members = append(members, userID)
+	}
+	rows.Close()
+
+	// file and folder shares go with the group through ON DELETE CASCADE
+	var orgID uuid.UUID
+	var name string
+	err = tx.QueryRow(`DELETE FROM user_groups WHERE id = $1 RETURNING org_id, name`, groupID).Scan(&orgID, &name)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = gs.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionGroupDeleted,
+		OrgID:   &orgID,
+		Details: AuditDetails{"group_id": groupID, "name": name, "members": members},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range members {
+		if err := RevokeStaleDownloads(tx, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RevokeStaleDownloads deletes pending download links of files userID can no longer access
+func RevokeStaleDownloads(tx *sql.Tx, userID uuid.UUID) error {
+	query := `
+		DELETE FROM file_downloads
+		WHERE user_id = $1 AND owner_id <> $1 AND NOT can_access_file($1, user_file_id)
+	`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return fmt.Errorf("failed to revoke download links: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ComponentHealth is the result of checking one dependency
+type ComponentHealth struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthReport is the result of checking every dependency the server needs to take traffic
+type HealthReport struct {
+	Healthy    bool               `json:"healthy"`
+	Components []*ComponentHealth `json:"components"`
+}
+
+// ReadinessReport is the public view of a HealthReport: it says which component is down,
+// but not why
+type ReadinessReport struct {
+	Healthy    bool               `json:"healthy"`
+	Components []*ComponentStatus `json:"components"`
+}
+
+// ComponentStatus is whether one dependency passed its check
+type ComponentStatus struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+}
+
+// readinessCacheTTL is how long Readiness reuses a report, so unauthenticated probes can't
+// make every request hit Postgres, Redis and the storage volume
+const readinessCacheTTL = 5 * time.Second
+
+// PoolStats are the connection pool numbers of sql.DB.Stats
+type PoolStats struct {
+	MaxOpenConnections int     `json:"max_open_connections"`
+	OpenConnections    int     `json:"open_connections"`
+	InUse              int     `json:"in_use"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"wait_count"`
+	WaitDurationMs     float64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64   `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64   `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64   `json:"max_lifetime_closed"`
+}
+
+// DiskStats is the space left on the filesystem holding the storage path
+type DiskStats struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+	Error      string `json:"error,omitempty"`
+}
+
+// MigrationStatus compares the schema version of the database with the newest migration
+// this build ships
+type MigrationStatus struct {
+	Expected uint `json:"expected"`
+	Current  uint `json:"current"`
+	Dirty    bool `json:"dirty"`
+}
+
+// SystemStatus is the detailed status for administrators
+type SystemStatus struct {
+	HealthReport
+	Instance   string           `json:"instance"`
+	StartedAt  time.Time        `json:"started_at"`
+	Migrations *MigrationStatus `json:"migrations,omitempty"`
+	Pool       PoolStats        `json:"pool"`
+	Disk       DiskStats        `json:"disk"`
+}
+
+// HealthService checks the dependencies of the server: Postgres, Redis, the storage
+// backend and the schema version. Each check gets timeout, they run in parallel.
+type HealthService struct {
+	db                *sql.DB
+	redis             *RedisClient
+	storagePath       string
+	expectedMigration uint
+	timeout           time.Duration
+	startedAt         time.Time
+
+	readinessMu sync.Mutex
+	readiness   *ReadinessReport
+	checkedAt   time.Time
+}
+
+func NewHealthService(db *sql.DB, redis *RedisClient, storagePath string, expectedMigration uint, timeout time.Duration) *HealthService {
+	return &HealthService{
+		db:                db,
+		redis:             redis,
+		storagePath:       storagePath,
+		expectedMigration: expectedMigration,
+		timeout:           timeout,
+		startedAt:         time.Now(),
+	}
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Check runs every dependency check and reports the server healthy when all of them pass
+func (hs *HealthService) Check(ctx context.Context) *HealthReport {
+	report, _ := hs.check(ctx)
+	return report
+}
+
+// Readiness is Check for unauthenticated callers: errors and latencies are left out and
+// the report is reused for readinessCacheTTL. Failures are logged instead.
+func (hs *HealthService) Readiness(ctx context.Context) *ReadinessReport {
+	hs.readinessMu.Lock()
+	defer hs.readinessMu.Unlock()
+	if hs.readiness != nil && time.Since(hs.checkedAt) < readinessCacheTTL {
+		return hs.readiness
+	}
+
+	report := hs.Check(ctx)
+	readiness := &ReadinessReport{Healthy: report.Healthy, Components: make([]*ComponentStatus, len(report.Components))}
+	for i, component := range report.Components {
+		readiness.Components[i] = &ComponentStatus{Name: component.Name, Healthy: component.Healthy}
+		if !component.Healthy {
+			slog.WarnContext(ctx, "Readiness check failed", "component", component.Name, "error", component.Error)
+		}
+	}
+	hs.readiness, hs.checkedAt = readiness, time.Now()
+	return readiness
+}
+
+func (hs *HealthService) check(ctx context.Context) (*HealthReport, *MigrationStatus) {
+	var migrations *MigrationStatus
+	checks := []healthCheck{
+		{"postgres", func(ctx context.Context) error { return hs.db.PingContext(ctx) }},
+		{"redis", hs.redis.Ping},
+		{"storage", hs.checkStorage},
+		{"migrations", func(ctx context.Context) error {
+			var err error
+			migrations, err = hs.checkMigrations(ctx)
+			return err
+		}},
+	}
+
+	report := &HealthReport{Healthy: true, Components: make([]*ComponentHealth, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Components[i] = hs.run(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	for _, component := range report.Components {
+		if !component.Healthy {
+			report.Healthy = false
+		}
+	}
+	return report, migrations
+}
+
+func (hs *HealthService) run(ctx context.Context, c healthCheck) *ComponentHealth {
+	ctx, cancel := context.WithTimeout(ctx, hs.timeout)
+	defer cancel()
+
+	started := time.Now()
+	err := c.check(ctx)
+	component := &ComponentHealth{
+		Name:      c.name,
+		Healthy:   err == nil,
+		LatencyMs: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		component.Error = err.Error()
+	}
+	return component
+}
+
+// checkStorage writes and removes a file in the storage path, so a read-only or full
+// volume fails the check
+func (hs *HealthService) checkStorage(ctx context.Context) error {
+	file, err := os.CreateTemp(hs.storagePath, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write([]byte("ok")); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// checkMigrations fails while a migration is half applied or the database is behind this
+// build. A database ahead of it is fine, a newer instance migrated it during a rollout.
+func (hs *HealthService) checkMigrations(ctx context.Context) (*MigrationStatus, error) {
+	status := &MigrationStatus{Expected: hs.expectedMigration}
+	err := hs.db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&status.Current, &status.Dirty)
+	if err == sql.ErrNoRows {
+		return status, fmt.Errorf("no migrations applied, expected version %d", status.Expected)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status.Dirty {
+		return status, fmt.Errorf("migration %d is dirty", status.Current)
+	}
+	if status.Current < status.Expected {
+		return status, fmt.Errorf("schema is at version %d, expected %d", status.Current, status.Expected)
+	}
+	return status, nil
+}
+
+// Status runs the checks and adds what administrators need to judge the load of the
+// instance: pool usage and the space left for uploads
+func (hs *HealthService) Status(ctx context.Context) *SystemStatus {
+	report, migrations := hs.check(ctx)
+	stats := hs.db.Stats()
+	status := &SystemStatus{
+		HealthReport: *report,
+		Instance:     instanceID(),
+		StartedAt:    hs.startedAt,
+		Migrations:   migrations,
+		Pool: PoolStats{
+			MaxOpenConnections: stats.MaxOpenConnections,
+			OpenConnections:    stats.OpenConnections,
+			InUse:              stats.InUse,
+			Idle:               stats.Idle,
+			WaitCount:          stats.WaitCount,
+			WaitDurationMs:     float64(stats.WaitDuration.Microseconds()) / 1000,
+			MaxIdleClosed:      stats.MaxIdleClosed,
+			MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+			MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+		},
+		Disk: DiskStats{Path: hs.storagePath},
+	}
+
+	free, total, err := diskSpace(hs.storagePath)
+	if err != nil {
+		status.Disk.Error = err.Error()
+	} else {
+		status.Disk.FreeBytes, status.Disk.TotalBytes = free, total
+	}
+	return status
+}
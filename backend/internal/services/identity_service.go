@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"file-vault/internal/models"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrProvisioningDisabled = errors.New("no FileVault account exists for this identity and provisioning is disabled")
+
+// ExternalIdentity is a user authenticated by an outside provider such as OIDC or LDAP
+type ExternalIdentity struct {
+	Provider string
+	Issuer   string
+	Subject  string
+	Email    string
+	Username string
+	// Role is applied on every login when set, nil keeps the role stored in FileVault. Only
+	// ADMIN and USER are mapped, a USER result leaves staff roles alone.
+	Role *models.UserRole
+}
+
+// IdentityService maps external identities onto rows in users
+type IdentityService struct {
+	db           *sql.DB
+	defaultQuota int64
+	audit        *AuditService
+}
+
+func NewIdentityService(db *sql.DB, defaultQuota int64, audit *AuditService) *IdentityService {
+	return &IdentityService{db: db, defaultQuota: defaultQuota, audit: audit}
+}
+
+// ResolveUser returns the local user for identity. An already linked identity wins, otherwise the
+// identity is linked to the user with the same email, otherwise a new user is created when allowed.
+// The returned bool reports whether a user was created.
+func (is *IdentityService) ResolveUser(ctx context.Context, identity ExternalIdentity, allowProvisioning bool) (*models.User, bool, error) {
+	if identity.Subject == "" || identity.Email == "" {
+		return nil, false, fmt.Errorf("Failed::Identity is missing subject or email")
+	}
+
+	tx, err := is.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	created := false
+	var userID uuid.UUID
+	err = tx.QueryRow(`
+		UPDATE user_identities SET last_login_at = NOW()
+		WHERE provider = $1 AND issuer = $2 AND subject = $3
+		RETURNING user_id
+	`, identity.Provider, identity.Issuer, identity.Subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(`SELECT id FROM users WHERE LOWER(email) = LOWER($1)`, identity.Email).Scan(&userID)
+		if err == sql.ErrNoRows {
+			if !allowProvisioning {
+				return nil, false, ErrProvisioningDisabled
+			}
+			userID, err = is.createUser(tx, identity)
+			created = true
+			if err == nil {
+				err = is.audit.Record(ctx, tx, AuditEvent{
+					UserID:  userID.String(),
+					Action:  models.AuditActionRegister,
+					Details: AuditDetails{"provider": identity.Provider},
+				})
+			}
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO user_identities (user_id, provider, issuer, subject)
+			VALUES ($1, $2, $3, $4)
+		`, userID, identity.Provider, identity.Issuer, identity.Subject)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the provider vouched for the address
+	_, err = tx.Exec(`
+		UPDATE users SET email_verified = true, email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $1 AND email_verified = false
+	`, userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the providers only map ADMIN and USER: staff roles granted in FileVault are kept unless
+	// the provider makes the user an admin
+	if identity.Role != nil && !created {
+		var previous models.UserRole
+		err = tx.QueryRow(`
+			UPDATE users u SET role = $1 FROM users old
+			WHERE u.id = $2 AND old.id = u.id AND u.role <> $1
+				AND ($1 = $3 OR u.role IN ($3, $4))
+			RETURNING old.role
+		`, *identity.Role, userID, models.UserRoleAdmin, models.UserRoleUser).Scan(&previous)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, false, err
+		}
+		if err == nil {
+			details := AuditChange(previous, *identity.Role)
+			details["target_user_id"] = userID
+			details["provider"] = identity.Provider
+			err = is.audit.Record(ctx, tx, AuditEvent{UserID: userID.String(), Action: models.AuditActionUserRoleChanged, Details: details})
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	var user models.User
+	err = tx.QueryRow(`
+		SELECT id, username, email, email_verified, role, storage_quota, totp_enabled, created_at, updated_at
+		FROM users WHERE id = $1
+	`, userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.Role,
+		&user.StorageQuota, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &user, created, tx.Commit()
+}
+
+func (is *IdentityService) createUser(tx *sql.Tx, identity ExternalIdentity) (uuid.UUID, error) {
+	username, err := uniqueUsername(tx, identity)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	role := models.UserRoleUser
+	if identity.Role != nil {
+		role = *identity.Role
+	}
+
+	// externally managed users have no local password, bcrypt never matches an empty hash
+	userID := uuid.New()
+	_, err = tx.Exec(`
+		INSERT INTO users (id, username, email, password_hash, role, storage_quota, email_verified, email_verified_at, created_at, updated_at)
+		VALUES ($1, $2, $3, '', $4, $5, true, NOW(), $6, $6)
+	`, userID, username, identity.Email, role, is.defaultQuota, time.Now())
+	return userID, err
+}
+
+var usernameCleanup = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func uniqueUsername(tx *sql.Tx, identity ExternalIdentity) (string, error) {
+	base := identity.Username
+	if base == "" {
+		base = strings.Split(identity.Email, "@")[0]
+	}
+	base = usernameCleanup.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)`, candidate).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		candidate = base + "-" + hex.EncodeToString(suffix)
+	}
+	return "", fmt.Errorf("Failed::Could not pick a unique username for %s", identity.Email)
+}
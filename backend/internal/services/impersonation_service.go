@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrImpersonationNotFound   = errors.New("impersonation session not found")
+	ErrImpersonationNotAllowed = errors.New("this account can't be impersonated")
+)
+
+// ImpersonationService records support sessions acting as a user. The start and end of a
+// session are audited in the same transaction that changes it.
+type ImpersonationService struct {
+	db    *sql.DB
+	audit *AuditService
+}
+
+func NewImpersonationService(db *sql.DB, audit *AuditService) *ImpersonationService {
+	return &ImpersonationService{db: db, audit: audit}
+}
+
+// Start opens a session of actorID acting as targetID. Only regular users can be
+// impersonated, the token carries the target's role and staff roles must not be reachable
+// through it. Suspended accounts can't be impersonated either.
+func (is *ImpersonationService) Start(ctx context.Context, actorID, targetID uuid.UUID, reason string, ttl time.Duration) (*models.ImpersonationSession, error) {
+	if actorID == targetID {
+		return nil, ErrImpersonationNotAllowed
+	}
+
+	tx, err := is.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var role models.UserRole
+	var suspended bool
+	err = tx.QueryRow(`SELECT role, suspended_at IS NOT NULL FROM users WHERE id = $1`, targetID).Scan(&role, &suspended)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if role != models.UserRoleUser || suspended {
+		return nil, ErrImpersonationNotAllowed
+	}
+
+	session := models.ImpersonationSession{ActorID: actorID, TargetID: targetID, Reason: reason}
+	query := `
+		INSERT INTO impersonation_sessions (actor_id, target_id, reason, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, started_at, expires_at
+	`
+	err = tx.QueryRow(query, actorID, targetID, reason, time.Now().Add(ttl)).Scan(&session.ID, &session.StartedAt, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := is.auditImpersonation(ctx, tx, &session, models.AuditActionImpersonationStarted); err != nil {
+		return nil, err
+	}
+
+	return &session, tx.Commit()
+}
+
+// End closes a session early. Only the acting staff member can end it.
+func (is *ImpersonationService) End(ctx context.Context, sessionID, actorID uuid.UUID) error {
+	tx, err := is.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var session models.ImpersonationSession
+	query := `
+		UPDATE impersonation_sessions SET ended_at = NOW()
+		WHERE id = $1 AND actor_id = $2 AND ended_at IS NULL
+		RETURNING id, actor_id, target_id, reason
+	`
+	err = tx.QueryRow(query, sessionID, actorID).Scan(&session.ID, &session.ActorID, &session.TargetID, &session.Reason)
+	if err == sql.ErrNoRows {
+		return ErrImpersonationNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := is.auditImpersonation(ctx, tx, &session, models.AuditActionImpersonationEnded); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListForTarget returns the sessions in which someone acted as targetID, newest first
+func (is *ImpersonationService) ListForTarget(targetID string) ([]*models.ImpersonationSession, error) {
+	return is.list(`WHERE target_id = $1`, targetID)
+}
+
+// ListForActor returns the sessions actorID started, newest first
+func (is *ImpersonationService) ListForActor(actorID string) ([]*models.ImpersonationSession, error) {
+	return is.list(`WHERE actor_id = $1`, actorID)
+}
+
+func (is *ImpersonationService) list(where string, arg string) ([]*models.ImpersonationSession, error) {
+	query := `
+		SELECT id, actor_id, target_id, reason, started_at, expires_at, ended_at
+		FROM impersonation_sessions
+		` + where + `
+		ORDER BY started_at DESC
+		LIMIT 100
+	`
+	rows, err := is.db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.ImpersonationSession{}
+	for rows.Next() {
+		var session models.ImpersonationSession
+		err := rows.Scan(&session.ID, &session.ActorID, &session.TargetID, &session.Reason,
+			&session.StartedAt, &session.ExpiresAt, &session.EndedAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, rows.Err()
+}
+
+// auditImpersonation records a session event under the target, attributed to the acting
+// staff member like the actions taken during the session
+func (is *ImpersonationService) auditImpersonation(ctx context.Context, tx *sql.Tx, session *models.ImpersonationSession, action models.AuditAction) error {
+	ctx = context.WithValue(ctx, auth.ActorIDKey, session.ActorID.String())
+	ctx = context.WithValue(ctx, auth.ImpersonationKey, session.ID.String())
+	return is.audit.Record(ctx, tx, AuditEvent{
+		UserID:  session.TargetID.String(),
+		Action:  action,
+		Details: AuditDetails{"reason": session.Reason},
+	})
+}
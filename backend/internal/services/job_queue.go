@@ -0,0 +1,355 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"file-vault/internal/logging"
+	"file-vault/internal/metrics"
+	"file-vault/internal/models"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// JobHandler runs one job. A returned error retries the job after a backoff, handlers must
+// therefore be safe to run more than once for the same payload.
+type JobHandler func(ctx context.Context, payload json.RawMessage) error
+
+// JobQueueConfig controls the workers. A failed job is retried with exponential backoff
+// from BackoffBase up to BackoffMax until it used MaxAttempts, then it is DEAD. A job whose
+// worker did not finish within LockTimeout is picked up again by another worker.
+type JobQueueConfig struct {
+	Workers      int
+	PollInterval time.Duration
+	LockTimeout  time.Duration
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	MaxAttempts  int
+}
+
+// JobQueue is a Postgres-backed queue of background jobs. Jobs are enqueued in the
+// transaction of the change they belong to, so they exist exactly when the change committed.
+type JobQueue struct {
+	db       *sql.DB
+	config   JobQueueConfig
+	workerID string
+
+	mu       sync.RWMutex
+	handlers map[string]JobHandler
+}
+
+func NewJobQueue(db *sql.DB, config JobQueueConfig) *JobQueue {
+	return &JobQueue{db: db, config: config, workerID: instanceID(), handlers: map[string]JobHandler{}}
+}
+
+// instanceID names this process in job locks and task runs
+func instanceID() string {
+	hostname, _ := os.Hostname()
+	return hostname + ":" + strconv.Itoa(os.Getpid())
+}
+
+// Register sets the handler of a kind of job. Jobs of kinds without a handler are DEAD.
+func (jq *JobQueue) Register(kind string, handler JobHandler) {
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	jq.handlers[kind] = handler
+}
+
+func (jq *JobQueue) handler(kind string) JobHandler {
+	jq.mu.RLock()
+	defer jq.mu.RUnlock()
+	return jq.handlers[kind]
+}
+
+// JobExecutor is a *sql.DB or, to enqueue a job together with a change, a *sql.Tx
+type JobExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// JobOptions are optional settings of an enqueued job. A job with a UniqueKey is dropped
+// while another job with the same key is still queued.
+type JobOptions struct {
+	RunAt       time.Time
+	MaxAttempts int
+	UniqueKey   string
+}
+
+// Enqueue adds a job of kind with payload encoded as JSON
+func (jq *JobQueue) Enqueue(exec JobExecutor, kind string, payload interface{}, options JobOptions) error {
+	if exec == nil {
+		exec = jq.db
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	runAt := options.RunAt
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	maxAttempts := options.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = jq.config.MaxAttempts
+	}
+	var uniqueKey *string
+	if options.UniqueKey != "" {
+		uniqueKey = &options.UniqueKey
+	}
+
+	_, err = exec.Exec(`
+		INSERT INTO jobs (kind, payload, max_attempts, run_at, unique_key)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (unique_key) WHERE status = 'QUEUED' DO NOTHING
+	`, kind, string(body), maxAttempts, runAt, uniqueKey)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue %s job: %w", kind, err)
+	}
+	return nil
+}
+
+// Run starts the workers and blocks until ctx is done and they finished their jobs
+func (jq *JobQueue) Run(ctx context.Context) {
+	workers := jq.config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jq.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (jq *JobQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		ran, err := jq.RunNext(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to run job", "error", err)
+		}
+		if ran {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(jq.config.PollInterval):
+		}
+	}
+}
+
+type claimedJob struct {
+	id          uuid.UUID
+	kind        string
+	payload     json.RawMessage
+	attempts    int
+	maxAttempts int
+}
+
+// RunNext claims the next due job and runs it, reporting whether there was one
+func (jq *JobQueue) RunNext(ctx context.Context) (bool, error) {
+	job, err := jq.claim()
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job: %w", err)
+	}
+
+	handler := jq.handler(job.kind)
+	if handler == nil {
+		return true, jq.fail(job, fmt.Errorf("no handler for %s jobs", job.kind), true)
+	}
+
+	jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jq.config.LockTimeout)
+	jobCtx = logging.With(jobCtx, slog.String("job_id", job.id.String()), slog.String("job_kind", job.kind))
+	defer cancel()
+	started := time.Now()
+	runErr := runJob(jobCtx, handler, job.payload)
+	metrics.JobDuration.WithLabelValues(job.kind).Observe(time.Since(started).Seconds())
+	if runErr != nil {
+		return true, jq.fail(job, runErr, job.attempts >= job.maxAttempts)
+	}
+	metrics.JobOutcomes.WithLabelValues(job.kind, "succeeded").Inc()
+	_, err = jq.db.Exec(`
+		UPDATE jobs SET status = 'SUCCEEDED', locked_by = NULL, locked_until = NULL, last_error = NULL,
+			finished_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2
+	`, job.id, jq.workerID)
+	return true, err
+}
+
+// runJob turns a panicking handler into a failed job instead of a dead worker
+func runJob(ctx context.Context, handler JobHandler, payload json.RawMessage) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+	return handler(ctx, payload)
+}
+
+// claim locks the oldest due job, or a running one whose worker let its lock expire. Other
+// workers skip the locked row instead of waiting for it.
+func (jq *JobQueue) claim() (*claimedJob, error) {
+	var job claimedJob
+	var payload string
+	err := jq.db.QueryRow(`
+		UPDATE jobs
+		SET status = 'RUNNING', attempts = attempts + 1, locked_by = $1,
+			locked_until = NOW() + $2 * INTERVAL '1 second', updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = 'QUEUED' AND run_at <= NOW()) OR (status = 'RUNNING' AND locked_until < NOW())
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, payload::text, attempts, max_attempts
+	`, jq.workerID, jq.config.LockTimeout.Seconds()).Scan(&job.id, &job.kind, &payload, &job.attempts, &job.maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	job.payload = json.RawMessage(payload)
+	return &job, nil
+}
+
+// fail queues the job again after the backoff, or moves it to the dead letters
+func (jq *JobQueue) fail(job *claimedJob, jobErr error, dead bool) error {
+	slog.Warn("Job failed", "job_id", job.id, "job_kind", job.kind, "attempt", job.attempts, "max_attempts", job.maxAttempts, "dead", dead, "error", jobErr)
+	if dead {
+		metrics.JobOutcomes.WithLabelValues(job.kind, "dead").Inc()
+		_, err := jq.db.Exec(`
+			UPDATE jobs SET status = 'DEAD', locked_by = NULL, locked_until = NULL, last_error = $3,
+				finished_at = NOW(), updated_at = NOW()
+			WHERE id = $1 AND locked_by = $2
+		`, job.id, jq.workerID, jobErr.Error())
+		return err
+	}
+	metrics.JobOutcomes.WithLabelValues(job.kind, "retried").Inc()
+	_, err := jq.db.Exec(`
+		UPDATE jobs SET status = 'QUEUED', locked_by = NULL, locked_until = NULL, last_error = $3, run_at = $4,
+			updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2
+	`, job.id, jq.workerID, jobErr.Error(), time.Now().Add(jq.backoff(job.attempts)))
+	return err
+}
+
+// backoff is the wait before the next attempt: BackoffBase doubling with every attempt up
+// to BackoffMax, with up to 20% jitter
+func (jq *JobQueue) backoff(attempts int) time.Duration {
+	delay := jq.config.BackoffMax
+	if attempts < 30 {
+		if scaled := jq.config.BackoffBase << (attempts - 1); scaled > 0 && scaled < delay {
+			delay = scaled
+		}
+	}
+	return delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+}
+
+const jobColumns = `id, kind, payload::text, status, attempts, max_attempts, run_at, locked_by, last_error,
+	created_at, updated_at, finished_at`
+
+func scanJob(row rowScanner) (*models.Job, error) {
+	var job models.Job
+	err := row.Scan(&job.ID, &job.Kind, &job.Payload, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt,
+		&job.LockedBy, &job.LastError, &job.CreatedAt, &job.UpdatedAt, &job.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// List returns jobs, optionally only those in status or of kind. Queued jobs come in the
+// order they run, the others newest first.
+func (jq *JobQueue) List(status *models.JobStatus, kind *string, limit, offset int) ([]*models.Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs
+		WHERE ($1::job_status IS NULL OR status = $1) AND ($2::text IS NULL OR kind = $2)
+		ORDER BY CASE WHEN status = 'QUEUED' THEN run_at END, updated_at DESC
+		LIMIT $3 OFFSET $4`
+	rows, err := jq.db.Query(query, status, kind, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*models.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Counts returns how many jobs of each kind are in each status
+func (jq *JobQueue) Counts() ([]*models.JobCount, error) {
+	rows, err := jq.db.Query(`SELECT kind, status, COUNT(*) FROM jobs GROUP BY kind, status ORDER BY kind, status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*models.JobCount{}
+	for rows.Next() {
+		var count models.JobCount
+		if err := rows.Scan(&count.Kind, &count.Status, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, &count)
+	}
+	return counts, rows.Err()
+}
+
+// Retry queues a dead job again with a fresh set of attempts
+func (jq *JobQueue) Retry(jobID uuid.UUID) (*models.Job, error) {
+	query := `
+		UPDATE jobs SET status = 'QUEUED', attempts = 0, run_at = NOW(), finished_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND status = 'DEAD'
+		RETURNING ` + jobColumns
+	job, err := scanJob(jq.db.QueryRow(query, jobID))
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	return job, err
+}
+
+// Discard deletes a queued or dead job. Running jobs cannot be discarded.
+func (jq *JobQueue) Discard(jobID uuid.UUID) error {
+	result, err := jq.db.Exec(`DELETE FROM jobs WHERE id = $1 AND status IN ('QUEUED', 'DEAD')`, jobID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// PurgeSucceeded deletes jobs that succeeded more than retention ago. Dead jobs stay until
+// they are retried or discarded.
+func (jq *JobQueue) PurgeSucceeded(retention time.Duration) (int64, error) {
+	result, err := jq.db.Exec(`
+		DELETE FROM jobs WHERE status = 'SUCCEEDED' AND finished_at < NOW() - $1 * INTERVAL '1 second'
+	`, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"file-vault/internal/models"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	ErrLDAPUserNotFound       = errors.New("user not found in directory")
+	ErrLDAPInvalidCredentials = errors.New("invalid directory credentials")
+)
+
+type LDAPConfig struct {
+	URL                string // ldap://host:389 or ldaps://host:636
+	StartTLS           bool
+	InsecureSkipVerify bool
+	// BindDN and BindPassword belong to the service account used to search for users
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter is an LDAP filter where {username} is replaced by the escaped login name
+	UserFilter        string
+	EmailAttribute    string
+	UsernameAttribute string
+	GroupAttribute    string
+	// AdminGroups are group DNs (or CNs) whose members get the ADMIN role
+	AdminGroups       []string
+	AllowProvisioning bool
+}
+
+// LDAPAuthenticator verifies passwords by binding to a directory as the user
+type LDAPAuthenticator struct {
+	config LDAPConfig
+}
+
+func NewLDAPAuthenticator(config LDAPConfig) *LDAPAuthenticator {
+	if config.UserFilter == "" {
+		config.UserFilter = "(|(uid={username})(mail={username}))"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	return &LDAPAuthenticator{config: config}
+}
+
+func (la *LDAPAuthenticator) Enabled() bool {
+	return la.config.URL != ""
+}
+
+func (la *LDAPAuthenticator) AllowProvisioning() bool {
+	return la.config.AllowProvisioning
+}
+
+// Authenticate looks the user up with the service account and then binds as them with password.
+// ErrLDAPUserNotFound lets the caller fall back to local accounts.
+func (la *LDAPAuthenticator) Authenticate(username, password string) (*ExternalIdentity, error) {
+	// an empty password would be an unauthenticated bind, which many servers accept
+	if password == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := la.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if la.config.BindDN != "" {
+		if err := conn.Bind(la.config.BindDN, la.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("Failed::LDAP service bind: %w", err)
+		}
+	}
+
+	filter := strings.ReplaceAll(la.config.UserFilter, "{username}", ldap.EscapeFilter(username))
+	request := ldap.NewSearchRequest(
+		la.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 10, false,
+		filter,
+		[]string{"dn", la.config.EmailAttribute, la.config.UsernameAttribute, la.config.GroupAttribute},
+		nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::LDAP search: %w", err)
+	}
+	if len(result.Entries) == 0 {
+		return nil, ErrLDAPUserNotFound
+	}
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("Failed::LDAP filter matched more than one entry for %s", username)
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrLDAPInvalidCredentials
+		}
+		return nil, fmt.Errorf("Failed::LDAP user bind: %w", err)
+	}
+
+	email := entry.GetAttributeValue(la.config.EmailAttribute)
+	if email == "" {
+		return nil, fmt.Errorf("Failed::LDAP entry %s has no %s attribute", entry.DN, la.config.EmailAttribute)
+	}
+
+	return &ExternalIdentity{
+		Provider: "ldap",
+		Issuer:   la.config.URL,
+		Subject:  strings.ToLower(entry.DN),
+		Email:    email,
+		Username: entry.GetAttributeValue(la.config.UsernameAttribute),
+		Role:     la.mapRole(entry.GetAttributeValues(la.config.GroupAttribute)),
+	}, nil
+}
+
+func (la *LDAPAuthenticator) mapRole(groups []string) *models.UserRole {
+	if len(la.config.AdminGroups) == 0 {
+		return nil
+	}
+
+	role := models.UserRoleUser
+	for _, group := range groups {
+		for _, admin := range la.config.AdminGroups {
+			if strings.EqualFold(group, admin) || strings.EqualFold(groupCN(group), admin) {
+				role = models.UserRoleAdmin
+			}
+		}
+	}
+	return &role
+}
+
+func (la *LDAPAuthenticator) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: la.config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(la.config.URL,
+		ldap.DialWithTLSConfig(tlsConfig),
+		ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::LDAP connect: %w", err)
+	}
+	conn.SetTimeout(10 * time.Second)
+
+	if la.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed::LDAP StartTLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// groupCN returns "admins" for "cn=admins,ou=groups,dc=example,dc=com"
+func groupCN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return dn
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+	return dn
+}
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"file-vault/internal/models"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jimlambrt/gldap"
+)
+
+const (
+	testLDAPBaseDN      = "ou=people,dc=example,dc=com"
+	testLDAPServiceDN   = "cn=filevault,ou=services,dc=example,dc=com"
+	testLDAPServicePass = "service-secret"
+	testLDAPAdminGroup  = "cn=filevault-admins,ou=groups,dc=example,dc=com"
+)
+
+// testDirectory is an in-process LDAP server holding a few entries. Binds check the
+// userPassword attribute, searches evaluate the filter the client sent.
+type testDirectory struct {
+	url     string
+	entries []*gldap.Entry
+	binds   atomic.Int32
+}
+
+type testDirectoryMode int
+
+const (
+	ldapPlain testDirectoryMode = iota
+	ldapStartTLS
+	ldapImplicitTLS
+)
+
+func startTestDirectory(t *testing.T, mode testDirectoryMode) *testDirectory {
+	t.Helper()
+	dir := &testDirectory{entries: []*gldap.Entry{
+		gldap.NewEntry(testLDAPServiceDN, map[string][]string{"userPassword": {testLDAPServicePass}}),
+		gldap.NewEntry("uid=ada,"+testLDAPBaseDN, map[string][]string{
+			"uid": {"ada"}, "mail": {"ada@example.com"}, "userPassword": {"ada-password"},
+			"memberOf": {testLDAPAdminGroup, "cn=staff,ou=groups,dc=example,dc=com"},
+		}),
+		gldap.NewEntry("uid=bob,"+testLDAPBaseDN, map[string][]string{
+			"uid": {"bob"}, "mail": {"bob@example.com"}, "userPassword": {"bob-password"},
+			"memberOf": {"cn=staff,ou=groups,dc=example,dc=com"},
+		}),
+		gldap.NewEntry("uid=nomail,"+testLDAPBaseDN, map[string][]string{
+			"uid": {"nomail"}, "userPassword": {"nomail-password"},
+		}),
+		// a uid that is someone else's mail makes the default filter ambiguous
+		gldap.NewEntry("uid=bob@example.com,"+testLDAPBaseDN, map[string][]string{
+			"uid": {"bob@example.com"}, "mail": {"other@example.com"}, "userPassword": {"x"},
+		}),
+		// outside the base DN, searches must not find it
+		gldap.NewEntry("uid=eve,ou=robots,dc=example,dc=com", map[string][]string{
+			"uid": {"eve"}, "mail": {"eve@example.com"}, "userPassword": {"eve-password"},
+		}),
+	}}
+
+	server, err := gldap.NewServer(gldap.WithLogger(hclog.NewNullLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := gldap.NewMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := testServerTLS(t)
+	mux.Bind(dir.bind)
+	mux.Search(dir.search)
+	if mode == ldapStartTLS {
+		mux.ExtendedOperation(func(w *gldap.ResponseWriter, r *gldap.Request) {
+			res := r.NewExtendedResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+			res.SetResponseName(gldap.ExtendedOperationStartTLS)
+			w.Write(res)
+			r.StartTLS(tlsConfig)
+		}, gldap.ExtendedOperationStartTLS)
+	}
+	server.Router(mux)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var options []gldap.Option
+	dir.url = "ldap://" + addr
+	if mode == ldapImplicitTLS {
+		options = append(options, gldap.WithTLSConfig(tlsConfig))
+		dir.url = "ldaps://" + addr
+	}
+	go server.Run(addr, options...)
+	t.Cleanup(func() { server.Stop() })
+	for !server.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	return dir
+}
+
+func (dir *testDirectory) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	dir.binds.Add(1)
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(resp)
+
+	m, err := r.GetSimpleBindMessage()
+	if err != nil || m.Password == "" {
+		return
+	}
+	for _, entry := range dir.entries {
+		if strings.EqualFold(entry.DN, m.UserName) && entry.GetAttributeValues("userPassword")[0] == string(m.Password) {
+			resp.SetResultCode(gldap.ResultSuccess)
+			return
+		}
+	}
+}
+
+func (dir *testDirectory) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	done := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer w.Write(done)
+
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		done.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	filter, err := ldap.CompileFilter(m.Filter)
+	if err != nil {
+		done.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	for _, entry := range dir.entries {
+		if !strings.HasSuffix(strings.ToLower(entry.DN), ","+strings.ToLower(m.BaseDN)) || !matchFilter(filter, entry) {
+			continue
+		}
+		result := r.NewSearchResponseEntry(entry.DN)
+		for _, attr := range entry.Attributes {
+			if attr.Name != "userPassword" {
+				result.AddAttribute(attr.Name, attr.Values)
+			}
+		}
+		w.Write(result)
+	}
+}
+
+// matchFilter evaluates the parts of RFC 4515 filters the authenticator uses
+func matchFilter(filter *ber.Packet, entry *gldap.Entry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matchFilter(filter.Children[0], entry)
+	case ldap.FilterPresent:
+		return len(entry.GetAttributeValues(filter.Data.String())) > 0
+	case ldap.FilterEqualityMatch:
+		attribute, value := filter.Children[0].Value.(string), filter.Children[1].Value.(string)
+		for _, v := range entry.GetAttributeValues(attribute) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testServerTLS is a self-signed certificate for 127.0.0.1, clients need InsecureSkipVerify
+func testServerTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "directory"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func testLDAPConfig(url string) LDAPConfig {
+	return LDAPConfig{
+		URL:          url,
+		BindDN:       testLDAPServiceDN,
+		BindPassword: testLDAPServicePass,
+		BaseDN:       testLDAPBaseDN,
+		AdminGroups:  []string{testLDAPAdminGroup},
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	dir := startTestDirectory(t, ldapPlain)
+	la := NewLDAPAuthenticator(testLDAPConfig(dir.url))
+
+	for _, login := range []string{"ada", "ada@example.com"} {
+		identity, err := la.Authenticate(login, "ada-password")
+		if err != nil {
+			t.Fatalf("Authenticate(%q): %v", login, err)
+		}
+		if identity.Provider != "ldap" || identity.Issuer != dir.url || identity.Subject != "uid=ada,"+testLDAPBaseDN {
+			t.Errorf("identity %+v is not ada's directory entry", identity)
+		}
+		if identity.Email != "ada@example.com" || identity.Username != "ada" {
+			t.Errorf("email %q username %q", identity.Email, identity.Username)
+		}
+		if identity.Role == nil || *identity.Role != models.UserRoleAdmin {
+			t.Errorf("role = %v, want ADMIN from the admin group", identity.Role)
+		}
+	}
+}
+
+func TestLDAPRoleMapping(t *testing.T) {
+	dir := startTestDirectory(t, ldapPlain)
+
+	tests := []struct {
+		name        string
+		adminGroups []string
+		user        string
+		want        *models.UserRole
+	}{
+		{"admin by DN", []string{testLDAPAdminGroup}, "ada", rolePtr(models.UserRoleAdmin)},
+		{"admin by CN", []string{"FileVault-Admins"}, "ada", rolePtr(models.UserRoleAdmin)},
+		{"not in the group", []string{testLDAPAdminGroup}, "bob", rolePtr(models.UserRoleUser)},
+		{"no mapping", nil, "ada", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testLDAPConfig(dir.url)
+			config.AdminGroups = tt.adminGroups
+			identity, err := NewLDAPAuthenticator(config).Authenticate(tt.user, tt.user+"-password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (identity.Role == nil) != (tt.want == nil) || (tt.want != nil && *identity.Role != *tt.want) {
+				t.Errorf("role = %v, want %v", identity.Role, tt.want)
+			}
+		})
+	}
+}
+
+func rolePtr(role models.UserRole) *models.UserRole {
+	return &role
+}
+
+func TestLDAPAuthenticateFailures(t *testing.T) {
+	dir := startTestDirectory(t, ldapPlain)
+	la := NewLDAPAuthenticator(testLDAPConfig(dir.url))
+
+	tests := []struct {
+		name, username, password string
+		want                     error
+	}{
+		{"wrong password", "ada", "bob-password", ErrLDAPInvalidCredentials},
+		{"unknown user", "mallory", "x", ErrLDAPUserNotFound},
+		{"outside the base DN", "eve", "eve-password", ErrLDAPUserNotFound},
+		{"wildcard is escaped", "*", "ada-password", ErrLDAPUserNotFound},
+		{"filter injection is escaped", "ada)(uid=*", "ada-password", ErrLDAPUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := la.Authenticate(tt.username, tt.password)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Authenticate = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPEmptyPasswordNeverBinds(t *testing.T) {
+	dir := startTestDirectory(t, ldapPlain)
+	la := NewLDAPAuthenticator(testLDAPConfig(dir.url))
+
+	if _, err := la.Authenticate("ada", ""); !errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Errorf("Authenticate = %v, want ErrLDAPInvalidCredentials", err)
+	}
+	if dir.binds.Load() != 0 {
+		t.Errorf("an empty password reached the directory")
+	}
+}
+
+func TestLDAPDirectoryErrors(t *testing.T) {
+	dir := startTestDirectory(t, ldapPlain)
+
+	config := testLDAPConfig(dir.url)
+	config.BindPassword = "wrong"
+	_, err := NewLDAPAuthenticator(config).Authenticate("ada", "ada-password")
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed::LDAP service bind") {
+		t.Errorf("bad service account: %v", err)
+	}
+
+	la := NewLDAPAuthenticator(testLDAPConfig(dir.url))
+	if _, err := la.Authenticate("nomail", "nomail-password"); err == nil || !strings.Contains(err.Error(), "has no mail attribute") {
+		t.Errorf("entry without mail: %v", err)
+	}
+	if _, err := la.Authenticate("bob@example.com", "bob-password"); err == nil || !strings.Contains(err.Error(), "more than one entry") {
+		t.Errorf("ambiguous filter: %v", err)
+	}
+
+	config = testLDAPConfig("ldap://127.0.0.1:1")
+	if _, err := NewLDAPAuthenticator(config).Authenticate("ada", "ada-password"); err == nil || !strings.HasPrefix(err.Error(), "Failed::LDAP connect") {
+		t.Errorf("unreachable directory: %v", err)
+	}
+}
+
+func TestLDAPTLS(t *testing.T) {
+	for name, mode := range map[string]testDirectoryMode{"StartTLS": ldapStartTLS, "ldaps": ldapImplicitTLS} {
+		t.Run(name, func(t *testing.T) {
+			dir := startTestDirectory(t, mode)
+			config := testLDAPConfig(dir.url)
+			config.StartTLS = mode == ldapStartTLS
+
+			if _, err := NewLDAPAuthenticator(config).Authenticate("ada", "ada-password"); err == nil {
+				t.Errorf("self-signed certificate was accepted")
+			}
+
+			config.InsecureSkipVerify = true
+			identity, err := NewLDAPAuthenticator(config).Authenticate("ada", "ada-password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Email != "ada@example.com" {
+				t.Errorf("email = %q", identity.Email)
+			}
+		})
+	}
+}
+
+func TestGroupCN(t *testing.T) {
+	tests := map[string]string{
+		"cn=admins,ou=groups,dc=example,dc=com": "admins",
+		"ou=groups,dc=example,dc=com":           "ou=groups,dc=example,dc=com",
+		"admins":                                "admins",
+	}
+	for dn, want := range tests {
+		if got := groupCN(dn); got != want {
+			t.Errorf("groupCN(%q) = %q, want %q", dn, got, want)
+		}
+	}
+}
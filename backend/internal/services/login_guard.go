@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type LoginGuardConfig struct {
+	MaxAccountFailures int           // failures before the account is locked
+	MaxIPFailures      int           // failures from one address before it is refused
+	FailureWindow      time.Duration // how long failures are remembered
+	LockoutDuration    time.Duration
+	DelayThreshold     int // failures before progressive delays start
+	MaxDelay           time.Duration
+}
+
+// LoginGuard tracks failed logins per account and per IP in redis.
+// Repeated failures first add an exponentially growing delay and then lock the account.
+type LoginGuard struct {
+	redisStore *RedisClient
+	Config     LoginGuardConfig
+}
+
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	seconds := int(e.RetryAfter.Round(time.Second).Seconds())
+	if e.Locked {
+		return fmt.Sprintf("account is temporarily locked after too many failed logins, try again in %d seconds", seconds)
+	}
+	return fmt.Sprintf("too many failed logins, try again in %d seconds", seconds)
+}
+
+func NewLoginGuard(redisClient *RedisClient, config LoginGuardConfig) *LoginGuard {
+	return &LoginGuard{
+		redisStore: redisClient,
+		Config:     config,
+	}
+}
+
+// Check returns a *LoginThrottledError when a login attempt must be refused without checking the password
+func (lg *LoginGuard) Check(ctx context.Context, email, ip string) error {
+	client := lg.redisStore.client
+	account := normalizeLoginKey(email)
+
+	if ttl, err := client.TTL(ctx, "login:lock:"+account).Result(); err != nil {
+		return err
+	} else if ttl > 0 {
+		return &LoginThrottledError{RetryAfter: ttl, Locked: true}
+	}
+
+	if ip != "" {
+		failures, err := client.Get(ctx, "login:fail:ip:"+ip).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if failures >= lg.Config.MaxIPFailures {
+			ttl, err := client.TTL(ctx, "login:fail:ip:"+ip).Result()
+			if err != nil {
+				return err
+			}
+			return &LoginThrottledError{RetryAfter: ttl}
+		}
+	}
+
+	if ttl, err := client.TTL(ctx, "login:delay:"+account).Result(); err != nil {
+		return err
+	} else if ttl > 0 {
+		return &LoginThrottledError{RetryAfter: ttl}
+	}
+
+	return nil
+}
+
+// RecordFailure counts a failed attempt and reports whether it locked the account
+func (lg *LoginGuard) RecordFailure(ctx context.Context, email, ip string) (bool, error) {
+	client := lg.redisStore.client
+	account := normalizeLoginKey(email)
+
+	failures, err := lg.increment(ctx, "login:fail:account:"+account)
+	if err != nil {
+		return false, err
+	}
+	if ip != "" {
+		if _, err := lg.increment(ctx, "login:fail:ip:"+ip); err != nil {
+			return false, err
+		}
+	}
+
+	if failures >= int64(lg.Config.MaxAccountFailures) {
+		_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "login:lock:"+account, 1, lg.Config.LockoutDuration)
+			pipe.Del(ctx, "login:fail:account:"+account, "login:delay:"+account)
+			return nil
+		})
+		return err == nil, err
+	}
+
+	if failures >= int64(lg.Config.DelayThreshold) {
+		delay := time.Second << min(failures-int64(lg.Config.DelayThreshold), 30)
+		if delay > lg.Config.MaxDelay {
+			delay = lg.Config.MaxDelay
+		}
+		if err := client.Set(ctx, "login:delay:"+account, 1, delay).Err(); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// RecordSuccess clears the account's failure history. IP counters expire on their own.
+func (lg *LoginGuard) RecordSuccess(ctx context.Context, email string) error {
+	account := normalizeLoginKey(email)
+	return lg.redisStore.client.Del(ctx, "login:fail:account:"+account, "login:delay:"+account).Err()
+}
+
+func (lg *LoginGuard) Unlock(ctx context.Context, email string) error {
+	account := normalizeLoginKey(email)
+	return lg.redisStore.client.Del(ctx, "login:lock:"+account, "login:fail:account:"+account, "login:delay:"+account).Err()
+}
+
+func (lg *LoginGuard) IsLocked(ctx context.Context, email string) (bool, error) {
+	ttl, err := lg.redisStore.client.TTL(ctx, "login:lock:"+normalizeLoginKey(email)).Result()
+	return ttl > 0, err
+}
+
+func (lg *LoginGuard) increment(ctx context.Context, key string) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := lg.redisStore.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.ExpireNX(ctx, key, lg.Config.FailureWindow)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func normalizeLoginKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+)
+
+// LoginTokens are what a login hands out once the first factor was checked
+type LoginTokens struct {
+	Token          string // access token, empty while a challenge is pending
+	ChallengeToken string // set when the user has to enter a TOTP code next
+	// TwoFactorSetupRequired restricts Token to enrolling a second factor
+	TwoFactorSetupRequired bool
+}
+
+// LoginTokenService applies the second factor rules every way of logging in shares:
+// password logins, the 2FA challenge and single sign-on
+type LoginTokenService struct {
+	keys     *auth.KeySet
+	settings *SettingsService
+	authz    *AuthorizationService
+}
+
+func NewLoginTokenService(keys *auth.KeySet, settings *SettingsService, authz *AuthorizationService) *LoginTokenService {
+	return &LoginTokenService{keys: keys, settings: settings, authz: authz}
+}
+
+// AfterFirstFactor is called once the password or the identity provider vouched for user.
+// Enrolled users get a TOTP challenge, everyone else their access token.
+func (ls *LoginTokenService) AfterFirstFactor(user *models.User) (*LoginTokens, error) {
+	if user.TwoFactorEnabled {
+		challenge, err := auth.GenerateChallengeToken(user.ID.String(), string(user.Role), ls.keys)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginTokens{ChallengeToken: challenge}, nil
+	}
+	return ls.Issue(user)
+}
+
+// Issue hands out an access token once every required factor has been checked. Admins
+// without 2FA get a restricted token while the 2FA policy covers their role.
+func (ls *LoginTokenService) Issue(user *models.User) (*LoginTokens, error) {
+	setupRequired, err := ls.TwoFactorSetupRequired(user)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := &LoginTokens{TwoFactorSetupRequired: setupRequired}
+	if setupRequired {
+		tokens.Token, err = auth.GenerateTwoFactorSetupToken(user.ID.String(), string(user.Role), ls.keys)
+	} else {
+		tokens.Token, err = auth.GenerateToken(user.ID.String(), string(user.Role), ls.keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// TwoFactorSetupRequired reports whether user must enroll a second factor before using
+// the privileges of their role
+func (ls *LoginTokenService) TwoFactorSetupRequired(user *models.User) (bool, error) {
+	if user.TwoFactorEnabled {
+		return false, nil
+	}
+	return ls.TwoFactorRequired(user.Role)
+}
+
+// TwoFactorRequired reports whether the 2FA policy applies to role. It covers every role
+// holding permissions the USER role lacks, not only ADMIN, so staff roles are included.
+func (ls *LoginTokenService) TwoFactorRequired(role models.UserRole) (bool, error) {
+	privileged, err := ls.authz.IsPrivileged(role)
+	if err != nil || !privileged {
+		return false, err
+	}
+	return ls.settings.GetBool(SettingAdminTwoFactorRequired)
+}
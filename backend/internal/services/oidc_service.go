@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-vault/internal/models"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// OIDCStateTTL is how long a login may take at the provider
+const OIDCStateTTL = 10 * time.Minute
+
+var ErrOIDCInvalidState = errors.New("login request expired or was already used")
+
+// ErrOIDCStateMismatch is returned for callbacks in a browser that did not start the login
+var ErrOIDCStateMismatch = errors.New("login was started in another browser")
+
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// RoleClaim names the ID token claim mapped to UserRole, e.g. "groups" or "roles"
+	RoleClaim string
+	// AdminValues are the claim values that grant the ADMIN role
+	AdminValues       []string
+	AllowProvisioning bool
+}
+
+// OIDCService runs the authorization code flow with PKCE against an OpenID Connect provider
+type OIDCService struct {
+	config     OIDCConfig
+	redisStore *RedisClient
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// oidcLoginState is kept in redis between the redirect to the provider and the callback
+type oidcLoginState struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+}
+
+func NewOIDCService(redisClient *RedisClient, config OIDCConfig) *OIDCService {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	return &OIDCService{config: config, redisStore: redisClient}
+}
+
+func (oc *OIDCService) Enabled() bool {
+	return oc.config.IssuerURL != "" && oc.config.ClientID != ""
+}
+
+func (oc *OIDCService) AllowProvisioning() bool {
+	return oc.config.AllowProvisioning
+}
+
+// AuthCodeURL starts a login and returns the provider URL to redirect the browser to.
+// binding has to be stored in the browser, e.g. in a cookie, and handed to Exchange: it ties
+// the callback to the browser that started the login.
+func (oc *OIDCService) AuthCodeURL(ctx context.Context) (authURL, binding string, err error) {
+	provider, err := oc.getProvider(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	payload, err := json.Marshal(oidcLoginState{Verifier: verifier, Nonce: nonce})
+	if err != nil {
+		return "", "", err
+	}
+	if err := oc.redisStore.client.Set(ctx, "oidc:state:"+state, payload, OIDCStateTTL).Err(); err != nil {
+		return "", "", err
+	}
+
+	authURL = oc.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return authURL, OIDCStateBinding(state), nil
+}
+
+// OIDCStateBinding is the value the browser keeps for state. It is a hash, so the cookie
+// alone can't be used to finish the login.
+func OIDCStateBinding(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// Exchange completes a login from the callback parameters and returns the verified identity.
+// binding is the value AuthCodeURL returned for the browser the callback arrived in.
+func (oc *OIDCService) Exchange(ctx context.Context, state, code, binding string) (*ExternalIdentity, error) {
+	provider, err := oc.getProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(OIDCStateBinding(state)), []byte(binding)) != 1 {
+		return nil, ErrOIDCStateMismatch
+	}
+
+	// GetDel makes every state single-use
+	payload, err := oc.redisStore.client.GetDel(ctx, "oidc:state:"+state).Bytes()
+	if err == redis.Nil {
+		return nil, ErrOIDCInvalidState
+	}
+	if err != nil {
+		return nil, err
+	}
+	var loginState oidcLoginState
+	if err := json.Unmarshal(payload, &loginState); err != nil {
+		return nil, err
+	}
+
+	token, err := oc.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(loginState.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Exchange authorization code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("Failed::Provider did not return an id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oc.config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::Verify id_token: %w", err)
+	}
+	if idToken.Nonce != loginState.Nonce {
+		return nil, fmt.Errorf("Failed::id_token nonce mismatch")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("Failed::Parse id_token claims: %w", err)
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil, fmt.Errorf("Failed::Provider did not return an email address")
+	}
+	// accounts are linked by email, so an unverified address could take over someone else's account
+	if !claimIsTrue(claims["email_verified"]) {
+		return nil, fmt.Errorf("Failed::Email address is not verified by the identity provider")
+	}
+	username, _ := claims["preferred_username"].(string)
+
+	return &ExternalIdentity{
+		Provider: "oidc",
+		Issuer:   idToken.Issuer,
+		Subject:  idToken.Subject,
+		Email:    email,
+		Username: username,
+		Role:     oc.mapRole(claims),
+	}, nil
+}
+
+func (oc *OIDCService) mapRole(claims map[string]any) *models.UserRole {
+	if oc.config.RoleClaim == "" {
+		return nil
+	}
+
+	var values []string
+	switch v := claims[oc.config.RoleClaim].(type) {
+	case string:
+		values = strings.Fields(strings.ReplaceAll(v, ",", " "))
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	role := models.UserRoleUser
+	for _, value := range values {
+		for _, admin := range oc.config.AdminValues {
+			if strings.EqualFold(value, admin) {
+				role = models.UserRoleAdmin
+			}
+		}
+	}
+	return &role
+}
+
+// getProvider runs discovery lazily so an unreachable provider does not keep the server from starting
+func (oc *OIDCService) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	if oc.provider != nil {
+		return oc.provider, nil
+	}
+	provider, err := oidc.NewProvider(ctx, oc.config.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed::OIDC discovery: %w", err)
+	}
+	oc.provider = provider
+	return provider, nil
+}
+
+func (oc *OIDCService) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oc.config.ClientID,
+		ClientSecret: oc.config.ClientSecret,
+		RedirectURL:  oc.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       oc.config.Scopes,
+	}
+}
+
+// some providers send email_verified as the string "true"
+func claimIsTrue(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"file-vault/internal/models"
+	"file-vault/internal/services/oidctest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testOIDCRedirect = "https://files.example.com/api/auth/oidc/callback"
+
+func newTestOIDC(t *testing.T) (*OIDCService, *oidctest.Provider, *miniredis.Miniredis) {
+	t.Helper()
+	idp := oidctest.NewProvider(t, "file-vault", "client-secret")
+	mr := miniredis.RunT(t)
+	redisClient := NewRedisClient("redis://" + mr.Addr())
+	t.Cleanup(func() { redisClient.Close() })
+
+	oidcService := NewOIDCService(redisClient, OIDCConfig{
+		IssuerURL:    idp.URL,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  testOIDCRedirect,
+		RoleClaim:    "groups",
+		AdminValues:  []string{"vault-admins"},
+	})
+	return oidcService, idp, mr
+}
+
+// startLogin runs AuthCodeURL and the provider's login and returns what arrives at the callback
+func startLogin(t *testing.T, oidcService *OIDCService, idp *oidctest.Provider) (state, code, binding string) {
+	t.Helper()
+	authURL, binding, err := oidcService.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	callback, err := idp.Login(authURL)
+	if err != nil {
+		t.Fatalf("login at provider: %v", err)
+	}
+	if !strings.HasPrefix(callback.String(), testOIDCRedirect+"?") {
+		t.Fatalf("provider redirected to %s, want the callback", callback)
+	}
+	return callback.Query().Get("state"), callback.Query().Get("code"), binding
+}
+
+func TestOIDCLogin(t *testing.T) {
+	oidcService, idp, _ := newTestOIDC(t)
+	idp.SetClaim("groups", []string{"staff", "vault-admins"})
+
+	state, code, binding := startLogin(t, oidcService, idp)
+	identity, err := oidcService.Exchange(context.Background(), state, code, binding)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Provider != "oidc" || identity.Issuer != idp.URL || identity.Subject != "user-1" ||
+		identity.Email != "ada@example.com" || identity.Username != "ada" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if identity.Role == nil || *identity.Role != models.UserRoleAdmin {
+		t.Errorf("role = %v, want ADMIN from the groups claim", identity.Role)
+	}
+}
+
+func TestOIDCAuthCodeURLUsesPKCE(t *testing.T) {
+	oidcService, _, _ := newTestOIDC(t)
+	authURL, binding, err := oidcService.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("nonce") == "" || query.Get("redirect_uri") != testOIDCRedirect {
+		t.Errorf("authorization URL lacks PKCE, nonce or redirect_uri: %s", authURL)
+	}
+	if binding != OIDCStateBinding(query.Get("state")) || binding == query.Get("state") {
+		t.Errorf("binding %q is not the hash of state %q", binding, query.Get("state"))
+	}
+}
+
+func TestOIDCStateIsBoundAndSingleUse(t *testing.T) {
+	oidcService, idp, _ := newTestOIDC(t)
+	ctx := context.Background()
+	state, code, binding := startLogin(t, oidcService, idp)
+
+	// a callback in another browser is refused without using up the state
+	_, otherBinding, err := oidcService.AuthCodeURL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wrong := range []string{"", otherBinding, state} {
+		if _, err := oidcService.Exchange(ctx, state, code, wrong); !errors.Is(err, ErrOIDCStateMismatch) {
+			t.Errorf("Exchange with binding %q = %v, want ErrOIDCStateMismatch", wrong, err)
+		}
+	}
+
+	if _, err := oidcService.Exchange(ctx, state, code, binding); err != nil {
+		t.Fatalf("Exchange in the right browser: %v", err)
+	}
+	if _, err := oidcService.Exchange(ctx, state, code, binding); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Errorf("replayed Exchange = %v, want ErrOIDCInvalidState", err)
+	}
+}
+
+func TestOIDCStateExpires(t *testing.T) {
+	oidcService, idp, mr := newTestOIDC(t)
+	state, code, binding := startLogin(t, oidcService, idp)
+
+	mr.FastForward(OIDCStateTTL + time.Second)
+	if _, err := oidcService.Exchange(context.Background(), state, code, binding); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Errorf("Exchange after %v = %v, want ErrOIDCInvalidState", OIDCStateTTL, err)
+	}
+}
+
+func TestOIDCRejectsIdentity(t *testing.T) {
+	tests := map[string]struct {
+		setup func(*testing.T, *oidctest.Provider)
+		want  string
+	}{
+		"unverified email": {
+			setup: func(_ *testing.T, idp *oidctest.Provider) { idp.SetClaim("email_verified", false) },
+			want:  "Email address is not verified",
+		},
+		"email_verified missing": {
+			setup: func(_ *testing.T, idp *oidctest.Provider) { idp.SetClaim("email_verified", nil) },
+			want:  "Email address is not verified",
+		},
+		"no email": {
+			setup: func(_ *testing.T, idp *oidctest.Provider) { idp.SetClaim("email", nil) },
+			want:  "did not return an email address",
+		},
+		"nonce of another login": {
+			setup: func(_ *testing.T, idp *oidctest.Provider) { idp.Nonce = "replayed" },
+			want:  "nonce mismatch",
+		},
+		"unknown signing key": {
+			setup: func(t *testing.T, idp *oidctest.Provider) { idp.SignWithUnknownKey(t) },
+			want:  "Verify id_token",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			oidcService, idp, _ := newTestOIDC(t)
+			tt.setup(t, idp)
+
+			state, code, binding := startLogin(t, oidcService, idp)
+			identity, err := oidcService.Exchange(context.Background(), state, code, binding)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Exchange = %+v, %v, want an error containing %q", identity, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCAcceptsStringEmailVerified(t *testing.T) {
+	oidcService, idp, _ := newTestOIDC(t)
+	idp.SetClaim("email_verified", "true")
+
+	state, code, binding := startLogin(t, oidcService, idp)
+	if _, err := oidcService.Exchange(context.Background(), state, code, binding); err != nil {
+		t.Errorf("Exchange with email_verified \"true\": %v", err)
+	}
+}
+
+func TestOIDCMapRole(t *testing.T) {
+	oidcService := NewOIDCService(nil, OIDCConfig{RoleClaim: "roles", AdminValues: []string{"Admin", "vault-admins"}})
+	tests := []struct {
+		claim any
+		want  models.UserRole
+	}{
+		{[]any{"staff", "vault-admins"}, models.UserRoleAdmin},
+		{[]any{"staff"}, models.UserRoleUser},
+		{"staff, admin", models.UserRoleAdmin}, // comma separated and case-insensitive
+		{"staff vault-admins", models.UserRoleAdmin},
+		{"administrators", models.UserRoleUser},
+		{nil, models.UserRoleUser}, // a missing claim demotes
+	}
+	for _, tt := range tests {
+		got := oidcService.mapRole(map[string]any{"roles": tt.claim})
+		if got == nil || *got != tt.want {
+			t.Errorf("mapRole(%v) = %v, want %s", tt.claim, got, tt.want)
+		}
+	}
+
+	withoutClaim := NewOIDCService(nil, OIDCConfig{})
+	if got := withoutClaim.mapRole(map[string]any{"roles": []any{"Admin"}}); got != nil {
+		t.Errorf("mapRole without RoleClaim = %v, want nil to leave roles alone", *got)
+	}
+}
@@ -0,0 +1,456 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// settings an organization admin can change
+const (
+	OrgSettingAllowPublicSharing = "allow_public_sharing"
+	OrgSettingAllowGroupCreation = "allow_member_group_creation"
+)
+
+var orgSettingDefaults = map[string]string{
+	OrgSettingAllowPublicSharing: "true",
+	OrgSettingAllowGroupCreation: "true",
+}
+
+var (
+	ErrOrgNotFound       = errors.New("organization not found")
+	ErrNotOrgMember      = errors.New("not a member of this organization")
+	ErrNoOrganization    = errors.New("user does not belong to any organization")
+	ErrUnknownOrgSetting = errors.New("unknown organization setting")
+	ErrInvalidOrgSlug    = errors.New("slug must be 3-50 lowercase letters, digits or dashes")
+	ErrLastOrgOwner      = errors.New("an organization needs at least one owner")
+)
+
+var orgSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,48}[a-z0-9]$`)
+
+// OrgMembership is the organization a request acts in and the caller's role there
+type OrgMembership struct {
+	OrgID uuid.UUID
+	Role  models.OrgRole
+}
+
+type OrganizationService struct {
+	db    *sql.DB
+	audit *AuditService
+}
+
+func NewOrganizationService(db *sql.DB, audit *AuditService) *OrganizationService {
+	return &OrganizationService{db: db, audit: audit}
+}
+
+// Current resolves the organization of a request: the one named in the X-Organization-ID
+// header when the user belongs to it, otherwise their default organization.
+func (orgs *OrganizationService) Current(ctx context.Context, userID string) (*OrgMembership, error) {
+	if requested := auth.GetOrgIDFromContext(ctx); requested != "" {
+		orgID, err := uuid.Parse(requested)
+		if err != nil {
+			return nil, ErrOrgNotFound
+		}
+		membership, err := orgs.Membership(orgID, userID)
+		if err != nil {
+			return nil, err
+		}
+		return membership, nil
+	}
+
+	// the default organization, falling back to the oldest membership if it was left
+	var membership OrgMembership
+	query := `
+		SELECT om.org_id, om.role
+		FROM organization_members om
+		JOIN users u ON u.id = om.user_id
+		WHERE om.user_id = $1
+		ORDER BY (om.org_id = u.default_org_id) DESC, om.joined_at
+		LIMIT 1
+	`
+	err := orgs.db.QueryRow(query, userID).Scan(&membership.OrgID, &membership.Role)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoOrganization
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &membership, nil
+}
+
+func (orgs *OrganizationService) Membership(orgID uuid.UUID, userID string) (*OrgMembership, error) {
+	membership := OrgMembership{OrgID: orgID}
+	query := `SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2`
+	err := orgs.db.QueryRow(query, orgID, userID).Scan(&membership.Role)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotOrgMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &membership, nil
+}
+
+// IsMember reports whether userID belongs to orgID
+func (orgs *OrganizationService) IsMember(orgID uuid.UUID, userID string) (bool, error) {
+	_, err := orgs.Membership(orgID, userID)
+	if errors.Is(err, ErrNotOrgMember) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SharesOrganization reports whether the two users are members of at least one common
+// organization. The default organization doesn't count, every account joins it.
+func (orgs *OrganizationService) SharesOrganization(userID, otherID string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM organization_members a
+			JOIN organization_members b ON b.org_id = a.org_id
+			JOIN organizations o ON o.id = a.org_id
+			WHERE a.user_id = $1 AND b.user_id = $2 AND o.slug <> 'default'
+		)`
+	var shares bool
+	err := orgs.db.QueryRow(query, userID, otherID).Scan(&shares)
+	return shares, err
+}
+
+// Create adds an organization with ownerID as its owner
+func (orgs *OrganizationService) Create(ctx context.Context, name, slug string, ownerID string) (*models.Organization, error) {
+	if !orgSlugPattern.MatchString(slug) {
+		return nil, ErrInvalidOrgSlug
+	}
+
+	tx, err := orgs.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	owner := models.OrgRoleOwner
+	org := models.Organization{Name: name, Slug: slug, Role: &owner}
+	query := `INSERT INTO organizations (name, slug) VALUES ($1, $2) RETURNING id, created_at, updated_at`
+	if err := tx.QueryRow(query, name, slug).Scan(&org.ID, &org.CreatedAt, &org.UpdatedAt); err != nil {
+		return nil, err
+	}
+	query = `INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, 'OWNER')`
+	if _, err := tx.Exec(query, org.ID, ownerID); err != nil {
+		return nil, err
+	}
+	err = orgs.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionOrgCreated,
+		OrgID:   &org.ID,
+		Details: AuditDetails{"name": name, "slug": slug},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &org, tx.Commit()
+}
+
+// Get loads an organization, with the role userID has in it
+func (orgs *OrganizationService) Get(orgID uuid.UUID, userID string) (*models.Organization, error) {
+	var org models.Organization
+	query := `
+		SELECT o.id, o.name, o.slug, o.storage_quota, o.created_at, o.updated_at, om.role
+		FROM organizations o
+		LEFT JOIN organization_members om ON om.org_id = o.id AND om.user_id = $2
+		WHERE o.id = $1
+	`
+	err := orgs.db.QueryRow(query, orgID, userID).Scan(
+		&org.ID, &org.Name, &org.Slug, &org.StorageQuota, &org.CreatedAt, &org.UpdatedAt, &org.Role,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrOrgNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+func (orgs *OrganizationService) ListForUser(userID string) ([]*models.Organization, error) {
+	query := `
+		SELECT o.id, o.name, o.slug, o.storage_quota, o.created_at, o.updated_at, om.role
+		FROM organizations o
+		JOIN organization_members om ON om.org_id = o.id
+		WHERE om.user_id = $1
+		ORDER BY o.name
+	`
+	rows, err := orgs.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations := []*models.Organization{}
+	for rows.Next() {
+		var org models.Organization
+		err := rows.Scan(&org.ID, &org.Name, &org.Slug, &org.StorageQuota, &org.CreatedAt, &org.UpdatedAt, &org.Role)
+		if err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, &org)
+	}
+	return organizations, rows.Err()
+}
+
+// SetDefault makes orgID the organization used when a request names none
+func (orgs *OrganizationService) SetDefault(orgID uuid.UUID, userID string) error {
+	if _, err := orgs.Membership(orgID, userID); err != nil {
+		return err
+	}
+	_, err := orgs.db.Exec(`UPDATE users SET default_org_id = $1 WHERE id = $2`, orgID, userID)
+	return err
+}
+
+func (orgs *OrganizationService) Members(orgID uuid.UUID) ([]*models.OrganizationMember, error) {
+	query := `
+		SELECT om.org_id, om.user_id, om.role, om.joined_at,
+			u.id, u.username, u.email, u.email_verified, u.role, u.storage_quota, u.totp_enabled, u.created_at, u.updated_at
+		FROM organization_members om
+		JOIN users u ON u.id = om.user_id
+		WHERE om.org_id = $1
+		ORDER BY u.username
+	`
+	rows, err := orgs.db.Query(query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*models.OrganizationMember{}
+	for rows.Next() {
+		var member models.OrganizationMember
+		var user models.User
+		err := rows.Scan(&member.OrgID, &member.UserID, &member.Role, &member.JoinedAt,
+			&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.Role,
+			&user.StorageQuota, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		member.User = &user
+		members = append(members, &member)
+	}
+	return members, rows.Err()
+}
+
+// AddMember adds userID to orgID, or changes their role when they already belong to it
+func (orgs *OrganizationService) AddMember(ctx context.Context, orgID, userID uuid.UUID, role models.OrgRole) error {
+	tx, err := orgs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous *models.OrgRole
+	query := `SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2 FOR UPDATE`
+	if err := tx.QueryRow(query, orgID, userID).Scan(&previous); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	query = `
+		INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role
+	`
+	if _, err := tx.Exec(query, orgID, userID, role); err != nil {
+		return err
+	}
+	if err := ensureOrgOwner(tx, orgID); err != nil {
+		return err
+	}
+	details := AuditChange(previous, role)
+	details["target_user_id"] = userID
+	err = orgs.audit.Record(ctx, tx, AuditEvent{Action: models.AuditActionOrgMemberAdded, OrgID: &orgID, Details: details})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember takes userID out of orgID together with everything that gave them access
+// to the organization's files: group memberships and direct file or folder shares.
+func (orgs *OrganizationService) RemoveMember(ctx context.Context, orgID, userID uuid.UUID) error {
+	tx, err := orgs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM organization_members WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotOrgMember
+	}
+	if err := ensureOrgOwner(tx, orgID); err != nil {
+		return err
+	}
+
+	cleanup := []string{
+		`DELETE FROM group_members gm USING user_groups g
+		 WHERE gm.group_id = g.id AND g.org_id = $1 AND gm.user_id = $2`,
+		`DELETE FROM file_shares fs USING user_files uf
+		 WHERE fs.file_id = uf.id AND uf.org_id = $1 AND fs.shared_with_user_id = $2`,
+		`DELETE FROM folder_shares fos USING folders f
+		 WHERE fos.folder_id = f.id AND f.org_id = $1 AND fos.shared_with_user_id = $2`,
+		`UPDATE users SET default_org_id = NULL WHERE id = $2 AND default_org_id = $1`,
+	}
+	for _, query := range cleanup {
+		if _, err := tx.Exec(query, orgID, userID); err != nil {
+			return fmt.Errorf("failed to revoke organization access: %w", err)
+		}
+	}
+	if err := RevokeStaleDownloads(tx, userID); err != nil {
+		return err
+	}
+	err = orgs.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionOrgMemberRemoved,
+		OrgID:   &orgID,
+		Details: AuditDetails{"target_user_id": userID},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func ensureOrgOwner(tx *sql.Tx, orgID uuid.UUID) error {
+	var owners int
+	query := `SELECT COUNT(*) FROM organization_members WHERE org_id = $1 AND role = 'OWNER'`
+	if err := tx.QueryRow(query, orgID).Scan(&owners); err != nil {
+		return err
+	}
+	// the default organization is managed by platform admins and may have no owner
+	var slug string
+	if err := tx.QueryRow(`SELECT slug FROM organizations WHERE id = $1`, orgID).Scan(&slug); err != nil {
+		return err
+	}
+	if owners == 0 && slug != "default" {
+		return ErrLastOrgOwner
+	}
+	return nil
+}
+
+// SetQuota sets the storage limit of the whole organization, nil removes it
+func (orgs *OrganizationService) SetQuota(ctx context.Context, orgID uuid.UUID, quota *int64) error {
+	tx, err := orgs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous *int64
+	err = tx.QueryRow(`SELECT storage_quota FROM organizations WHERE id = $1 FOR UPDATE`, orgID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return ErrOrgNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE organizations SET storage_quota = $1, updated_at = NOW() WHERE id = $2`, quota, orgID); err != nil {
+		return err
+	}
+	err = orgs.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionOrgQuotaChanged,
+		OrgID:   &orgID,
+		Details: AuditChange(previous, quota),
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Settings returns every known setting of orgID, with defaults for the unset ones
+func (orgs *OrganizationService) Settings(orgID uuid.UUID) ([]*models.OrganizationSetting, error) {
+	values := map[string]string{}
+	for key, value := range orgSettingDefaults {
+		values[key] = value
+	}
+
+	rows, err := orgs.db.Query(`SELECT key, value FROM organization_settings WHERE org_id = $1`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	settings := []*models.OrganizationSetting{}
+	for _, key := range []string{OrgSettingAllowPublicSharing, OrgSettingAllowGroupCreation} {
+		settings = append(settings, &models.OrganizationSetting{Key: key, Value: values[key]})
+	}
+	return settings, nil
+}
+
+func (orgs *OrganizationService) GetBoolSetting(orgID uuid.UUID, key string) (bool, error) {
+	value, ok := orgSettingDefaults[key]
+	if !ok {
+		return false, ErrUnknownOrgSetting
+	}
+	err := orgs.db.QueryRow(`SELECT value FROM organization_settings WHERE org_id = $1 AND key = $2`, orgID, key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+func (orgs *OrganizationService) SetSetting(ctx context.Context, orgID uuid.UUID, key, value string) error {
+	if _, ok := orgSettingDefaults[key]; !ok {
+		return ErrUnknownOrgSetting
+	}
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("setting %s must be true or false", key)
+	}
+
+	tx, err := orgs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	previous := orgSettingDefaults[key]
+	query := `SELECT value FROM organization_settings WHERE org_id = $1 AND key = $2 FOR UPDATE`
+	if err := tx.QueryRow(query, orgID, key).Scan(&previous); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	query = `
+		INSERT INTO organization_settings (org_id, key, value, updated_at) VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (org_id, key) DO UPDATE SET value = EXCLUDED.value, updated_at = NOW()
+	`
+	if _, err := tx.Exec(query, orgID, key, value); err != nil {
+		return err
+	}
+	details := AuditChange(previous, value)
+	details["key"] = key
+	err = orgs.audit.Record(ctx, tx, AuditEvent{Action: models.AuditActionOrgSettingsChanged, OrgID: &orgID, Details: details})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HasPermission reports whether an organization role grants permission inside that organization
+func (orgs *OrganizationService) HasPermission(role models.OrgRole, permission models.Permission) (bool, error) {
+	var allowed bool
+	query := `SELECT EXISTS(SELECT 1 FROM org_role_permissions WHERE role = $1 AND permission = $2)`
+	err := orgs.db.QueryRow(query, role, permission).Scan(&allowed)
+	return allowed, err
+}
@@ -0,0 +1,29 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSharesOrganizationIgnoresDefault(t *testing.T) {
+	db := testDB(t)
+	orgs := NewOrganizationService(db, NewAuditService(db))
+	manager, other := testUser(t, db), testUser(t, db)
+
+	shares, err := orgs.SharesOrganization(manager.String(), other.String())
+	if err != nil || shares {
+		t.Fatalf("SharesOrganization with only the default organization in common = %v, %v, want false", shares, err)
+	}
+
+	orgID := testOrg(t, db)
+	for _, userID := range []uuid.UUID{manager, other} {
+		if _, err := db.Exec(`INSERT INTO organization_members (org_id, user_id) VALUES ($1, $2)`, orgID, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shares, err = orgs.SharesOrganization(manager.String(), other.String())
+	if err != nil || !shares {
+		t.Errorf("SharesOrganization with a common organization = %v, %v, want true", shares, err)
+	}
+}
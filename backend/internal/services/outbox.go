@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+const (
+	JobOutboxRelay = "outbox.relay"
+
+	outboxBatchSize = 100
+)
+
+// OutboxHandler passes on one message of a topic. A returned error keeps the message and
+// every later one in the outbox until the relay is retried.
+type OutboxHandler func(ctx context.Context, payload json.RawMessage) error
+
+// Outbox holds messages for systems outside the database, e.g. the event bus. They are
+// written in the transaction of the change and relayed once it committed, at least once
+// and in the order they were added. Relays run one at a time, so they can't overtake each
+// other.
+type Outbox struct {
+	db   *sql.DB
+	jobs *JobQueue
+
+	mu       sync.RWMutex
+	handlers map[string]OutboxHandler
+}
+
+func NewOutbox(db *sql.DB, jobs *JobQueue) *Outbox {
+	outbox := &Outbox{db: db, jobs: jobs, handlers: map[string]OutboxHandler{}}
+	jobs.Register(JobOutboxRelay, outbox.Relay)
+	return outbox
+}
+
+// Handle sets the handler of a topic
+func (o *Outbox) Handle(topic string, handler OutboxHandler) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handlers[topic] = handler
+}
+
+// Add writes a message and queues a relay for it. A queued relay that starts before the
+// transaction of exec commits misses the message, the scheduled relay picks those up.
+func (o *Outbox) Add(exec JobExecutor, topic string, payload interface{}) error {
+	if exec == nil {
+		exec = o.db
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := exec.Exec(`INSERT INTO outbox (topic, payload) VALUES ($1, $2)`, topic, string(body)); err != nil {
+		return fmt.Errorf("failed to add %s message to outbox: %w", topic, err)
+	}
+	return o.jobs.Enqueue(exec, JobOutboxRelay, struct{}{}, JobOptions{UniqueKey: JobOutboxRelay})
+}
+
+// Relay passes the messages in the outbox to their handlers until it is empty. It is the
+// handler of outbox.relay jobs.
+func (o *Outbox) Relay(ctx context.Context, _ json.RawMessage) error {
+	for {
+		relayed, err := o.relayBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if relayed < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+func (o *Outbox) relayBatch(ctx context.Context) (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// one relay at a time keeps the order, the next one waits and continues after this batch
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('outbox.relay'))`); err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT id, topic, payload::text FROM outbox ORDER BY id LIMIT $1`, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type message struct {
+		id      int64
+		topic   string
+		payload string
+	}
+	var messages []message
+	for rows.Next() {
+		var m message
+		if err := rows.Scan(&m.id, &m.topic, &m.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var relayed []int64
+	for _, m := range messages {
+		o.mu.RLock()
+		handler := o.handlers[m.topic]
+		o.mu.RUnlock()
+		if handler == nil {
+			slog.WarnContext(ctx, "Dropping outbox message without a handler", "topic", m.topic, "message_id", m.id)
+		} else if err := handler(ctx, json.RawMessage(m.payload)); err != nil {
+			// keep what was relayed so far, the rest is retried with the job
+			if _, delErr := tx.Exec(`DELETE FROM outbox WHERE id = ANY($1)`, pq.Array(relayed)); delErr == nil {
+				tx.Commit()
+			}
+			return 0, fmt.Errorf("failed to relay %s message %d: %w", m.topic, m.id, err)
+		}
+		relayed = append(relayed, m.id)
+	}
+	if len(messages) > 0 {
+		if _, err := tx.Exec(`DELETE FROM outbox WHERE id = ANY($1)`, pq.Array(relayed)); err != nil {
+			return 0, err
+		}
+	}
+	return len(messages), tx.Commit()
+}
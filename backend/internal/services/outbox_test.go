@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestConcurrentRelaysKeepOrder(t *testing.T) {
+	db := testDB(t)
+	outbox := NewOutbox(db, NewJobQueue(db, JobQueueConfig{}))
+	topic := "test." + uuid.NewString()
+	t.Cleanup(func() { db.Exec(`DELETE FROM jobs WHERE unique_key = $1 AND status = 'QUEUED'`, JobOutboxRelay) })
+
+	var mu sync.Mutex
+	var relayed []int
+	outbox.Handle(topic, func(ctx context.Context, payload json.RawMessage) error {
+		var n int
+		if err := json.Unmarshal(payload, &n); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond) // give a second relay the chance to overtake
+		mu.Lock()
+		relayed = append(relayed, n)
+		mu.Unlock()
+		return nil
+	})
+
+	const messages = 2*outboxBatchSize + 10
+	for n := range messages {
+		if err := outbox.Add(nil, topic, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := outbox.Relay(context.Background(), nil); err != nil {
+				t.Errorf("Relay: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(relayed) != messages {
+		t.Fatalf("relayed %d messages, want %d", len(relayed), messages)
+	}
+	for i, n := range relayed {
+		if n != i {
+			t.Fatalf("message %d relayed at position %d, want in order: %v", n, i, relayed)
+		}
+	}
+}
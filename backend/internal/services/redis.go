@@ -1,6 +1,9 @@
 package services
 
 import (
+	"context"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -12,7 +15,11 @@ func NewRedisClient(redisURL string) *RedisClient {
 	if opt, err := redis.ParseURL(redisURL); err != nil {
 		panic("Failed to parse redis URL: " + err.Error())
 	} else {
-		return &RedisClient{client: redis.NewClient(opt)}
+		client := redis.NewClient(opt)
+		if err := redisotel.InstrumentTracing(client); err != nil {
+			panic("Failed to instrument redis: " + err.Error())
+		}
+		return &RedisClient{client: client}
 	}
 }
 
@@ -23,3 +30,8 @@ func (rc *RedisClient) Close() error {
 
 
 
+
+// Ping checks that Redis answers
+func (rc *RedisClient) Ping(ctx context.Context) error {
+	return rc.client.Ping(ctx).Err()
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"file-vault/internal/logging"
+	"file-vault/internal/models"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	ErrScheduledTaskNotFound = errors.New("scheduled task not found")
+	ErrScheduledTaskRunning  = errors.New("scheduled task is already running")
+)
+
+// ScheduledTaskFunc is the work of a scheduled task
+type ScheduledTaskFunc func(ctx context.Context) error
+
+type scheduledTask struct {
+	name     string
+	spec     string
+	schedule cron.Schedule
+	run      ScheduledTaskFunc
+}
+
+// Scheduler runs periodic maintenance on cron schedules, once per cluster. Every instance
+// checks the schedules, the one that gets a task's Postgres advisory lock moves next_run_at
+// past the slot and runs it. The lock is held in a transaction for the whole run, so runs
+// never overlap, and goes away with the connection of an instance that crashed.
+type Scheduler struct {
+	db       *sql.DB
+	interval time.Duration
+	instance string
+
+	mu    sync.RWMutex
+	tasks map[string]*scheduledTask
+	ctx   context.Context
+	runs  sync.WaitGroup
+}
+
+func NewScheduler(db *sql.DB, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		interval: interval,
+		instance: instanceID(),
+		tasks:    map[string]*scheduledTask{},
+		ctx:      context.Background(),
+	}
+}
+
+// Register adds a task running on spec, a five field cron expression or a descriptor like
+// @hourly or @every 30m. Tasks are registered before Run, those scheduled "off" are skipped.
+func (s *Scheduler) Register(name, spec string, run ScheduledTaskFunc) error {
+	if spec == "off" {
+		return nil
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q for %s: %w", spec, name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[name] = &scheduledTask{name: name, spec: spec, schedule: schedule, run: run}
+	return nil
+}
+
+func (s *Scheduler) task(name string) *scheduledTask {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tasks[name]
+}
+
+// Run checks the schedules every interval until ctx is done, then waits for the runs it
+// started. Runs get ctx, so they are asked to stop with it.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	s.ctx = ctx
+	tasks := make([]*scheduledTask, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, task)
+	}
+	s.mu.Unlock()
+
+	for _, task := range tasks {
+		if err := s.sync(task); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		for _, task := range tasks {
+			s.runs.Add(1)
+			go func() {
+				defer s.runs.Done()
+				if err := s.start(ctx, task, models.ScheduledTaskTriggerSchedule, nil, nil); err != nil {
+					slog.ErrorContext(ctx, "Failed to run scheduled task", "task", task.name, "error", err)
+				}
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			s.runs.Wait()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync stores a task's schedule. A changed schedule starts over from now, an unchanged one
+// keeps the slot the cluster is at.
+func (s *Scheduler) sync(task *scheduledTask) error {
+	_, err := s.db.Exec(`
+		INSERT INTO scheduled_tasks (name, schedule, next_run_at) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET
+			next_run_at = CASE WHEN scheduled_tasks.schedule = EXCLUDED.schedule
+				THEN scheduled_tasks.next_run_at ELSE EXCLUDED.next_run_at END,
+			schedule = EXCLUDED.schedule,
+			updated_at = NOW()
+	`, task.name, task.spec, task.schedule.Next(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to store schedule of %s: %w", task.name, err)
+	}
+	return nil
+}
+
+// RunNow starts a task outside its schedule and returns the run, which continues in the
+// background
+func (s *Scheduler) RunNow(name string, userID uuid.UUID) (*models.ScheduledTaskRun, error) {
+	task := s.task(name)
+	if task == nil {
+		return nil, ErrScheduledTaskNotFound
+	}
+	s.mu.RLock()
+	ctx := s.ctx
+	s.mu.RUnlock()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	started := make(chan *models.ScheduledTaskRun, 1)
+	finished := make(chan error, 1)
+	s.runs.Add(1)
+	go func() {
+		defer s.runs.Done()
+		err := s.start(ctx, task, models.ScheduledTaskTriggerManual, &userID, func(run *models.ScheduledTaskRun) {
+			started <- run
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to run scheduled task", "task", task.name, "error", err)
+		}
+		finished <- err
+	}()
+
+	select {
+	case run := <-started:
+		return run, nil
+	case err := <-finished:
+		select {
+		case run := <-started:
+			return run, nil
+		default:
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrScheduledTaskRunning
+	}
+}
+
+// start runs task if this instance gets its lock and, for scheduled runs, the task is due.
+// Nothing runs when either is not the case. onStart gets the run once it is recorded,
+// before the task itself runs.
+func (s *Scheduler) start(ctx context.Context, task *scheduledTask, trigger models.ScheduledTaskTrigger, userID *uuid.UUID, onStart func(*models.ScheduledTaskRun)) error {
+	tx, err := s.db.BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, schedulerLockKey(task.name)).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+
+	// the schedule itself is updated outside the transaction, which only holds the lock
+	if trigger == models.ScheduledTaskTriggerSchedule {
+		result, err := s.db.Exec(`
+			UPDATE scheduled_tasks SET next_run_at = $3, last_run_at = NOW()
+			WHERE name = $1 AND schedule = $2 AND next_run_at <= NOW()
+		`, task.name, task.spec, task.schedule.Next(time.Now()))
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil
+		}
+	} else if _, err := s.db.Exec(`UPDATE scheduled_tasks SET last_run_at = NOW() WHERE name = $1`, task.name); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO scheduled_task_runs (task_name, trigger, triggered_by, instance) VALUES ($1, $2, $3, $4)
+		RETURNING ` + scheduledTaskRunColumns
+	run, err := scanScheduledTaskRun(s.db.QueryRow(query, task.name, trigger, userID, s.instance))
+	if err != nil {
+		return err
+	}
+	if onStart != nil {
+		onStart(run)
+	}
+
+	taskCtx := logging.With(ctx, slog.String("task", task.name), slog.String("run_id", run.ID.String()))
+	runErr := runScheduledTask(taskCtx, task)
+	status, message := models.ScheduledTaskRunSucceeded, (*string)(nil)
+	if runErr != nil {
+		text := runErr.Error()
+		status, message = models.ScheduledTaskRunFailed, &text
+		slog.ErrorContext(ctx, "Scheduled task failed", "task", task.name, "run_id", run.ID, "error", runErr)
+	}
+	_, err = s.db.Exec(`
+		UPDATE scheduled_task_runs SET status = $2, error = $3, finished_at = NOW() WHERE id = $1
+	`, run.ID, status, message)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runScheduledTask turns a panicking task into a failed run
+func runScheduledTask(ctx context.Context, task *scheduledTask) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("task panicked: %v", recovered)
+		}
+	}()
+	return task.run(ctx)
+}
+
+func schedulerLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("filevault:scheduler:" + name))
+	return int64(h.Sum64())
+}
+
+const scheduledTaskRunColumns = `id, task_name, trigger, triggered_by, instance, status, error, started_at, finished_at`
+
+func scanScheduledTaskRun(row rowScanner) (*models.ScheduledTaskRun, error) {
+	var run models.ScheduledTaskRun
+	err := row.Scan(&run.ID, &run.TaskName, &run.Trigger, &run.TriggeredBy, &run.Instance, &run.Status, &run.Error,
+		&run.StartedAt, &run.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// Tasks returns the tasks registered in this instance with their schedule state and last run
+func (s *Scheduler) Tasks() ([]*models.ScheduledTask, error) {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.tasks))
+	for name := range s.tasks {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+
+	tasks := []*models.ScheduledTask{}
+	for _, name := range names {
+		var task models.ScheduledTask
+		err := s.db.QueryRow(`SELECT name, schedule, next_run_at, last_run_at FROM scheduled_tasks WHERE name = $1`, name).
+			Scan(&task.Name, &task.Schedule, &task.NextRunAt, &task.LastRunAt)
+		if err == sql.ErrNoRows {
+			continue // not stored before Run
+		}
+		if err != nil {
+			return nil, err
+		}
+		query := `SELECT ` + scheduledTaskRunColumns + ` FROM scheduled_task_runs WHERE task_name = $1 ORDER BY started_at DESC LIMIT 1`
+		task.LastRun, err = scanScheduledTaskRun(s.db.QueryRow(query, name))
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		tasks = append(tasks, &task)
+	}
+	return tasks, nil
+}
+
+// Runs returns the newest runs, optionally only those of one task
+func (s *Scheduler) Runs(name *string, limit int) ([]*models.ScheduledTaskRun, error) {
+	query := `SELECT ` + scheduledTaskRunColumns + ` FROM scheduled_task_runs
+		WHERE $1::text IS NULL OR task_name = $1
+		ORDER BY started_at DESC
+		LIMIT $2`
+	rows, err := s.db.Query(query, name, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []*models.ScheduledTaskRun{}
+	for rows.Next() {
+		run, err := scanScheduledTaskRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
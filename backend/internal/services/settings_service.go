@@ -0,0 +1,64 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"file-vault/internal/models"
+	"strconv"
+)
+
+const SettingAdminTwoFactorRequired = "admin_2fa_required"
+
+// SettingsService reads and writes runtime settings stored in app_settings
+type SettingsService struct {
+	db    *sql.DB
+	audit *AuditService
+}
+
+func NewSettingsService(db *sql.DB, audit *AuditService) *SettingsService {
+	return &SettingsService{db: db, audit: audit}
+}
+
+func (ss *SettingsService) Get(key string) (string, error) {
+	var value string
+	err := ss.db.QueryRow(`SELECT value FROM app_settings WHERE key = $1`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (ss *SettingsService) GetBool(key string) (bool, error) {
+	value, err := ss.Get(key)
+	if err != nil || value == "" {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+func (ss *SettingsService) Set(ctx context.Context, key, value string) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous *string
+	err = tx.QueryRow(`SELECT value FROM app_settings WHERE key = $1 FOR UPDATE`, key).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	query := `
+		INSERT INTO app_settings (key, value, updated_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = NOW()
+	`
+	if _, err := tx.Exec(query, key, value); err != nil {
+		return err
+	}
+	details := AuditChange(previous, value)
+	details["key"] = key
+	if err := ss.audit.Record(ctx, tx, AuditEvent{Action: models.AuditActionSettingChanged, Details: details}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -85,3 +85,48 @@ func (ss *StorageService) GetUserStats(userID string) (*models.StorageStats, err
 
 	return &stats, err
 }
+
+// GetOrgStats reports storage of one organization. Contents shared by several files of the
+// org are counted once, like the global stats do across the whole server.
+func (ss *StorageService) GetOrgStats(orgID string) (*models.StorageStats, error) {
+	query := `
+		WITH org_files AS (
+			SELECT uf.user_id, uf.file_content_id, fc.size
+			FROM user_files uf
+			JOIN file_contents fc ON uf.file_content_id = fc.id
+			WHERE uf.org_id = $1
+		),
+		org_storage_data AS (
+			SELECT
+				COALESCE((SELECT SUM(size) FROM (SELECT DISTINCT file_content_id, size FROM org_files) contents), 0) as total_deduplicated,
+				COALESCE(SUM(size), 0) as total_original,
+				COUNT(DISTINCT user_id) as user_count,
+				COUNT(*) as file_count
+			FROM org_files
+		)
+		SELECT 
+			total_deduplicated,
+			total_original,
+			total_original - total_deduplicated as saved_bytes,
+			CASE 
+				WHEN total_original > 0 THEN 
+					((total_original - total_deduplicated)::float / total_original::float) * 100
+				ELSE 0
+			END as saved_percentage,
+			user_count,
+			file_count
+		FROM org_storage_data
+	`
+
+	var stats models.StorageStats
+	err := ss.db.QueryRow(query, orgID).Scan(
+		&stats.TotalUsed,
+		&stats.OriginalSize,
+		&stats.SavedBytes,
+		&stats.SavedPercentage,
+		&stats.UserCount,
+		&stats.FileCount,
+	)
+
+	return &stats, err
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+)
+
+const thumbnailSize = 256
+
+// thumbnailMimeTypes are the images thumbnails can be generated for
+var thumbnailMimeTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+func CanThumbnail(mimeType string) bool {
+	return thumbnailMimeTypes[mimeType]
+}
+
+// GenerateThumbnail scales the image at filePath down to fit thumbnailSize and stores it
+// as a JPEG next to the other blobs, returning its path. Thumbnails are named after the
+// content hash, regenerating one overwrites it.
+func (fs *FileService) GenerateThumbnail(filePath, hash string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	// refuse decompression bombs before allocating the full image
+	if config.Width*config.Height > 50_000_000 {
+		return "", fmt.Errorf("image of %dx%d is too large for a thumbnail", config.Width, config.Height)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	dir := filepath.Join(fs.storagePath, "thumbnails")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, hash+".jpg")
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := jpeg.Encode(out, scaleDown(src, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// scaleDown fits src into a size x size box by averaging the source pixels under each
+// thumbnail pixel. Images that already fit are only converted.
+func scaleDown(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/bounds.Dx())
+		} else {
+			width, height = max(1, width*size/bounds.Dy()), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			// JPEG has no alpha, transparent areas become white
+			alpha := a / n
+			white := 0xffff - alpha
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white), G: uint16(g/n + white), B: uint16(b/n + white), A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+type TwoFactorService struct {
+	db     *sql.DB
+	issuer string
+	audit  *AuditService
+}
+
+type TwoFactorEnrollment struct {
+	Secret     string
+	OtpauthURI string
+}
+
+func NewTwoFactorService(db *sql.DB, issuer string, audit *AuditService) *TwoFactorService {
+	return &TwoFactorService{db: db, issuer: issuer, audit: audit}
+}
+
+func (tf *TwoFactorService) IsEnabled(userID string) (bool, error) {
+	var enabled bool
+	err := tf.db.QueryRow(`SELECT totp_enabled FROM users WHERE id = $1`, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// BeginEnrollment stores a fresh, not yet enabled secret for the user.
+// Calling it again before confirming replaces the pending secret.
+func (tf *TwoFactorService) BeginEnrollment(userID string) (*TwoFactorEnrollment, error) {
+	var email string
+	var enabled bool
+	err := tf.db.QueryRow(`SELECT email, totp_enabled FROM users WHERE id = $1`, userID).Scan(&email, &enabled)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, fmt.Errorf("Failed::Two-factor authentication is already enabled")
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tf.db.Exec(`UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2`, secret, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TwoFactorEnrollment{
+		Secret:     secret,
+		OtpauthURI: auth.TOTPURI(tf.issuer, email, secret),
+	}, nil
+}
+
+// ConfirmEnrollment enables 2FA once the user proves their authenticator works
+// and returns the plaintext recovery codes. They are never retrievable again.
+func (tf *TwoFactorService) ConfirmEnrollment(ctx context.Context, userID, code string) ([]string, error) {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	var lastStep int64
+	err = tx.QueryRow(`SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1 FOR UPDATE`, userID).
+		Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, fmt.Errorf("Failed::Two-factor authentication is already enabled")
+	}
+	if !secret.Valid {
+		return nil, fmt.Errorf("Failed::Two-factor enrollment has not been started")
+	}
+
+	step, ok := auth.ValidateTOTP(secret.String, code, time.Now())
+	if !ok || step <= lastStep {
+		return nil, fmt.Errorf("Failed::Invalid two-factor code")
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled = true, totp_last_step = $1 WHERE id = $2`, step, userID); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tf.audit.Record(ctx, tx, AuditEvent{UserID: userID, Action: models.AuditActionTwoFactorEnabled}); err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// Verify accepts either a current TOTP code or an unused recovery code
+func (tf *TwoFactorService) Verify(userID, code string) (bool, error) {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	var lastStep int64
+	err = tx.QueryRow(`SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1 FOR UPDATE`, userID).
+		Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		return false, err
+	}
+	if !enabled || !secret.Valid {
+		return false, nil
+	}
+
+	if step, ok := auth.ValidateTOTP(secret.String, code, time.Now()); ok {
+		// a code can only be used once, even within its validity window
+		if step <= lastStep {
+			return false, nil
+		}
+		if _, err := tx.Exec(`UPDATE users SET totp_last_step = $1 WHERE id = $2`, step, userID); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	result, err := tx.Exec(`
+		UPDATE user_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (tf *TwoFactorService) Disable(ctx context.Context, userID string) error {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0 WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if err := tf.audit.Record(ctx, tx, AuditEvent{UserID: userID, Action: models.AuditActionTwoFactorDisabled}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tf *TwoFactorService) RegenerateRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tf.audit.Record(ctx, tx, AuditEvent{UserID: userID, Action: models.AuditActionRecoveryCodesRegenerated}); err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func (tf *TwoFactorService) RemainingRecoveryCodes(userID string) (int, error) {
+	var count int
+	err := tf.db.QueryRow(`SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID).Scan(&count)
+	return count, err
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a code like "3f9a1c-b27e04"
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(buf)
+	return code[:6] + "-" + code[6:], nil
+}
+
+// recovery codes carry 48 bits of randomness so a fast hash is enough here
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,325 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserSuspended = errors.New("account is suspended")
+	ErrLastAdmin     = errors.New("at least one active admin must remain")
+	ErrSelfTransfer  = errors.New("files can't be transferred to the deleted user")
+)
+
+// UserService handles the account lifecycle admins drive: suspension, role changes and
+// deletion with cleanup of the deduplicated contents the user referenced.
+type UserService struct {
+	db       *sql.DB
+	fileJobs *FileJobs
+	audit    *AuditService
+}
+
+func NewUserService(db *sql.DB, fileJobs *FileJobs, audit *AuditService) *UserService {
+	return &UserService{db: db, fileJobs: fileJobs, audit: audit}
+}
+
+// AccountState returns the current role of userID and whether the account may be used.
+// Deleted accounts are reported inactive.
+func (us *UserService) AccountState(userID string) (string, bool, error) {
+	var role string
+	var suspended bool
+	query := `SELECT role, suspended_at IS NOT NULL FROM users WHERE id = $1`
+	err := us.db.QueryRow(query, userID).Scan(&role, &suspended)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return role, !suspended, nil
+}
+
+// TokenState is the auth.AccountLookup of the server. Impersonation tokens also need their
+// session to be running and the acting staff member to be active.
+func (us *UserService) TokenState(claims *auth.Claims) (string, bool, error) {
+	role, active, err := us.AccountState(claims.UserID)
+	if err != nil || !active || claims.ActorID == "" {
+		return role, active, err
+	}
+
+	sessionID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return "", false, nil
+	}
+	var running bool
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM impersonation_sessions s
+			JOIN users a ON a.id = s.actor_id
+			WHERE s.id = $1 AND s.actor_id = $2 AND s.target_id = $3
+			  AND s.ended_at IS NULL AND s.expires_at > NOW() AND a.suspended_at IS NULL
+		)
+	`
+	if err := us.db.QueryRow(query, sessionID, claims.ActorID, claims.UserID).Scan(&running); err != nil {
+		return "", false, err
+	}
+	return role, running, nil
+}
+
+// EnsureActive fails with ErrUserSuspended for suspended accounts
+func (us *UserService) EnsureActive(userID string) error {
+	_, active, err := us.AccountState(userID)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrUserSuspended
+	}
+	return nil
+}
+
+func (us *UserService) Suspend(ctx context.Context, userID uuid.UUID, reason string) error {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role, err := lockUser(tx, userID)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE users SET suspended_at = COALESCE(suspended_at, NOW()), suspended_reason = $2, updated_at = NOW()
+		WHERE id = $1
+	`
+	if _, err := tx.Exec(query, userID, reason); err != nil {
+		return err
+	}
+	if err := ensureActiveAdmin(tx, role); err != nil {
+		return err
+	}
+	// pending download links must not outlive the suspension
+	if _, err := tx.Exec(`DELETE FROM file_downloads WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	err = us.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionUserSuspended,
+		Details: AuditDetails{"target_user_id": userID, "reason": reason},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (us *UserService) Reactivate(ctx context.Context, userID uuid.UUID) error {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET suspended_at = NULL, suspended_reason = NULL, updated_at = NOW() WHERE id = $1`
+	result, err := tx.Exec(query, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	err = us.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionUserReactivated,
+		Details: AuditDetails{"target_user_id": userID},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (us *UserService) SetRole(ctx context.Context, userID uuid.UUID, role models.UserRole) error {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	previous, err := lockUser(tx, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE users SET role = $2, updated_at = NOW() WHERE id = $1`, userID, role); err != nil {
+		return err
+	}
+	if err := ensureActiveAdmin(tx, previous); err != nil {
+		return err
+	}
+	details := AuditChange(previous, role)
+	details["target_user_id"] = userID
+	if err := us.audit.Record(ctx, tx, AuditEvent{Action: models.AuditActionUserRoleChanged, Details: details}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes userID. With transferTo set, their files and folders move to that user
+// first, otherwise the files are deleted and contents nobody references anymore are removed
+// together with their blobs.
+func (us *UserService) Delete(ctx context.Context, userID uuid.UUID, transferTo *uuid.UUID) error {
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	role, err := lockUser(tx, userID)
+	if err != nil {
+		return err
+	}
+	// recorded first, the organization of the entry comes from the user being deleted
+	err = us.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionUserDeleted,
+		Details: AuditDetails{"target_user_id": userID, "transferred_to": transferTo},
+	})
+	if err != nil {
+		return err
+	}
+	if transferTo != nil {
+		if err := transferFiles(tx, userID, *transferTo); err != nil {
+			return err
+		}
+	}
+
+	// user_files would go with the user through ON DELETE CASCADE, which leaves the
+	// reference counts of the contents behind
+	query := `
+		WITH removed AS (
+			DELETE FROM user_files WHERE user_id = $1 RETURNING file_content_id
+		)
+		UPDATE file_contents fc
+		SET reference_count = fc.reference_count - r.files
+		FROM (SELECT file_content_id, COUNT(*) AS files FROM removed GROUP BY file_content_id) r
+		WHERE fc.id = r.file_content_id
+		RETURNING fc.id
+	`
+	rows, err := tx.Query(query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to release file contents: %w", err)
+	}
+	var contentIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		contentIDs = append(contentIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, id := range contentIDs {
+		var path, thumbnailPath string
+		err := tx.QueryRow(`
+			DELETE FROM file_contents WHERE id = $1 AND reference_count <= 0
+			RETURNING file_path, COALESCE(thumbnail_path, '')
+		`, id).Scan(&path, &thumbnailPath)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete file content: %w", err)
+		}
+		paths = append(paths, path, thumbnailPath)
+	}
+	// the blobs are removed once the deletion committed
+	if err := us.fileJobs.EnqueueBlobDeletion(tx, paths...); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if err := ensureActiveAdmin(tx, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transferFiles hands the files and folders of userID to newOwner, who joins the
+// organizations the files belong to.
+func transferFiles(tx *sql.Tx, userID, newOwner uuid.UUID) error {
+	if userID == newOwner {
+		return ErrSelfTransfer
+	}
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, newOwner).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("transfer target: %w", ErrUserNotFound)
+	}
+
+	queries := []string{
+		`INSERT INTO organization_members (org_id, user_id)
+		 SELECT DISTINCT org_id, $2::uuid FROM user_files WHERE user_id = $1
+		 UNION SELECT DISTINCT org_id, $2::uuid FROM folders WHERE user_id = $1
+		 ON CONFLICT DO NOTHING`,
+		`UPDATE user_files SET user_id = $2, updated_at = NOW() WHERE user_id = $1`,
+		`UPDATE folders SET user_id = $2, updated_at = NOW() WHERE user_id = $1`,
+		`UPDATE file_downloads SET owner_id = $2 WHERE owner_id = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, userID, newOwner); err != nil {
+			return fmt.Errorf("failed to transfer files: %w", err)
+		}
+	}
+
+	// the new owner doesn't need shares of their own files
+	query := `
+		DELETE FROM file_shares fs USING user_files uf
+		WHERE fs.file_id = uf.id AND uf.user_id = $1 AND fs.shared_with_user_id = $1
+	`
+	if _, err := tx.Exec(query, newOwner); err != nil {
+		return fmt.Errorf("failed to transfer files: %w", err)
+	}
+	return nil
+}
+
+// lockUser locks the row of userID for the rest of tx and returns the role it had
+func lockUser(tx *sql.Tx, userID uuid.UUID) (models.UserRole, error) {
+	var role models.UserRole
+	err := tx.QueryRow(`SELECT role FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return role, err
+}
+
+// ensureActiveAdmin keeps the server from losing its last usable admin account when an
+// account that had the previous role changes
+func ensureActiveAdmin(tx *sql.Tx, previous models.UserRole) error {
+	if previous != models.UserRoleAdmin {
+		return nil
+	}
+	var admins int
+	query := `SELECT COUNT(*) FROM users WHERE role = 'ADMIN' AND suspended_at IS NULL`
+	if err := tx.QueryRow(query).Scan(&admins); err != nil {
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"file-vault/internal/models"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrWebhookTargetForbidden = errors.New("webhook target is a loopback, private or link-local address")
+
+// newWebhookClient returns the client deliveries are sent with. It does not follow
+// redirects or use proxies, and unless private targets are allowed it refuses to connect
+// to addresses inside the network, whatever the webhook's host name resolves to.
+func newWebhookClient(config WebhookConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if !config.AllowPrivateTargets {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+				ip.IsMulticast() || ip.IsUnspecified() {
+				return ErrWebhookTargetForbidden
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   config.Timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: config.Timeout},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// SignWebhookPayload is the X-FileVault-Signature of body sent at timestamp (Unix seconds).
+// Receivers recompute it with their secret and reject old timestamps to stop replays.
+func SignWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+const JobDeliverWebhook = "webhook.deliver"
+
+type DeliverWebhookJob struct {
+	DeliveryID uuid.UUID `json:"delivery_id"`
+}
+
+type dueDelivery struct {
+	id        uuid.UUID
+	webhookID uuid.UUID
+	eventType string
+	payload   string
+	attempts  int
+	url       string
+	secret    string
+}
+
+// Deliver sends one attempt of a pending delivery. It is the handler of webhook.deliver
+// jobs, the next attempt of a failed delivery is a new job due after the backoff.
+// Deliveries of disabled webhooks stay pending until the webhook is enabled again.
+func (ws *WebhookService) Deliver(ctx context.Context, payload json.RawMessage) error {
+	var job DeliverWebhookJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	var delivery dueDelivery
+	err := ws.db.QueryRowContext(ctx, `
+		SELECT d.id, d.webhook_id, d.event_type, d.payload::text, d.attempts, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id = $1 AND d.status = 'PENDING' AND w.enabled
+	`, job.DeliveryID).Scan(&delivery.id, &delivery.webhookID, &delivery.eventType, &delivery.payload,
+		&delivery.attempts, &delivery.url, &delivery.secret)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	status, sendErr := ws.send(delivery)
+	return ws.recordAttempt(delivery, status, sendErr)
+}
+
+// send posts a delivery and returns the response status, 0 when there was no response
+func (ws *WebhookService) send(delivery dueDelivery) (int, error) {
+	body := []byte(delivery.payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FileVault-Webhooks/1.0")
+	req.Header.Set("X-FileVault-Event", delivery.eventType)
+	req.Header.Set("X-FileVault-Delivery", delivery.id.String())
+	req.Header.Set("X-FileVault-Timestamp", timestamp)
+	req.Header.Set("X-FileVault-Signature", SignWebhookPayload(delivery.secret, timestamp, body))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordAttempt stores the outcome of a send. Failed deliveries are retried after the
+// backoff until they run out of attempts, and the webhook is disabled once too many
+// attempts in a row failed.
+func (ws *WebhookService) recordAttempt(delivery dueDelivery, status int, sendErr error) error {
+	var statusCode *int
+	if status != 0 {
+		statusCode = &status
+	}
+
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if sendErr == nil {
+		_, err = tx.Exec(`
+			UPDATE webhook_deliveries
+			SET status = 'SUCCEEDED', attempts = attempts + 1, last_status_code = $2, last_error = NULL,
+				next_attempt_at = NULL, delivered_at = NOW()
+			WHERE id = $1
+		`, delivery.id, statusCode)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE webhooks SET consecutive_failures = 0 WHERE id = $1`, delivery.webhookID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	attempts := delivery.attempts + 1
+	var nextAttempt *time.Time
+	state := models.WebhookDeliveryFailed
+	if attempts < ws.config.MaxAttempts {
+		next := time.Now().Add(ws.backoff(attempts))
+		nextAttempt, state = &next, models.WebhookDeliveryPending
+	}
+	_, err = tx.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_status_code = $4, last_error = $5, next_attempt_at = $6
+		WHERE id = $1
+	`, delivery.id, state, attempts, statusCode, sendErr.Error(), nextAttempt)
+	if err != nil {
+		return err
+	}
+	if nextAttempt != nil {
+		if err := ws.enqueueDelivery(tx, delivery.id, *nextAttempt); err != nil {
+			return err
+		}
+	}
+
+	var failures int
+	reason := fmt.Sprintf("Disabled after %d failed deliveries in a row", ws.config.DisableAfter)
+	err = tx.QueryRow(`
+		UPDATE webhooks
+		SET consecutive_failures = consecutive_failures + 1,
+			disabled_reason = CASE WHEN enabled AND consecutive_failures + 1 >= $2 THEN $3 ELSE disabled_reason END,
+			enabled = enabled AND consecutive_failures + 1 < $2
+		WHERE id = $1
+		RETURNING consecutive_failures
+	`, delivery.webhookID, ws.config.DisableAfter, reason).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	if failures == ws.config.DisableAfter {
+		slog.Warn("Webhook disabled after repeated failed deliveries", "webhook_id", delivery.webhookID, "failures", failures)
+	}
+	return tx.Commit()
+}
+
+// backoff is the wait before the next attempt: BackoffBase doubling with every attempt up
+// to BackoffMax, with up to 20% jitter so failed receivers are not hit all at once
+func (ws *WebhookService) backoff(attempts int) time.Duration {
+	delay := ws.config.BackoffMax
+	if attempts < 30 {
+		if scaled := ws.config.BackoffBase << (attempts - 1); scaled > 0 && scaled < delay {
+			delay = scaled
+		}
+	}
+	return delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+}
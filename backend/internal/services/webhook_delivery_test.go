@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// webhookReceiver is an httptest server that checks the signature of every delivery the
+// way a receiver would and answers with status
+type webhookReceiver struct {
+	*httptest.Server
+	t        *testing.T
+	status   atomic.Int32
+	requests atomic.Int32
+}
+
+func newWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	rec := &webhookReceiver{t: t}
+	rec.status.Store(int32(status))
+	rec.Server = httptest.NewServer(http.HandlerFunc(rec.serve))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *webhookReceiver) serve(w http.ResponseWriter, r *http.Request) {
+	rec.requests.Add(1)
+	body, _ := io.ReadAll(r.Body)
+
+	timestamp := r.Header.Get("X-FileVault-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		rec.t.Errorf("timestamp %q is not current", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get("X-FileVault-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+		rec.t.Errorf("signature = %q, want %q", got, want)
+	}
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		rec.t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+	}
+	if r.Header.Get("X-FileVault-Delivery") == "" || r.Header.Get("X-FileVault-Event") == "" {
+		rec.t.Errorf("delivery and event headers are missing: %v", r.Header)
+	}
+	w.WriteHeader(int(rec.status.Load()))
+}
+
+func testWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Timeout:             5 * time.Second,
+		MaxAttempts:         5,
+		BackoffBase:         30 * time.Second,
+		BackoffMax:          time.Hour,
+		DisableAfter:        3,
+		AllowPrivateTargets: true, // the receiver listens on loopback
+	}
+}
+
+func testDelivery(url string) dueDelivery {
+	return dueDelivery{
+		id:        uuid.New(),
+		webhookID: uuid.New(),
+		eventType: "UPLOADED",
+		payload:   `{"type":"UPLOADED","file":{"filename":"report.pdf"}}`,
+		url:       url,
+		secret:    testWebhookSecret,
+	}
+}
+
+func TestSendSignsDelivery(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	config := testWebhookConfig()
+	ws := &WebhookService{config: config, client: newWebhookClient(config)}
+
+	status, err := ws.send(testDelivery(receiver.URL))
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("send = %d, %v, want 204 without error", status, err)
+	}
+	if receiver.requests.Load() != 1 {
+		t.Errorf("receiver got %d requests, want 1", receiver.requests.Load())
+	}
+}
+
+func TestSendFailsOnErrorStatusAndRedirect(t *testing.T) {
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusFound} {
+		receiver := newWebhookReceiver(t, code)
+		config := testWebhookConfig()
+		ws := &WebhookService{config: config, client: newWebhookClient(config)}
+
+		status, err := ws.send(testDelivery(receiver.URL))
+		if err == nil || status != code {
+			t.Errorf("send = %d, %v, want %d with an error", status, err, code)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateTargets(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	config := testWebhookConfig()
+	config.AllowPrivateTargets = false
+	ws := &WebhookService{config: config, client: newWebhookClient(config)}
+
+	status, err := ws.send(testDelivery(receiver.URL))
+	if !errors.Is(err, ErrWebhookTargetForbidden) || status != 0 {
+		t.Errorf("send = %d, %v, want ErrWebhookTargetForbidden", status, err)
+	}
+	if receiver.requests.Load() != 0 {
+		t.Errorf("receiver on loopback was reached")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	ws := &WebhookService{config: testWebhookConfig()}
+	tests := []struct {
+		attempts int
+		min      time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{8, time.Hour}, // capped at BackoffMax
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		for range 20 {
+			got := ws.backoff(tt.attempts)
+			if got < tt.min || got > tt.min+tt.min/5 {
+				t.Fatalf("backoff(%d) = %v, want %v plus up to 20%% jitter", tt.attempts, got, tt.min)
+			}
+		}
+	}
+}
+
+// newWebhookFixture stores a webhook posting to url and one pending delivery of it
+func newWebhookFixture(t *testing.T, db *sql.DB, url string) (webhookID, deliveryID uuid.UUID) {
+	t.Helper()
+	orgID := testOrg(t, db)
+	err := db.QueryRow(`
+		INSERT INTO webhooks (org_id, url, events, secret) VALUES ($1, $2, '{UPLOADED}', $3) RETURNING id
+	`, orgID, url, testWebhookSecret).Scan(&webhookID)
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	err = db.QueryRow(`
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, next_attempt_at)
+		VALUES ($1, 'UPLOADED', '{"type":"UPLOADED"}', NOW()) RETURNING id
+	`, webhookID).Scan(&deliveryID)
+	if err != nil {
+		t.Fatalf("create delivery: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM jobs WHERE unique_key = $1`, JobDeliverWebhook+":"+deliveryID.String())
+	})
+	return webhookID, deliveryID
+}
+
+func deliverJob(t *testing.T, ws *WebhookService, deliveryID uuid.UUID) {
+	t.Helper()
+	payload, _ := json.Marshal(DeliverWebhookJob{DeliveryID: deliveryID})
+	if err := ws.Deliver(context.Background(), payload); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+}
+
+func TestDeliverRetriesThenDisablesWebhook(t *testing.T) {
+	db := testDB(t)
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	ws := NewWebhookService(db, NewAuditService(db), NewJobQueue(db, JobQueueConfig{MaxAttempts: 3}), testWebhookConfig())
+	webhookID, deliveryID := newWebhookFixture(t, db, receiver.URL)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		deliverJob(t, ws, deliveryID)
+
+		var status string
+		var attempts, lastCode int
+		var nextAttempt time.Time
+		err := db.QueryRow(`
+			SELECT status, attempts, last_status_code, next_attempt_at FROM webhook_deliveries WHERE id = $1
+		`, deliveryID).Scan(&status, &attempts, &lastCode, &nextAttempt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != "PENDING" || attempts != attempt || lastCode != http.StatusServiceUnavailable {
+			t.Fatalf("after attempt %d: status %s, attempts %d, last status %d", attempt, status, attempts, lastCode)
+		}
+		if !nextAttempt.After(time.Now()) {
+			t.Errorf("after attempt %d: next attempt %v is not in the future", attempt, nextAttempt)
+		}
+
+		var retryAt time.Time
+		err = db.QueryRow(`
+			SELECT run_at FROM jobs WHERE unique_key = $1 AND status = 'QUEUED'
+		`, JobDeliverWebhook+":"+deliveryID.String()).Scan(&retryAt)
+		if err != nil {
+			t.Fatalf("after attempt %d: no retry job queued: %v", attempt, err)
+		}
+	}
+
+	var enabled bool
+	var failures int
+	var reason sql.NullString
+	err := db.QueryRow(`SELECT enabled, consecutive_failures, disabled_reason FROM webhooks WHERE id = $1`, webhookID).
+		Scan(&enabled, &failures, &reason)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled || failures != 3 || !reason.Valid {
+		t.Fatalf("webhook enabled %v with %d failures and reason %q, want it disabled after 3", enabled, failures, reason.String)
+	}
+
+	// deliveries of a disabled webhook wait for it to be enabled again
+	deliverJob(t, ws, deliveryID)
+	if receiver.requests.Load() != 3 {
+		t.Errorf("disabled webhook was sent to, receiver got %d requests", receiver.requests.Load())
+	}
+
+	if _, err := db.Exec(`UPDATE webhooks SET enabled = true WHERE id = $1`, webhookID); err != nil {
+		t.Fatal(err)
+	}
+	receiver.status.Store(http.StatusOK)
+	deliverJob(t, ws, deliveryID)
+
+	var status string
+	if err := db.QueryRow(`SELECT status FROM webhook_deliveries WHERE id = $1`, deliveryID).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT consecutive_failures FROM webhooks WHERE id = $1`, webhookID).Scan(&failures); err != nil {
+		t.Fatal(err)
+	}
+	if status != "SUCCEEDED" || failures != 0 {
+		t.Errorf("after success: status %s with %d failures, want SUCCEEDED and 0", status, failures)
+	}
+}
+
+func TestDeliverGivesUpAfterMaxAttempts(t *testing.T) {
+	db := testDB(t)
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	config := testWebhookConfig()
+	config.DisableAfter = 100
+	ws := NewWebhookService(db, NewAuditService(db), NewJobQueue(db, JobQueueConfig{MaxAttempts: 3}), config)
+	_, deliveryID := newWebhookFixture(t, db, receiver.URL)
+
+	if _, err := db.Exec(`UPDATE webhook_deliveries SET attempts = $2 WHERE id = $1`, deliveryID, config.MaxAttempts-1); err != nil {
+		t.Fatal(err)
+	}
+	deliverJob(t, ws, deliveryID)
+
+	var status string
+	var attempts int
+	var nextAttempt sql.NullTime
+	err := db.QueryRow(`SELECT status, attempts, next_attempt_at FROM webhook_deliveries WHERE id = $1`, deliveryID).
+		Scan(&status, &attempts, &nextAttempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "FAILED" || attempts != config.MaxAttempts || nextAttempt.Valid {
+		t.Errorf("status %s after %d attempts, next attempt %v, want FAILED without a next attempt", status, attempts, nextAttempt)
+	}
+
+	var queued bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM jobs WHERE unique_key = $1 AND status = 'QUEUED')`,
+		JobDeliverWebhook+":"+deliveryID.String()).Scan(&queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued {
+		t.Errorf("a retry was queued for a delivery out of attempts")
+	}
+}
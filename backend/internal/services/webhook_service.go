@@ -0,0 +1,510 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"file-vault/internal/auth"
+	"file-vault/internal/models"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidWebhookURL       = errors.New("webhook URL must be an absolute http or https URL")
+	ErrInvalidWebhookEvents    = errors.New("webhooks take at least one of the UPLOADED, DELETED and SHARED events")
+)
+
+// webhookEvents are the file events webhooks can subscribe to
+var webhookEvents = map[models.FileEventType]bool{
+	models.FileEventUploaded: true,
+	models.FileEventDeleted:  true,
+	models.FileEventShared:   true,
+}
+
+// WebhookConfig controls delivery. A delivery is retried with exponential backoff from
+// BackoffBase up to BackoffMax until MaxAttempts, and a webhook is disabled after
+// DisableAfter failed attempts in a row.
+type WebhookConfig struct {
+	Timeout      time.Duration
+	MaxAttempts  int
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	DisableAfter int
+	// AllowPrivateTargets lets webhooks reach loopback and private addresses, for
+	// receivers on the local network and for testing
+	AllowPrivateTargets bool
+}
+
+// WebhookService manages webhooks and delivers the file events they subscribe to.
+// Deliveries are written in the transaction of the change, each with a webhook.deliver
+// job that sends it.
+type WebhookService struct {
+	db     *sql.DB
+	audit  *AuditService
+	jobs   *JobQueue
+	config WebhookConfig
+	client *http.Client
+}
+
+func NewWebhookService(db *sql.DB, audit *AuditService, jobs *JobQueue, config WebhookConfig) *WebhookService {
+	ws := &WebhookService{db: db, audit: audit, jobs: jobs, config: config, client: newWebhookClient(config)}
+	jobs.Register(JobDeliverWebhook, ws.Deliver)
+	return ws
+}
+
+// WebhookInput is what a webhook posts where. FolderID limits it to files in that folder
+// and its subfolders.
+type WebhookInput struct {
+	URL      string
+	Events   []models.FileEventType
+	FolderID *uuid.UUID
+}
+
+func (input WebhookInput) validate() error {
+	target, err := url.Parse(input.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	if len(input.Events) == 0 {
+		return ErrInvalidWebhookEvents
+	}
+	for _, event := range input.Events {
+		if !webhookEvents[event] {
+			return ErrInvalidWebhookEvents
+		}
+	}
+	return nil
+}
+
+const webhookColumns = `id, org_id, user_id, url, events, folder_id, secret, enabled, consecutive_failures,
+	disabled_reason, created_by, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebhook(row rowScanner) (*models.Webhook, error) {
+	var webhook models.Webhook
+	var events []string
+	err := row.Scan(&webhook.ID, &webhook.OrgID, &webhook.UserID, &webhook.URL, pq.Array(&events), &webhook.FolderID,
+		&webhook.Secret, &webhook.Enabled, &webhook.ConsecutiveFailures, &webhook.DisabledReason, &webhook.CreatedBy,
+		&webhook.CreatedAt, &webhook.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		webhook.Events = append(webhook.Events, models.FileEventType(event))
+	}
+	return &webhook, nil
+}
+
+func eventNames(events []models.FileEventType) []string {
+	names := make([]string, len(events))
+	for i, event := range events {
+		names[i] = string(event)
+	}
+	return names
+}
+
+// Create adds a webhook of orgID, owned by userID or for the whole organization when
+// userID is nil. A secret is generated when none is given.
+func (ws *WebhookService) Create(ctx context.Context, orgID uuid.UUID, userID *uuid.UUID, input WebhookInput, secret string) (*models.Webhook, error) {
+	if err := input.validate(); err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		generated, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		secret = generated
+	}
+
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO webhooks (org_id, user_id, url, events, folder_id, secret, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')::uuid)
+		RETURNING ` + webhookColumns
+	webhook, err := scanWebhook(tx.QueryRow(query, orgID, userID, input.URL, pq.Array(eventNames(input.Events)),
+		input.FolderID, secret, auth.GetUserIDFromContext(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	err = ws.audit.Record(ctx, tx, AuditEvent{
+		Action: models.AuditActionWebhookCreated,
+		OrgID:  &orgID,
+		Details: AuditDetails{
+			"webhook_id": webhook.ID, "url": webhook.URL, "events": webhook.Events,
+			"folder_id": webhook.FolderID, "organization": userID == nil,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return webhook, tx.Commit()
+}
+
+func (ws *WebhookService) Get(webhookID uuid.UUID) (*models.Webhook, error) {
+	webhook, err := scanWebhook(ws.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, webhookID))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+	return webhook, err
+}
+
+// List returns the webhooks userID owns in orgID, or the organization's webhooks when
+// userID is nil
+func (ws *WebhookService) List(orgID uuid.UUID, userID *uuid.UUID) ([]*models.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks
+		WHERE org_id = $1 AND user_id IS NOT DISTINCT FROM $2
+		ORDER BY created_at`
+	rows, err := ws.db.Query(query, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*models.Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// Update replaces the target, events and folder of a webhook
+func (ws *WebhookService) Update(ctx context.Context, webhookID uuid.UUID, input WebhookInput) (*models.Webhook, error) {
+	if err := input.validate(); err != nil {
+		return nil, err
+	}
+	return ws.update(ctx, webhookID, func(tx *sql.Tx, before *models.Webhook) (*models.Webhook, AuditDetails, error) {
+		query := `
+			UPDATE webhooks SET url = $2, events = $3, folder_id = $4, updated_at = NOW()
+			WHERE id = $1
+			RETURNING ` + webhookColumns
+		after, err := scanWebhook(tx.QueryRow(query, webhookID, input.URL, pq.Array(eventNames(input.Events)), input.FolderID))
+		if err != nil {
+			return nil, nil, err
+		}
+		details := AuditChange(
+			map[string]interface{}{"url": before.URL, "events": before.Events, "folder_id": before.FolderID},
+			map[string]interface{}{"url": after.URL, "events": after.Events, "folder_id": after.FolderID},
+		)
+		return after, details, nil
+	})
+}
+
+// SetEnabled turns a webhook on or off. Enabling it clears the failures that disabled it,
+// its pending deliveries are sent again.
+func (ws *WebhookService) SetEnabled(ctx context.Context, webhookID uuid.UUID, enabled bool) (*models.Webhook, error) {
+	return ws.update(ctx, webhookID, func(tx *sql.Tx, before *models.Webhook) (*models.Webhook, AuditDetails, error) {
+		query := `
+			UPDATE webhooks SET enabled = $2, consecutive_failures = 0, disabled_reason = NULL, updated_at = NOW()
+			WHERE id = $1
+			RETURNING ` + webhookColumns
+		after, err := scanWebhook(tx.QueryRow(query, webhookID, enabled))
+		if err != nil {
+			return nil, nil, err
+		}
+		if enabled && !before.Enabled {
+			if err := ws.resumeDeliveries(tx, webhookID); err != nil {
+				return nil, nil, err
+			}
+		}
+		return after, AuditChange(map[string]bool{"enabled": before.Enabled}, map[string]bool{"enabled": enabled}), nil
+	})
+}
+
+// RotateSecret replaces the signing secret of a webhook and returns the new one
+func (ws *WebhookService) RotateSecret(ctx context.Context, webhookID uuid.UUID) (string, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = ws.update(ctx, webhookID, func(tx *sql.Tx, before *models.Webhook) (*models.Webhook, AuditDetails, error) {
+		query := `UPDATE webhooks SET secret = $2, updated_at = NOW() WHERE id = $1 RETURNING ` + webhookColumns
+		after, err := scanWebhook(tx.QueryRow(query, webhookID, secret))
+		if err != nil {
+			return nil, nil, err
+		}
+		return after, AuditDetails{"secret_rotated": true}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// update applies change to the locked webhook and records it as WEBHOOK_UPDATED
+func (ws *WebhookService) update(ctx context.Context, webhookID uuid.UUID, change func(tx *sql.Tx, before *models.Webhook) (*models.Webhook, AuditDetails, error)) (*models.Webhook, error) {
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := scanWebhook(tx.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = $1 FOR UPDATE`, webhookID))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	after, details, err := change(tx, before)
+	if err != nil {
+		return nil, err
+	}
+	details["webhook_id"] = webhookID
+	err = ws.audit.Record(ctx, tx, AuditEvent{Action: models.AuditActionWebhookUpdated, OrgID: &before.OrgID, Details: details})
+	if err != nil {
+		return nil, err
+	}
+	return after, tx.Commit()
+}
+
+// Delete removes a webhook with its delivery log
+func (ws *WebhookService) Delete(ctx context.Context, webhookID uuid.UUID) error {
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orgID uuid.UUID
+	var target string
+	err = tx.QueryRow(`DELETE FROM webhooks WHERE id = $1 RETURNING org_id, url`, webhookID).Scan(&orgID, &target)
+	if err == sql.ErrNoRows {
+		return ErrWebhookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = ws.audit.Record(ctx, tx, AuditEvent{
+		Action:  models.AuditActionWebhookDeleted,
+		OrgID:   &orgID,
+		Details: AuditDetails{"webhook_id": webhookID, "url": target},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = `id, webhook_id, event_type, payload::text, status, attempts, next_attempt_at,
+	last_status_code, last_error, replay_of, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventType, &delivery.Payload, &delivery.Status,
+		&delivery.Attempts, &delivery.NextAttemptAt, &delivery.LastStatusCode, &delivery.LastError, &delivery.ReplayOf,
+		&delivery.CreatedAt, &delivery.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// Deliveries returns the newest deliveries of a webhook, optionally only those in status
+func (ws *WebhookService) Deliveries(webhookID uuid.UUID, status *models.WebhookDeliveryStatus, limit int) ([]*models.WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2::webhook_delivery_status IS NULL OR status = $2)
+		ORDER BY created_at DESC
+		LIMIT $3`
+	rows, err := ws.db.Query(query, webhookID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*models.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (ws *WebhookService) GetDelivery(deliveryID uuid.UUID) (*models.WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = $1`
+	delivery, err := scanWebhookDelivery(ws.db.QueryRow(query, deliveryID))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	return delivery, err
+}
+
+// Replay queues the payload of a past delivery again as a new delivery
+func (ws *WebhookService) Replay(deliveryID uuid.UUID) (*models.WebhookDelivery, error) {
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, next_attempt_at, replay_of)
+		SELECT webhook_id, event_type, payload, NOW(), id FROM webhook_deliveries WHERE id = $1
+		RETURNING ` + webhookDeliveryColumns
+	delivery, err := scanWebhookDelivery(tx.QueryRow(query, deliveryID))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.enqueueDelivery(tx, delivery.ID, time.Time{}); err != nil {
+		return nil, err
+	}
+	return delivery, tx.Commit()
+}
+
+// resumeDeliveries queues the pending deliveries of a webhook that was enabled again
+func (ws *WebhookService) resumeDeliveries(tx *sql.Tx, webhookID uuid.UUID) error {
+	rows, err := tx.Query(`SELECT id FROM webhook_deliveries WHERE webhook_id = $1 AND status = 'PENDING'`, webhookID)
+	if err != nil {
+		return err
+	}
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := ws.enqueueDelivery(tx, id, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ws *WebhookService) enqueueDelivery(exec JobExecutor, deliveryID uuid.UUID, runAt time.Time) error {
+	return ws.jobs.Enqueue(exec, JobDeliverWebhook, DeliverWebhookJob{DeliveryID: deliveryID},
+		JobOptions{RunAt: runAt, UniqueKey: JobDeliverWebhook + ":" + deliveryID.String()})
+}
+
+// WebhookExecutor is a *sql.DB or *sql.Tx
+type WebhookExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// WebhookEvent is a change to a file. Data is added to the payload, e.g. the share of a
+// SHARED event.
+type WebhookEvent struct {
+	Type   models.FileEventType
+	FileID uuid.UUID
+	Data   map[string]interface{}
+}
+
+type webhookFile struct {
+	ID       uuid.UUID  `json:"id"`
+	Filename string     `json:"filename"`
+	FolderID *uuid.UUID `json:"folder_id"`
+	OwnerID  uuid.UUID  `json:"owner_id"`
+	Size     int64      `json:"size"`
+	MimeType string     `json:"mime_type"`
+	SHA256   string     `json:"sha256"`
+}
+
+type webhookPayload struct {
+	ID         uuid.UUID              `json:"id"`
+	Type       models.FileEventType   `json:"type"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	OrgID      uuid.UUID              `json:"org_id"`
+	UserID     string                 `json:"user_id,omitempty"` // who made the change
+	File       webhookFile            `json:"file"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+}
+
+// Enqueue queues event for every enabled webhook it matches. It runs in the transaction of
+// the change, before a deleted file is gone, so deliveries exist exactly when the change does.
+func (ws *WebhookService) Enqueue(ctx context.Context, exec WebhookExecutor, event WebhookEvent) error {
+	if exec == nil {
+		exec = ws.db
+	}
+
+	payload := webhookPayload{
+		ID: uuid.New(), Type: event.Type, OccurredAt: time.Now().UTC(), Data: event.Data,
+		UserID: auth.GetUserIDFromContext(ctx),
+	}
+	err := exec.QueryRow(`
+		SELECT uf.id, uf.filename, uf.folder_id, uf.user_id, uf.org_id, fc.size, fc.mime_type, fc.sha256_hash
+		FROM user_files uf
+		JOIN file_contents fc ON fc.id = uf.file_content_id
+		WHERE uf.id = $1
+	`, event.FileID).Scan(&payload.File.ID, &payload.File.Filename, &payload.File.FolderID, &payload.File.OwnerID,
+		&payload.OrgID, &payload.File.Size, &payload.File.MimeType, &payload.File.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to load file for webhooks: %w", err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	rows, err := exec.Query(`
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent_folder_id FROM folders WHERE id = $5
+			UNION
+			SELECT f.id, f.parent_folder_id FROM folders f JOIN ancestors a ON f.id = a.parent_folder_id
+		)
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, next_attempt_at)
+		SELECT w.id, $1, $2, NOW()
+		FROM webhooks w
+		WHERE w.enabled AND w.org_id = $3 AND $1 = ANY(w.events)
+		  AND (w.user_id IS NULL OR w.user_id = $4)
+		  AND (w.folder_id IS NULL OR w.folder_id IN (SELECT id FROM ancestors))
+		RETURNING id
+	`, string(event.Type), string(body), payload.OrgID, payload.File.OwnerID, payload.File.FolderID)
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook deliveries: %w", err)
+	}
+	var deliveryIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveryIDs = append(deliveryIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range deliveryIDs {
+		if err := ws.enqueueDelivery(exec, id, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for every request, continuing the trace of the caller.
+// The span is named after the route once the ServeMux matched it. otelhttp hands a copy of
+// the request down, so nothing between this and the mux may copy it again, and it has to
+// sit outside metrics.Middleware, which would otherwise read the pattern from the wrong
+// request. Websocket upgrades are not traced.
+func Middleware(next http.Handler) http.Handler {
+	named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Pattern == "" {
+			return
+		}
+		route := r.Pattern
+		if _, path, found := strings.Cut(route, " "); found {
+			route = path
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	})
+	return otelhttp.NewHandler(named, "http.request", otelhttp.WithFilter(func(r *http.Request) bool {
+		return r.Header.Get("Upgrade") == ""
+	}))
+}
@@ -0,0 +1,142 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"file-vault/internal/metrics"
+	"file-vault/internal/tracing"
+	"file-vault/internal/tracing/tracingtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+)
+
+func newRecorder(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	provider, exporter := tracingtest.NewInMemory(tracing.Config{ServiceName: "file-vault-test"})
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return exporter
+}
+
+func attributeValue(attrs []attribute.KeyValue, key attribute.Key) (string, bool) {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Value.Emit(), true
+		}
+	}
+	return "", false
+}
+
+// The server stacks tracing outside metrics, both have to see the route the mux matched
+func TestMiddlewareNamesSpanAndMetricsAfterRoute(t *testing.T) {
+	exporter := newRecorder(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files/{downloadID}/preview/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := tracing.Middleware(metrics.Middleware(mux))
+
+	counter := metrics.HTTPRequests.WithLabelValues("GET /api/files/{downloadID}/preview/{userID}", "GET", "418")
+	before := testutil.ToFloat64(counter)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/files/1234/preview/5678", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTeapot)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if want := "GET /api/files/{downloadID}/preview/{userID}"; spans[0].Name != want {
+		t.Errorf("span name = %q, want %q", spans[0].Name, want)
+	}
+	route, ok := attributeValue(spans[0].Attributes, semconv.HTTPRouteKey)
+	if !ok || route != "/api/files/{downloadID}/preview/{userID}" {
+		t.Errorf("http.route = %q, want the pattern without its method", route)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("route was counted %v times, want 1", got)
+	}
+}
+
+func TestMiddlewareLeavesUnmatchedRequestsUnnamed(t *testing.T) {
+	exporter := newRecorder(t)
+	handler := tracing.Middleware(http.NewServeMux())
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if spans[0].Name != "GET" {
+		t.Errorf("span name = %q, want only the method", spans[0].Name)
+	}
+	if route, ok := attributeValue(spans[0].Attributes, semconv.HTTPRouteKey); ok {
+		t.Errorf("http.route = %q on an unmatched request", route)
+	}
+}
+
+func TestMiddlewareContinuesCallerTrace(t *testing.T) {
+	exporter := newRecorder(t)
+	handler := tracing.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if got := spans[0].SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the caller's", got)
+	}
+	if got := spans[0].Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent span ID = %s, want the caller's", got)
+	}
+}
+
+func TestMiddlewareSkipsWebsocketUpgrades(t *testing.T) {
+	exporter := newRecorder(t)
+	handler := tracing.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/graphql", nil)
+	req.Header.Set("Upgrade", "websocket")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("got %d spans for a websocket upgrade, want none", len(spans))
+	}
+}
+
+func TestEndRecordsError(t *testing.T) {
+	exporter := newRecorder(t)
+
+	_, span := tracing.Start(context.Background(), "storage.store", attribute.String("file.hash", "abc"))
+	tracing.End(span, errors.New("disk full"))
+	_, span = tracing.Start(context.Background(), "storage.read")
+	tracing.End(span, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if spans[0].Status.Code != codes.Error || spans[0].Status.Description != "disk full" {
+		t.Errorf("status = %+v, want the error", spans[0].Status)
+	}
+	if len(spans[0].Events) != 1 || spans[0].Events[0].Name != "exception" {
+		t.Errorf("events = %+v, want the recorded error", spans[0].Events)
+	}
+	if spans[1].Status.Code != codes.Unset {
+		t.Errorf("status = %+v, want unset", spans[1].Status)
+	}
+}
@@ -0,0 +1,94 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are exported over OTLP when an
+// endpoint is configured, tracingtest records them in memory for tests.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "file-vault"
+
+// Config controls the exporter. Without an OTLPEndpoint no spans are recorded. New traces
+// are sampled at SampleRatio, requests continuing a trace follow the caller's decision.
+type Config struct {
+	ServiceName  string
+	Environment  string
+	OTLPEndpoint string // e.g. http://otel-collector:4318
+	SampleRatio  float64
+}
+
+// Provider owns the tracer provider and flushes its spans on Shutdown
+type Provider struct {
+	tp *sdktrace.TracerProvider
+}
+
+// Setup installs the global tracer provider and the W3C trace context propagator
+func Setup(ctx context.Context, config Config) (*Provider, error) {
+	setPropagator()
+	if config.OTLPEndpoint == "" {
+		return &Provider{}, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.OTLPEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	return install(config, sdktrace.WithBatcher(exporter)), nil
+}
+
+// NewSynchronous installs a provider that hands every span to exporter as soon as it ends,
+// which is what tests want. Servers use Setup, which exports in batches.
+func NewSynchronous(config Config, exporter sdktrace.SpanExporter) *Provider {
+	setPropagator()
+	return install(config, sdktrace.WithSyncer(exporter))
+}
+
+func setPropagator() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+func install(config Config, exporter sdktrace.TracerProviderOption) *Provider {
+	tp := sdktrace.NewTracerProvider(
+		exporter,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(config.ServiceName),
+			semconv.DeploymentEnvironmentName(config.Environment),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return &Provider{tp: tp}
+}
+
+// Shutdown exports the remaining spans
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p.tp == nil {
+		return nil
+	}
+	return p.tp.Shutdown(ctx)
+}
+
+// Start starts a span of the server's own work, such as a storage operation
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if there is one, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
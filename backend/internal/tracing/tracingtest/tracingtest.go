@@ -0,0 +1,17 @@
+// Package tracingtest records spans in memory for tests. It lives apart from tracing so
+// the server binary does not link the SDK's test exporter.
+package tracingtest
+
+import (
+	"file-vault/internal/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// NewInMemory installs a provider that samples every trace and keeps each span in the
+// returned exporter as soon as it ends
+func NewInMemory(config tracing.Config) (*tracing.Provider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	config.SampleRatio = 1
+	return tracing.NewSynchronous(config, exporter), exporter
+}
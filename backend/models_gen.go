@@ -9,9 +9,27 @@ import (
 	"github.com/google/uuid"
 )
 
+type AuditLogFilter struct {
+	UserID  *uuid.UUID           `json:"userId,omitempty"`
+	ActorID *uuid.UUID           `json:"actorId,omitempty"`
+	Actions []models.AuditAction `json:"actions,omitempty"`
+	FileID  *uuid.UUID           `json:"fileId,omitempty"`
+	IPRange *string              `json:"ipRange,omitempty"`
+	From    *time.Time           `json:"from,omitempty"`
+	To      *time.Time           `json:"to,omitempty"`
+}
+
+type AuditLogPage struct {
+	Entries    []*models.AuditLog `json:"entries"`
+	NextCursor *string            `json:"nextCursor,omitempty"`
+}
+
 type AuthPayload struct {
-	Token string       `json:"token"`
-	User  *models.User `json:"user"`
+	Token                  *string      `json:"token,omitempty"`
+	User                   *models.User `json:"user"`
+	TwoFactorRequired      bool         `json:"twoFactorRequired"`
+	ChallengeToken         *string      `json:"challengeToken,omitempty"`
+	TwoFactorSetupRequired bool         `json:"twoFactorSetupRequired"`
 }
 
 type CreateFolderInput struct {
@@ -20,6 +38,11 @@ type CreateFolderInput struct {
 	IsPublic       *bool      `json:"isPublic,omitempty"`
 }
 
+type CreatedWebhook struct {
+	Webhook *models.Webhook `json:"webhook"`
+	Secret  string          `json:"secret"`
+}
+
 type FileFiltersInput struct {
 	Search     *string    `json:"search,omitempty"`
 	MimeType   *string    `json:"mimeType,omitempty"`
@@ -32,6 +55,11 @@ type FileFiltersInput struct {
 	FolderID   *uuid.UUID `json:"folderId,omitempty"`
 }
 
+type ImpersonationPayload struct {
+	Token   string                       `json:"token"`
+	Session *models.ImpersonationSession `json:"session"`
+}
+
 type LoginInput struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -40,6 +68,11 @@ type LoginInput struct {
 type Mutation struct {
 }
 
+type OrganizationSettingInput struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
 type Query struct {
 }
 
@@ -49,12 +82,33 @@ type RegisterInput struct {
 	Password string `json:"password"`
 }
 
+type RolePermissions struct {
+	Role        models.UserRole `json:"role"`
+	Permissions []string        `json:"permissions"`
+}
+
 type Subscription struct {
 }
 
+type TwoFactorActivation struct {
+	RecoveryCodes []string     `json:"recoveryCodes"`
+	Auth          *AuthPayload `json:"auth"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauthURI"`
+}
+
 type UpdateFileInput struct {
 	Filename *string    `json:"filename,omitempty"`
 	Tags     []string   `json:"tags,omitempty"`
 	IsPublic *bool      `json:"isPublic,omitempty"`
 	FolderID *uuid.UUID `json:"folderId,omitempty"`
 }
+
+type WebhookInput struct {
+	URL      string                 `json:"url"`
+	Events   []models.FileEventType `json:"events"`
+	FolderID *uuid.UUID             `json:"folderId,omitempty"`
+}